@@ -0,0 +1,382 @@
+package dpaggregate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/logkey"
+)
+
+// The statistics that can be emitted for gauges
+const (
+	Sum   = "sum"
+	Count = "count"
+	Min   = "min"
+	Max   = "max"
+	Last  = "last"
+)
+
+// Config controls how an Aggregator groups datapoints
+type Config struct {
+	// Interval is how long each window is
+	Interval *time.Duration
+	// Dimensions are the dimensions datapoints are grouped by, every other dimension is dropped
+	Dimensions []string
+	// Stats are the statistics emitted for gauges and rates, each as the metric name suffixed with the stat
+	Stats []string
+	// IdleWindows is how many windows a cumulative counter series is remembered for without new datapoints
+	IdleWindows *int64
+}
+
+// DefaultConfig are default values for aggregators
+var DefaultConfig = &Config{
+	Interval:    pointer.Duration(time.Second * 10),
+	Dimensions:  []string{},
+	Stats:       []string{Sum, Count, Min, Max, Last},
+	IdleWindows: pointer.Int64(5),
+}
+
+// Sink is a dpsink and trace.sink
+type Sink interface {
+	dpsink.Sink
+	trace.Sink
+}
+
+type aggregate struct {
+	metric string
+	dims   map[string]string
+	meta   map[interface{}]interface{}
+	mtype  datapoint.MetricType
+	ints   bool
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+	last   float64
+	// total is the running value of cumulative counters, which live across windows until they go idle
+	total float64
+	idle  int64
+}
+
+type source struct {
+	last float64
+	idle int64
+}
+
+// rough sizes of an aggregate and a source on top of their keys, used to estimate memory use
+const (
+	aggregateOverhead = 256
+	sourceOverhead    = 64
+)
+
+// Aggregator is a sink that groups gauges, counts and cumulative counters by their metric, token and a subset
+// of their dimensions and sends one set of datapoints per group every window.  Gauges and rates are sent as
+// the configured stats, counts as their sum and cumulative counters as the running total of the increases of
+// every series in the group.  Other datapoints, events and spans are sent on as they are.
+type Aggregator struct {
+	interval    time.Duration
+	dimensions  []string
+	stats       []string
+	idleWindows int64
+
+	mu         sync.Mutex
+	aggregates map[string]*aggregate
+	sources    map[string]*source
+	memory     int64
+
+	next        Sink
+	logger      log.Logger
+	stopContext context.Context
+	stopFunc    context.CancelFunc
+	done        sync.WaitGroup
+	counters    struct {
+		datapointsIn  int64
+		datapointsOut int64
+		passedThrough int64
+		flushes       int64
+	}
+}
+
+var _ Sink = &Aggregator{}
+
+// New creates an Aggregator that flushes to next every interval until it is closed
+func New(ctx context.Context, conf *Config, next Sink, logger log.Logger) (*Aggregator, error) {
+	conf = pointer.FillDefaultFrom(conf, DefaultConfig).(*Config)
+	if *conf.Interval <= 0 {
+		return nil, fmt.Errorf("aggregation interval must be positive, not %s", *conf.Interval)
+	}
+	for _, s := range conf.Stats {
+		switch s {
+		case Sum, Count, Min, Max, Last:
+		default:
+			return nil, fmt.Errorf("unknown aggregation stat %s", s)
+		}
+	}
+	stopContext, stopFunc := context.WithCancel(ctx)
+	a := &Aggregator{
+		interval:    *conf.Interval,
+		dimensions:  conf.Dimensions,
+		stats:       conf.Stats,
+		idleWindows: *conf.IdleWindows,
+		aggregates:  make(map[string]*aggregate),
+		sources:     make(map[string]*source),
+		next:        next,
+		logger:      log.NewContext(logger).With(logkey.Struct, "Aggregator"),
+		stopContext: stopContext,
+		stopFunc:    stopFunc,
+	}
+	a.done.Add(1)
+	go a.flushLoop()
+	return a, nil
+}
+
+func (a *Aggregator) flushLoop() {
+	defer a.done.Done()
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopContext.Done():
+			return
+		case <-ticker.C:
+			log.IfErr(a.logger, a.Flush(context.Background()))
+		}
+	}
+}
+
+// Close stops the flush ticker and flushes what has been aggregated so far
+func (a *Aggregator) Close() error {
+	a.stopFunc()
+	a.done.Wait()
+	return a.Flush(context.Background())
+}
+
+func numericValue(v datapoint.Value) (float64, bool, bool) {
+	switch value := v.(type) {
+	case datapoint.IntValue:
+		return float64(value.Int()), true, true
+	case datapoint.FloatValue:
+		return value.Float(), false, true
+	}
+	return 0, false, false
+}
+
+func aggregatable(mtype datapoint.MetricType) bool {
+	return mtype == datapoint.Gauge || mtype == datapoint.Rate || mtype == datapoint.Count || mtype == datapoint.Counter
+}
+
+func seriesKey(metric string, mtype datapoint.MetricType, token interface{}, dims map[string]string, keys []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\x00%d\x00%v", metric, mtype, token)
+	for _, k := range keys {
+		if v, exists := dims[k]; exists {
+			b.WriteString("\x00" + k + "=" + v)
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys(dims map[string]string) []string {
+	keys := make([]string, 0, len(dims))
+	for k := range dims {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AddDatapoints aggregates gauges, counts and cumulative counters and sends any other datapoints to next
+func (a *Aggregator) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	atomic.AddInt64(&a.counters.datapointsIn, int64(len(points)))
+	var passThrough []*datapoint.Datapoint
+	a.mu.Lock()
+	for _, dp := range points {
+		value, isInt, ok := numericValue(dp.Value)
+		if !ok || !aggregatable(dp.MetricType) {
+			passThrough = append(passThrough, dp)
+			continue
+		}
+		a.add(dp, value, isInt)
+	}
+	a.mu.Unlock()
+	if len(passThrough) == 0 {
+		return nil
+	}
+	atomic.AddInt64(&a.counters.passedThrough, int64(len(passThrough)))
+	return a.next.AddDatapoints(ctx, passThrough)
+}
+
+func (a *Aggregator) add(dp *datapoint.Datapoint, value float64, isInt bool) {
+	token := dp.Meta[sfxclient.TokenHeaderName]
+	key := seriesKey(dp.Metric, dp.MetricType, token, dp.Dimensions, a.dimensions)
+	agg, exists := a.aggregates[key]
+	if !exists {
+		agg = &aggregate{metric: dp.Metric, dims: make(map[string]string, len(a.dimensions)), mtype: dp.MetricType, ints: true, min: value, max: value}
+		for _, k := range a.dimensions {
+			if v, has := dp.Dimensions[k]; has {
+				agg.dims[k] = v
+			}
+		}
+		if token != nil {
+			agg.meta = map[interface{}]interface{}{sfxclient.TokenHeaderName: token}
+		}
+		a.aggregates[key] = agg
+		a.memory += int64(len(key)) + aggregateOverhead
+	}
+	agg.ints = agg.ints && isInt
+	agg.idle = 0
+	if dp.MetricType == datapoint.Counter {
+		agg.total += a.increase(seriesKey(dp.Metric, dp.MetricType, token, dp.Dimensions, sortedKeys(dp.Dimensions)), value)
+	}
+	agg.count++
+	agg.sum += value
+	agg.last = value
+	if value < agg.min {
+		agg.min = value
+	}
+	if value > agg.max {
+		agg.max = value
+	}
+}
+
+// increase returns how much a cumulative counter series went up since its last value, treating a drop as a reset
+func (a *Aggregator) increase(key string, value float64) float64 {
+	src, exists := a.sources[key]
+	if !exists {
+		a.sources[key] = &source{last: value}
+		a.memory += int64(len(key)) + sourceOverhead
+		return 0
+	}
+	src.idle = 0
+	delta := value - src.last
+	if delta < 0 {
+		delta = value
+	}
+	src.last = value
+	return delta
+}
+
+func (agg *aggregate) value(v float64) datapoint.Value {
+	if agg.ints {
+		return datapoint.NewIntValue(int64(v))
+	}
+	return datapoint.NewFloatValue(v)
+}
+
+func (agg *aggregate) stat(stat string) datapoint.Value {
+	switch stat {
+	case Sum:
+		return agg.value(agg.sum)
+	case Count:
+		return datapoint.NewIntValue(agg.count)
+	case Min:
+		return agg.value(agg.min)
+	case Max:
+		return agg.value(agg.max)
+	}
+	return agg.value(agg.last)
+}
+
+// datapoint creates a datapoint of the aggregate with its own copy of the dimensions and meta, since sinks
+// further down may change them
+func (agg *aggregate) datapoint(metric string, value datapoint.Value, mtype datapoint.MetricType, now time.Time) *datapoint.Datapoint {
+	dims := make(map[string]string, len(agg.dims))
+	for k, v := range agg.dims {
+		dims[k] = v
+	}
+	meta := make(map[interface{}]interface{}, len(agg.meta))
+	for k, v := range agg.meta {
+		meta[k] = v
+	}
+	return datapoint.NewWithMeta(metric, dims, meta, value, mtype, now)
+}
+
+func (a *Aggregator) emit(agg *aggregate, now time.Time) []*datapoint.Datapoint {
+	switch agg.mtype {
+	case datapoint.Count:
+		return []*datapoint.Datapoint{agg.datapoint(agg.metric, agg.value(agg.sum), datapoint.Count, now)}
+	case datapoint.Counter:
+		return []*datapoint.Datapoint{agg.datapoint(agg.metric, agg.value(agg.total), datapoint.Counter, now)}
+	}
+	dps := make([]*datapoint.Datapoint, 0, len(a.stats))
+	for _, stat := range a.stats {
+		dps = append(dps, agg.datapoint(agg.metric+"."+stat, agg.stat(stat), datapoint.Gauge, now))
+	}
+	return dps
+}
+
+// collect returns the datapoints of the window that just ended and resets it.  Cumulative counters are kept until
+// they have been idle for IdleWindows windows.
+func (a *Aggregator) collect(now time.Time) []*datapoint.Datapoint {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dps := make([]*datapoint.Datapoint, 0, len(a.aggregates))
+	for key, agg := range a.aggregates {
+		if agg.idle == 0 {
+			dps = append(dps, a.emit(agg, now)...)
+		}
+		agg.idle++
+		if agg.mtype != datapoint.Counter || agg.idle > a.idleWindows {
+			delete(a.aggregates, key)
+			a.memory -= int64(len(key)) + aggregateOverhead
+		}
+	}
+	for key, src := range a.sources {
+		src.idle++
+		if src.idle > a.idleWindows {
+			delete(a.sources, key)
+			a.memory -= int64(len(key)) + sourceOverhead
+		}
+	}
+	return dps
+}
+
+// Flush sends the datapoints aggregated in the current window to next
+func (a *Aggregator) Flush(ctx context.Context) error {
+	atomic.AddInt64(&a.counters.flushes, 1)
+	dps := a.collect(time.Now())
+	if len(dps) == 0 {
+		return nil
+	}
+	atomic.AddInt64(&a.counters.datapointsOut, int64(len(dps)))
+	return a.next.AddDatapoints(ctx, dps)
+}
+
+// AddEvents is a passthrough
+func (a *Aggregator) AddEvents(ctx context.Context, events []*event.Event) error {
+	return a.next.AddEvents(ctx, events)
+}
+
+// AddSpans is a passthrough
+func (a *Aggregator) AddSpans(ctx context.Context, spans []*trace.Span) error {
+	return a.next.AddSpans(ctx, spans)
+}
+
+// Datapoints returns the number of series being aggregated, an estimate of the memory they use and counters of
+// the datapoints that went through the aggregator
+func (a *Aggregator) Datapoints() []*datapoint.Datapoint {
+	a.mu.Lock()
+	series, sources, memory := len(a.aggregates), len(a.sources), a.memory
+	a.mu.Unlock()
+	return []*datapoint.Datapoint{
+		sfxclient.Gauge("aggregator.series", nil, int64(series)),
+		sfxclient.Gauge("aggregator.counter_sources", nil, int64(sources)),
+		sfxclient.Gauge("aggregator.memory_bytes", nil, memory),
+		sfxclient.Cumulative("aggregator.datapoints_in", nil, atomic.LoadInt64(&a.counters.datapointsIn)),
+		sfxclient.Cumulative("aggregator.datapoints_out", nil, atomic.LoadInt64(&a.counters.datapointsOut)),
+		sfxclient.Cumulative("aggregator.passed_through", nil, atomic.LoadInt64(&a.counters.passedThrough)),
+		sfxclient.Cumulative("aggregator.flushes", nil, atomic.LoadInt64(&a.counters.flushes)),
+	}
+}
@@ -0,0 +1,175 @@
+package dpaggregate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func point(metric string, dims map[string]string, value datapoint.Value, mtype datapoint.MetricType) *datapoint.Datapoint {
+	return datapoint.New(metric, dims, value, mtype, time.Now())
+}
+
+func byName(dps []*datapoint.Datapoint) map[string]*datapoint.Datapoint {
+	ret := make(map[string]*datapoint.Datapoint, len(dps))
+	for _, dp := range dps {
+		ret[dp.Metric] = dp
+	}
+	return ret
+}
+
+func TestAggregator(t *testing.T) {
+	Convey("given an aggregator that keeps the service dimension", t, func() {
+		sink := dptest.NewBasicSink()
+		sink.Resize(10)
+		a, err := New(context.Background(), &Config{
+			Interval:    pointer.Duration(time.Hour),
+			Dimensions:  []string{"service"},
+			IdleWindows: pointer.Int64(1),
+		}, sink, log.Discard)
+		So(err, ShouldBeNil)
+		ctx := context.Background()
+		Convey("gauges should be rolled up into stats", func() {
+			So(a.AddDatapoints(ctx, []*datapoint.Datapoint{
+				point("cpu", map[string]string{"service": "api", "pod": "a"}, datapoint.NewIntValue(3), datapoint.Gauge),
+				point("cpu", map[string]string{"service": "api", "pod": "b"}, datapoint.NewIntValue(1), datapoint.Gauge),
+				point("cpu", map[string]string{"service": "api", "pod": "c"}, datapoint.NewIntValue(2), datapoint.Gauge),
+				point("cpu", map[string]string{"service": "db", "pod": "d"}, datapoint.NewFloatValue(0.5), datapoint.Rate),
+			}), ShouldBeNil)
+			So(sink.PointsChan, ShouldHaveLength, 0)
+			So(dptest.ExactlyOne(a.Datapoints(), "aggregator.series").Value, ShouldResemble, datapoint.NewIntValue(2))
+			So(a.Flush(ctx), ShouldBeNil)
+			dps := <-sink.PointsChan
+			So(dps, ShouldHaveLength, 10)
+			api := dptest.ExactlyOneDims(dps, "cpu.sum", map[string]string{"service": "api"})
+			So(api.Value, ShouldResemble, datapoint.NewIntValue(6))
+			So(api.MetricType, ShouldEqual, datapoint.Gauge)
+			So(dptest.ExactlyOneDims(dps, "cpu.count", map[string]string{"service": "api"}).Value, ShouldResemble, datapoint.NewIntValue(3))
+			So(dptest.ExactlyOneDims(dps, "cpu.min", map[string]string{"service": "api"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+			So(dptest.ExactlyOneDims(dps, "cpu.max", map[string]string{"service": "api"}).Value, ShouldResemble, datapoint.NewIntValue(3))
+			So(dptest.ExactlyOneDims(dps, "cpu.last", map[string]string{"service": "api"}).Value, ShouldResemble, datapoint.NewIntValue(2))
+			So(dptest.ExactlyOneDims(dps, "cpu.last", map[string]string{"service": "db"}).Value, ShouldResemble, datapoint.NewFloatValue(0.5))
+			So(dptest.ExactlyOne(a.Datapoints(), "aggregator.series").Value, ShouldResemble, datapoint.NewIntValue(0))
+			So(dptest.ExactlyOne(a.Datapoints(), "aggregator.memory_bytes").Value, ShouldResemble, datapoint.NewIntValue(0))
+			So(a.Flush(ctx), ShouldBeNil)
+			So(sink.PointsChan, ShouldHaveLength, 0)
+		})
+		Convey("counts should be summed", func() {
+			So(a.AddDatapoints(ctx, []*datapoint.Datapoint{
+				point("requests", map[string]string{"pod": "a"}, datapoint.NewIntValue(3), datapoint.Count),
+				point("requests", map[string]string{"pod": "b"}, datapoint.NewFloatValue(1.5), datapoint.Count),
+			}), ShouldBeNil)
+			So(a.Flush(ctx), ShouldBeNil)
+			dps := <-sink.PointsChan
+			So(dps, ShouldHaveLength, 1)
+			So(dps[0].Metric, ShouldEqual, "requests")
+			So(dps[0].Dimensions, ShouldResemble, map[string]string{})
+			So(dps[0].MetricType, ShouldEqual, datapoint.Count)
+			So(dps[0].Value, ShouldResemble, datapoint.NewFloatValue(4.5))
+		})
+		Convey("cumulative counters should add up the increases of each series", func() {
+			send := func(pod string, v int64) {
+				So(a.AddDatapoints(ctx, []*datapoint.Datapoint{point("bytes", map[string]string{"pod": pod}, datapoint.NewIntValue(v), datapoint.Counter)}), ShouldBeNil)
+			}
+			flushed := func() datapoint.Value {
+				So(a.Flush(ctx), ShouldBeNil)
+				dps := <-sink.PointsChan
+				So(dps, ShouldHaveLength, 1)
+				So(dps[0].MetricType, ShouldEqual, datapoint.Counter)
+				return dps[0].Value
+			}
+			send("a", 100)
+			send("b", 50)
+			So(flushed(), ShouldResemble, datapoint.NewIntValue(0))
+			send("a", 110)
+			send("b", 55)
+			send("b", 65)
+			So(flushed(), ShouldResemble, datapoint.NewIntValue(25))
+			// b restarted
+			send("b", 5)
+			So(flushed(), ShouldResemble, datapoint.NewIntValue(30))
+			So(dptest.ExactlyOne(a.Datapoints(), "aggregator.counter_sources").Value, ShouldResemble, datapoint.NewIntValue(1))
+			// nothing is sent for idle windows and series are forgotten after IdleWindows, like a already was
+			So(a.Flush(ctx), ShouldBeNil)
+			So(sink.PointsChan, ShouldHaveLength, 0)
+			So(a.Flush(ctx), ShouldBeNil)
+			So(dptest.ExactlyOne(a.Datapoints(), "aggregator.series").Value, ShouldResemble, datapoint.NewIntValue(0))
+			So(dptest.ExactlyOne(a.Datapoints(), "aggregator.counter_sources").Value, ShouldResemble, datapoint.NewIntValue(0))
+			send("a", 200)
+			So(flushed(), ShouldResemble, datapoint.NewIntValue(0))
+		})
+		Convey("tokens should keep series apart", func() {
+			withToken := point("cpu", nil, datapoint.NewIntValue(1), datapoint.Gauge)
+			withToken.Meta[sfxclient.TokenHeaderName] = "tok"
+			So(a.AddDatapoints(ctx, []*datapoint.Datapoint{withToken, point("cpu", nil, datapoint.NewIntValue(1), datapoint.Gauge)}), ShouldBeNil)
+			So(a.Flush(ctx), ShouldBeNil)
+			dps := <-sink.PointsChan
+			So(dps, ShouldHaveLength, 10)
+			tokens := 0
+			for _, dp := range dps {
+				if dp.Meta[sfxclient.TokenHeaderName] == "tok" {
+					tokens++
+				}
+			}
+			So(tokens, ShouldEqual, 5)
+		})
+		Convey("other datapoints, events and spans should pass through", func() {
+			points := []*datapoint.Datapoint{
+				point("state", nil, datapoint.NewStringValue("up"), datapoint.Gauge),
+				point("mode", nil, datapoint.NewIntValue(1), datapoint.Enum),
+			}
+			So(a.AddDatapoints(ctx, points), ShouldBeNil)
+			So(<-sink.PointsChan, ShouldResemble, points)
+			events := []*event.Event{dptest.E()}
+			So(a.AddEvents(ctx, events), ShouldBeNil)
+			So(<-sink.EventsChan, ShouldResemble, events)
+			spans := []*trace.Span{{}}
+			So(a.AddSpans(ctx, spans), ShouldBeNil)
+			So(<-sink.TracesChan, ShouldResemble, spans)
+			stats := byName(a.Datapoints())
+			So(stats["aggregator.passed_through"].Value, ShouldResemble, datapoint.NewIntValue(2))
+			So(stats["aggregator.datapoints_in"].Value, ShouldResemble, datapoint.NewIntValue(2))
+		})
+		Convey("errors from the next sink should be returned", func() {
+			sink.RetError(errors.New("nope"))
+			So(a.AddDatapoints(ctx, []*datapoint.Datapoint{point("state", nil, nil, datapoint.Gauge)}), ShouldNotBeNil)
+			So(a.AddDatapoints(ctx, []*datapoint.Datapoint{point("cpu", nil, datapoint.NewIntValue(1), datapoint.Gauge)}), ShouldBeNil)
+			So(a.Flush(ctx), ShouldNotBeNil)
+		})
+		Reset(func() {
+			sink.RetError(nil)
+			So(a.Close(), ShouldBeNil)
+		})
+	})
+	Convey("the aggregator should flush on its interval and on close", t, func() {
+		sink := dptest.NewBasicSink()
+		sink.Resize(10)
+		a, err := New(context.Background(), &Config{Interval: pointer.Duration(time.Millisecond), Stats: []string{Last}}, sink, log.Discard)
+		So(err, ShouldBeNil)
+		So(a.AddDatapoints(context.Background(), []*datapoint.Datapoint{point("cpu", nil, datapoint.NewIntValue(1), datapoint.Gauge)}), ShouldBeNil)
+		dps := <-sink.PointsChan
+		So(dps, ShouldHaveLength, 1)
+		So(dps[0].Metric, ShouldEqual, "cpu.last")
+		So(a.Close(), ShouldBeNil)
+		So(a.AddDatapoints(context.Background(), []*datapoint.Datapoint{point("cpu", nil, datapoint.NewIntValue(2), datapoint.Gauge)}), ShouldBeNil)
+		So(a.Close(), ShouldBeNil)
+		So((<-sink.PointsChan)[0].Value, ShouldResemble, datapoint.NewIntValue(2))
+		So(byName(a.Datapoints())["aggregator.flushes"].Value.(datapoint.IntValue).Int(), ShouldBeGreaterThanOrEqualTo, 2)
+	})
+	Convey("bad configs should throw errors", t, func() {
+		_, err := New(context.Background(), &Config{Interval: pointer.Duration(0)}, nil, log.Discard)
+		So(err, ShouldNotBeNil)
+		_, err = New(context.Background(), &Config{Stats: []string{"p99"}}, nil, log.Discard)
+		So(err, ShouldNotBeNil)
+	})
+}
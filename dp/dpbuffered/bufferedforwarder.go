@@ -3,10 +3,14 @@ package dpbuffered
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"path/filepath"
 	"runtime"
 
 	"github.com/signalfx/golib/v3/datapoint"
@@ -17,6 +21,7 @@ import (
 	"github.com/signalfx/golib/v3/sfxclient"
 	"github.com/signalfx/golib/v3/trace"
 	"github.com/signalfx/ingest-protocols/logkey"
+	"github.com/signalfx/ingest-protocols/protocol"
 )
 
 // Config controls BufferedForwarder limits
@@ -31,10 +36,16 @@ type Config struct {
 	Cdim               *log.CtxDimensions
 	Name               *string
 	UseAuthFromRequest *bool
+	// SpillDirectory enables an on disk queue for datapoints, events and spans that do not fit in memory or fail to
+	// send.  The auth tokens of spilled batches are stored in plaintext, so the directory should only be readable by
+	// the user running the forwarder.
+	SpillDirectory   *string
+	SpillMaxBytes    *int64
+	SpillSegmentSize *int64
 }
 
 func (c *Config) String() string {
-	return fmt.Sprintf("Config [Name: %s BufferSize: %d MaxTotalDatapoints: %d MaxTotalEvents: %d MaxTotalSpans: %d MaxDrainSize: %d NumDrainingThreads: %d UseAuthFromRequest: %t", *c.Name, *c.BufferSize, *c.MaxTotalDatapoints, *c.MaxTotalEvents, *c.MaxTotalSpans, *c.MaxDrainSize, *c.NumDrainingThreads, *c.UseAuthFromRequest)
+	return fmt.Sprintf("Config [Name: %s BufferSize: %d MaxTotalDatapoints: %d MaxTotalEvents: %d MaxTotalSpans: %d MaxDrainSize: %d NumDrainingThreads: %d UseAuthFromRequest: %t SpillDirectory: %s SpillMaxBytes: %d SpillSegmentSize: %d", *c.Name, *c.BufferSize, *c.MaxTotalDatapoints, *c.MaxTotalEvents, *c.MaxTotalSpans, *c.MaxDrainSize, *c.NumDrainingThreads, *c.UseAuthFromRequest, *c.SpillDirectory, *c.SpillMaxBytes, *c.SpillSegmentSize)
 }
 
 // DefaultConfig are default values for buffered forwarders
@@ -47,8 +58,14 @@ var DefaultConfig = &Config{
 	NumDrainingThreads: pointer.Int64(int64(runtime.NumCPU())),
 	Name:               pointer.String(""),
 	UseAuthFromRequest: pointer.Bool(false),
+	SpillDirectory:     pointer.String(""),
+	SpillMaxBytes:      pointer.Int64(1 << 30),
+	SpillSegmentSize:   pointer.Int64(64 << 20),
 }
 
+// spillRetryInterval is how long to wait before moving spilled items back into full memory buffers
+var spillRetryInterval = time.Millisecond * 100
+
 // Sink is a dpsink and trace.sink
 type Sink interface {
 	dpsink.Sink
@@ -62,6 +79,14 @@ type stats struct {
 	eventsInFlight          int64
 	totalTracesBuffered     int64
 	tracesInFlight          int64
+	// set while the last send of each type failed, so spilled items are only moved back slowly
+	datapointSendFailed int32
+	eventSendFailed     int32
+	traceSendFailed     int32
+	// items whose send failed in a way that would fail again, so were not spilled
+	datapointsDropped int64
+	eventsDropped     int64
+	tracesDropped     int64
 }
 
 // BufferedForwarder abstracts out datapoint buffering.  Points put on its channel are buffered
@@ -83,6 +108,11 @@ type BufferedForwarder struct {
 	holdEvents     []*event.Event
 	holdSpans      []*trace.Span
 
+	// the spill queues are nil unless a SpillDirectory is configured
+	dpSpill *spillQueue
+	eSpill  *spillQueue
+	tSpill  *spillQueue
+
 	logger     log.Logger
 	checker    *dpsink.ItemFlagger
 	cdim       *log.CtxDimensions
@@ -103,12 +133,25 @@ func (forwarder *BufferedForwarder) DebugEndpoints() map[string]http.Handler {
 
 var _ dpsink.Sink = &BufferedForwarder{}
 
+// BufferFullRetryAfter is how long clients are asked to wait before resending items refused because a buffer is full
+const BufferFullRetryAfter = time.Second
+
 type errDPBufferFull string
 
 func (e errDPBufferFull) Error() string {
 	return "Forwarder " + string(e) + " unable to send more datapoints.  Buffer full"
 }
 
+// StatusCode is 503, since the forwarder is overloaded rather than the request being invalid
+func (e errDPBufferFull) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// RetryAfter is BufferFullRetryAfter
+func (e errDPBufferFull) RetryAfter() time.Duration {
+	return BufferFullRetryAfter
+}
+
 // AddDatapoints sends the datapoints to a chan buffer that eventually is flushed in big groups
 func (forwarder *BufferedForwarder) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
 	if forwarder.checker.CtxFlagCheck.HasFlag(ctx) {
@@ -117,6 +160,9 @@ func (forwarder *BufferedForwarder) AddDatapoints(ctx context.Context, points []
 	atomic.AddInt64(&forwarder.stats.totalDatapointsBuffered, int64(len(points)))
 	if *forwarder.config.MaxTotalDatapoints <= atomic.LoadInt64(&forwarder.stats.totalDatapointsBuffered) {
 		atomic.AddInt64(&forwarder.stats.totalDatapointsBuffered, int64(-len(points)))
+		if forwarder.dpSpill != nil && forwarder.dpSpill.Push(newDatapointRecord(points)) == nil {
+			return nil
+		}
 		return errDPBufferFull(forwarder.identifier)
 	}
 	select {
@@ -135,6 +181,16 @@ func (e errEBufferFull) Error() string {
 	return "Forwarder " + string(e) + " unable to send more events.  Buffer full"
 }
 
+// StatusCode is 503, since the forwarder is overloaded rather than the request being invalid
+func (e errEBufferFull) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// RetryAfter is BufferFullRetryAfter
+func (e errEBufferFull) RetryAfter() time.Duration {
+	return BufferFullRetryAfter
+}
+
 // AddEvents sends the events to a chan buffer that eventually is flushed in big groups
 func (forwarder *BufferedForwarder) AddEvents(ctx context.Context, events []*event.Event) error {
 	if forwarder.checker.CtxFlagCheck.HasFlag(ctx) {
@@ -143,6 +199,9 @@ func (forwarder *BufferedForwarder) AddEvents(ctx context.Context, events []*eve
 	atomic.AddInt64(&forwarder.stats.totalEventsBuffered, int64(len(events)))
 	if *forwarder.config.MaxTotalEvents <= atomic.LoadInt64(&forwarder.stats.totalEventsBuffered) {
 		atomic.AddInt64(&forwarder.stats.totalEventsBuffered, int64(-len(events)))
+		if forwarder.eSpill != nil && forwarder.eSpill.Push(newEventRecord(events)) == nil {
+			return nil
+		}
 		return errEBufferFull(forwarder.identifier)
 	}
 	select {
@@ -161,11 +220,24 @@ func (e errTBufferFull) Error() string {
 	return "Forwarder " + string(e) + " unable to send more traces.  Buffer full"
 }
 
+// StatusCode is 503, since the forwarder is overloaded rather than the request being invalid
+func (e errTBufferFull) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// RetryAfter is BufferFullRetryAfter
+func (e errTBufferFull) RetryAfter() time.Duration {
+	return BufferFullRetryAfter
+}
+
 // AddSpans sends the traces to a chan buffer that traceually is flushed in big groups
 func (forwarder *BufferedForwarder) AddSpans(ctx context.Context, traces []*trace.Span) error {
 	atomic.AddInt64(&forwarder.stats.totalTracesBuffered, int64(len(traces)))
 	if *forwarder.config.MaxTotalSpans <= atomic.LoadInt64(&forwarder.stats.totalTracesBuffered) {
 		atomic.AddInt64(&forwarder.stats.totalTracesBuffered, int64(-len(traces)))
+		if forwarder.tSpill != nil && forwarder.tSpill.Push(newSpanRecord(traces)) == nil {
+			return nil
+		}
 		return errTBufferFull(forwarder.identifier)
 	}
 	select {
@@ -180,7 +252,7 @@ func (forwarder *BufferedForwarder) AddSpans(ctx context.Context, traces []*trac
 
 // DebugDatapoints returns debug level datapoints about this forwarder, including errors processing datapoints
 func (forwarder *BufferedForwarder) DebugDatapoints() []*datapoint.Datapoint {
-	return []*datapoint.Datapoint{
+	dps := []*datapoint.Datapoint{
 		sfxclient.Gauge("datapoint_chan_backup_size", nil, int64(len(forwarder.dpChan))),
 		sfxclient.Gauge("event_chan_backup_size", nil, int64(len(forwarder.eChan))),
 		sfxclient.Gauge("datapoint_backup_size", nil, atomic.LoadInt64(&forwarder.stats.totalDatapointsBuffered)),
@@ -188,6 +260,20 @@ func (forwarder *BufferedForwarder) DebugDatapoints() []*datapoint.Datapoint {
 		sfxclient.Gauge("trace_chan_backup_size", nil, int64(len(forwarder.tChan))),
 		sfxclient.Gauge("trace_backup_size", nil, atomic.LoadInt64(&forwarder.stats.totalTracesBuffered)),
 	}
+	if forwarder.dpSpill != nil {
+		dps = append(dps,
+			sfxclient.Gauge("datapoint_spill_queue_depth", nil, forwarder.dpSpill.Depth()),
+			sfxclient.Gauge("datapoint_spill_queue_bytes", nil, forwarder.dpSpill.Bytes()),
+			sfxclient.Gauge("event_spill_queue_depth", nil, forwarder.eSpill.Depth()),
+			sfxclient.Gauge("event_spill_queue_bytes", nil, forwarder.eSpill.Bytes()),
+			sfxclient.Gauge("trace_spill_queue_depth", nil, forwarder.tSpill.Depth()),
+			sfxclient.Gauge("trace_spill_queue_bytes", nil, forwarder.tSpill.Bytes()),
+			sfxclient.Cumulative("datapoint_spill_dropped", nil, atomic.LoadInt64(&forwarder.stats.datapointsDropped)),
+			sfxclient.Cumulative("event_spill_dropped", nil, atomic.LoadInt64(&forwarder.stats.eventsDropped)),
+			sfxclient.Cumulative("trace_spill_dropped", nil, atomic.LoadInt64(&forwarder.stats.tracesDropped)),
+		)
+	}
+	return dps
 }
 
 // DefaultDatapoints does nothing and exists to satisfy the protocol.forwarder interface
@@ -200,7 +286,8 @@ func (forwarder *BufferedForwarder) Datapoints() []*datapoint.Datapoint {
 	return append(forwarder.DebugDatapoints(), forwarder.DefaultDatapoints()...)
 }
 
-// Pipeline for a BufferedForwarder is the total of all buffers and what is in flight
+// Pipeline for a BufferedForwarder is the total of all buffers and what is in flight.  Spilled items
+// are not counted since they are kept on disk across restarts.
 func (forwarder *BufferedForwarder) Pipeline() int64 {
 	return int64(len(forwarder.dpChan)) + int64(len(forwarder.eChan)) + atomic.LoadInt64(&forwarder.stats.datapointsInFlight) + atomic.LoadInt64(&forwarder.stats.eventsInFlight) + int64(len(forwarder.tChan)) + atomic.LoadInt64(&forwarder.stats.tracesInFlight)
 }
@@ -395,6 +482,12 @@ func (forwarder *BufferedForwarder) getTokenFromSpans(spans []*trace.Span, curre
 func (forwarder *BufferedForwarder) Close() error {
 	forwarder.stopFunc()
 	forwarder.threadsWaitingToDie.Wait()
+	if forwarder.dpSpill != nil {
+		forwarder.spillBuffered()
+		log.IfErr(forwarder.logger, forwarder.dpSpill.Close())
+		log.IfErr(forwarder.logger, forwarder.eSpill.Close())
+		log.IfErr(forwarder.logger, forwarder.tSpill.Close())
+	}
 	return forwarder.closeSender()
 }
 
@@ -413,6 +506,9 @@ func (forwarder *BufferedForwarder) doData(drainIndex int64) {
 		if err != nil {
 			logger.Log(log.Err, err, "error sending datapoints")
 		}
+		forwarder.afterSend(forwarder.dpSpill, &forwarder.stats.datapointSendFailed, &forwarder.stats.datapointsDropped, len(datapoints), err, func() *spillRecord {
+			return newDatapointRecord(datapoints)
+		})
 		logDpIfFlag(logger, forwarder.checker, datapoints, "Finished sending datapoint")
 	}
 }
@@ -432,6 +528,9 @@ func (forwarder *BufferedForwarder) doEvent(drainIndex int64) {
 		if err != nil {
 			logger.Log(log.Err, err, "error sending events")
 		}
+		forwarder.afterSend(forwarder.eSpill, &forwarder.stats.eventSendFailed, &forwarder.stats.eventsDropped, len(events), err, func() *spillRecord {
+			return newEventRecord(events)
+		})
 		logEvIfFlag(logger, forwarder.checker, events, "Finished sending event")
 	}
 }
@@ -450,6 +549,163 @@ func (forwarder *BufferedForwarder) doSpan(drainIndex int64) {
 		if err != nil {
 			logger.Log(log.Err, err, "error sending traces")
 		}
+		forwarder.afterSend(forwarder.tSpill, &forwarder.stats.traceSendFailed, &forwarder.stats.tracesDropped, len(traces), err, func() *spillRecord {
+			return newSpanRecord(traces)
+		})
+	}
+}
+
+// refill reserves room for n items in a memory buffer and sends them.  A batch larger than the
+// whole buffer is still let through once the buffer is empty so it cannot block the spill queue.
+func (forwarder *BufferedForwarder) refill(buffered *int64, limit int64, n int, send func() bool) bool {
+	total := atomic.AddInt64(buffered, int64(n))
+	if limit <= total && total > int64(n) {
+		atomic.AddInt64(buffered, int64(-n))
+		return false
+	}
+	if send() {
+		return true
+	}
+	atomic.AddInt64(buffered, int64(-n))
+	return false
+}
+
+// unspill moves a spilled record back into memory, returning false if there is no room yet
+func (forwarder *BufferedForwarder) unspill(rec *spillRecord) bool {
+	done := forwarder.stopContext.Done()
+	switch rec.Kind {
+	case spillDatapoints:
+		points := rec.datapoints()
+		return forwarder.refill(&forwarder.stats.totalDatapointsBuffered, *forwarder.config.MaxTotalDatapoints, len(points), func() bool {
+			select {
+			case forwarder.dpChan <- points:
+				return true
+			case <-done:
+				return false
+			}
+		})
+	case spillEvents:
+		events := rec.events()
+		return forwarder.refill(&forwarder.stats.totalEventsBuffered, *forwarder.config.MaxTotalEvents, len(events), func() bool {
+			select {
+			case forwarder.eChan <- events:
+				return true
+			case <-done:
+				return false
+			}
+		})
+	case spillSpans:
+		spans := rec.spans()
+		return forwarder.refill(&forwarder.stats.totalTracesBuffered, *forwarder.config.MaxTotalSpans, len(spans), func() bool {
+			select {
+			case forwarder.tChan <- spans:
+				return true
+			case <-done:
+				return false
+			}
+		})
+	}
+	// nothing we know how to send, so drop it
+	return true
+}
+
+// afterSend records whether a send failed and puts the batch of a failed send back on the spill queue, so it is sent
+// again later instead of being dropped.  Batches the sink refused outright would be refused again, so they are
+// dropped and counted instead.
+func (forwarder *BufferedForwarder) afterSend(q *spillQueue, sendFailed *int32, dropped *int64, n int, err error, rec func() *spillRecord) {
+	if q == nil {
+		return
+	}
+	if err == nil {
+		atomic.StoreInt32(sendFailed, 0)
+		return
+	}
+	if !retryable(err) {
+		atomic.StoreInt32(sendFailed, 0)
+		atomic.AddInt64(dropped, int64(n))
+		return
+	}
+	atomic.StoreInt32(sendFailed, 1)
+	if perr := q.Push(rec()); perr != nil {
+		forwarder.logger.Log(log.Err, perr, "unable to spill items that failed to send")
+	}
+}
+
+// retryable returns if a send failed because the sink could not be reached or was overloaded, rather than because it
+// refused the data
+func retryable(err error) bool {
+	if _, ok := protocol.AsBackoffError(err); ok {
+		return true
+	}
+	var throttled *sfxclient.TooManyRequestError
+	if errors.As(err, &throttled) {
+		return true
+	}
+	var apiErr *sfxclient.SFXAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// drainSpill moves spilled records back into memory as there is room.  While sends are failing only one record is
+// moved back each spillRetryInterval, to find out if sends work again without pulling the whole queue into memory.
+func (forwarder *BufferedForwarder) drainSpill(q *spillQueue, sendFailed *int32) {
+	defer forwarder.threadsWaitingToDie.Done()
+	for forwarder.stopContext.Err() == nil {
+		failing := atomic.LoadInt32(sendFailed) != 0
+		rec, err := q.Peek()
+		if err != nil {
+			forwarder.logger.Log(log.Err, err, "unable to read spilled items")
+		}
+		if rec != nil && forwarder.unspill(rec) {
+			q.Remove()
+			if !failing {
+				continue
+			}
+		}
+		// an empty queue only needs to wait for the next push, unless sends are failing
+		forwarder.waitToDrain(q, failing || rec != nil || err != nil, failing)
+	}
+}
+
+func (forwarder *BufferedForwarder) waitToDrain(q *spillQueue, retry bool, failing bool) {
+	var retryAfter <-chan time.Time
+	if retry {
+		retryAfter = time.After(spillRetryInterval)
+	}
+	notify := q.notify
+	if failing {
+		// failed sends are pushed back on the queue, which must not wake it up right away
+		notify = nil
+	}
+	select {
+	case <-notify:
+	case <-retryAfter:
+	case <-forwarder.stopContext.Done():
+	}
+}
+
+// spillBuffered moves anything still held in memory to the spill queue so it is not lost on close
+func (forwarder *BufferedForwarder) spillBuffered() {
+	if len(forwarder.holdDatapoints) > 0 {
+		log.IfErr(forwarder.logger, forwarder.dpSpill.Push(newDatapointRecord(forwarder.holdDatapoints)))
+	}
+	if len(forwarder.holdEvents) > 0 {
+		log.IfErr(forwarder.logger, forwarder.eSpill.Push(newEventRecord(forwarder.holdEvents)))
+	}
+	if len(forwarder.holdSpans) > 0 {
+		log.IfErr(forwarder.logger, forwarder.tSpill.Push(newSpanRecord(forwarder.holdSpans)))
+	}
+	for len(forwarder.dpChan) > 0 {
+		log.IfErr(forwarder.logger, forwarder.dpSpill.Push(newDatapointRecord(<-forwarder.dpChan)))
+	}
+	for len(forwarder.eChan) > 0 {
+		log.IfErr(forwarder.logger, forwarder.eSpill.Push(newEventRecord(<-forwarder.eChan)))
+	}
+	for len(forwarder.tChan) > 0 {
+		log.IfErr(forwarder.logger, forwarder.tSpill.Push(newSpanRecord(<-forwarder.tChan)))
 	}
 }
 
@@ -460,6 +716,12 @@ func (forwarder *BufferedForwarder) start() {
 		go forwarder.doEvent(i)
 		go forwarder.doSpan(i)
 	}
+	if forwarder.dpSpill != nil {
+		forwarder.threadsWaitingToDie.Add(3)
+		go forwarder.drainSpill(forwarder.dpSpill, &forwarder.stats.datapointSendFailed)
+		go forwarder.drainSpill(forwarder.eSpill, &forwarder.stats.eventSendFailed)
+		go forwarder.drainSpill(forwarder.tSpill, &forwarder.stats.traceSendFailed)
+	}
 }
 
 type flagChecker interface {
@@ -489,6 +751,24 @@ func logEvIfFlag(l log.Logger, checker flagChecker, ev []*event.Event, msg strin
 	}
 }
 
+// openSpill opens a spill queue per item type under the spill directory, sharing SpillMaxBytes
+func (forwarder *BufferedForwarder) openSpill() error {
+	budget := &spillBudget{max: *forwarder.config.SpillMaxBytes}
+	var queues []*spillQueue
+	for _, name := range []string{"datapoints", "events", "spans"} {
+		q, err := newSpillQueue(filepath.Join(*forwarder.config.SpillDirectory, name), budget, *forwarder.config.SpillSegmentSize)
+		if err != nil {
+			for _, opened := range queues {
+				log.IfErr(forwarder.logger, opened.Close())
+			}
+			return err
+		}
+		queues = append(queues, q)
+	}
+	forwarder.dpSpill, forwarder.eSpill, forwarder.tSpill = queues[0], queues[1], queues[2]
+	return nil
+}
+
 // StartupFinished runs the afterStartup method on the forwarder
 func (forwarder *BufferedForwarder) StartupFinished() error {
 	return forwarder.afterStartup()
@@ -518,6 +798,11 @@ func NewBufferedForwarder(ctx context.Context, config *Config, sendTo Sink, clos
 		debugEndpoints:     debugEnpoints,
 		useAuthFromRequest: *config.UseAuthFromRequest,
 	}
+	if *config.SpillDirectory != "" {
+		if err := ret.openSpill(); err != nil {
+			logCtx.Log(log.Err, err, "unable to open spill directory, items over the buffer limits will be dropped")
+		}
+	}
 	ret.start()
 	return ret
 }
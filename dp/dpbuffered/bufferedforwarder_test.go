@@ -6,9 +6,15 @@ import (
 
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 
+	"net"
 	"net/http"
 
 	"github.com/signalfx/golib/v3/datapoint"
@@ -21,6 +27,7 @@ import (
 	"github.com/signalfx/golib/v3/trace"
 	"github.com/signalfx/golib/v3/web"
 	"github.com/signalfx/ingest-protocols/logkey"
+	"github.com/signalfx/ingest-protocols/protocol"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/stretchr/testify/assert"
 )
@@ -387,6 +394,15 @@ func TestBufferedForwarderMaxTotalEvents(t *testing.T) {
 	assert.True(t, found, "With small buffer size, I should error out with a full buffer")
 }
 
+func TestBufferFullErrorsBackOff(t *testing.T) {
+	for _, err := range []error{errDPBufferFull("a"), errEBufferFull("a"), errTBufferFull("a")} {
+		backoff, ok := err.(protocol.BackoffError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusServiceUnavailable, backoff.StatusCode())
+		assert.Equal(t, BufferFullRetryAfter, backoff.RetryAfter())
+	}
+}
+
 func TestTokenContext(t *testing.T) {
 	Convey("test token context", t, func() {
 		ctx := context.Background()
@@ -475,3 +491,158 @@ func TestTokenContext(t *testing.T) {
 		})
 	})
 }
+
+func TestBufferedForwarderSpill(t *testing.T) {
+	Convey("a forwarder with a spill directory", t, func() {
+		dir, err := ioutil.TempDir("", "spill")
+		So(err, ShouldBeNil)
+		oldInterval := spillRetryInterval
+		spillRetryInterval = time.Millisecond
+		ctx := context.Background()
+		config := &Config{
+			BufferSize:         pointer.Int64(10),
+			MaxTotalDatapoints: pointer.Int64(3),
+			MaxTotalEvents:     pointer.Int64(3),
+			MaxTotalSpans:      pointer.Int64(3),
+			NumDrainingThreads: pointer.Int64(1),
+			MaxDrainSize:       pointer.Int64(1000),
+			Cdim:               &log.CtxDimensions{},
+			Checker: &dpsink.ItemFlagger{
+				CtxFlagCheck: &web.HeaderCtxFlag{},
+			},
+			SpillDirectory: pointer.String(dir),
+		}
+		sendTo := dptest.NewBasicSink()
+		bf := NewBufferedForwarder(ctx, config, sendTo, c, c, log.Discard, d)
+		stat := func(bf *BufferedForwarder, name string) int64 {
+			return dptest.ExactlyOne(bf.Datapoints(), name).Value.(datapoint.IntValue).Int()
+		}
+		fill := func() {
+			for i := 0; i < 10; i++ {
+				So(bf.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP(), dptest.DP()}), ShouldBeNil)
+				So(bf.AddEvents(ctx, []*event.Event{dptest.E(), dptest.E()}), ShouldBeNil)
+				So(bf.AddSpans(ctx, []*trace.Span{{}, {}}), ShouldBeNil)
+			}
+		}
+		// the sink sends one kind at a time, so every kind has to be read for any of them to make progress
+		collect := func() {
+			var points, events, spans int
+			for points < 20 || events < 20 || spans < 20 {
+				select {
+				case dps := <-sendTo.PointsChan:
+					points += len(dps)
+				case evs := <-sendTo.EventsChan:
+					events += len(evs)
+				case sps := <-sendTo.TracesChan:
+					spans += len(sps)
+				}
+			}
+			So(points, ShouldEqual, 20)
+			So(events, ShouldEqual, 20)
+			So(spans, ShouldEqual, 20)
+		}
+		Reset(func() {
+			spillRetryInterval = oldInterval
+			So(os.RemoveAll(dir), ShouldBeNil)
+		})
+		Convey("should spill what does not fit in memory and send it once the sink catches up", func() {
+			fill()
+			So(len(bf.Datapoints()), ShouldEqual, numStats+9)
+			// at most one batch of each kind is in flight, one is in memory and the rest are on disk
+			for _, kind := range []string{"datapoint", "event", "trace"} {
+				So(stat(bf, kind+"_spill_queue_depth"), ShouldBeGreaterThanOrEqualTo, 8)
+				So(stat(bf, kind+"_spill_queue_bytes"), ShouldBeGreaterThan, 0)
+			}
+			collect()
+			So(bf.Close(), ShouldBeNil)
+		})
+		Convey("should keep spilled items across restarts", func() {
+			fill()
+			// the batches in flight are canceled and spilled with everything else
+			So(bf.Close(), ShouldBeNil)
+			bf = NewBufferedForwarder(ctx, config, sendTo, c, c, log.Discard, d)
+			So(stat(bf, "datapoint_spill_queue_depth"), ShouldBeGreaterThan, 0)
+			collect()
+			So(bf.Close(), ShouldBeNil)
+		})
+		Convey("should keep batches that fail to send on disk until sends work again", func() {
+			sendTo.RetError(&sfxclient.SFXAPIError{StatusCode: http.StatusServiceUnavailable})
+			fill()
+			time.Sleep(time.Millisecond * 20)
+			for _, kind := range []string{"datapoint", "event", "trace"} {
+				So(stat(bf, kind+"_spill_queue_depth"), ShouldBeGreaterThanOrEqualTo, 8)
+			}
+			sendTo.RetError(nil)
+			collect()
+			So(bf.Close(), ShouldBeNil)
+		})
+		Convey("should drop batches the sink refuses instead of spilling them", func() {
+			sendTo.RetError(&sfxclient.SFXAPIError{StatusCode: http.StatusBadRequest})
+			fill()
+			for _, kind := range []string{"datapoint", "event", "trace"} {
+				for stat(bf, kind+"_spill_dropped") < 20 {
+					time.Sleep(time.Millisecond)
+				}
+				So(stat(bf, kind+"_spill_queue_depth"), ShouldEqual, 0)
+			}
+			So(bf.Close(), ShouldBeNil)
+		})
+		Convey("should create files only their owner can read", func() {
+			fill()
+			So(bf.Close(), ShouldBeNil)
+			files, err := filepath.Glob(filepath.Join(dir, "datapoints", "*"))
+			So(err, ShouldBeNil)
+			So(files, ShouldNotBeEmpty)
+			for _, file := range append(files, filepath.Join(dir, "datapoints")) {
+				info, err := os.Stat(file)
+				So(err, ShouldBeNil)
+				So(info.Mode().Perm()&0o077, ShouldEqual, 0)
+			}
+		})
+		Convey("should run without spilling if the directory can not be used", func() {
+			So(bf.Close(), ShouldBeNil)
+			file := filepath.Join(dir, "file")
+			So(ioutil.WriteFile(file, nil, 0644), ShouldBeNil)
+			config.SpillDirectory = pointer.String(file)
+			bf = NewBufferedForwarder(ctx, config, sendTo, c, c, log.Discard, d)
+			So(bf.dpSpill, ShouldBeNil)
+			So(len(bf.Datapoints()), ShouldEqual, numStats)
+			So(bf.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func TestBufferedForwarderUnspill(t *testing.T) {
+	Convey("unspill should only move records that fit", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		f := &BufferedForwarder{
+			dpChan: make(chan []*datapoint.Datapoint),
+			config: &Config{
+				MaxTotalDatapoints: pointer.Int64(3),
+			},
+			stopContext: ctx,
+		}
+		rec := newDatapointRecord([]*datapoint.Datapoint{dptest.DP(), dptest.DP()})
+		f.stats.totalDatapointsBuffered = 2
+		So(f.unspill(rec), ShouldBeFalse)
+		So(f.stats.totalDatapointsBuffered, ShouldEqual, 2)
+		f.stats.totalDatapointsBuffered = 0
+		cancel()
+		So(f.unspill(rec), ShouldBeFalse)
+		So(f.stats.totalDatapointsBuffered, ShouldEqual, 0)
+		So(f.unspill(&spillRecord{}), ShouldBeTrue)
+	})
+}
+
+func TestRetryable(t *testing.T) {
+	Convey("only sends that could work later should be retried", t, func() {
+		So(retryable(errDPBufferFull("full")), ShouldBeTrue)
+		So(retryable(&sfxclient.TooManyRequestError{RetryAfter: time.Second}), ShouldBeTrue)
+		So(retryable(&sfxclient.SFXAPIError{StatusCode: http.StatusBadGateway}), ShouldBeTrue)
+		So(retryable(&net.OpError{Op: "dial", Err: errors.New("refused")}), ShouldBeTrue)
+		So(retryable(fmt.Errorf("send: %w", context.Canceled)), ShouldBeTrue)
+		So(retryable(&sfxclient.SFXAPIError{StatusCode: http.StatusBadRequest}), ShouldBeFalse)
+		So(retryable(&sfxclient.SFXAPIError{StatusCode: http.StatusUnauthorized}), ShouldBeFalse)
+		So(retryable(errors.New("invalid")), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,623 @@
+package dpbuffered
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/errors"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+)
+
+const (
+	spillSegmentSuffix = ".seg"
+	spillCursorFile    = "cursor"
+	// each record is prefixed by its payload length and a crc32 of the payload
+	spillHeaderSize = 8
+)
+
+const (
+	spillDatapoints byte = iota + 1
+	spillEvents
+	spillSpans
+)
+
+var (
+	errSpillFull    = errors.New("spill queue is full")
+	errSpillClosed  = errors.New("spill queue is closed")
+	errSpillCorrupt = errors.New("corrupt spill record")
+)
+
+// spillDatapoint keeps the value type of a datapoint, which the datapoint JSON encoding loses
+type spillDatapoint struct {
+	Metric     string               `json:"metric"`
+	Dimensions map[string]string    `json:"dimensions,omitempty"`
+	ValueType  string               `json:"valueType"`
+	Value      string               `json:"value"`
+	MetricType datapoint.MetricType `json:"metricType"`
+	Timestamp  time.Time            `json:"timestamp"`
+}
+
+type spillEvent struct {
+	EventType  string                 `json:"eventType"`
+	Category   event.Category         `json:"category"`
+	Dimensions map[string]string      `json:"dimensions,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+// spillRecord is one batch handed to the forwarder.  The token is kept so batches can still be
+// sent with the auth they came in with, and is written to disk in plaintext like the rest of the record.
+type spillRecord struct {
+	Kind       byte              `json:"kind"`
+	Token      string            `json:"token,omitempty"`
+	Datapoints []*spillDatapoint `json:"datapoints,omitempty"`
+	Events     []*spillEvent     `json:"events,omitempty"`
+	Spans      []*trace.Span     `json:"spans,omitempty"`
+}
+
+func tokenFromMeta(meta map[interface{}]interface{}) string {
+	if tok, ok := meta[sfxclient.TokenHeaderName].(string); ok {
+		return tok
+	}
+	return ""
+}
+
+func tokenMeta(token string) map[interface{}]interface{} {
+	if token == "" {
+		return nil
+	}
+	return map[interface{}]interface{}{sfxclient.TokenHeaderName: token}
+}
+
+func toSpillDatapoint(dp *datapoint.Datapoint) *spillDatapoint {
+	ret := &spillDatapoint{
+		Metric:     dp.Metric,
+		Dimensions: dp.Dimensions,
+		MetricType: dp.MetricType,
+		Timestamp:  dp.Timestamp,
+	}
+	switch v := dp.Value.(type) {
+	case datapoint.IntValue:
+		ret.ValueType, ret.Value = "int", strconv.FormatInt(v.Int(), 10)
+	case datapoint.FloatValue:
+		ret.ValueType, ret.Value = "float", strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case nil:
+	default:
+		ret.ValueType, ret.Value = "string", v.String()
+	}
+	return ret
+}
+
+func (s *spillDatapoint) toDatapoint(token string) *datapoint.Datapoint {
+	var value datapoint.Value
+	switch s.ValueType {
+	case "int":
+		i, _ := strconv.ParseInt(s.Value, 10, 64)
+		value = datapoint.NewIntValue(i)
+	case "float":
+		f, _ := strconv.ParseFloat(s.Value, 64)
+		value = datapoint.NewFloatValue(f)
+	case "string":
+		value = datapoint.NewStringValue(s.Value)
+	}
+	return datapoint.NewWithMeta(s.Metric, s.Dimensions, tokenMeta(token), value, s.MetricType, s.Timestamp)
+}
+
+func (s *spillEvent) toEvent(token string) *event.Event {
+	e := event.NewWithProperties(s.EventType, s.Category, s.Dimensions, s.Properties, s.Timestamp)
+	e.Meta = tokenMeta(token)
+	return e
+}
+
+func newDatapointRecord(points []*datapoint.Datapoint) *spillRecord {
+	rec := &spillRecord{Kind: spillDatapoints, Datapoints: make([]*spillDatapoint, 0, len(points))}
+	for _, dp := range points {
+		rec.Datapoints = append(rec.Datapoints, toSpillDatapoint(dp))
+	}
+	if len(points) > 0 {
+		rec.Token = tokenFromMeta(points[0].Meta)
+	}
+	return rec
+}
+
+func newEventRecord(events []*event.Event) *spillRecord {
+	rec := &spillRecord{Kind: spillEvents, Events: make([]*spillEvent, 0, len(events))}
+	for _, e := range events {
+		rec.Events = append(rec.Events, &spillEvent{
+			EventType:  e.EventType,
+			Category:   e.Category,
+			Dimensions: e.Dimensions,
+			Properties: e.Properties,
+			Timestamp:  e.Timestamp,
+		})
+	}
+	if len(events) > 0 {
+		rec.Token = tokenFromMeta(events[0].Meta)
+	}
+	return rec
+}
+
+func newSpanRecord(spans []*trace.Span) *spillRecord {
+	rec := &spillRecord{Kind: spillSpans, Spans: spans}
+	if len(spans) > 0 {
+		rec.Token = tokenFromMeta(spans[0].Meta)
+	}
+	return rec
+}
+
+func (r *spillRecord) datapoints() []*datapoint.Datapoint {
+	ret := make([]*datapoint.Datapoint, 0, len(r.Datapoints))
+	for _, dp := range r.Datapoints {
+		ret = append(ret, dp.toDatapoint(r.Token))
+	}
+	return ret
+}
+
+func (r *spillRecord) events() []*event.Event {
+	ret := make([]*event.Event, 0, len(r.Events))
+	for _, e := range r.Events {
+		ret = append(ret, e.toEvent(r.Token))
+	}
+	return ret
+}
+
+func (r *spillRecord) spans() []*trace.Span {
+	for _, s := range r.Spans {
+		s.Meta = tokenMeta(r.Token)
+	}
+	return r.Spans
+}
+
+func decodeSpillRecord(payload []byte) (*spillRecord, error) {
+	var rec spillRecord
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&rec); err != nil {
+		return nil, err
+	}
+	for _, e := range rec.Events {
+		for k, v := range e.Properties {
+			if n, ok := v.(json.Number); ok {
+				e.Properties[k] = spillNumber(n)
+			}
+		}
+	}
+	return &rec, nil
+}
+
+// spillNumber restores event property numbers to the int64 or float64 they were encoded from
+func spillNumber(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// spillBudget is the disk space shared by the spill queues of a forwarder
+type spillBudget struct {
+	max  int64
+	used int64
+}
+
+func (b *spillBudget) reserve(n int64) bool {
+	if atomic.AddInt64(&b.used, n) > b.max {
+		atomic.AddInt64(&b.used, -n)
+		return false
+	}
+	return true
+}
+
+func (b *spillBudget) release(n int64) {
+	atomic.AddInt64(&b.used, -n)
+}
+
+type spillSegment struct {
+	id   int64
+	size int64
+	// records not read yet
+	records int64
+}
+
+// spillQueue is an on disk FIFO of record batches split across fixed size segment files.  Segments
+// are removed once fully read and the read position is saved on close, so the queue survives restarts.
+// Records read after the last clean close may be delivered again after a crash.  Files are only readable by their
+// owner, since records hold auth tokens.
+type spillQueue struct {
+	dir         string
+	budget      *spillBudget
+	segmentSize int64
+
+	mu       sync.Mutex
+	segments []*spillSegment
+	writer   *os.File
+	reader   *os.File
+	readBuf  *bufio.Reader
+	readPos  int64
+	nextID   int64
+	depth    int64
+	bytes    int64
+	closed   bool
+	notify   chan struct{}
+	// the record returned by Peek stays here until it is removed
+	pending     *spillRecord
+	pendingSize int64
+}
+
+func spillSegmentPath(dir string, id int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", id, spillSegmentSuffix))
+}
+
+func newSpillQueue(dir string, budget *spillBudget, segmentSize int64) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Annotatef(err, "unable to create spill directory %s", dir)
+	}
+	q := &spillQueue{
+		dir:         dir,
+		budget:      budget,
+		segmentSize: segmentSize,
+		notify:      make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&budget.used, q.bytes)
+	return q, nil
+}
+
+// listSegments returns the ids of the segment files in the spill directory, oldest first
+func listSegments(dir string) ([]*spillSegment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read spill directory %s", dir)
+	}
+	var segments []*spillSegment
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, spillSegmentSuffix) {
+			continue
+		}
+		if id, perr := strconv.ParseInt(strings.TrimSuffix(name, spillSegmentSuffix), 10, 64); perr == nil {
+			segments = append(segments, &spillSegment{id: id})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].id < segments[j].id })
+	return segments, nil
+}
+
+// load finds existing segments, drops any partially written record at their end and skips what
+// was already read before the last close
+func (q *spillQueue) load() error {
+	segments, err := listSegments(q.dir)
+	if err != nil {
+		return err
+	}
+	cursorID, cursorPos := q.readCursor()
+	q.nextID = cursorID
+	if len(segments) > 0 && segments[len(segments)-1].id >= q.nextID {
+		q.nextID = segments[len(segments)-1].id + 1
+	}
+	for len(segments) > 0 && segments[0].id < cursorID {
+		if err = os.Remove(spillSegmentPath(q.dir, segments[0].id)); err != nil {
+			return errors.Annotatef(err, "unable to remove spill segment")
+		}
+		segments = segments[1:]
+	}
+	q.segments = segments
+	for _, seg := range q.segments {
+		skip := int64(0)
+		if seg.id == cursorID {
+			skip = cursorPos
+		}
+		if err = q.scanSegment(seg, skip); err != nil {
+			return err
+		}
+	}
+	if len(q.segments) > 0 && q.segments[0].id == cursorID {
+		q.readPos = cursorPos
+		if q.readPos > q.segments[0].size {
+			q.readPos = q.segments[0].size
+		}
+		q.bytes -= q.readPos
+	}
+	return nil
+}
+
+func (q *spillQueue) readCursor() (int64, int64) {
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, spillCursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	var id, pos int64
+	if _, err = fmt.Sscanf(string(b), "%d %d", &id, &pos); err != nil {
+		return 0, 0
+	}
+	return id, pos
+}
+
+// scanSegment counts the complete records in a segment, truncating anything after the last one
+func (q *spillQueue) scanSegment(seg *spillSegment, skip int64) error {
+	f, err := os.OpenFile(spillSegmentPath(q.dir, seg.id), os.O_RDWR, 0)
+	if err != nil {
+		return errors.Annotatef(err, "unable to open spill segment")
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Annotatef(err, "unable to stat spill segment")
+	}
+	r := bufio.NewReader(f)
+	var pos int64
+	for {
+		n, rerr := readSpillRecord(r, info.Size()-pos, nil)
+		if rerr != nil {
+			break
+		}
+		pos += n
+		if pos > skip {
+			q.depth++
+			seg.records++
+		}
+	}
+	seg.size = pos
+	q.bytes += pos
+	return f.Truncate(pos)
+}
+
+// readSpillRecord reads one record from r, which has remaining bytes left, returning its size on disk and copying
+// the payload into payload when it is not nil
+func readSpillRecord(r io.Reader, remaining int64, payload *[]byte) (int64, error) {
+	var header [spillHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	// a corrupt length must not be trusted with an allocation
+	if int64(size) > remaining-spillHeaderSize {
+		return 0, errSpillCorrupt
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	if crc32.ChecksumIEEE(buf) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, errSpillCorrupt
+	}
+	if payload != nil {
+		*payload = buf
+	}
+	return int64(size) + spillHeaderSize, nil
+}
+
+// Push appends a record to the queue, failing if it would go over the max bytes
+func (q *spillQueue) Push(rec *spillRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, spillHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[spillHeaderSize:], payload)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errSpillClosed
+	}
+	if !q.budget.reserve(int64(len(buf))) {
+		return errSpillFull
+	}
+	if err = q.openWriter(int64(len(buf))); err != nil {
+		q.budget.release(int64(len(buf)))
+		return err
+	}
+	seg := q.segments[len(q.segments)-1]
+	if _, err = q.writer.Write(buf); err != nil {
+		// drop whatever part of the record made it to disk so the segment stays readable
+		_ = q.writer.Truncate(seg.size)
+		q.budget.release(int64(len(buf)))
+		return errors.Annotatef(err, "unable to write spill segment")
+	}
+	seg.size += int64(len(buf))
+	seg.records++
+	q.bytes += int64(len(buf))
+	q.depth++
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// openWriter makes sure the writer points at a segment with room for size more bytes
+func (q *spillQueue) openWriter(size int64) error {
+	if len(q.segments) > 0 {
+		last := q.segments[len(q.segments)-1]
+		if last.size == 0 || last.size+size <= q.segmentSize {
+			if q.writer != nil {
+				return nil
+			}
+			f, err := os.OpenFile(spillSegmentPath(q.dir, last.id), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+			if err != nil {
+				return errors.Annotatef(err, "unable to open spill segment")
+			}
+			q.writer = f
+			return nil
+		}
+	}
+	q.closeWriter()
+	id := q.nextID
+	f, err := os.OpenFile(spillSegmentPath(q.dir, id), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errors.Annotatef(err, "unable to create spill segment")
+	}
+	q.writer = f
+	q.nextID++
+	q.segments = append(q.segments, &spillSegment{id: id})
+	return nil
+}
+
+func (q *spillQueue) closeWriter() {
+	if q.writer != nil {
+		_ = q.writer.Close()
+		q.writer = nil
+	}
+}
+
+func (q *spillQueue) closeReader() {
+	if q.reader != nil {
+		_ = q.reader.Close()
+		q.reader = nil
+		q.readBuf = nil
+	}
+}
+
+// Peek returns the oldest record without removing it, or nil if the queue is empty
+func (q *spillQueue) Peek() (*spillRecord, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return nil, errSpillClosed
+		}
+		if q.pending != nil {
+			return q.pending, nil
+		}
+		if len(q.segments) == 0 {
+			return nil, nil
+		}
+		head := q.segments[0]
+		if q.readPos >= head.size {
+			if len(q.segments) == 1 {
+				return nil, nil
+			}
+			if err := q.removeHead(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if q.reader == nil {
+			f, err := os.Open(spillSegmentPath(q.dir, head.id))
+			if err != nil {
+				return nil, errors.Annotatef(err, "unable to open spill segment")
+			}
+			if _, err = f.Seek(q.readPos, io.SeekStart); err != nil {
+				_ = f.Close()
+				return nil, errors.Annotatef(err, "unable to seek spill segment")
+			}
+			q.reader = f
+			q.readBuf = bufio.NewReader(f)
+		}
+		var payload []byte
+		n, err := readSpillRecord(q.readBuf, head.size-q.readPos, &payload)
+		if err != nil {
+			// where the next record starts can't be trusted after a bad one, so give up on the rest of the segment
+			q.dropHead()
+			return nil, errors.Annotatef(err, "dropped the rest of unreadable spill segment %d", head.id)
+		}
+		rec, err := decodeSpillRecord(payload)
+		if err != nil {
+			// the record can never be sent so skip past it
+			q.advance(n)
+			return nil, errors.Annotatef(err, "unable to decode spill record")
+		}
+		q.pending, q.pendingSize = rec, n
+		return rec, nil
+	}
+}
+
+// Remove discards the record returned by the last Peek
+func (q *spillQueue) Remove() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending != nil {
+		q.advance(q.pendingSize)
+		q.pending = nil
+	}
+}
+
+func (q *spillQueue) advance(n int64) {
+	q.readPos += n
+	q.bytes -= n
+	q.budget.release(n)
+	q.depth--
+	q.segments[0].records--
+}
+
+// dropHead skips everything not read yet in the head segment
+func (q *spillQueue) dropHead() {
+	q.closeReader()
+	head := q.segments[0]
+	rest := head.size - q.readPos
+	q.readPos = head.size
+	q.bytes -= rest
+	q.budget.release(rest)
+	q.depth -= head.records
+	head.records = 0
+}
+
+func (q *spillQueue) removeHead() error {
+	q.closeReader()
+	if err := os.Remove(spillSegmentPath(q.dir, q.segments[0].id)); err != nil {
+		return errors.Annotatef(err, "unable to remove spill segment")
+	}
+	q.segments = q.segments[1:]
+	q.readPos = 0
+	return nil
+}
+
+// Depth is the number of records waiting to be read
+func (q *spillQueue) Depth() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+// Bytes is the disk space used by records waiting to be read
+func (q *spillQueue) Bytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// Close saves the read position so unread records are picked up when the queue is opened again
+func (q *spillQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.closeReader()
+	q.closeWriter()
+	id := q.nextID
+	if len(q.segments) > 0 {
+		id = q.segments[0].id
+	}
+	cursor := []byte(fmt.Sprintf("%d %d\n", id, q.readPos))
+	tmp := filepath.Join(q.dir, spillCursorFile+".tmp")
+	if err := ioutil.WriteFile(tmp, cursor, 0o600); err != nil {
+		return errors.Annotatef(err, "unable to write spill cursor")
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, spillCursorFile))
+}
@@ -0,0 +1,329 @@
+package dpbuffered
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spillDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	return dir
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spillSegmentSuffix))
+	require.NoError(t, err)
+	return files
+}
+
+func TestSpillRecordRoundTrip(t *testing.T) {
+	now := time.Unix(1000, 5).UTC()
+	meta := map[interface{}]interface{}{sfxclient.TokenHeaderName: "tok"}
+	points := []*datapoint.Datapoint{
+		datapoint.NewWithMeta("a", map[string]string{"host": "x"}, meta, datapoint.NewIntValue(3), datapoint.Counter, now),
+		datapoint.New("b", nil, datapoint.NewFloatValue(2), datapoint.Gauge, now),
+		datapoint.New("c", nil, datapoint.NewStringValue("s"), datapoint.Gauge, now),
+		datapoint.New("d", nil, nil, datapoint.Gauge, now),
+	}
+	events := []*event.Event{
+		event.NewWithProperties("e", event.USERDEFINED, map[string]string{"k": "v"}, map[string]interface{}{"i": int64(1), "f": 1.5, "s": "x"}, now),
+	}
+	events[0].Meta = meta
+	name := "span"
+	spans := []*trace.Span{{TraceID: "1", ID: "2", Name: &name, Meta: meta}}
+
+	decode := func(rec *spillRecord) *spillRecord {
+		b, err := json.Marshal(rec)
+		require.NoError(t, err)
+		out, err := decodeSpillRecord(b)
+		require.NoError(t, err)
+		return out
+	}
+
+	dps := decode(newDatapointRecord(points)).datapoints()
+	require.Len(t, dps, 4)
+	assert.Equal(t, points[0].String(), dps[0].String())
+	assert.Equal(t, "tok", dps[0].Meta[sfxclient.TokenHeaderName])
+	assert.Equal(t, datapoint.NewFloatValue(2), dps[1].Value)
+	assert.Equal(t, datapoint.NewStringValue("s"), dps[2].Value)
+	assert.Nil(t, dps[3].Value)
+	// every item in a batch shares the token of the first one
+	assert.Equal(t, "tok", dps[3].Meta[sfxclient.TokenHeaderName])
+	assert.Empty(t, decode(newDatapointRecord(points[1:])).datapoints()[0].Meta)
+
+	evs := decode(newEventRecord(events)).events()
+	require.Len(t, evs, 1)
+	assert.Equal(t, events[0].Properties, evs[0].Properties)
+	assert.Equal(t, events[0].Dimensions, evs[0].Dimensions)
+	assert.Equal(t, "tok", evs[0].Meta[sfxclient.TokenHeaderName])
+
+	sps := decode(newSpanRecord(spans)).spans()
+	require.Len(t, sps, 1)
+	assert.Equal(t, "span", *sps[0].Name)
+	assert.Equal(t, "tok", sps[0].Meta[sfxclient.TokenHeaderName])
+
+	assert.Empty(t, newDatapointRecord(nil).Token)
+	assert.Empty(t, newEventRecord(nil).Token)
+	assert.Empty(t, newSpanRecord(nil).Token)
+
+	_, err := decodeSpillRecord([]byte("{"))
+	assert.Error(t, err)
+}
+
+func TestSpillQueue(t *testing.T) {
+	dir := spillDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	q, err := newSpillQueue(dir, &spillBudget{max: 1 << 20}, 200)
+	require.NoError(t, err)
+
+	rec, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, q.Push(newSpanRecord([]*trace.Span{{TraceID: "t", ID: string(rune('a' + i))}})))
+	}
+	assert.Equal(t, int64(5), q.Depth())
+	assert.True(t, q.Bytes() > 0)
+	assert.True(t, len(segmentFiles(t, dir)) > 1, "small segments should rotate")
+
+	// peeking again returns the same record until it is removed
+	rec, err = q.Peek()
+	require.NoError(t, err)
+	again, err := q.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, rec, again)
+	assert.Equal(t, "a", rec.Spans[0].ID)
+	q.Remove()
+	q.Remove()
+	assert.Equal(t, int64(4), q.Depth())
+
+	rec, err = q.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "b", rec.Spans[0].ID)
+	require.NoError(t, q.Close())
+	assert.NoError(t, q.Close())
+	assert.Equal(t, errSpillClosed, q.Push(newSpanRecord(nil)))
+	_, err = q.Peek()
+	assert.Equal(t, errSpillClosed, err)
+
+	// unread records survive a restart
+	q, err = newSpillQueue(dir, &spillBudget{max: 1 << 20}, 200)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), q.Depth())
+	var ids []string
+	for {
+		rec, err = q.Peek()
+		require.NoError(t, err)
+		if rec == nil {
+			break
+		}
+		ids = append(ids, rec.Spans[0].ID)
+		q.Remove()
+	}
+	assert.Equal(t, []string{"b", "c", "d", "e"}, ids)
+	assert.Equal(t, int64(0), q.Depth())
+	assert.Equal(t, int64(0), q.Bytes())
+	assert.Len(t, segmentFiles(t, dir), 1)
+
+	// new segments keep counting up after everything was read
+	require.NoError(t, q.Close())
+	q, err = newSpillQueue(dir, &spillBudget{max: 1 << 20}, 200)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), q.Depth())
+	require.NoError(t, q.Push(newSpanRecord([]*trace.Span{{TraceID: "t", ID: "f"}})))
+	require.NoError(t, q.Close())
+	q, err = newSpillQueue(dir, &spillBudget{max: 1 << 20}, 200)
+	require.NoError(t, err)
+	rec, err = q.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "f", rec.Spans[0].ID)
+	assert.NoError(t, q.Close())
+}
+
+func TestSpillQueueLimits(t *testing.T) {
+	dir := spillDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	q, err := newSpillQueue(dir, &spillBudget{max: 100}, 1000)
+	require.NoError(t, err)
+	require.NoError(t, q.Push(newSpanRecord(nil)))
+	assert.Equal(t, errSpillFull, q.Push(newSpanRecord([]*trace.Span{{TraceID: "a very long trace id that will not fit", ID: "x"}})))
+	assert.Equal(t, int64(1), q.Depth())
+	require.NoError(t, q.Close())
+
+	_, err = newSpillQueue(filepath.Join(segmentFiles(t, dir)[0], "sub"), &spillBudget{max: 100}, 1000)
+	assert.Error(t, err)
+
+	// queues sharing a budget count each other's bytes, including what was already on disk
+	budget := &spillBudget{max: 80}
+	q, err = newSpillQueue(dir, budget, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, q.Bytes(), budget.used)
+	other, err := newSpillQueue(filepath.Join(dir, "other"), budget, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, errSpillFull, other.Push(newSpanRecord([]*trace.Span{{TraceID: "a long trace id", ID: "0123456789"}})))
+	_, err = q.Peek()
+	require.NoError(t, err)
+	q.Remove()
+	assert.Equal(t, int64(0), budget.used)
+	assert.NoError(t, other.Push(newSpanRecord([]*trace.Span{{TraceID: "a long trace id", ID: "0123456789"}})))
+	require.NoError(t, q.Close())
+	require.NoError(t, other.Close())
+}
+
+func TestSpillQueueRecovery(t *testing.T) {
+	dir := spillDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	q, err := newSpillQueue(dir, &spillBudget{max: 1 << 20}, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, q.Push(newSpanRecord([]*trace.Span{{ID: "a"}})))
+	require.NoError(t, q.Push(newSpanRecord([]*trace.Span{{ID: "b"}})))
+	size := q.Bytes()
+	// simulate a crash: no cursor is written and the last record is half on disk
+	seg := segmentFiles(t, dir)[0]
+	require.NoError(t, os.Truncate(seg, size-3))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "x"+spillSegmentSuffix), []byte("x"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, spillCursorFile), []byte("garbage"), 0644))
+
+	q, err = newSpillQueue(dir, &spillBudget{max: 1 << 20}, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), q.Depth())
+	rec, err := q.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "a", rec.Spans[0].ID)
+	q.Remove()
+	rec, err = q.Peek()
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+	require.NoError(t, q.Close())
+
+	// segments before the cursor were already read and a cursor past the end reads nothing
+	require.NoError(t, ioutil.WriteFile(spillSegmentPath(dir, 7), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, spillCursorFile), []byte("7 1000\n"), 0644))
+	q, err = newSpillQueue(dir, &spillBudget{max: 1 << 20}, 1<<20)
+	require.NoError(t, err)
+	_, err = os.Stat(spillSegmentPath(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(0), q.Bytes())
+	require.NoError(t, q.Push(newSpanRecord([]*trace.Span{{ID: "c"}})))
+	rec, err = q.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "c", rec.Spans[0].ID)
+	require.NoError(t, q.Close())
+}
+
+func TestSpillQueueBadRecords(t *testing.T) {
+	dir := spillDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	q, err := newSpillQueue(dir, &spillBudget{max: 1 << 20}, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, q.Push(newSpanRecord(nil)))
+	require.NoError(t, q.Close())
+
+	// replace the payload with valid checksummed bytes that are not a record
+	seg := segmentFiles(t, dir)[0]
+	payload := []byte("[1]")
+	buf := make([]byte, spillHeaderSize, spillHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	buf = append(buf, payload...)
+	require.NoError(t, ioutil.WriteFile(seg, buf, 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, spillCursorFile)))
+
+	q, err = newSpillQueue(dir, &spillBudget{max: 1 << 20}, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), q.Depth())
+	_, err = q.Peek()
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), q.Depth())
+	rec, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+
+	// a missing segment file can not be read
+	require.NoError(t, q.Push(newSpanRecord(nil)))
+	q.closeReader()
+	require.NoError(t, os.Remove(seg))
+	_, err = q.Peek()
+	assert.Error(t, err)
+	require.NoError(t, q.Close())
+}
+
+func TestSpillQueueCorruptSegment(t *testing.T) {
+	dir := spillDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	budget := &spillBudget{max: 1 << 20}
+	q, err := newSpillQueue(dir, budget, 1<<20)
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, q.Push(newSpanRecord([]*trace.Span{{ID: id}})))
+	}
+	rec, err := q.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "a", rec.Spans[0].ID)
+	q.Remove()
+
+	// flip the last byte of b's payload so its checksum no longer matches, reopening the segment to see it
+	q.closeReader()
+	seg := segmentFiles(t, dir)[0]
+	b, err := ioutil.ReadFile(seg)
+	require.NoError(t, err)
+	next := q.readPos + spillHeaderSize + int64(binary.BigEndian.Uint32(b[q.readPos:]))
+	b[next-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(seg, b, 0600))
+
+	// the rest of the segment is dropped instead of failing on the same record forever
+	_, err = q.Peek()
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), q.Depth())
+	assert.Equal(t, int64(0), q.Bytes())
+	assert.Equal(t, int64(0), budget.used)
+	rec, err = q.Peek()
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+
+	require.NoError(t, q.Push(newSpanRecord([]*trace.Span{{ID: "d"}})))
+	assert.Equal(t, int64(1), q.Depth())
+	rec, err = q.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "d", rec.Spans[0].ID)
+	require.NoError(t, q.Close())
+}
+
+func TestReadSpillRecordLength(t *testing.T) {
+	// a length past the end of the segment is corrupt and must not be allocated
+	header := make([]byte, spillHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], 0xffffffff)
+	_, err := readSpillRecord(bytes.NewReader(header), spillHeaderSize+10, nil)
+	assert.Equal(t, errSpillCorrupt, err)
+
+	binary.BigEndian.PutUint32(header[0:4], 2)
+	_, err = readSpillRecord(bytes.NewReader(append(header, 1, 2)), spillHeaderSize+1, nil)
+	assert.Equal(t, errSpillCorrupt, err)
+}
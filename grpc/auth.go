@@ -5,6 +5,7 @@ import (
 
 	"github.com/signalfx/golib/v3/sfxclient"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 )
 
 // SignalFxTokenAuth is a credentials.PerRPCCredentials object that sets an auth token on each gRPC request
@@ -28,3 +29,16 @@ func (a *SignalFxTokenAuth) GetRequestMetadata(ctx context.Context, uri ...strin
 func (a *SignalFxTokenAuth) RequireTransportSecurity() bool {
 	return !a.DisableTransportSecurity
 }
+
+// TokenFromIncomingContext returns the auth token SignalFxTokenAuth set on the gRPC request of ctx, or "" if it has
+// none.  This is the server side of SignalFxTokenAuth.
+func TokenFromIncomingContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if tokens := md.Get(sfxclient.TokenHeaderName); len(tokens) > 0 {
+		return tokens[0]
+	}
+	return ""
+}
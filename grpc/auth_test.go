@@ -6,6 +6,7 @@ import (
 
 	"github.com/signalfx/golib/v3/sfxclient"
 	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc/metadata"
 )
 
 func TestGRPCAuth(t *testing.T) {
@@ -25,3 +26,14 @@ func TestGRPCAuth(t *testing.T) {
 		So(a.RequireTransportSecurity(), ShouldBeFalse)
 	})
 }
+
+func TestTokenFromIncomingContext(t *testing.T) {
+	Convey("the token should be read from incoming metadata", t, func() {
+		a := &SignalFxTokenAuth{Token: "test"}
+		md, err := a.GetRequestMetadata(context.Background())
+		So(err, ShouldBeNil)
+		So(TokenFromIncomingContext(metadata.NewIncomingContext(context.Background(), metadata.New(md))), ShouldEqual, "test")
+		So(TokenFromIncomingContext(metadata.NewIncomingContext(context.Background(), metadata.MD{})), ShouldEqual, "")
+		So(TokenFromIncomingContext(context.Background()), ShouldEqual, "")
+	})
+}
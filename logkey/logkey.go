@@ -59,4 +59,8 @@ var (
 	ListenFrom = log.Key("listen_from")
 	// WavefrontLine is a direct line received from wavefront protocol
 	WavefrontLine = log.Key("wavefront_line")
+	// StatsdLine is a direct line received from statsd protocol
+	StatsdLine = log.Key("statsd_line")
+	// InfluxLine is a direct line received from influx line protocol
+	InfluxLine = log.Key("influx_line")
 )
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	goerrors "errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/signalfx/golib/v3/errors"
+	"github.com/signalfx/golib/v3/log"
+)
+
+// BackoffError is implemented by errors that mean data was refused because something is overloaded or a client is
+// sending too much, rather than because the data is invalid.  Clients should resend the data after RetryAfter.
+type BackoffError interface {
+	error
+	StatusCode() int
+	RetryAfter() time.Duration
+}
+
+// RetryAfterSeconds is the value of a Retry-After header for d, rounded up to a whole second
+func RetryAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(math.Max(d.Seconds(), 1))), 10)
+}
+
+// MultiErr is like the golib errors.MultiErr, but keeps its errors visible to AsBackoffError
+type MultiErr struct {
+	Errs []error
+}
+
+func (e *MultiErr) Error() string {
+	r := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		r = append(r, err.Error())
+	}
+	return strings.Join(r, " | ")
+}
+
+// NewMultiErr returns nil if errs has no errors, the error itself if it has one, and a MultiErr of them otherwise
+func NewMultiErr(errs []error) error {
+	retErrs := make([]error, 0, len(errs))
+	for _, err := range errs {
+		if err != nil {
+			retErrs = append(retErrs, err)
+		}
+	}
+	if len(retErrs) == 0 {
+		return nil
+	}
+	if len(retErrs) == 1 {
+		return retErrs[0]
+	}
+	return &MultiErr{Errs: retErrs}
+}
+
+// AsBackoffError finds the first BackoffError in err, looking through wrapped errors, golib annotations and the
+// errors of a MultiErr
+func AsBackoffError(err error) (BackoffError, bool) {
+	for ; err != nil; err = errors.Next(err) {
+		if multi, ok := err.(*MultiErr); ok {
+			for _, e := range multi.Errs {
+				if backoff, ok := AsBackoffError(e); ok {
+					return backoff, true
+				}
+			}
+			return nil, false
+		}
+		var backoff BackoffError
+		if goerrors.As(err, &backoff) {
+			return backoff, true
+		}
+	}
+	return nil, false
+}
+
+// WriteBackoff responds with the status code and Retry-After header of a BackoffError found in err and returns true,
+// or does nothing and returns false if there is none
+func WriteBackoff(rw http.ResponseWriter, err error, logger log.Logger) bool {
+	backoff, ok := AsBackoffError(err)
+	if !ok {
+		return false
+	}
+	rw.Header().Set("Retry-After", RetryAfterSeconds(backoff.RetryAfter()))
+	rw.WriteHeader(backoff.StatusCode())
+	_, err = rw.Write([]byte(backoff.Error()))
+	log.IfErr(logger, err)
+	return true
+}
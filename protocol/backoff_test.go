@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	goliberrors "github.com/signalfx/golib/v3/errors"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type backoffErr time.Duration
+
+func (b backoffErr) Error() string {
+	return "slow down"
+}
+
+func (b backoffErr) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+func (b backoffErr) RetryAfter() time.Duration {
+	return time.Duration(b)
+}
+
+func TestWriteBackoff(t *testing.T) {
+	rw := httptest.NewRecorder()
+	assert.False(t, WriteBackoff(rw, errors.New("nope"), log.Discard))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = httptest.NewRecorder()
+	assert.True(t, WriteBackoff(rw, backoffErr(time.Millisecond*1500), log.Discard))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("Retry-After"))
+	assert.Equal(t, "slow down", rw.Body.String())
+
+	assert.Equal(t, "1", RetryAfterSeconds(0))
+
+	rw = httptest.NewRecorder()
+	assert.True(t, WriteBackoff(rw, NewMultiErr([]error{errors.New("nope"), fmt.Errorf("sink: %w", backoffErr(time.Second))}), log.Discard))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func TestAsBackoffError(t *testing.T) {
+	backoff, ok := AsBackoffError(goliberrors.Annotate(backoffErr(time.Second), "annotated"))
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, backoff.RetryAfter())
+
+	_, ok = AsBackoffError(NewMultiErr([]error{errors.New("a"), errors.New("b")}))
+	assert.False(t, ok)
+	_, ok = AsBackoffError(nil)
+	assert.False(t, ok)
+}
+
+func TestNewMultiErr(t *testing.T) {
+	assert.Nil(t, NewMultiErr([]error{nil, nil}))
+	single := errors.New("a")
+	assert.Equal(t, single, NewMultiErr([]error{nil, single}))
+	assert.Equal(t, "a | b", NewMultiErr([]error{single, errors.New("b")}).Error())
+}
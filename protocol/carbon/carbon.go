@@ -25,17 +25,54 @@ func NativeCarbonLine(dp *datapoint.Datapoint) (string, bool) {
 	return "", false
 }
 
+// parseTags splits a graphite 1.1 tagged metric such as "path;tag1=v1;tag2=v2" into its path and tags
+func parseTags(metric string) (string, map[string]string, error) {
+	parts := strings.Split(metric, ";")
+	if len(parts) == 1 {
+		return metric, nil, nil
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, tag := range parts[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return "", nil, errors.Errorf("invalid carbon tag '%s' in metric %s", tag, metric)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return parts[0], tags, nil
+}
+
+// mergeTags adds tags to the dimensions the deconstructor found, which win on conflicts since they come
+// from explicit configuration
+func mergeTags(dimensions map[string]string, tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return dimensions
+	}
+	if dimensions == nil {
+		dimensions = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		if _, exists := dimensions[k]; !exists {
+			dimensions[k] = v
+		}
+	}
+	return dimensions
+}
+
 // NewCarbonDatapoint creates a new datapoint from a line in carbon and injects into the datapoint
-// metadata about the original line.
+// metadata about the original line.  Graphite tags on the metric path become dimensions.
 func NewCarbonDatapoint(line string, metricDeconstructor metricdeconstructor.MetricDeconstructor) (*datapoint.Datapoint, error) {
 	parts := strings.SplitN(line, " ", 3)
 	meta := map[interface{}]interface{}{
 		carbonNative: line,
 	}
 	if len(parts) != 3 {
-		return nil, errors.Errorf("Note: Gateway does not support pickle format: invalid carbon input line: %s", line)
+		return nil, errors.Errorf("invalid carbon input line: %s", line)
+	}
+	originalMetricName, tags, err := parseTags(parts[0])
+	if err != nil {
+		return nil, err
 	}
-	originalMetricName := parts[0]
 	metricName, mtype, dimensions, err := metricDeconstructor.Parse(originalMetricName)
 
 	if err == metricdeconstructor.ErrSkipMetric {
@@ -44,6 +81,7 @@ func NewCarbonDatapoint(line string, metricDeconstructor metricdeconstructor.Met
 	if err != nil {
 		return nil, err
 	}
+	dimensions = mergeTags(dimensions, tags)
 
 	metricTime, err := strconv.ParseFloat(parts[2], 64)
 	if err != nil {
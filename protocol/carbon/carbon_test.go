@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/ingest-protocols/dp/dpdimsort"
 	"github.com/signalfx/ingest-protocols/protocol/carbon/metricdeconstructor"
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +18,12 @@ func (parser *errorDeconstructor) Parse(originalMetric string) (string, datapoin
 	return "", datapoint.Gauge, nil, errors.New("error parsing")
 }
 
+type staticDimsDeconstructor struct{}
+
+func (parser *staticDimsDeconstructor) Parse(originalMetric string) (string, datapoint.MetricType, map[string]string, error) {
+	return originalMetric, datapoint.Gauge, map[string]string{"env": "configured"}, nil
+}
+
 var carbonTestCases = []struct {
 	in            string
 	deconstructor metricdeconstructor.MetricDeconstructor
@@ -23,6 +31,7 @@ var carbonTestCases = []struct {
 	val           datapoint.Value
 	metricType    datapoint.MetricType
 	timestamp     int64
+	dims          map[string]string
 	shouldErr     bool
 }{
 	{
@@ -49,6 +58,37 @@ var carbonTestCases = []struct {
 		val:       datapoint.NewFloatValue(3.3),
 		timestamp: 1519398226544000000,
 	},
+	{
+		in:        "hello;env=prod;dc=a=b 3 3",
+		name:      "hello",
+		val:       datapoint.NewIntValue(3),
+		timestamp: 3000000000,
+		dims:      map[string]string{"env": "prod", "dc": "a=b"},
+	},
+	{
+		in:            "hello;env=prod 3 3",
+		deconstructor: &staticDimsDeconstructor{},
+		name:          "hello",
+		val:           datapoint.NewIntValue(3),
+		timestamp:     3000000000,
+		dims:          map[string]string{"env": "configured"},
+	},
+	{
+		in:            "hello;host=a 3 3",
+		deconstructor: &metricdeconstructor.NilDeconstructor{},
+	},
+	{
+		in:        "hello;env 3 3",
+		shouldErr: true,
+	},
+	{
+		in:        "hello;=prod 3 3",
+		shouldErr: true,
+	},
+	{
+		in:        "hello;env= 3 3",
+		shouldErr: true,
+	},
 	{
 		in:        "INVALIDLINE",
 		shouldErr: true,
@@ -82,7 +122,13 @@ func TestNewCarbonDatapointTable(t *testing.T) {
 				assert.Equal(t, nil, err, fmt.Sprintf("input: '%s' unexpectedly raised the error %v", tt.in, err))
 			}
 		}
+		if err == nil && s == nil {
+			continue
+		}
 		if err == nil {
+			if tt.dims != nil {
+				assert.Equal(t, tt.dims, s.Dimensions, fmt.Sprintf("unexpected dimensions with input %s", tt.in))
+			}
 			assert.Equal(t, tt.name, s.Metric, fmt.Sprintf("expected metric name '%s' and got '%s' with input %s", tt.name, s.Metric, tt.in))
 			assert.Equal(t, tt.val, s.Value, fmt.Sprintf("expected value %v and got %v with input %s", tt.val, s.Value, tt.in))
 			assert.Equal(t, tt.metricType, s.MetricType, fmt.Sprintf("expected metric type %v and got %v with input %s", tt.metricType, s.MetricType, tt.in))
@@ -100,3 +146,16 @@ func TestConvertDatapointToCarbonLine(t *testing.T) {
 	carbonDp, _ := NativeCarbonLine(dp)
 	assert.Equal(t, "hello 3.3 3", carbonDp, "Should get the carbon line back")
 }
+
+func TestMergeTags(t *testing.T) {
+	assert.Nil(t, mergeTags(nil, nil))
+	assert.Equal(t, map[string]string{"a": "b"}, mergeTags(nil, map[string]string{"a": "b"}))
+}
+
+func TestDatapointToGraphite(t *testing.T) {
+	dp := datapoint.New("cpu.idle", map[string]string{"host": "a b", "dc;x": "east", "empty": "", "a=b": "c;d=e"}, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())
+	f := &Forwarder{taggedOutput: true}
+	assert.Equal(t, "cpu.idle;a_b=c_d=e;dc_x=east;host=a_b", f.datapointToGraphite(dp))
+	f = &Forwarder{dimensionComparor: dpdimsort.NewOrdering([]string{"host"})}
+	assert.Equal(t, "a b.cpu.idle", f.datapointToGraphite(datapoint.New("cpu.idle", map[string]string{"host": "a b"}, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())))
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +23,7 @@ import (
 type Forwarder struct {
 	filtering.FilteredForwarder
 	dimensionComparor dpdimsort.Ordering
+	taggedOutput      bool
 	connectionAddress string
 	connectionTimeout time.Duration
 
@@ -38,6 +40,7 @@ type ForwarderConfig struct {
 	DimensionOrder         []string
 	IdleConnectionPoolSize *int64
 	Timer                  timekeeper.TimeKeeper
+	TaggedOutput           *bool
 }
 
 var defaultForwarderConfig = &ForwarderConfig{
@@ -46,6 +49,7 @@ var defaultForwarderConfig = &ForwarderConfig{
 	Port:                   pointer.Uint16(2003),
 	IdleConnectionPoolSize: pointer.Int64(5),
 	Timer:                  &timekeeper.RealTime{},
+	TaggedOutput:           pointer.Bool(false),
 }
 
 // NewForwarder creates a new unbuffered forwarder for sending points to carbon
@@ -62,6 +66,7 @@ func NewForwarder(host string, passedConf *ForwarderConfig) (*Forwarder, error)
 	}
 	ret := &Forwarder{
 		dimensionComparor: dpdimsort.NewOrdering(conf.DimensionOrder),
+		taggedOutput:      *conf.TaggedOutput,
 		connectionTimeout: *conf.Timeout,
 		connectionAddress: connectionAddress,
 		tk:                conf.Timer,
@@ -101,7 +106,36 @@ func (f *Forwarder) Datapoints() []*datapoint.Datapoint {
 	return append(f.DebugDatapoints(), f.DefaultDatapoints()...)
 }
 
+var (
+	graphiteTagKeyReplacer   = strings.NewReplacer(";", "_", " ", "_", "=", "_", "!", "_", "^", "_")
+	graphiteTagValueReplacer = strings.NewReplacer(";", "_", " ", "_")
+)
+
+// datapointToTaggedGraphite emits the graphite 1.1 tagged form of a datapoint with tags sorted by name,
+// which is how graphite itself canonicalizes them
+func datapointToTaggedGraphite(dp *datapoint.Datapoint) string {
+	keys := make([]string, 0, len(dp.Dimensions))
+	for k, v := range dp.Dimensions {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(dp.Metric)
+	for _, k := range keys {
+		sb.WriteByte(';')
+		sb.WriteString(graphiteTagKeyReplacer.Replace(k))
+		sb.WriteByte('=')
+		sb.WriteString(graphiteTagValueReplacer.Replace(dp.Dimensions[k]))
+	}
+	return sb.String()
+}
+
 func (f *Forwarder) datapointToGraphite(dp *datapoint.Datapoint) string {
+	if f.taggedOutput {
+		return datapointToTaggedGraphite(dp)
+	}
 	dims := dp.Dimensions
 	sortedDims := f.dimensionComparor.Sort(dims)
 	ret := make([]string, 0, len(sortedDims)+1)
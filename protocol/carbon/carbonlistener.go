@@ -2,6 +2,7 @@ package carbon
 
 import (
 	"bufio"
+	"encoding/binary"
 	"io"
 	"net"
 	"strings"
@@ -35,6 +36,7 @@ type Listener struct {
 	serverAcceptDeadline time.Duration
 	connectionTimeout    time.Duration
 	listenfunc           func()
+	handleConn           func(ctx context.Context, conn carbonListenConn) error
 	logger               log.Logger
 	stats                listenerStats
 	wg                   sync.WaitGroup
@@ -51,6 +53,7 @@ type listenerStats struct {
 	invalidDatapoints   int64
 	totalConnections    int64
 	activeConnections   int64
+	invalidPickleFrames int64
 }
 
 // DebugDatapoints returns datapoints that are used for debugging the listener
@@ -61,6 +64,7 @@ func (listener *Listener) DebugDatapoints() []*datapoint.Datapoint {
 		sfxclient.Gauge("active_connections", nil, atomic.LoadInt64(&listener.stats.activeConnections)),
 		sfxclient.Cumulative("idle_timeouts", nil, atomic.LoadInt64(&listener.stats.idleTimeouts)),
 		sfxclient.Cumulative("retry_listen_errors", nil, atomic.LoadInt64(&listener.stats.retriedListenErrors)),
+		sfxclient.Cumulative("invalid_pickle_frames", nil, atomic.LoadInt64(&listener.stats.invalidPickleFrames)),
 	}
 }
 
@@ -174,6 +178,78 @@ func (listener *Listener) handleTCPConnection(ctx context.Context, conn carbonLi
 	}
 }
 
+// handlePickleConnection reads the 4 byte big endian length prefixed pickle messages carbon-relay sends
+// on its pickle port
+func (listener *Listener) handlePickleConnection(ctx context.Context, conn carbonListenConn) error {
+	connLogger := log.NewContext(listener.logger).With(logkey.RemoteAddr, conn.RemoteAddr())
+	defer func() {
+		log.IfErr(connLogger, conn.Close())
+	}()
+	reader := bufio.NewReader(conn)
+	atomic.AddInt64(&listener.stats.totalConnections, 1)
+	atomic.AddInt64(&listener.stats.activeConnections, 1)
+	defer atomic.AddInt64(&listener.stats.activeConnections, -1)
+	var header [4]byte
+	for {
+		log.IfErr(connLogger, conn.SetDeadline(time.Now().Add(listener.connectionTimeout)))
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err == io.EOF {
+				atomic.AddInt64(&listener.stats.totalEOFCloses, 1)
+				return nil
+			}
+			return listener.pickleReadErr(connLogger, err)
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxPickleFrameSize {
+			atomic.AddInt64(&listener.stats.invalidPickleFrames, 1)
+			err := errors.Errorf("pickle frame of %d bytes is larger than the %d byte limit", size, maxPickleFrameSize)
+			connLogger.Log(log.Err, err, "Closing carbon pickle connection")
+			return err
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return listener.pickleReadErr(connLogger, err)
+		}
+		lines, invalid, err := decodePickleFrame(payload)
+		if err != nil {
+			atomic.AddInt64(&listener.stats.invalidPickleFrames, 1)
+			connLogger.Log(log.Err, err, "Received data on a carbon pickle port, but it doesn't look like pickled carbon data")
+			continue
+		}
+		atomic.AddInt64(&listener.stats.invalidDatapoints, invalid)
+		dps := make([]*datapoint.Datapoint, 0, len(lines))
+		for _, line := range lines {
+			var dp *datapoint.Datapoint
+			dp, err = NewCarbonDatapoint(line, listener.metricDeconstructor)
+			if err != nil {
+				atomic.AddInt64(&listener.stats.invalidDatapoints, 1)
+				connLogger.Log(logkey.CarbonLine, line, log.Err, err, "Received a pickled carbon metric that could not be parsed")
+				continue
+			}
+			if dp == nil {
+				atomic.AddInt64(&listener.stats.skippedDatapoints, 1)
+				continue
+			}
+			dps = append(dps, dp)
+		}
+		if len(dps) > 0 {
+			log.IfErr(connLogger, listener.sink.AddDatapoints(ctx, dps))
+			atomic.AddInt64(&listener.stats.totalDatapoints, int64(len(dps)))
+		}
+	}
+}
+
+func (listener *Listener) pickleReadErr(connLogger log.Logger, err error) error {
+	if err == io.ErrUnexpectedEOF {
+		atomic.AddInt64(&listener.stats.invalidPickleFrames, 1)
+		connLogger.Log(log.Err, err, "Carbon pickle connection closed in the middle of a frame")
+		return nil
+	}
+	atomic.AddInt64(&listener.stats.idleTimeouts, 1)
+	connLogger.Log(log.Err, err, "Listening for carbon pickle data returned an error (Note: We timeout idle connections)")
+	return err
+}
+
 func (listener *Listener) startListeningUDP() {
 	defer listener.wg.Done()
 	defer listener.logger.Log("Stop listening carbon UDP")
@@ -219,7 +295,7 @@ func (listener *Listener) startListeningTCP() {
 			return
 		}
 		go func() {
-			log.IfErr(listener.logger, listener.handleTCPConnection(context.Background(), conn))
+			log.IfErr(listener.logger, listener.handleConn(context.Background(), conn))
 		}()
 	}
 }
@@ -230,6 +306,12 @@ const (
 	UDP = "udp"
 )
 
+// Constants for the framing config: plaintext lines or carbon's length prefixed pickle messages
+const (
+	LineFraming   = "line"
+	PickleFraming = "pickle"
+)
+
 // ListenerConfig controls optional parameters for carbon listeners
 type ListenerConfig struct {
 	ServerAcceptDeadline *time.Duration
@@ -238,6 +320,7 @@ type ListenerConfig struct {
 	MetricDeconstructor  metricdeconstructor.MetricDeconstructor
 	Logger               log.Logger
 	Protocol             *string
+	Framing              *string
 }
 
 var defaultListenerConfig = &ListenerConfig{
@@ -246,6 +329,7 @@ var defaultListenerConfig = &ListenerConfig{
 	ListenAddr:           pointer.String("127.0.0.1:2003"),
 	MetricDeconstructor:  &metricdeconstructor.IdentityMetricDeconstructor{},
 	Protocol:             pointer.String(TCP),
+	Framing:              pointer.String(LineFraming),
 }
 
 // Addr returns the listening address of this carbon listener
@@ -258,6 +342,17 @@ func (listener *Listener) Addr() net.Addr {
 
 func (listener *Listener) getServer(conf *ListenerConfig) error {
 	loweredProtocol := strings.ToLower(*conf.Protocol)
+	switch strings.ToLower(*conf.Framing) {
+	case LineFraming:
+		listener.handleConn = listener.handleTCPConnection
+	case PickleFraming:
+		if loweredProtocol != TCP {
+			return fmt.Errorf("'%s' framing is only supported over '%s'", PickleFraming, TCP)
+		}
+		listener.handleConn = listener.handlePickleConnection
+	default:
+		return fmt.Errorf("specified framing '%s' not recognized. '%s' or '%s' only please", *conf.Framing, LineFraming, PickleFraming)
+	}
 	if loweredProtocol == UDP {
 		serverAddr, err := net.ResolveUDPAddr(UDP, *conf.ListenAddr)
 		if err != nil {
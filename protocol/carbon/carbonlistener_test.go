@@ -2,6 +2,8 @@ package carbon
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -451,3 +453,101 @@ func TestInvalidConnection(t *testing.T) {
 		So(listener, ShouldBeNil)
 	})
 }
+
+func pickleFrame(payload []byte) []byte {
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestCarbonListenerPickle(t *testing.T) {
+	Convey("pickle framing config is validated", t, func() {
+		_, err := NewListener(dptest.NewBasicSink(), &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:0"),
+			Framing:    pointer.String("json"),
+		})
+		So(err, ShouldNotBeNil)
+		_, err = NewListener(dptest.NewBasicSink(), &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:0"),
+			Protocol:   pointer.String(UDP),
+			Framing:    pointer.String(PickleFraming),
+		})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("A pickle listener", t, func() {
+		listenFrom := &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:0"),
+			Framing:    pointer.String(PickleFraming),
+		}
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(10)
+		listener, err := NewListener(sendTo, listenFrom)
+		So(err, ShouldBeNil)
+		send := func(data ...[]byte) {
+			s, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", nettest.TCPPort(listener)))
+			So(err, ShouldBeNil)
+			for _, d := range data {
+				_, err = s.Write(d)
+				So(err, ShouldBeNil)
+			}
+			So(s.Close(), ShouldBeNil)
+		}
+		waitFor := func(stat *int64, val int64) {
+			for atomic.LoadInt64(stat) != val {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		Convey("should decode each frame and skip bad ones", func() {
+			payload, err := hex.DecodeString(pickledMetrics["protocol 2"])
+			So(err, ShouldBeNil)
+			send(pickleFrame([]byte("cos\nsystem\n.")), pickleFrame(payload), pickleFrame([]byte("(U\x01xK\x01K\x02\x86\x86U\x01x\x85U\x03y zK\x01K\x02\x86\x86l.")))
+			dps := <-sendTo.PointsChan
+			So(len(dps), ShouldEqual, 4)
+			So(dps[0].Metric, ShouldEqual, "a.b")
+			So(dps[0].Value, ShouldResemble, datapoint.NewFloatValue(2.5))
+			So(dps[0].Timestamp, ShouldResemble, time.Unix(1500000000, 0))
+			So(dps[3].Value, ShouldResemble, datapoint.NewIntValue(1099511627776))
+			line, exists := NativeCarbonLine(dps[1])
+			So(exists, ShouldBeTrue)
+			So(line, ShouldEqual, "c.d 3 1500000000.5")
+			dps = <-sendTo.PointsChan
+			So(len(dps), ShouldEqual, 1)
+			So(dps[0].Metric, ShouldEqual, "x")
+			waitFor(&listener.stats.totalEOFCloses, 1)
+			stats := listener.Datapoints()
+			So(dptest.ExactlyOne(stats, "invalid_pickle_frames").Value.String(), ShouldEqual, "1")
+			So(dptest.ExactlyOne(stats, "invalid_datapoints").Value.String(), ShouldEqual, "2")
+		})
+		Convey("should drop connections with oversized frames", func() {
+			send([]byte{0xff, 0xff, 0xff, 0xff})
+			waitFor(&listener.stats.invalidPickleFrames, 1)
+		})
+		Convey("should count frames cut short", func() {
+			send([]byte{0, 0, 0, 10, '('})
+			waitFor(&listener.stats.invalidPickleFrames, 1)
+			send([]byte{0, 0})
+			waitFor(&listener.stats.invalidPickleFrames, 2)
+		})
+		Convey("should skip metrics the deconstructor skips", func() {
+			So(listener.Close(), ShouldBeNil)
+			listenFrom.MetricDeconstructor = &metricdeconstructor.NilDeconstructor{}
+			listener, err = NewListener(sendTo, listenFrom)
+			So(err, ShouldBeNil)
+			send(pickleFrame([]byte("(U\x01xK\x01K\x02\x86\x86l.")))
+			waitFor(&listener.stats.skippedDatapoints, 1)
+		})
+		Convey("should time out idle connections", func() {
+			So(listener.Close(), ShouldBeNil)
+			listenFrom.ConnectionTimeout = pointer.Duration(time.Millisecond)
+			listener, err = NewListener(sendTo, listenFrom)
+			So(err, ShouldBeNil)
+			s, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", nettest.TCPPort(listener)))
+			So(err, ShouldBeNil)
+			waitFor(&listener.stats.idleTimeouts, 1)
+			So(s.Close(), ShouldBeNil)
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+}
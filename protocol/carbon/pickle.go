@@ -0,0 +1,414 @@
+package carbon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/signalfx/golib/v3/errors"
+)
+
+// maxPickleFrameSize matches the limit carbon's own pickle receiver places on a single message
+const maxPickleFrameSize = 1 << 20
+
+var (
+	errPickleTruncated = errors.New("truncated pickle data")
+	errPickleStack     = errors.New("pickle stack underflow")
+	errPickleNoStop    = errors.New("pickle data has no STOP opcode")
+)
+
+// pickleList is a mutable list so that APPEND is visible through the memo
+type pickleList struct {
+	items []interface{}
+}
+
+type pickleTuple []interface{}
+
+// unpickler decodes the subset of the pickle format needed for plain data (lists, tuples, strings and
+// numbers).  Opcodes that reference globals or build objects are rejected rather than executed.
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	marks []int
+	memo  map[int]interface{}
+}
+
+func unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{data: data, memo: make(map[int]interface{})}
+	return u.run()
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, errPickleTruncated
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	idx := bytes.IndexByte(u.data[u.pos:], '\n')
+	if idx < 0 {
+		return "", errPickleTruncated
+	}
+	line := string(u.data[u.pos : u.pos+idx])
+	u.pos += idx + 1
+	return line, nil
+}
+
+func (u *unpickler) readUint(n int) (uint64, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errPickleStack
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) popN(n int) ([]interface{}, error) {
+	if n < 0 || n > len(u.stack) {
+		return nil, errPickleStack
+	}
+	items := make([]interface{}, n)
+	copy(items, u.stack[len(u.stack)-n:])
+	u.stack = u.stack[:len(u.stack)-n]
+	return items, nil
+}
+
+func (u *unpickler) popMark() ([]interface{}, error) {
+	if len(u.marks) == 0 {
+		return nil, errPickleStack
+	}
+	mark := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	return u.popN(len(u.stack) - mark)
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errPickleStack
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+func (u *unpickler) appendTo(items ...interface{}) error {
+	t, err := u.top()
+	if err != nil {
+		return err
+	}
+	l, ok := t.(*pickleList)
+	if !ok {
+		return errors.Errorf("cannot append to %T", t)
+	}
+	l.items = append(l.items, items...)
+	return nil
+}
+
+func (u *unpickler) get(idx int) error {
+	v, exists := u.memo[idx]
+	if !exists {
+		return errors.Errorf("pickle memo index %d not found", idx)
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) put(idx int) error {
+	t, err := u.top()
+	if err == nil {
+		u.memo[idx] = t
+	}
+	return err
+}
+
+func (u *unpickler) pushString(lenBytes int) error {
+	n, err := u.readUint(lenBytes)
+	if err != nil {
+		return err
+	}
+	if n > uint64(len(u.data)) {
+		return errPickleTruncated
+	}
+	b, err := u.read(int(n))
+	if err == nil {
+		u.push(string(b))
+	}
+	return err
+}
+
+func (u *unpickler) pushLong(n int) error {
+	if n > 8 {
+		return errors.Errorf("pickle long of %d bytes is too large", n)
+	}
+	v, err := u.readUint(n)
+	if err != nil {
+		return err
+	}
+	if n > 0 && n < 8 && v&(1<<(uint(n)*8-1)) != 0 {
+		v -= 1 << (uint(n) * 8)
+	}
+	u.push(int64(v))
+	return nil
+}
+
+// step runs a single opcode, returning true once STOP is reached
+// nolint: gocyclo
+func (u *unpickler) step(op byte) (bool, error) {
+	var err error
+	var n uint64
+	var line string
+	switch op {
+	case '.': // STOP
+		return true, nil
+	case 0x80: // PROTO
+		_, err = u.read(1)
+	case 0x95: // FRAME
+		_, err = u.read(8)
+	case '(': // MARK
+		u.marks = append(u.marks, len(u.stack))
+	case '0': // POP
+		_, err = u.pop()
+	case '1': // POP_MARK
+		_, err = u.popMark()
+	case '2': // DUP
+		var v interface{}
+		if v, err = u.top(); err == nil {
+			u.push(v)
+		}
+	case ')': // EMPTY_TUPLE
+		u.push(pickleTuple{})
+	case ']': // EMPTY_LIST
+		u.push(&pickleList{})
+	case 'l', 't': // LIST, TUPLE
+		var items []interface{}
+		if items, err = u.popMark(); err == nil {
+			if op == 'l' {
+				u.push(&pickleList{items: items})
+			} else {
+				u.push(pickleTuple(items))
+			}
+		}
+	case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+		var items []interface{}
+		if items, err = u.popN(int(op - 0x84)); err == nil {
+			u.push(pickleTuple(items))
+		}
+	case 'a': // APPEND
+		var v interface{}
+		if v, err = u.pop(); err == nil {
+			err = u.appendTo(v)
+		}
+	case 'e': // APPENDS
+		var items []interface{}
+		if items, err = u.popMark(); err == nil {
+			err = u.appendTo(items...)
+		}
+	case 'N': // NONE
+		u.push(nil)
+	case 0x88, 0x89: // NEWTRUE, NEWFALSE
+		u.push(op == 0x88)
+	case 'J': // BININT
+		if n, err = u.readUint(4); err == nil {
+			u.push(int64(int32(uint32(n))))
+		}
+	case 'K': // BININT1
+		if n, err = u.readUint(1); err == nil {
+			u.push(int64(n))
+		}
+	case 'M': // BININT2
+		if n, err = u.readUint(2); err == nil {
+			u.push(int64(n))
+		}
+	case 0x8a: // LONG1
+		if n, err = u.readUint(1); err == nil {
+			err = u.pushLong(int(n))
+		}
+	case 0x8b: // LONG4
+		if n, err = u.readUint(4); err == nil {
+			err = u.pushLong(int(n))
+		}
+	case 'I', 'L': // INT, LONG
+		if line, err = u.readLine(); err == nil {
+			err = u.pushTextInt(line)
+		}
+	case 'G': // BINFLOAT
+		var b []byte
+		if b, err = u.read(8); err == nil {
+			u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+		}
+	case 'F': // FLOAT
+		var f float64
+		if line, err = u.readLine(); err == nil {
+			if f, err = strconv.ParseFloat(line, 64); err == nil {
+				u.push(f)
+			}
+		}
+	case 'S': // STRING
+		if line, err = u.readLine(); err == nil {
+			if len(line) < 2 || (line[0] != '\'' && line[0] != '"') || line[len(line)-1] != line[0] {
+				return false, errors.Errorf("invalid pickle string %s", line)
+			}
+			u.push(line[1 : len(line)-1])
+		}
+	case 'V': // UNICODE
+		if line, err = u.readLine(); err == nil {
+			u.push(line)
+		}
+	case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+		err = u.pushString(1)
+	case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+		err = u.pushString(4)
+	case 0x8d, 0x8e: // BINUNICODE8, BINBYTES8
+		err = u.pushString(8)
+	case 'p', 'g': // PUT, GET
+		var idx int
+		if line, err = u.readLine(); err == nil {
+			if idx, err = strconv.Atoi(line); err == nil {
+				err = u.memoOp(op == 'p', idx)
+			}
+		}
+	case 'q', 'h': // BINPUT, BINGET
+		if n, err = u.readUint(1); err == nil {
+			err = u.memoOp(op == 'q', int(n))
+		}
+	case 'r', 'j': // LONG_BINPUT, LONG_BINGET
+		if n, err = u.readUint(4); err == nil {
+			err = u.memoOp(op == 'r', int(n))
+		}
+	case 0x94: // MEMOIZE
+		err = u.put(len(u.memo))
+	default:
+		return false, errors.Errorf("unsupported pickle opcode 0x%02x", op)
+	}
+	return false, err
+}
+
+func (u *unpickler) memoOp(isPut bool, idx int) error {
+	if isPut {
+		return u.put(idx)
+	}
+	return u.get(idx)
+}
+
+func (u *unpickler) pushTextInt(line string) error {
+	switch line {
+	case "00":
+		u.push(false)
+		return nil
+	case "01":
+		u.push(true)
+		return nil
+	}
+	v, err := strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+	if err == nil {
+		u.push(v)
+	}
+	return err
+}
+
+func (u *unpickler) run() (interface{}, error) {
+	for u.pos < len(u.data) {
+		op := u.data[u.pos]
+		u.pos++
+		done, err := u.step(op)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return u.pop()
+		}
+	}
+	return nil, errPickleNoStop
+}
+
+func pickleSequence(v interface{}) ([]interface{}, bool) {
+	switch s := v.(type) {
+	case *pickleList:
+		return s.items, true
+	case pickleTuple:
+		return s, true
+	}
+	return nil, false
+}
+
+func pickleNumber(v interface{}) (string, bool) {
+	switch n := v.(type) {
+	case int64:
+		return strconv.FormatInt(n, 10), true
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64), true
+	case string:
+		_, err := strconv.ParseFloat(n, 64)
+		return n, err == nil
+	}
+	return "", false
+}
+
+// pickleLine converts a (path, (timestamp, value)) tuple into the equivalent plaintext carbon line
+func pickleLine(v interface{}) (string, bool) {
+	outer, ok := pickleSequence(v)
+	if !ok || len(outer) != 2 {
+		return "", false
+	}
+	path, ok := outer[0].(string)
+	if !ok || path == "" || strings.ContainsAny(path, " \t\r\n") {
+		return "", false
+	}
+	inner, ok := pickleSequence(outer[1])
+	if !ok || len(inner) != 2 {
+		return "", false
+	}
+	timestamp, ok := pickleNumber(inner[0])
+	if !ok {
+		return "", false
+	}
+	value, ok := pickleNumber(inner[1])
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%s %s %s", path, value, timestamp), true
+}
+
+// decodePickleFrame decodes the payload of one length prefixed pickle message into carbon lines,
+// returning how many entries were not valid metric tuples
+func decodePickleFrame(payload []byte) ([]string, int64, error) {
+	obj, err := unpickle(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries, ok := pickleSequence(obj)
+	if !ok {
+		return nil, 0, errors.Errorf("expected a pickled list of metrics, got %T", obj)
+	}
+	lines := make([]string, 0, len(entries))
+	invalid := int64(0)
+	for _, e := range entries {
+		if line, ok := pickleLine(e); ok {
+			lines = append(lines, line)
+		} else {
+			invalid++
+		}
+	}
+	return lines, invalid, nil
+}
@@ -0,0 +1,129 @@
+package carbon
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pickleMetricLines = []string{
+	"a.b 2.5 1500000000",
+	"c.d 3 1500000000.5",
+	"e.f -2 1",
+	"big 1099511627776 1",
+}
+
+// the same metrics pickled by python's pickle.dumps at each protocol version
+var pickledMetrics = map[string]string{
+	"protocol 0": "286c70300a2856612e620a70310a2849313530303030303030300a46322e350a7470320a7470330a612856632e640a70340a2846313530303030303030302e350a49330a7470350a7470360a612856652e660a70370a2849310a492d320a7470380a7470390a6128566269670a7031300a2849310a4c313039393531313632373737364c0a747031310a747031320a612e",
+	"protocol 1": "5d710028285803000000612e627101284a002f6859474004000000000000747102747103285803000000632e647104284741d65a0bc02000004b03747105747106285803000000652e667107284b014afeffffff747108747109285803000000626967710a284b014c313039393531313632373737364c0a74710b74710c652e",
+	"protocol 2": "80025d7100285803000000612e6271014a002f68594740040000000000008671028671035803000000632e6471044741d65a0bc02000004b038671058671065803000000652e6671074b014afeffffff8671088671095803000000626967710a4b018a0600000000000186710b86710c652e",
+	"protocol 4": "80049557000000000000005d94288c03612e62944a002f6859474004000000000000869486948c03632e64944741d65a0bc02000004b03869486948c03652e66944b014afeffffff869486948c03626967944b018a0600000000000186948694652e",
+}
+
+func TestDecodePickleFrame(t *testing.T) {
+	for name, h := range pickledMetrics {
+		payload, err := hex.DecodeString(h)
+		require.NoError(t, err)
+		lines, invalid, err := decodePickleFrame(payload)
+		assert.NoError(t, err, name)
+		assert.Equal(t, int64(0), invalid, name)
+		assert.Equal(t, pickleMetricLines, lines, name)
+	}
+
+	// python 2 carbon-relay sends byte strings
+	lines, invalid, err := decodePickleFrame([]byte("(lp0\n(S'a.b'\np1\n(I1\nF2.5\ntp2\ntp3\na(U\x03c.d(I01\nS\"7\"\ntta."))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), invalid)
+	assert.Equal(t, []string{"a.b 2.5 1"}, lines)
+
+	lines, invalid, err = decodePickleFrame([]byte("(X\x03\x00\x00\x00a bK\x01K\x02\x86\x86U\x01xK\x01\x85\x86U\x01xK\x01N\x86\x86U\x01xK\x01S'x'\n\x86\x86K\x01K\x01K\x02\x86\x86]t."))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), invalid)
+	assert.Empty(t, lines)
+
+	_, _, err = decodePickleFrame([]byte("K\x01."))
+	assert.Error(t, err)
+	_, _, err = decodePickleFrame([]byte("c"))
+	assert.Error(t, err)
+}
+
+func TestUnpickle(t *testing.T) {
+	goodCases := []struct {
+		in  string
+		out interface{}
+	}{
+		{in: ").", out: pickleTuple{}},
+		{in: "N\x88\x89\x87.", out: pickleTuple{nil, true, false}},
+		{in: "(I00\nI01\nI-5\nL7L\nt.", out: pickleTuple{false, true, int64(-5), int64(7)}},
+		{in: "M\x01\x02\x85.", out: pickleTuple{int64(0x0201)}},
+		{in: "\x8b\x02\x00\x00\x00\xff\xff.", out: int64(-1)},
+		{in: "\x8a\x00.", out: int64(0)},
+		{in: "\x8a\x08\xff\xff\xff\xff\xff\xff\xff\xff.", out: int64(-1)},
+		{in: "J\xff\xff\xff\xff.", out: int64(-1)},
+		{in: "G?\xf8\x00\x00\x00\x00\x00\x00.", out: 1.5},
+		{in: "Vabc\n.", out: "abc"},
+		{in: "T\x01\x00\x00\x00aB\x01\x00\x00\x00bC\x01c\x8d\x01\x00\x00\x00\x00\x00\x00\x00d(t.", out: pickleTuple{}},
+		{in: "C\x01cp3\ng3\n\x86.", out: pickleTuple{"c", "c"}},
+		{in: "K\x01K\x020(K\x031\x852\x86.", out: pickleTuple{pickleTuple{int64(1)}, pickleTuple{int64(1)}}},
+		{in: "C\x01cr\x00\x01\x00\x00j\x00\x01\x00\x00\x86.", out: pickleTuple{"c", "c"}},
+		{in: "](K\x01K\x02e.", out: &pickleList{items: []interface{}{int64(1), int64(2)}}},
+	}
+	for _, tt := range goodCases {
+		out, err := unpickle([]byte(tt.in))
+		assert.NoError(t, err, "%q", tt.in)
+		assert.Equal(t, tt.out, out, "%q", tt.in)
+	}
+
+	badCases := []string{
+		"",
+		"K\x01",
+		"a.",
+		"t.",
+		"\x86.",
+		"K\x01K\x02a.",
+		"(K\x01e.",
+		"h\x05.",
+		"S'abc\n.",
+		"Sx\n.",
+		"S\n.",
+		"I\n.",
+		"Iabc",
+		"Fabc\n.",
+		"F",
+		"V",
+		"\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00\x00.",
+		"\x8a\x02\x00",
+		"\x8a",
+		"\x8b\x02",
+		"X\x05\x00\x00\x00ab",
+		"X\xff\xff\xff\xff",
+		"\x8d\xff\xff\xff\xff\xff\xff\xff\xff",
+		"J\x00",
+		"K",
+		"M\x00",
+		"G\x00",
+		"\x80",
+		"\x95\x00",
+		"p\n",
+		"pabc\n",
+		"p0\n",
+		"q",
+		"q\x00",
+		"r\x00",
+		"\x94",
+		"cos\nsystem\n.",
+		"R.",
+		"0",
+		"1",
+		"2",
+		"N(0t.",
+		"N(0e.",
+	}
+	for _, in := range badCases {
+		_, err := unpickle([]byte(in))
+		assert.Error(t, err, "%q", in)
+	}
+}
@@ -16,7 +16,6 @@ import (
 	"github.com/mailru/easyjson"
 	"github.com/signalfx/golib/v3/datapoint"
 	"github.com/signalfx/golib/v3/datapoint/dpsink"
-	"github.com/signalfx/golib/v3/errors"
 	"github.com/signalfx/golib/v3/event"
 	"github.com/signalfx/golib/v3/log"
 	"github.com/signalfx/golib/v3/pointer"
@@ -75,6 +74,9 @@ func (decoder *JSONDecoder) ServeHTTPC(ctx context.Context, rw http.ResponseWrit
 	err := decoder.Read(ctx, req)
 	if err != nil {
 		atomic.AddInt64(&decoder.TotalErrors, 1)
+		if protocol.WriteBackoff(rw, err, decoder.Logger) {
+			return
+		}
 		rw.WriteHeader(http.StatusBadRequest)
 		_, err = rw.Write([]byte(fmt.Sprintf("Unable to decode json: %s", err.Error())))
 		log.IfErr(decoder.Logger, err)
@@ -124,7 +126,7 @@ func (decoder *JSONDecoder) Read(ctx context.Context, req *http.Request) error {
 	if len(es) > 0 {
 		e2 = decoder.SendTo.AddEvents(ctx, es)
 	}
-	return errors.NewMultiErr([]error{e1, e2})
+	return protocol.NewMultiErr([]error{e1, e2})
 }
 
 func (decoder *JSONDecoder) defaultDims(req *http.Request) map[string]string {
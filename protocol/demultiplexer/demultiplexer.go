@@ -2,111 +2,232 @@ package demultiplexer
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/signalfx/golib/v3/datapoint"
 	"github.com/signalfx/golib/v3/datapoint/dpsink"
-	"github.com/signalfx/golib/v3/errors"
 	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/eventcounter"
 	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
 	"github.com/signalfx/golib/v3/sfxclient"
 	"github.com/signalfx/golib/v3/trace"
 	"github.com/signalfx/ingest-protocols/logkey"
+	"github.com/signalfx/ingest-protocols/protocol"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
 )
 
+// TimestampPolicy is what the Demultiplexer does with items received later than LateDuration or further into
+// the future than FutureDuration
+type TimestampPolicy string
+
+const (
+	// Pass forwards the items unchanged, and is what an empty policy does
+	Pass TimestampPolicy = "pass"
+	// Drop does not forward the items
+	Drop TimestampPolicy = "drop"
+	// Clamp sets the timestamp of the items to now
+	Clamp TimestampPolicy = "clamp"
+)
+
+// UnmarshalText accepts any case of pass, drop or clamp
+func (p *TimestampPolicy) UnmarshalText(text []byte) error {
+	switch policy := TimestampPolicy(strings.ToLower(string(text))); policy {
+	case Pass, Drop, Clamp:
+		*p = policy
+		return nil
+	}
+	return fmt.Errorf("unknown timestamp policy %q", text)
+}
+
+// DefaultLogLimit is how many late or future items are logged per second when LogLimit is not set
+const DefaultLogLimit = int64(10)
+
 // Demultiplexer is a sink that forwards points it sees to multiple sinks
 type Demultiplexer struct {
-	DatapointSinks []dpsink.DSink
-	EventSinks     []dpsink.ESink
-	TraceSinks     []trace.Sink
-	Logger         log.Logger
-	LateDuration   *time.Duration
-	FutureDuration *time.Duration
-	stats          struct {
+	DatapointSinks   []dpsink.DSink
+	EventSinks       []dpsink.ESink
+	TraceSinks       []trace.Sink
+	LogSinks         []sfxlog.LogSink
+	Logger           log.Logger
+	LateDuration     *time.Duration
+	FutureDuration   *time.Duration
+	DatapointPolicy  TimestampPolicy
+	EventPolicy      TimestampPolicy
+	SpanPolicy       TimestampPolicy
+	LogLimit         *int64
+	routes           []*route
+	windowLogger     log.Logger
+	windowLoggerOnce sync.Once
+	stats            struct {
 		lateDps      int64
 		futureDps    int64
 		lateEvents   int64
 		futureEvents int64
 		lateSpans    int64
 		futureSpans  int64
+
+		droppedDps    int64
+		clampedDps    int64
+		droppedEvents int64
+		clampedEvents int64
+		droppedSpans  int64
+		clampedSpans  int64
+
+		unroutedDps    int64
+		unroutedEvents int64
+		unroutedSpans  int64
 	}
 }
 
 var _ dpsink.Sink = &Demultiplexer{}
+var _ sfxlog.LogSink = &Demultiplexer{}
 
-// AddDatapoints forwards all points to each sendTo sink.  Returns the error message of the last
+// AddDatapoints forwards points to each sendTo sink they are routed to.  Returns the error message of the last
 // sink to have an error.
 func (streamer *Demultiplexer) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
 	if len(points) == 0 {
 		return nil
 	}
-	streamer.handleLateOrFuturePoints(points)
+	points = streamer.handleLateOrFuturePoints(points)
 	if v := ctx.Value(sfxclient.TokenHeaderName); v != nil {
 		for _, d := range points {
 			d.Meta[sfxclient.TokenHeaderName] = v
 		}
 	}
 	var errs []error
-	for _, sendTo := range streamer.DatapointSinks {
-		if err := sendTo.AddDatapoints(ctx, points); err != nil {
+	for i, toSend := range streamer.routeDatapoints(points) {
+		if len(toSend) == 0 {
+			continue
+		}
+		if err := streamer.DatapointSinks[i].AddDatapoints(ctx, toSend); err != nil {
 			errs = append(errs, err)
 		}
 	}
-	return errors.NewMultiErr(errs)
+	return protocol.NewMultiErr(errs)
 }
 
-func (streamer *Demultiplexer) handleLateOrFuturePoints(points []*datapoint.Datapoint) {
-	if streamer.FutureDuration != nil || streamer.LateDuration != nil {
-		now := time.Now()
+type windowCounters struct {
+	late    *int64
+	future  *int64
+	dropped *int64
+	clamped *int64
+}
 
-		for _, d := range points {
-			if streamer.FutureDuration != nil && d.Timestamp.After(now.Add(*streamer.FutureDuration)) {
-				atomic.AddInt64(&streamer.stats.futureDps, 1)
-				streamer.Logger.Log(logkey.Name, d.String(), logkey.Delta, d.Timestamp.Sub(now), "datapoint received too far into the future")
-			} else if streamer.LateDuration != nil && d.Timestamp.Before(now.Add(-*streamer.LateDuration)) {
-				atomic.AddInt64(&streamer.stats.lateDps, 1)
-				streamer.Logger.Log(logkey.Name, d.String(), logkey.Delta, now.Sub(d.Timestamp), "datapoint received too far into the past")
-			}
+func (streamer *Demultiplexer) rateLimitedLogger() log.Logger {
+	streamer.windowLoggerOnce.Do(func() {
+		limit := DefaultLogLimit
+		if streamer.LogLimit != nil {
+			limit = *streamer.LogLimit
 		}
+		streamer.windowLogger = &log.RateLimitedLogger{
+			EventCounter: eventcounter.New(time.Now(), time.Second),
+			Limit:        limit,
+			Logger:       streamer.Logger,
+		}
+	})
+	return streamer.windowLogger
+}
+
+// checkWindow counts and logs a timestamp that is outside of the late or future window and returns whether the
+// policy drops or clamps it
+func (streamer *Demultiplexer) checkWindow(now time.Time, ts time.Time, policy TimestampPolicy, counters windowCounters, kind string, name func() string) (drop bool, clamp bool) {
+	var msg string
+	var delta time.Duration
+	switch {
+	case streamer.FutureDuration != nil && ts.After(now.Add(*streamer.FutureDuration)):
+		atomic.AddInt64(counters.future, 1)
+		msg, delta = kind+" received too far into the future", ts.Sub(now)
+	case streamer.LateDuration != nil && ts.Before(now.Add(-*streamer.LateDuration)):
+		atomic.AddInt64(counters.late, 1)
+		msg, delta = kind+" received too far into the past", now.Sub(ts)
+	default:
+		return false, false
+	}
+	if logger := streamer.rateLimitedLogger(); !log.IsDisabled(logger) {
+		logger.Log(logkey.Name, name(), logkey.Delta, delta, msg)
+	}
+	switch policy {
+	case Drop:
+		atomic.AddInt64(counters.dropped, 1)
+		return true, false
+	case Clamp:
+		atomic.AddInt64(counters.clamped, 1)
+		return false, true
+	}
+	return false, false
+}
+
+func (streamer *Demultiplexer) handleLateOrFuturePoints(points []*datapoint.Datapoint) []*datapoint.Datapoint {
+	if streamer.FutureDuration == nil && streamer.LateDuration == nil {
+		return points
+	}
+	now := time.Now()
+	counters := windowCounters{late: &streamer.stats.lateDps, future: &streamer.stats.futureDps, dropped: &streamer.stats.droppedDps, clamped: &streamer.stats.clampedDps}
+	kept := points
+	if streamer.DatapointPolicy == Drop {
+		kept = make([]*datapoint.Datapoint, 0, len(points))
 	}
+	for _, d := range points {
+		drop, clamp := streamer.checkWindow(now, d.Timestamp, streamer.DatapointPolicy, counters, "datapoint", d.String)
+		if clamp {
+			d.Timestamp = now
+		}
+		if streamer.DatapointPolicy == Drop && !drop {
+			kept = append(kept, d)
+		}
+	}
+	return kept
 }
 
-// AddEvents forwards all events to each sendTo sink.  Returns the error message of the last
+// AddEvents forwards events to each sendTo sink they are routed to.  Returns the error message of the last
 // sink to have an error.
 func (streamer *Demultiplexer) AddEvents(ctx context.Context, events []*event.Event) error {
 	if len(events) == 0 {
 		return nil
 	}
-	streamer.handleLateOrFutureEvents(events)
+	events = streamer.handleLateOrFutureEvents(events)
 	if v := ctx.Value(sfxclient.TokenHeaderName); v != nil {
 		for _, e := range events {
 			addMeta(&e.Meta, sfxclient.TokenHeaderName, v)
 		}
 	}
 	var errs []error
-	for _, sendTo := range streamer.EventSinks {
-		if err := sendTo.AddEvents(ctx, events); err != nil {
+	for i, toSend := range streamer.routeEvents(events) {
+		if len(toSend) == 0 {
+			continue
+		}
+		if err := streamer.EventSinks[i].AddEvents(ctx, toSend); err != nil {
 			errs = append(errs, err)
 		}
 	}
-	return errors.NewMultiErr(errs)
+	return protocol.NewMultiErr(errs)
 }
 
-func (streamer *Demultiplexer) handleLateOrFutureEvents(events []*event.Event) {
-	if streamer.FutureDuration != nil || streamer.LateDuration != nil {
-		now := time.Now()
-
-		for _, d := range events {
-			if streamer.FutureDuration != nil && d.Timestamp.After(now.Add(*streamer.FutureDuration)) {
-				atomic.AddInt64(&streamer.stats.futureEvents, 1)
-				streamer.Logger.Log(logkey.Name, d.String(), logkey.Delta, d.Timestamp.Sub(now), "event received too far into the future")
-			} else if streamer.LateDuration != nil && d.Timestamp.Before(now.Add(-*streamer.LateDuration)) {
-				atomic.AddInt64(&streamer.stats.lateEvents, 1)
-				streamer.Logger.Log(logkey.Name, d.String(), logkey.Delta, now.Sub(d.Timestamp), "event received too far into the past")
-			}
+func (streamer *Demultiplexer) handleLateOrFutureEvents(events []*event.Event) []*event.Event {
+	if streamer.FutureDuration == nil && streamer.LateDuration == nil {
+		return events
+	}
+	now := time.Now()
+	counters := windowCounters{late: &streamer.stats.lateEvents, future: &streamer.stats.futureEvents, dropped: &streamer.stats.droppedEvents, clamped: &streamer.stats.clampedEvents}
+	kept := events
+	if streamer.EventPolicy == Drop {
+		kept = make([]*event.Event, 0, len(events))
+	}
+	for _, e := range events {
+		drop, clamp := streamer.checkWindow(now, e.Timestamp, streamer.EventPolicy, counters, "event", e.String)
+		if clamp {
+			e.Timestamp = now
+		}
+		if streamer.EventPolicy == Drop && !drop {
+			kept = append(kept, e)
 		}
 	}
+	return kept
 }
 
 func addMeta(m *map[interface{}]interface{}, k interface{}, v interface{}) {
@@ -116,30 +237,52 @@ func addMeta(m *map[interface{}]interface{}, k interface{}, v interface{}) {
 	(*m)[k] = v
 }
 
-// AddSpans forwards all traces to each sentTo sink. Returns the error of the last sink to have an error.
+// AddSpans forwards traces to each sentTo sink they are routed to. Returns the error of the last sink to have an error.
 // to avoid conflicts with adding tags in forwarders, each span needs to be a copy to avoid concurrent modification issues
 func (streamer *Demultiplexer) AddSpans(ctx context.Context, spans []*trace.Span) error {
 	if len(spans) == 0 {
 		return nil
 	}
-	streamer.handleLateOrFutureSpans(spans)
+	spans = streamer.handleLateOrFutureSpans(spans)
 	if v := ctx.Value(sfxclient.TokenHeaderName); v != nil {
 		for _, s := range spans {
 			addMeta(&s.Meta, sfxclient.TokenHeaderName, v)
 		}
 	}
+	batches := streamer.routeSpans(spans)
+	last := len(batches) - 1
+	for last > 0 && len(batches[last]) == 0 {
+		last--
+	}
 	var errs []error
-	for i, sendTo := range streamer.TraceSinks {
-		toSend := spans
-		if i < len(streamer.TraceSinks)-1 {
+	for i, toSend := range batches {
+		if len(toSend) == 0 {
+			continue
+		}
+		if i < last {
 			// this is because of smart samplers
-			toSend = deepCopySpans(spans)
+			toSend = deepCopySpans(toSend)
+		}
+		if err := streamer.TraceSinks[i].AddSpans(ctx, toSend); err != nil {
+			errs = append(errs, err)
 		}
-		if err := sendTo.AddSpans(ctx, toSend); err != nil {
+	}
+	return protocol.NewMultiErr(errs)
+}
+
+// AddLogs forwards logs to every log sink. Returns the errors of the sinks that had one.  Logs have no Meta, so the
+// token stays in ctx for the sinks to find.
+func (streamer *Demultiplexer) AddLogs(ctx context.Context, logs []*sfxlog.ResourceLogs) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, sink := range streamer.LogSinks {
+		if err := sink.AddLogs(ctx, logs); err != nil {
 			errs = append(errs, err)
 		}
 	}
-	return errors.NewMultiErr(errs)
+	return protocol.NewMultiErr(errs)
 }
 
 func deepCopySpans(spans []*trace.Span) []*trace.Span {
@@ -168,23 +311,40 @@ func deepCopySpans(spans []*trace.Span) []*trace.Span {
 	return retSpans
 }
 
-func (streamer *Demultiplexer) handleLateOrFutureSpans(spans []*trace.Span) {
-	if streamer.FutureDuration != nil || streamer.LateDuration != nil {
-		now := time.Now()
-		for _, d := range spans {
-			if d.Timestamp != nil {
-				if streamer.FutureDuration != nil && time.Unix(0, *d.Timestamp*int64(time.Microsecond)).After(now.Add(*streamer.FutureDuration)) {
-
-					atomic.AddInt64(&streamer.stats.futureSpans, 1)
-					streamer.Logger.Log(logkey.Name, d.ID, logkey.Delta, time.Unix(0, *d.Timestamp*int64(time.Microsecond)).Sub(now), "trace received too far into the future")
-				} else if streamer.LateDuration != nil && time.Unix(0, *d.Timestamp*int64(time.Microsecond)).Before(now.Add(-*streamer.LateDuration)) {
-
-					atomic.AddInt64(&streamer.stats.lateSpans, 1)
-					streamer.Logger.Log(logkey.Name, d.ID, logkey.Delta, now.Sub(time.Unix(0, *d.Timestamp*int64(time.Microsecond))), "trace received too far into the past")
-				}
-			}
+func (streamer *Demultiplexer) handleLateOrFutureSpans(spans []*trace.Span) []*trace.Span {
+	if streamer.FutureDuration == nil && streamer.LateDuration == nil {
+		return spans
+	}
+	now := time.Now()
+	counters := windowCounters{late: &streamer.stats.lateSpans, future: &streamer.stats.futureSpans, dropped: &streamer.stats.droppedSpans, clamped: &streamer.stats.clampedSpans}
+	kept := spans
+	if streamer.SpanPolicy == Drop {
+		kept = make([]*trace.Span, 0, len(spans))
+	}
+	for _, s := range spans {
+		var drop, clamp bool
+		if s.Timestamp != nil {
+			id := s.ID
+			drop, clamp = streamer.checkWindow(now, time.Unix(0, *s.Timestamp*int64(time.Microsecond)), streamer.SpanPolicy, counters, "trace", func() string { return id })
+		}
+		if clamp {
+			s.Timestamp = pointer.Int64(now.UnixNano() / int64(time.Microsecond))
+		}
+		if streamer.SpanPolicy == Drop && !drop {
+			kept = append(kept, s)
 		}
 	}
+	return kept
+}
+
+func policyStats(policy TimestampPolicy, kind string, counters windowCounters) []*datapoint.Datapoint {
+	switch policy {
+	case Drop:
+		return []*datapoint.Datapoint{sfxclient.Cumulative("dropped.count", map[string]string{"type": kind}, atomic.LoadInt64(counters.dropped))}
+	case Clamp:
+		return []*datapoint.Datapoint{sfxclient.Cumulative("clamped.count", map[string]string{"type": kind}, atomic.LoadInt64(counters.clamped))}
+	}
+	return nil
 }
 
 // Datapoints adheres to the sfxclient.Collector interface
@@ -204,5 +364,13 @@ func (streamer *Demultiplexer) Datapoints() []*datapoint.Datapoint {
 			sfxclient.Cumulative("late.count", map[string]string{"type": "spans"}, atomic.LoadInt64(&streamer.stats.lateSpans)),
 		}...)
 	}
+	if streamer.FutureDuration != nil || streamer.LateDuration != nil {
+		dps = append(dps, policyStats(streamer.DatapointPolicy, "datapoint", windowCounters{dropped: &streamer.stats.droppedDps, clamped: &streamer.stats.clampedDps})...)
+		dps = append(dps, policyStats(streamer.EventPolicy, "event", windowCounters{dropped: &streamer.stats.droppedEvents, clamped: &streamer.stats.clampedEvents})...)
+		dps = append(dps, policyStats(streamer.SpanPolicy, "spans", windowCounters{dropped: &streamer.stats.droppedSpans, clamped: &streamer.stats.clampedSpans})...)
+	}
+	if len(streamer.routes) > 0 {
+		dps = append(dps, streamer.routeDatapointStats()...)
+	}
 	return dps
 }
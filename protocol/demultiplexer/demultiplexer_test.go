@@ -1,6 +1,8 @@
 package demultiplexer
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
 
 	"time"
@@ -15,6 +17,7 @@ import (
 	"github.com/signalfx/golib/v3/pointer"
 	"github.com/signalfx/golib/v3/sfxclient"
 	"github.com/signalfx/golib/v3/trace"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -64,3 +67,118 @@ func TestNew(t *testing.T) {
 	assert.NoError(t, demux.AddSpans(context.Background(), []*trace.Span{}))
 	cancelFunc()
 }
+
+func TestTimestampPolicies(t *testing.T) {
+	sink := dptest.NewBasicSink()
+	sink.Resize(10)
+	c := &log.Counter{}
+	second := time.Second
+	demux := Demultiplexer{
+		DatapointSinks:  []dpsink.DSink{sink},
+		EventSinks:      []dpsink.ESink{sink},
+		TraceSinks:      []trace.Sink{sink},
+		Logger:          c,
+		LateDuration:    &second,
+		FutureDuration:  &second,
+		DatapointPolicy: Drop,
+		EventPolicy:     Clamp,
+		SpanPolicy:      Drop,
+		LogLimit:        pointer.Int64(2),
+	}
+	late := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+	ctx := context.Background()
+
+	pts := []*datapoint.Datapoint{dptest.DP(), dptest.DP(), dptest.DP()}
+	pts[0].Timestamp = late
+	pts[2].Timestamp = future
+	assert.NoError(t, demux.AddDatapoints(ctx, pts))
+	assert.Equal(t, []*datapoint.Datapoint{pts[1]}, <-sink.PointsChan)
+	assert.NoError(t, demux.AddDatapoints(ctx, pts[:1]))
+	assert.Len(t, sink.PointsChan, 0)
+
+	es := []*event.Event{dptest.E(), dptest.E()}
+	es[0].Timestamp = late
+	es[1].Timestamp = future
+	assert.NoError(t, demux.AddEvents(ctx, es))
+	assert.Equal(t, es, <-sink.EventsChan)
+	assert.True(t, time.Since(es[0].Timestamp) < time.Minute/2)
+	assert.True(t, time.Until(es[1].Timestamp) < time.Minute/2)
+
+	spans := []*trace.Span{{ID: "late", Timestamp: pointer.Int64(late.UnixNano() / 1000)}, {ID: "none"}}
+	assert.NoError(t, demux.AddSpans(ctx, spans))
+	assert.Equal(t, spans[1:], <-sink.TracesChan)
+
+	assert.Equal(t, int64(3), demux.stats.droppedDps)
+	assert.Equal(t, int64(2), demux.stats.clampedEvents)
+	assert.Equal(t, int64(1), demux.stats.droppedSpans)
+	assert.Equal(t, int64(2), c.Count, "logging should be rate limited")
+
+	dps := demux.Datapoints()
+	assert.Len(t, dps, 9)
+	assert.Equal(t, int64(3), dptest.ExactlyOneDims(dps, "dropped.count", map[string]string{"type": "datapoint"}).Value.(datapoint.IntValue).Int())
+	assert.Equal(t, int64(2), dptest.ExactlyOneDims(dps, "clamped.count", map[string]string{"type": "event"}).Value.(datapoint.IntValue).Int())
+	assert.Equal(t, int64(1), dptest.ExactlyOneDims(dps, "dropped.count", map[string]string{"type": "spans"}).Value.(datapoint.IntValue).Int())
+}
+
+func TestTimestampPolicyClampSpans(t *testing.T) {
+	sink := dptest.NewBasicSink()
+	sink.Resize(1)
+	second := time.Second
+	demux := Demultiplexer{
+		TraceSinks:     []trace.Sink{sink},
+		Logger:         log.Discard,
+		FutureDuration: &second,
+		SpanPolicy:     Clamp,
+	}
+	spans := []*trace.Span{{Timestamp: pointer.Int64(time.Now().Add(time.Hour).UnixNano() / 1000)}}
+	assert.NoError(t, demux.AddSpans(context.Background(), spans))
+	assert.Equal(t, spans, <-sink.TracesChan)
+	assert.True(t, *spans[0].Timestamp <= time.Now().UnixNano()/1000)
+	assert.Equal(t, int64(1), demux.stats.clampedSpans)
+	assert.Equal(t, int64(1), dptest.ExactlyOne(demux.Datapoints(), "clamped.count").Value.(datapoint.IntValue).Int())
+}
+
+func TestTimestampPolicyUnmarshal(t *testing.T) {
+	var p TimestampPolicy
+	assert.NoError(t, json.Unmarshal([]byte(`"Drop"`), &p))
+	assert.Equal(t, Drop, p)
+	assert.NoError(t, p.UnmarshalText([]byte("clamp")))
+	assert.Equal(t, Clamp, p)
+	assert.NoError(t, p.UnmarshalText([]byte("PASS")))
+	assert.Equal(t, Pass, p)
+	assert.Error(t, p.UnmarshalText([]byte("drip")))
+	assert.Equal(t, Pass, p)
+}
+
+type logSink struct {
+	logs  [][]*sfxlog.ResourceLogs
+	token interface{}
+	err   error
+}
+
+func (s *logSink) AddLogs(ctx context.Context, logs []*sfxlog.ResourceLogs) error {
+	s.logs = append(s.logs, logs)
+	s.token = ctx.Value(sfxclient.TokenHeaderName)
+	return s.err
+}
+
+func TestAddLogs(t *testing.T) {
+	sink1 := &logSink{}
+	sink2 := &logSink{err: errors.New("nope")}
+	demux := Demultiplexer{
+		LogSinks: []sfxlog.LogSink{sink1, sink2},
+		Logger:   log.Discard,
+	}
+	ctx := context.WithValue(context.Background(), sfxclient.TokenHeaderName, "foo")
+	logs := []*sfxlog.ResourceLogs{{LogRecords: []*sfxlog.LogRecord{{Name: "a"}}}}
+	assert.Error(t, demux.AddLogs(ctx, logs))
+	assert.Equal(t, [][]*sfxlog.ResourceLogs{logs}, sink1.logs)
+	assert.Equal(t, [][]*sfxlog.ResourceLogs{logs}, sink2.logs)
+	assert.Equal(t, "foo", sink1.token)
+	assert.NoError(t, demux.AddLogs(ctx, nil))
+	assert.Len(t, sink1.logs, 1)
+	sink2.err = nil
+	assert.NoError(t, demux.AddLogs(ctx, logs))
+	assert.Len(t, sink2.logs, 2)
+}
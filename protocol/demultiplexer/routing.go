@@ -0,0 +1,273 @@
+package demultiplexer
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/gobwas/glob"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/config/globbing"
+)
+
+// RouteConfig selects the sinks that receive the items it matches.  Every matcher that is set must match.
+// MetricName and MetricRegex match datapoint metric names and event types, Service and Operation match spans,
+// Dimensions match datapoint and event dimensions or span tags and Token matches the token an item was sent with.
+// MetricName, Service, Operation and Dimensions values are globs where only "*" is a wildcard.
+//
+// DatapointSinks, EventSinks and TraceSinks are indexes into the sinks of the Demultiplexer.  A route only
+// applies to a signal type when its sinks are set, and an empty (but set) list drops what it matches.
+type RouteConfig struct {
+	Name           *string           `json:",omitempty"`
+	MetricName     *string           `json:",omitempty"`
+	MetricRegex    *string           `json:",omitempty"`
+	Dimensions     map[string]string `json:",omitempty"`
+	Token          *string           `json:",omitempty"`
+	Service        *string           `json:",omitempty"`
+	Operation      *string           `json:",omitempty"`
+	DatapointSinks []int
+	EventSinks     []int
+	TraceSinks     []int
+}
+
+type route struct {
+	name           string
+	metricName     glob.Glob
+	metricRegex    *regexp.Regexp
+	dimensions     map[string]glob.Glob
+	token          *string
+	service        glob.Glob
+	operation      glob.Glob
+	datapointSinks []int
+	eventSinks     []int
+	traceSinks     []int
+	stats          struct {
+		dps    int64
+		events int64
+		spans  int64
+	}
+}
+
+func checkSinks(name string, kind string, sinks []int, count int) error {
+	for _, s := range sinks {
+		if s < 0 || s >= count {
+			return fmt.Errorf("route %s: %s sink %d out of range, there are %d", name, kind, s, count)
+		}
+	}
+	return nil
+}
+
+func getGlob(pattern *string) glob.Glob {
+	if pattern == nil {
+		return nil
+	}
+	return globbing.GetGlob(*pattern)
+}
+
+// nolint: gocyclo
+func newRoute(i int, conf *RouteConfig, streamer *Demultiplexer) (*route, error) {
+	r := &route{
+		name:           fmt.Sprintf("route_%d", i),
+		token:          conf.Token,
+		metricName:     getGlob(conf.MetricName),
+		service:        getGlob(conf.Service),
+		operation:      getGlob(conf.Operation),
+		datapointSinks: conf.DatapointSinks,
+		eventSinks:     conf.EventSinks,
+		traceSinks:     conf.TraceSinks,
+	}
+	if conf.Name != nil {
+		r.name = *conf.Name
+	}
+	if conf.MetricName != nil && conf.MetricRegex != nil {
+		return nil, fmt.Errorf("route %s: only one of MetricName and MetricRegex can be set", r.name)
+	}
+	if conf.MetricRegex != nil {
+		var err error
+		if r.metricRegex, err = regexp.Compile(*conf.MetricRegex); err != nil {
+			return nil, fmt.Errorf("route %s: %s", r.name, err)
+		}
+	}
+	if len(conf.Dimensions) > 0 {
+		r.dimensions = make(map[string]glob.Glob, len(conf.Dimensions))
+		for k, v := range conf.Dimensions {
+			r.dimensions[k] = globbing.GetGlob(v)
+		}
+	}
+	if err := checkSinks(r.name, "datapoint", r.datapointSinks, len(streamer.DatapointSinks)); err != nil {
+		return nil, err
+	}
+	if err := checkSinks(r.name, "event", r.eventSinks, len(streamer.EventSinks)); err != nil {
+		return nil, err
+	}
+	if err := checkSinks(r.name, "trace", r.traceSinks, len(streamer.TraceSinks)); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *route) matchMetric(name string) bool {
+	if r.service != nil || r.operation != nil {
+		return false
+	}
+	if r.metricName != nil && !r.metricName.Match(name) {
+		return false
+	}
+	return r.metricRegex == nil || r.metricRegex.MatchString(name)
+}
+
+func (r *route) matchSpan(service string, operation string) bool {
+	if r.metricName != nil || r.metricRegex != nil {
+		return false
+	}
+	if r.service != nil && !r.service.Match(service) {
+		return false
+	}
+	return r.operation == nil || r.operation.Match(operation)
+}
+
+func (r *route) matchCommon(dims map[string]string, meta map[interface{}]interface{}) bool {
+	for k, g := range r.dimensions {
+		v, exists := dims[k]
+		if !exists || !g.Match(v) {
+			return false
+		}
+	}
+	if r.token != nil {
+		token, _ := meta[sfxclient.TokenHeaderName].(string)
+		return token == *r.token
+	}
+	return true
+}
+
+// SetRoutes replaces the routes of the Demultiplexer.  Items are sent to the sinks of the first route that
+// matches them and to every sink when none do.  Sinks must be set before routes are, and routes can not be
+// changed while the Demultiplexer is in use.
+func (streamer *Demultiplexer) SetRoutes(confs []*RouteConfig) error {
+	routes := make([]*route, 0, len(confs))
+	for i, conf := range confs {
+		r, err := newRoute(i, conf, streamer)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, r)
+	}
+	streamer.routes = routes
+	return nil
+}
+
+// routeItems calls send with the sinks each of count items should go to, which are either the sinks of the first
+// matching route or all of them.  find returns the sinks and counter of the first
+// matching route, or a nil counter when no route matches.
+func routeItems(count int, sinks int, unrouted *int64, find func(i int) ([]int, *int64), send func(item int, sink int)) {
+	for i := 0; i < count; i++ {
+		if selected, counter := find(i); counter != nil {
+			atomic.AddInt64(counter, 1)
+			for _, s := range selected {
+				send(i, s)
+			}
+			continue
+		}
+		atomic.AddInt64(unrouted, 1)
+		for s := 0; s < sinks; s++ {
+			send(i, s)
+		}
+	}
+}
+
+func (streamer *Demultiplexer) routeDatapoints(points []*datapoint.Datapoint) [][]*datapoint.Datapoint {
+	batches := make([][]*datapoint.Datapoint, len(streamer.DatapointSinks))
+	if len(streamer.routes) == 0 {
+		for s := range batches {
+			batches[s] = points
+		}
+		return batches
+	}
+	routeItems(len(points), len(batches), &streamer.stats.unroutedDps, func(i int) ([]int, *int64) {
+		d := points[i]
+		for _, r := range streamer.routes {
+			if r.datapointSinks != nil && r.matchMetric(d.Metric) && r.matchCommon(d.Dimensions, d.Meta) {
+				return r.datapointSinks, &r.stats.dps
+			}
+		}
+		return nil, nil
+	}, func(i int, s int) {
+		batches[s] = append(batches[s], points[i])
+	})
+	return batches
+}
+
+func (streamer *Demultiplexer) routeEvents(events []*event.Event) [][]*event.Event {
+	batches := make([][]*event.Event, len(streamer.EventSinks))
+	if len(streamer.routes) == 0 {
+		for s := range batches {
+			batches[s] = events
+		}
+		return batches
+	}
+	routeItems(len(events), len(batches), &streamer.stats.unroutedEvents, func(i int) ([]int, *int64) {
+		e := events[i]
+		for _, r := range streamer.routes {
+			if r.eventSinks != nil && r.matchMetric(e.EventType) && r.matchCommon(e.Dimensions, e.Meta) {
+				return r.eventSinks, &r.stats.events
+			}
+		}
+		return nil, nil
+	}, func(i int, s int) {
+		batches[s] = append(batches[s], events[i])
+	})
+	return batches
+}
+
+func spanNames(s *trace.Span) (string, string) {
+	var service, operation string
+	if s.LocalEndpoint != nil && s.LocalEndpoint.ServiceName != nil {
+		service = *s.LocalEndpoint.ServiceName
+	}
+	if s.Name != nil {
+		operation = *s.Name
+	}
+	return service, operation
+}
+
+func (streamer *Demultiplexer) routeSpans(spans []*trace.Span) [][]*trace.Span {
+	batches := make([][]*trace.Span, len(streamer.TraceSinks))
+	if len(streamer.routes) == 0 {
+		for s := range batches {
+			batches[s] = spans
+		}
+		return batches
+	}
+	routeItems(len(spans), len(batches), &streamer.stats.unroutedSpans, func(i int) ([]int, *int64) {
+		s := spans[i]
+		service, operation := spanNames(s)
+		for _, r := range streamer.routes {
+			if r.traceSinks != nil && r.matchSpan(service, operation) && r.matchCommon(s.Tags, s.Meta) {
+				return r.traceSinks, &r.stats.spans
+			}
+		}
+		return nil, nil
+	}, func(i int, s int) {
+		batches[s] = append(batches[s], spans[i])
+	})
+	return batches
+}
+
+func (streamer *Demultiplexer) routeDatapointStats() []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, len(streamer.routes)*3+3)
+	for _, r := range streamer.routes {
+		dps = append(dps,
+			sfxclient.Cumulative("route.count", map[string]string{"route": r.name, "type": "datapoint"}, atomic.LoadInt64(&r.stats.dps)),
+			sfxclient.Cumulative("route.count", map[string]string{"route": r.name, "type": "event"}, atomic.LoadInt64(&r.stats.events)),
+			sfxclient.Cumulative("route.count", map[string]string{"route": r.name, "type": "spans"}, atomic.LoadInt64(&r.stats.spans)),
+		)
+	}
+	return append(dps,
+		sfxclient.Cumulative("unrouted.count", map[string]string{"type": "datapoint"}, atomic.LoadInt64(&streamer.stats.unroutedDps)),
+		sfxclient.Cumulative("unrouted.count", map[string]string{"type": "event"}, atomic.LoadInt64(&streamer.stats.unroutedEvents)),
+		sfxclient.Cumulative("unrouted.count", map[string]string{"type": "spans"}, atomic.LoadInt64(&streamer.stats.unroutedSpans)),
+	)
+}
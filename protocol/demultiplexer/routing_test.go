@@ -0,0 +1,153 @@
+package demultiplexer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bufferedSinks(n int) []*dptest.BasicSink {
+	sinks := make([]*dptest.BasicSink, n)
+	for i := range sinks {
+		sinks[i] = dptest.NewBasicSink()
+		sinks[i].Resize(10)
+	}
+	return sinks
+}
+
+func routedDemux(sinks []*dptest.BasicSink) *Demultiplexer {
+	demux := &Demultiplexer{Logger: log.Discard}
+	for _, s := range sinks {
+		demux.DatapointSinks = append(demux.DatapointSinks, s)
+		demux.EventSinks = append(demux.EventSinks, s)
+		demux.TraceSinks = append(demux.TraceSinks, s)
+	}
+	return demux
+}
+
+func stat(t *testing.T, demux *Demultiplexer, name string, dims map[string]string) int64 {
+	for _, dp := range demux.Datapoints() {
+		if dp.Metric == name && reflect.DeepEqual(dims, dp.Dimensions) {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	t.Fatalf("no %s %v", name, dims)
+	return 0
+}
+
+func TestRoutingDatapoints(t *testing.T) {
+	sinks := bufferedSinks(2)
+	demux := routedDemux(sinks)
+	require.NoError(t, demux.SetRoutes([]*RouteConfig{
+		{Name: pointer.String("carbon"), MetricName: pointer.String("carbon.*"), DatapointSinks: []int{0}},
+		{MetricRegex: pointer.String("^sfx\\."), Dimensions: map[string]string{"env": "prod*"}, DatapointSinks: []int{1}},
+		{Token: pointer.String("drop"), DatapointSinks: []int{}},
+		{Service: pointer.String("*"), DatapointSinks: []int{0}},
+	}))
+
+	points := []*datapoint.Datapoint{
+		datapoint.New("carbon.cpu", nil, datapoint.NewIntValue(1), datapoint.Gauge, time.Now()),
+		datapoint.New("sfx.cpu", map[string]string{"env": "production"}, datapoint.NewIntValue(1), datapoint.Gauge, time.Now()),
+		datapoint.New("sfx.mem", map[string]string{"env": "dev"}, datapoint.NewIntValue(1), datapoint.Gauge, time.Now()),
+	}
+	assert.NoError(t, demux.AddDatapoints(context.Background(), points))
+	assert.Equal(t, []*datapoint.Datapoint{points[0], points[2]}, <-sinks[0].PointsChan)
+	assert.Equal(t, []*datapoint.Datapoint{points[1], points[2]}, <-sinks[1].PointsChan)
+
+	ctx := context.WithValue(context.Background(), sfxclient.TokenHeaderName, "drop")
+	assert.NoError(t, demux.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}))
+	assert.Len(t, sinks[0].PointsChan, 0)
+	assert.Len(t, sinks[1].PointsChan, 0)
+
+	assert.Equal(t, int64(1), stat(t, demux, "route.count", map[string]string{"route": "carbon", "type": "datapoint"}))
+	assert.Equal(t, int64(1), stat(t, demux, "route.count", map[string]string{"route": "route_1", "type": "datapoint"}))
+	assert.Equal(t, int64(1), stat(t, demux, "route.count", map[string]string{"route": "route_2", "type": "datapoint"}))
+	assert.Equal(t, int64(0), stat(t, demux, "route.count", map[string]string{"route": "route_3", "type": "datapoint"}))
+	assert.Equal(t, int64(1), stat(t, demux, "unrouted.count", map[string]string{"type": "datapoint"}))
+	assert.Len(t, demux.Datapoints(), 15)
+}
+
+func TestRoutingEvents(t *testing.T) {
+	sinks := bufferedSinks(2)
+	demux := routedDemux(sinks)
+	require.NoError(t, demux.SetRoutes([]*RouteConfig{
+		{MetricName: pointer.String("deploy"), EventSinks: []int{1}},
+		{MetricName: pointer.String("*"), DatapointSinks: []int{0}},
+	}))
+	events := []*event.Event{
+		event.New("deploy", event.USERDEFINED, map[string]string{}, time.Now()),
+		event.New("alert", event.USERDEFINED, map[string]string{}, time.Now()),
+	}
+	assert.NoError(t, demux.AddEvents(context.Background(), events))
+	assert.Equal(t, []*event.Event{events[1]}, <-sinks[0].EventsChan)
+	assert.Equal(t, events, <-sinks[1].EventsChan)
+	assert.Equal(t, int64(1), stat(t, demux, "route.count", map[string]string{"route": "route_0", "type": "event"}))
+	assert.Equal(t, int64(1), stat(t, demux, "unrouted.count", map[string]string{"type": "event"}))
+}
+
+func TestRoutingSpans(t *testing.T) {
+	sinks := bufferedSinks(3)
+	demux := routedDemux(sinks)
+	require.NoError(t, demux.SetRoutes([]*RouteConfig{
+		{Service: pointer.String("api"), Operation: pointer.String("get*"), TraceSinks: []int{0, 1}},
+		{Dimensions: map[string]string{"sampled": "no"}, TraceSinks: []int{}},
+		{MetricName: pointer.String("*"), TraceSinks: []int{2}},
+	}))
+	spans := []*trace.Span{
+		{ID: "a", Name: pointer.String("getUser"), LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String("api")}, Tags: map[string]string{"k": "v"}},
+		{ID: "b", Name: pointer.String("putUser"), LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String("api")}},
+		{ID: "c", Tags: map[string]string{"sampled": "no"}},
+	}
+	assert.NoError(t, demux.AddSpans(context.Background(), spans))
+	first := <-sinks[0].TracesChan
+	second := <-sinks[1].TracesChan
+	assert.Equal(t, []string{"a", "b"}, []string{first[0].ID, first[1].ID})
+	assert.Equal(t, []string{"a", "b"}, []string{second[0].ID, second[1].ID})
+	assert.Equal(t, []*trace.Span{spans[1]}, <-sinks[2].TracesChan)
+	// every sink but the last one gets copies so tags can be changed safely
+	first[0].Tags["k"] = "changed"
+	assert.Equal(t, "v", spans[0].Tags["k"])
+	assert.Equal(t, "v", second[0].Tags["k"])
+
+	// the last sink that gets anything is handed the original spans
+	assert.NoError(t, demux.AddSpans(context.Background(), spans[:1]))
+	<-sinks[0].TracesChan
+	assert.Equal(t, spans[:1], <-sinks[1].TracesChan)
+	assert.Len(t, sinks[2].TracesChan, 0)
+
+	assert.Equal(t, int64(2), stat(t, demux, "route.count", map[string]string{"route": "route_0", "type": "spans"}))
+	assert.Equal(t, int64(1), stat(t, demux, "route.count", map[string]string{"route": "route_1", "type": "spans"}))
+	assert.Equal(t, int64(1), stat(t, demux, "unrouted.count", map[string]string{"type": "spans"}))
+}
+
+func TestSetRoutesErrors(t *testing.T) {
+	demux := &Demultiplexer{
+		DatapointSinks: []dpsink.DSink{dptest.NewBasicSink()},
+		EventSinks:     []dpsink.ESink{dptest.NewBasicSink()},
+		TraceSinks:     []trace.Sink{dptest.NewBasicSink()},
+	}
+	for _, conf := range []*RouteConfig{
+		{MetricName: pointer.String("a"), MetricRegex: pointer.String("a")},
+		{MetricRegex: pointer.String("[")},
+		{DatapointSinks: []int{1}},
+		{EventSinks: []int{-1}},
+		{TraceSinks: []int{3}},
+	} {
+		assert.Error(t, demux.SetRoutes([]*RouteConfig{conf}))
+	}
+	assert.Len(t, demux.routes, 0)
+	assert.NoError(t, demux.SetRoutes(nil))
+	assert.Len(t, demux.Datapoints(), 0)
+}
@@ -0,0 +1,147 @@
+package filtering
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/signalfx/ingest-protocols/config/globbing"
+)
+
+// DimensionFilter matches the dimensions of datapoints and events or the tags of spans.  Exactly one of Exists,
+// Regex, Glob, Values, And, Or and Not must be set, and all but the last three need a Dimension to check.
+// Exists matches when the dimension is present (or absent when false), Regex, Glob and Values match its value
+// and And, Or and Not combine other filters.  Name is only used for the counters of top level filters.
+type DimensionFilter struct {
+	Name      *string            `json:",omitempty"`
+	Dimension *string            `json:",omitempty"`
+	Exists    *bool              `json:",omitempty"`
+	Regex     *string            `json:",omitempty"`
+	Glob      *string            `json:",omitempty"`
+	Values    []string           `json:",omitempty"`
+	And       []*DimensionFilter `json:",omitempty"`
+	Or        []*DimensionFilter `json:",omitempty"`
+	Not       *DimensionFilter   `json:",omitempty"`
+}
+
+type predicate func(dims map[string]string) bool
+
+type dimensionRule struct {
+	name    string
+	match   predicate
+	matches int64
+}
+
+func (d *DimensionFilter) set() int {
+	set := 0
+	for _, isSet := range []bool{d.Exists != nil, d.Regex != nil, d.Glob != nil, d.Values != nil, d.And != nil, d.Or != nil, d.Not != nil} {
+		if isSet {
+			set++
+		}
+	}
+	return set
+}
+
+func compileAll(filters []*DimensionFilter) ([]predicate, error) {
+	predicates := make([]predicate, 0, len(filters))
+	for _, filter := range filters {
+		p, err := compile(filter)
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, p)
+	}
+	return predicates, nil
+}
+
+func compileCombination(d *DimensionFilter) (predicate, error) {
+	if d.Not != nil {
+		p, err := compile(d.Not)
+		if err != nil {
+			return nil, err
+		}
+		return func(dims map[string]string) bool {
+			return !p(dims)
+		}, nil
+	}
+	all := d.And != nil
+	filters := d.Or
+	if all {
+		filters = d.And
+	}
+	predicates, err := compileAll(filters)
+	if err != nil {
+		return nil, err
+	}
+	return func(dims map[string]string) bool {
+		for _, p := range predicates {
+			if p(dims) != all {
+				return !all
+			}
+		}
+		return all
+	}, nil
+}
+
+func compileValue(key string, d *DimensionFilter) (predicate, error) {
+	var matches func(string) bool
+	switch {
+	case d.Regex != nil:
+		r, err := regexp.Compile(*d.Regex)
+		if err != nil {
+			return nil, err
+		}
+		matches = r.MatchString
+	case d.Glob != nil:
+		matches = globbing.GetGlob(*d.Glob).Match
+	default:
+		values := make(map[string]struct{}, len(d.Values))
+		for _, v := range d.Values {
+			values[v] = struct{}{}
+		}
+		matches = func(v string) bool {
+			_, exists := values[v]
+			return exists
+		}
+	}
+	return func(dims map[string]string) bool {
+		v, exists := dims[key]
+		return exists && matches(v)
+	}, nil
+}
+
+func compile(d *DimensionFilter) (predicate, error) {
+	if d == nil || d.set() != 1 {
+		return nil, fmt.Errorf("dimension filters need exactly one of Exists, Regex, Glob, Values, And, Or or Not")
+	}
+	if d.And != nil || d.Or != nil || d.Not != nil {
+		return compileCombination(d)
+	}
+	if d.Dimension == nil {
+		return nil, fmt.Errorf("dimension filters on values need a Dimension")
+	}
+	key := *d.Dimension
+	if d.Exists != nil {
+		exists := *d.Exists
+		return func(dims map[string]string) bool {
+			_, present := dims[key]
+			return present == exists
+		}, nil
+	}
+	return compileValue(key, d)
+}
+
+func compileRules(prefix string, filters []*DimensionFilter) ([]*dimensionRule, error) {
+	rules := make([]*dimensionRule, 0, len(filters))
+	for i, filter := range filters {
+		name := fmt.Sprintf("%s_%d", prefix, i)
+		if filter != nil && filter.Name != nil {
+			name = *filter.Name
+		}
+		p, err := compile(filter)
+		if err != nil {
+			return nil, fmt.Errorf("dimension filter %s: %s", name, err)
+		}
+		rules = append(rules, &dimensionRule{name: name, match: p})
+	}
+	return rules, nil
+}
@@ -0,0 +1,113 @@
+package filtering
+
+import (
+	"testing"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDimensionFilters(t *testing.T) {
+	dims := map[string]string{"env": "dev", "service": "api", "host": "web-1"}
+	matches := func(d *DimensionFilter) bool {
+		p, err := compile(d)
+		So(err, ShouldBeNil)
+		return p(dims)
+	}
+	Convey("single dimension filters should match values", t, func() {
+		So(matches(&DimensionFilter{Dimension: pointer.String("env"), Exists: pointer.Bool(true)}), ShouldBeTrue)
+		So(matches(&DimensionFilter{Dimension: pointer.String("env"), Exists: pointer.Bool(false)}), ShouldBeFalse)
+		So(matches(&DimensionFilter{Dimension: pointer.String("zone"), Exists: pointer.Bool(false)}), ShouldBeTrue)
+		So(matches(&DimensionFilter{Dimension: pointer.String("host"), Regex: pointer.String(`^web-\d+$`)}), ShouldBeTrue)
+		So(matches(&DimensionFilter{Dimension: pointer.String("host"), Glob: pointer.String("db-*")}), ShouldBeFalse)
+		So(matches(&DimensionFilter{Dimension: pointer.String("host"), Glob: pointer.String("web-*")}), ShouldBeTrue)
+		So(matches(&DimensionFilter{Dimension: pointer.String("service"), Values: []string{"api", "web"}}), ShouldBeTrue)
+		So(matches(&DimensionFilter{Dimension: pointer.String("service"), Values: []string{"db"}}), ShouldBeFalse)
+		So(matches(&DimensionFilter{Dimension: pointer.String("zone"), Values: []string{""}}), ShouldBeFalse)
+	})
+	Convey("filters should combine", t, func() {
+		env := &DimensionFilter{Dimension: pointer.String("env"), Values: []string{"dev"}}
+		db := &DimensionFilter{Dimension: pointer.String("service"), Values: []string{"db"}}
+		So(matches(&DimensionFilter{And: []*DimensionFilter{env, db}}), ShouldBeFalse)
+		So(matches(&DimensionFilter{Or: []*DimensionFilter{env, db}}), ShouldBeTrue)
+		So(matches(&DimensionFilter{Or: []*DimensionFilter{db}}), ShouldBeFalse)
+		So(matches(&DimensionFilter{And: []*DimensionFilter{env, {Not: db}}}), ShouldBeTrue)
+	})
+	Convey("bad filters should throw errors", t, func() {
+		for _, d := range []*DimensionFilter{
+			nil,
+			{},
+			{Dimension: pointer.String("a"), Exists: pointer.Bool(true), Values: []string{"a"}},
+			{Exists: pointer.Bool(true)},
+			{Dimension: pointer.String("a"), Regex: pointer.String("[")},
+			{Not: &DimensionFilter{}},
+			{And: []*DimensionFilter{{}}},
+		} {
+			_, err := compile(d)
+			So(err, ShouldNotBeNil)
+		}
+		forwarder := FilteredForwarder{}
+		So(forwarder.Setup(&FilterObj{AllowDimensions: []*DimensionFilter{{}}}), ShouldNotBeNil)
+		So(forwarder.Setup(&FilterObj{DenyDimensions: []*DimensionFilter{{Name: pointer.String("bad")}}}).Error(), ShouldContainSubstring, "bad")
+	})
+}
+
+func TestFilterDimensions(t *testing.T) {
+	Convey("deny dimension rules drop what they match", t, func() {
+		forwarder := FilteredForwarder{}
+		So(forwarder.Setup(&FilterObj{
+			Deny: []string{"^denied$"},
+			DenyDimensions: []*DimensionFilter{
+				{Name: pointer.String("dev"), Dimension: pointer.String("env"), Values: []string{"dev"}},
+				{Dimension: pointer.String("internal"), Exists: pointer.Bool(true)},
+			},
+		}), ShouldBeNil)
+		dev := dptest.DP()
+		dev.Dimensions = map[string]string{"env": "dev"}
+		prod := dptest.DP()
+		prod.Dimensions = map[string]string{"env": "prod"}
+		denied := dptest.DP()
+		denied.Metric = "denied"
+		So(forwarder.FilterDatapoints([]*datapoint.Datapoint{dev, prod, denied}), ShouldResemble, []*datapoint.Datapoint{prod})
+		So(forwarder.FilteredDatapoints, ShouldEqual, 2)
+
+		e := dptest.E()
+		e.Dimensions = map[string]string{"internal": "yes"}
+		So(forwarder.FilterEvents([]*event.Event{e, dptest.E()}), ShouldHaveLength, 1)
+		So(forwarder.FilteredEvents, ShouldEqual, 1)
+
+		spans := []*trace.Span{{Tags: map[string]string{"env": "dev"}}, {}}
+		So(forwarder.FilterSpans(spans), ShouldResemble, spans[1:])
+		So(forwarder.FilteredSpans, ShouldEqual, 1)
+
+		dps := forwarder.GetFilteredDatapoints()
+		So(dps, ShouldHaveLength, 5)
+		So(dptest.ExactlyOneDims(dps, "filtered_by_forwarder", map[string]string{"type": "event"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+		So(dptest.ExactlyOneDims(dps, "filter_rule_matches", map[string]string{"rule": "dev"}).Value, ShouldResemble, datapoint.NewIntValue(2))
+		So(dptest.ExactlyOneDims(dps, "filter_rule_matches", map[string]string{"rule": "deny_1"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+	})
+	Convey("allow dimension rules only keep what they match", t, func() {
+		forwarder := FilteredForwarder{}
+		So(forwarder.Setup(&FilterObj{
+			AllowDimensions: []*DimensionFilter{{Dimension: pointer.String("service"), Values: []string{"api", "web"}}},
+			DenyDimensions:  []*DimensionFilter{{Dimension: pointer.String("service"), Exists: pointer.Bool(true)}},
+		}), ShouldBeNil)
+		So(forwarder.FilterDimensions(map[string]string{"service": "api"}), ShouldBeTrue)
+		So(forwarder.FilterDimensions(map[string]string{"service": "db"}), ShouldBeFalse)
+		So(forwarder.FilterDimensions(nil), ShouldBeFalse)
+		So(dptest.ExactlyOneDims(forwarder.GetFilteredDatapoints(), "filter_rule_matches", map[string]string{"rule": "allow_0"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+	})
+	Convey("without dimension rules events and spans are untouched", t, func() {
+		forwarder := FilteredForwarder{}
+		So(forwarder.Setup(&FilterObj{Deny: []string{".*"}}), ShouldBeNil)
+		events := []*event.Event{dptest.E()}
+		So(forwarder.FilterEvents(events), ShouldResemble, events)
+		spans := []*trace.Span{{}}
+		So(forwarder.FilterSpans(spans), ShouldResemble, spans)
+		So(forwarder.GetFilteredDatapoints(), ShouldHaveLength, 1)
+	})
+}
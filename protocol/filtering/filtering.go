@@ -5,20 +5,29 @@ import (
 	"sync/atomic"
 
 	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
 	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
 )
 
 // FilteredForwarder is a struct to hold the filtering logic
 type FilteredForwarder struct {
 	allow              []*regexp.Regexp
 	deny               []*regexp.Regexp
+	allowDimensions    []*dimensionRule
+	denyDimensions     []*dimensionRule
 	FilteredDatapoints int64
+	FilteredEvents     int64
+	FilteredSpans      int64
 }
 
-// FilterObj contains the Allow and Deny objects
+// FilterObj contains the Allow and Deny objects.  Allow and Deny match metric names, while AllowDimensions and
+// DenyDimensions match the dimensions of datapoints and events or the tags of spans the same way.
 type FilterObj struct {
-	Allow []string `json:",omitempty"`
-	Deny  []string `json:",omitempty"`
+	Allow           []string           `json:",omitempty"`
+	Deny            []string           `json:",omitempty"`
+	AllowDimensions []*DimensionFilter `json:",omitempty"`
+	DenyDimensions  []*DimensionFilter `json:",omitempty"`
 }
 
 // Setup the FilteredForwarder based on the FilteredForwarderConfig
@@ -40,8 +49,18 @@ func (f *FilteredForwarder) Setup(filters *FilterObj) error {
 			}
 			denys[i] = rd
 		}
+		allowDimensions, err := compileRules("allow", filters.AllowDimensions)
+		if err != nil {
+			return err
+		}
+		denyDimensions, err := compileRules("deny", filters.DenyDimensions)
+		if err != nil {
+			return err
+		}
 		f.allow = allows
 		f.deny = denys
+		f.allowDimensions = allowDimensions
+		f.denyDimensions = denyDimensions
 	}
 	return nil
 }
@@ -67,13 +86,38 @@ func (f *FilteredForwarder) FilterMetricName(metricName string) bool {
 	return found || (len(f.allow) == 0 && !denied)
 }
 
-// FilterDatapoints filters datapoints based on the metric name as well as counts how many it filters
+// FilterDimensions returns true for dimensions which match an allow rule, or if no allow rules are present,
+// if they didn't match a deny rule.  Returns false otherwise.
+func (f *FilteredForwarder) FilterDimensions(dims map[string]string) bool {
+	for _, r := range f.allowDimensions {
+		if r.match(dims) {
+			atomic.AddInt64(&r.matches, 1)
+			return true
+		}
+	}
+	if len(f.allowDimensions) > 0 {
+		return false
+	}
+	for _, r := range f.denyDimensions {
+		if r.match(dims) {
+			atomic.AddInt64(&r.matches, 1)
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FilteredForwarder) hasDimensionRules() bool {
+	return len(f.allowDimensions) > 0 || len(f.denyDimensions) > 0
+}
+
+// FilterDatapoints filters datapoints based on the metric name and dimensions as well as counts how many it filters
 func (f *FilteredForwarder) FilterDatapoints(datapoints []*datapoint.Datapoint) []*datapoint.Datapoint {
 	// TODO use a sync.pool of buffers here
 	// TODO if we spun this off into several go routines instead of doing this in the main forwarder thread we could do a lot more work
 	validDatapoints := make([]*datapoint.Datapoint, 0, len(datapoints))
 	for _, d := range datapoints {
-		if f.FilterMetricName(d.Metric) {
+		if f.FilterMetricName(d.Metric) && f.FilterDimensions(d.Dimensions) {
 			validDatapoints = append(validDatapoints, d)
 		}
 	}
@@ -82,7 +126,51 @@ func (f *FilteredForwarder) FilterDatapoints(datapoints []*datapoint.Datapoint)
 	return validDatapoints
 }
 
-// GetFilteredDatapoints returns a cumulative counter of how many datapoints were filtered by this forwarder
+// FilterEvents filters events based on their dimensions as well as counts how many it filters
+func (f *FilteredForwarder) FilterEvents(events []*event.Event) []*event.Event {
+	if !f.hasDimensionRules() {
+		return events
+	}
+	validEvents := make([]*event.Event, 0, len(events))
+	for _, e := range events {
+		if f.FilterDimensions(e.Dimensions) {
+			validEvents = append(validEvents, e)
+		}
+	}
+	atomic.AddInt64(&f.FilteredEvents, int64(len(events)-len(validEvents)))
+	return validEvents
+}
+
+// FilterSpans filters spans based on their tags as well as counts how many it filters
+func (f *FilteredForwarder) FilterSpans(spans []*trace.Span) []*trace.Span {
+	if !f.hasDimensionRules() {
+		return spans
+	}
+	validSpans := make([]*trace.Span, 0, len(spans))
+	for _, s := range spans {
+		if f.FilterDimensions(s.Tags) {
+			validSpans = append(validSpans, s)
+		}
+	}
+	atomic.AddInt64(&f.FilteredSpans, int64(len(spans)-len(validSpans)))
+	return validSpans
+}
+
+// GetFilteredDatapoints returns a cumulative counter of how many datapoints were filtered by this forwarder, and
+// when there are dimension rules how many events and spans were filtered and how often each rule matched
 func (f *FilteredForwarder) GetFilteredDatapoints() []*datapoint.Datapoint {
-	return []*datapoint.Datapoint{sfxclient.Cumulative("filtered_by_forwarder", nil, atomic.LoadInt64(&f.FilteredDatapoints))}
+	dps := []*datapoint.Datapoint{sfxclient.Cumulative("filtered_by_forwarder", nil, atomic.LoadInt64(&f.FilteredDatapoints))}
+	if !f.hasDimensionRules() {
+		return dps
+	}
+	dps = append(dps,
+		sfxclient.Cumulative("filtered_by_forwarder", map[string]string{"type": "event"}, atomic.LoadInt64(&f.FilteredEvents)),
+		sfxclient.Cumulative("filtered_by_forwarder", map[string]string{"type": "spans"}, atomic.LoadInt64(&f.FilteredSpans)),
+	)
+	for _, rules := range [][]*dimensionRule{f.allowDimensions, f.denyDimensions} {
+		for _, r := range rules {
+			dps = append(dps, sfxclient.Cumulative("filter_rule_matches", map[string]string{"rule": r.name}, atomic.LoadInt64(&r.matches)))
+		}
+	}
+	return dps
 }
@@ -0,0 +1,218 @@
+package influx
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/errors"
+)
+
+type fieldKind int
+
+const (
+	floatField fieldKind = iota
+	intField
+	boolField
+	stringField
+)
+
+// field is a single field of a line, with the value already converted unless it is a string
+type field struct {
+	key   string
+	kind  fieldKind
+	value datapoint.Value
+}
+
+// point is a single parsed line of influx line protocol
+type point struct {
+	measurement  string
+	tags         map[string]string
+	fields       []field
+	timestamp    int64
+	hasTimestamp bool
+}
+
+var (
+	errMissingFields    = errors.New("line has no fields")
+	errMissingMeasure   = errors.New("line has no measurement")
+	errInvalidTag       = errors.New("invalid tag")
+	errInvalidField     = errors.New("invalid field")
+	errInvalidTimestamp = errors.New("invalid timestamp")
+	errInvalidPrecision = errors.New("invalid precision")
+	errTimestampRange   = errors.New("timestamp out of range")
+)
+
+// precisions maps the values accepted by the v1 and v2 write endpoints' precision parameter
+var precisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+func getPrecision(precision string) (time.Duration, error) {
+	if p, exists := precisions[precision]; exists {
+		return p, nil
+	}
+	return 0, errInvalidPrecision
+}
+
+// indexUnescaped returns the index of the first sep in s that is not escaped with a backslash and,
+// if quoted is set, not inside a double quoted string
+func indexUnescaped(s string, sep byte, quoted bool) int {
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuote = !inQuote
+		case s[i] == sep && !inQuote:
+			return i
+		}
+	}
+	return -1
+}
+
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, sep, quoted)
+		if i == -1 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// unescape removes the backslashes line protocol uses to escape commas, equals signs and spaces
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', '=', ' ':
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseLine parses a single line of the form
+//
+//	<measurement>[,<tag>=<value>...] <field>=<value>[,<field>=<value>...] [timestamp]
+func parseLine(line string) (*point, error) {
+	end := indexUnescaped(line, ' ', false)
+	if end == -1 {
+		return nil, errMissingFields
+	}
+	key, rest := line[:end], strings.TrimLeft(line[end+1:], " ")
+	p := &point{}
+	parts := splitUnescaped(key, ',', false)
+	p.measurement = unescape(parts[0])
+	if p.measurement == "" {
+		return nil, errMissingMeasure
+	}
+	if len(parts) > 1 {
+		p.tags = make(map[string]string, len(parts)-1)
+		for _, tag := range parts[1:] {
+			eq := indexUnescaped(tag, '=', false)
+			if eq <= 0 || eq == len(tag)-1 {
+				return nil, errors.Annotatef(errInvalidTag, "tag %q", tag)
+			}
+			p.tags[unescape(tag[:eq])] = unescape(tag[eq+1:])
+		}
+	}
+
+	end = indexUnescaped(rest, ' ', true)
+	fields := rest
+	if end != -1 {
+		fields = rest[:end]
+		if ts := strings.TrimSpace(rest[end+1:]); ts != "" {
+			t, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return nil, errors.Annotatef(errInvalidTimestamp, "timestamp %q", ts)
+			}
+			p.timestamp = t
+			p.hasTimestamp = true
+		}
+	}
+	if fields == "" {
+		return nil, errMissingFields
+	}
+	for _, f := range splitUnescaped(fields, ',', true) {
+		parsed, err := parseField(f)
+		if err != nil {
+			return nil, err
+		}
+		p.fields = append(p.fields, parsed)
+	}
+	return p, nil
+}
+
+func parseField(f string) (field, error) {
+	eq := indexUnescaped(f, '=', false)
+	if eq <= 0 || eq == len(f)-1 {
+		return field{}, errors.Annotatef(errInvalidField, "field %q", f)
+	}
+	ret := field{key: unescape(f[:eq])}
+	raw := f[eq+1:]
+	switch {
+	case raw[0] == '"':
+		if len(raw) < 2 || raw[len(raw)-1] != '"' {
+			return field{}, errors.Annotatef(errInvalidField, "field %q", f)
+		}
+		ret.kind = stringField
+	case raw[len(raw)-1] == 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return field{}, errors.Annotatef(errInvalidField, "field %q", f)
+		}
+		ret.kind = intField
+		ret.value = datapoint.NewIntValue(v)
+	case raw[len(raw)-1] == 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 63)
+		if err != nil {
+			return field{}, errors.Annotatef(errInvalidField, "field %q", f)
+		}
+		ret.kind = intField
+		ret.value = datapoint.NewIntValue(int64(v))
+	default:
+		if b, isBool := parseBool(raw); isBool {
+			ret.kind = boolField
+			ret.value = datapoint.NewIntValue(b)
+			break
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return field{}, errors.Annotatef(errInvalidField, "field %q", f)
+		}
+		ret.kind = floatField
+		ret.value = datapoint.NewFloatValue(v)
+	}
+	return ret, nil
+}
+
+// parseBool accepts the boolean spellings allowed by line protocol and returns them as 1 or 0
+func parseBool(s string) (int64, bool) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true
+	}
+	return 0, false
+}
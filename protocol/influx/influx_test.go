@@ -0,0 +1,123 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+var influxTestCases = []struct {
+	in          string
+	measurement string
+	tags        map[string]string
+	fields      []field
+	timestamp   int64
+	shouldErr   error
+}{
+	{
+		in:          "cpu usage_idle=98.5",
+		measurement: "cpu",
+		fields:      []field{{key: "usage_idle", kind: floatField, value: datapoint.NewFloatValue(98.5)}},
+	},
+	{
+		in:          "cpu,host=a,cpu=cpu0 usage_idle=98.5,usage_user=1i 1465839830100400200",
+		measurement: "cpu",
+		tags:        map[string]string{"host": "a", "cpu": "cpu0"},
+		fields: []field{
+			{key: "usage_idle", kind: floatField, value: datapoint.NewFloatValue(98.5)},
+			{key: "usage_user", kind: intField, value: datapoint.NewIntValue(1)},
+		},
+		timestamp: 1465839830100400200,
+	},
+	{
+		in:          `disk\ io,path=C:\\,name=a\,b\=c\ d reads=3u,up=t,down=FALSE,msg="hello, world" 10`,
+		measurement: "disk io",
+		tags:        map[string]string{"path": `C:\\`, "name": "a,b=c d"},
+		fields: []field{
+			{key: "reads", kind: intField, value: datapoint.NewIntValue(3)},
+			{key: "up", kind: boolField, value: datapoint.NewIntValue(1)},
+			{key: "down", kind: boolField, value: datapoint.NewIntValue(0)},
+			{key: "msg", kind: stringField},
+		},
+		timestamp: 10,
+	},
+	{
+		in:        "cpu",
+		shouldErr: errMissingFields,
+	},
+	{
+		in:        ",host=a value=1",
+		shouldErr: errMissingMeasure,
+	},
+	{
+		in:        "cpu  ",
+		shouldErr: errMissingFields,
+	},
+	{
+		in:        "cpu,host value=1",
+		shouldErr: errInvalidTag,
+	},
+	{
+		in:        "cpu,host= value=1",
+		shouldErr: errInvalidTag,
+	},
+	{
+		in:        "cpu value=1 bob",
+		shouldErr: errInvalidTimestamp,
+	},
+	{
+		in:        "cpu value=",
+		shouldErr: errInvalidField,
+	},
+	{
+		in:        "cpu value=bob",
+		shouldErr: errInvalidField,
+	},
+	{
+		in:        "cpu value=1.5i",
+		shouldErr: errInvalidField,
+	},
+	{
+		in:        "cpu value=-1u",
+		shouldErr: errInvalidField,
+	},
+	{
+		in:        `cpu value="unterminated`,
+		shouldErr: errInvalidField,
+	},
+}
+
+func TestParseLine(t *testing.T) {
+	for _, c := range influxTestCases {
+		p, err := parseLine(c.in)
+		if c.shouldErr != nil {
+			assert.Equal(t, c.shouldErr, errors.Tail(err), c.in)
+			continue
+		}
+		assert.NoError(t, err, c.in)
+		assert.Equal(t, c.measurement, p.measurement, c.in)
+		assert.Equal(t, c.tags, p.tags, c.in)
+		assert.Equal(t, c.fields, p.fields, c.in)
+		assert.Equal(t, c.timestamp, p.timestamp, c.in)
+		assert.Equal(t, c.timestamp != 0, p.hasTimestamp, c.in)
+	}
+}
+
+func TestGetPrecision(t *testing.T) {
+	for in, expected := range map[string]time.Duration{"": time.Nanosecond, "u": time.Microsecond, "ms": time.Millisecond, "s": time.Second, "h": time.Hour} {
+		p, err := getPrecision(in)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, p)
+	}
+	_, err := getPrecision("fortnight")
+	assert.Equal(t, errInvalidPrecision, err)
+}
+
+func TestUnescape(t *testing.T) {
+	assert.Equal(t, "a,b c=d", unescape(`a\,b\ c\=d`))
+	assert.Equal(t, `a\b`, unescape(`a\b`))
+	assert.Equal(t, `a\`, unescape(`a\`))
+}
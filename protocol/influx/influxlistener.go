@@ -0,0 +1,249 @@
+package influx
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/errors"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/signalfx/ingest-protocols/logkey"
+	"github.com/signalfx/ingest-protocols/protocol"
+	"github.com/signalfx/ingest-protocols/protocol/zipper"
+)
+
+// ListenerServer will listen for influx line protocol writes
+type ListenerServer struct {
+	protocol.CloseableHealthCheck
+	listener  net.Listener
+	server    http.Server
+	decoder   *LineDecoder
+	collector sfxclient.Collector
+}
+
+var _ protocol.Listener = &ListenerServer{}
+
+// Close the socket currently open for influx connections
+func (s *ListenerServer) Close() error {
+	return s.listener.Close()
+}
+
+// DebugDatapoints returns datapoints that are used for debugging the listener
+func (s *ListenerServer) DebugDatapoints() []*datapoint.Datapoint {
+	return append(s.collector.Datapoints(), s.HealthDatapoints()...)
+}
+
+// DefaultDatapoints returns datapoints that should always be reported from the listener
+func (s *ListenerServer) DefaultDatapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{}
+}
+
+// Datapoints returns decoder datapoints
+func (s *ListenerServer) Datapoints() []*datapoint.Datapoint {
+	return append(s.DebugDatapoints(), s.DefaultDatapoints()...)
+}
+
+// LineDecoder decodes influx line protocol into datapoints.  Each field of a line becomes a datapoint
+// named <measurement>.<field> with the line's tags as dimensions.
+type LineDecoder struct {
+	SendTo dpsink.Sink
+	Logger log.Logger
+
+	TotalErrors         int64
+	TotalMalformedLines int64
+	TotalTypeConflicts  int64
+	TotalSkippedFields  int64
+}
+
+func writeError(rw http.ResponseWriter, code int, msg string) error {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	return json.NewEncoder(rw).Encode(map[string]string{"error": msg})
+}
+
+// ServeHTTPC decodes datapoints for the connection and sends them to the decoder's sink.  Like influx,
+// valid lines are written even when some lines are malformed, in which case a 400 is returned.
+func (decoder *LineDecoder) ServeHTTPC(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
+	precision, err := getPrecision(req.URL.Query().Get("precision"))
+	if err != nil {
+		atomic.AddInt64(&decoder.TotalErrors, 1)
+		log.IfErr(decoder.Logger, writeError(rw, http.StatusBadRequest, err.Error()))
+		return
+	}
+	dps, malformed, err := decoder.read(req.Body, precision, time.Now())
+	if err == nil && len(dps) > 0 {
+		err = decoder.SendTo.AddDatapoints(ctx, dps)
+	}
+	if err != nil {
+		atomic.AddInt64(&decoder.TotalErrors, 1)
+		log.IfErr(decoder.Logger, writeError(rw, http.StatusInternalServerError, err.Error()))
+		return
+	}
+	if len(malformed) > 0 {
+		log.IfErr(decoder.Logger, writeError(rw, http.StatusBadRequest, "partial write: "+malformed[0]))
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// read returns the datapoints of every valid line along with a description of each malformed line
+func (decoder *LineDecoder) read(body io.Reader, precision time.Duration, now time.Time) ([]*datapoint.Datapoint, []string, error) {
+	var malformed []string
+	// a metric name must keep the same field type within a write, otherwise the field is dropped
+	kinds := make(map[string]fieldKind)
+	dps := make([]*datapoint.Datapoint, 0)
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			p, perr := parseLine(line)
+			var timestamp time.Time
+			if perr == nil {
+				timestamp, perr = pointTime(p, precision, now)
+			}
+			if perr != nil {
+				atomic.AddInt64(&decoder.TotalMalformedLines, 1)
+				decoder.Logger.Log(logkey.InfluxLine, line, log.Err, perr, "Unable to parse influx line")
+				malformed = append(malformed, fmt.Sprintf("unable to parse '%s': %s", line, perr.Error()))
+			} else {
+				dps = decoder.appendDatapoints(dps, p, kinds, timestamp)
+			}
+		}
+		if err == io.EOF {
+			return dps, malformed, nil
+		}
+	}
+}
+
+// pointTime converts the timestamp of a point from precision units, rejecting ones that do not fit in int64 nanoseconds
+func pointTime(p *point, precision time.Duration, now time.Time) (time.Time, error) {
+	if !p.hasTimestamp {
+		return now, nil
+	}
+	limit := math.MaxInt64 / int64(precision)
+	if p.timestamp > limit || p.timestamp < -limit {
+		return time.Time{}, errors.Annotatef(errTimestampRange, "timestamp %d", p.timestamp)
+	}
+	return time.Unix(0, p.timestamp*int64(precision)), nil
+}
+
+func (decoder *LineDecoder) appendDatapoints(dps []*datapoint.Datapoint, p *point, kinds map[string]fieldKind, timestamp time.Time) []*datapoint.Datapoint {
+	for _, f := range p.fields {
+		if f.kind == stringField {
+			atomic.AddInt64(&decoder.TotalSkippedFields, 1)
+			continue
+		}
+		metricName := p.measurement + "." + f.key
+		if kind, exists := kinds[metricName]; exists && kind != f.kind {
+			atomic.AddInt64(&decoder.TotalTypeConflicts, 1)
+			continue
+		}
+		kinds[metricName] = f.kind
+		// every field gets its own copy of the tags, so later sinks can change one datapoint's dimensions
+		dims := make(map[string]string, len(p.tags))
+		for k, v := range p.tags {
+			dims[k] = v
+		}
+		dps = append(dps, datapoint.New(metricName, dims, f.value, datapoint.Gauge, timestamp))
+	}
+	return dps
+}
+
+// Datapoints about this decoder, including how many lines it could not decode
+func (decoder *LineDecoder) Datapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.Cumulative("influx.invalid_requests", nil, atomic.LoadInt64(&decoder.TotalErrors)),
+		sfxclient.Cumulative("influx.malformed_lines", nil, atomic.LoadInt64(&decoder.TotalMalformedLines)),
+		sfxclient.Cumulative("influx.type_conflicts", nil, atomic.LoadInt64(&decoder.TotalTypeConflicts)),
+		sfxclient.Cumulative("influx.skipped_string_fields", nil, atomic.LoadInt64(&decoder.TotalSkippedFields)),
+	}
+}
+
+// ListenerConfig controls optional parameters for influx listeners
+type ListenerConfig struct {
+	ListenAddr      *string
+	Timeout         *time.Duration
+	StartingContext context.Context
+	HealthCheck     *string
+	HTTPChain       web.NextConstructor
+	Logger          log.Logger
+}
+
+var defaultListenerConfig = &ListenerConfig{
+	ListenAddr:      pointer.String("127.0.0.1:8086"),
+	Timeout:         pointer.Duration(time.Second * 30),
+	HealthCheck:     pointer.String("/healthz"),
+	Logger:          log.Discard,
+	StartingContext: context.Background(),
+}
+
+// NewListener serves http influx line protocol requests
+func NewListener(sink dpsink.Sink, passedConf *ListenerConfig) (*ListenerServer, error) {
+	zippers := zipper.NewZipper()
+	conf := pointer.FillDefaultFrom(passedConf, defaultListenerConfig).(*ListenerConfig)
+
+	listener, err := net.Listen("tcp", *conf.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := mux.NewRouter()
+	metricTracking := &web.RequestCounter{}
+	fullHandler := web.NewHandler(conf.StartingContext, web.FromHTTP(r))
+	if conf.HTTPChain != nil {
+		fullHandler.Add(web.NextHTTP(metricTracking.ServeHTTP))
+		fullHandler.Add(conf.HTTPChain)
+	}
+	decoder := LineDecoder{
+		SendTo: sink,
+		Logger: log.NewContext(conf.Logger).With(logkey.Protocol, "influx", logkey.Direction, "listener"),
+	}
+	listenServer := ListenerServer{
+		listener: listener,
+		server: http.Server{
+			Handler:      fullHandler,
+			Addr:         listener.Addr().String(),
+			ReadTimeout:  *conf.Timeout,
+			WriteTimeout: *conf.Timeout,
+		},
+		decoder: &decoder,
+		collector: sfxclient.NewMultiCollector(
+			metricTracking,
+			&decoder,
+			zippers,
+		),
+	}
+	listenServer.SetupHealthCheck(conf.HealthCheck, r, conf.Logger)
+	httpHandler := web.NewHandler(conf.StartingContext, listenServer.decoder)
+	SetupInfluxPaths(r, zippers.GzipHandler(httpHandler))
+
+	go func() {
+		log.IfErr(conf.Logger, listenServer.server.Serve(listener))
+	}()
+	return &listenServer, nil
+}
+
+// SetupInfluxPaths tells the router which paths the given handler (which should handle influx line
+// protocol) should see
+func SetupInfluxPaths(r *mux.Router, handler http.Handler) {
+	r.Path("/write").Methods("POST").Handler(handler)
+	r.Path("/api/v2/write").Methods("POST").Handler(handler)
+}
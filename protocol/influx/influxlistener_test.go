@@ -0,0 +1,159 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/web"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("nope")
+}
+
+func TestInfluxListener(t *testing.T) {
+	Convey("invalid listener host should fail to connect", t, func() {
+		conf := &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:99999999r"),
+		}
+		_, err := NewListener(dptest.NewBasicSink(), conf)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("a basic influx listener", t, func() {
+		callCount := int64(0)
+		conf := &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:0"),
+			HTTPChain: func(ctx context.Context, rw http.ResponseWriter, r *http.Request, next web.ContextHandler) {
+				atomic.AddInt64(&callCount, 1)
+				next.ServeHTTPC(ctx, rw, r)
+			},
+		}
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(10)
+		listener, err := NewListener(sendTo, conf)
+		So(err, ShouldBeNil)
+		client := &http.Client{}
+		post := func(path string, body string, gzipped bool) (*http.Response, string) {
+			var b bytes.Buffer
+			if gzipped {
+				w := gzip.NewWriter(&b)
+				_, err := w.Write([]byte(body))
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+			} else {
+				b.WriteString(body)
+			}
+			req, err := http.NewRequest("POST", fmt.Sprintf("http://%s%s", listener.server.Addr, path), &b)
+			So(err, ShouldBeNil)
+			req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+			if gzipped {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			resp, err := client.Do(req)
+			So(err, ShouldBeNil)
+			respBody, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			return resp, string(respBody)
+		}
+		Convey("Should expose health check", func() {
+			resp, err := client.Get(fmt.Sprintf("http://%s/healthz", listener.server.Addr))
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(atomic.LoadInt64(&callCount), ShouldEqual, 1)
+		})
+		Convey("Should accept v1 writes", func() {
+			resp, _ := post("/write?db=telegraf&precision=s", "cpu,host=a usage_idle=98.5,usage_user=1i 1465839830\n\n# comment\nmem used=3i\n", false)
+			So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+			dps := <-sendTo.PointsChan
+			So(len(dps), ShouldEqual, 3)
+			So(dps[0].Metric, ShouldEqual, "cpu.usage_idle")
+			So(dps[0].Dimensions, ShouldResemble, map[string]string{"host": "a"})
+			So(dps[0].Value, ShouldResemble, datapoint.NewFloatValue(98.5))
+			So(dps[0].MetricType, ShouldEqual, datapoint.Gauge)
+			So(dps[0].Timestamp, ShouldResemble, time.Unix(1465839830, 0))
+			So(dps[1].Metric, ShouldEqual, "cpu.usage_user")
+			So(dps[1].Value, ShouldResemble, datapoint.NewIntValue(1))
+			// every datapoint should have its own dimensions
+			dps[0].Dimensions["host"] = "changed"
+			So(dps[1].Dimensions, ShouldResemble, map[string]string{"host": "a"})
+			So(dps[2].Metric, ShouldEqual, "mem.used")
+			So(time.Since(dps[2].Timestamp), ShouldBeLessThan, time.Minute)
+		})
+		Convey("Should accept gzipped v2 writes", func() {
+			resp, _ := post("/api/v2/write?org=o&bucket=b&precision=ms", "cpu usage_idle=98.5 1465839830100", true)
+			So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+			dp := sendTo.Next()
+			So(dp.Metric, ShouldEqual, "cpu.usage_idle")
+			So(dp.Timestamp, ShouldResemble, time.Unix(1465839830, int64(100*time.Millisecond)))
+		})
+		Convey("Should reject invalid precisions", func() {
+			resp, body := post("/write?precision=fortnight", "cpu usage_idle=98.5", false)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(body, ShouldContainSubstring, "invalid precision")
+			So(dptest.ExactlyOne(listener.DebugDatapoints(), "influx.invalid_requests").Value.String(), ShouldEqual, "1")
+		})
+		Convey("Should reject timestamps that overflow at the given precision", func() {
+			resp, body := post("/write?precision=s", "cpu usage_idle=98.5 9223372036854775\ncpu usage_idle=1 1465839830", false)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(body, ShouldContainSubstring, "timestamp out of range")
+			dp := sendTo.Next()
+			So(dp.Timestamp, ShouldResemble, time.Unix(1465839830, 0))
+			So(dptest.ExactlyOne(listener.DebugDatapoints(), "influx.malformed_lines").Value.String(), ShouldEqual, "1")
+		})
+		Convey("Should write valid lines and report malformed ones", func() {
+			resp, body := post("/write", "cpu usage_idle=98.5\nbad\ncpu usage_idle=1i\ncpu msg=\"hi\"", false)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(body, ShouldContainSubstring, "partial write: unable to parse 'bad'")
+			dp := sendTo.Next()
+			So(dp.Metric, ShouldEqual, "cpu.usage_idle")
+			dps := listener.DebugDatapoints()
+			So(dptest.ExactlyOne(dps, "influx.malformed_lines").Value.String(), ShouldEqual, "1")
+			So(dptest.ExactlyOne(dps, "influx.type_conflicts").Value.String(), ShouldEqual, "1")
+			So(dptest.ExactlyOne(dps, "influx.skipped_string_fields").Value.String(), ShouldEqual, "1")
+		})
+		Convey("Should return sink errors", func() {
+			sendTo.RetError(errors.New("nope"))
+			resp, body := post("/write", "cpu usage_idle=98.5", false)
+			So(resp.StatusCode, ShouldEqual, http.StatusInternalServerError)
+			So(body, ShouldContainSubstring, "nope")
+		})
+		Convey("Should only accept known paths", func() {
+			resp, _ := post("/query", "cpu usage_idle=98.5", false)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Should have the default datapoints", func() {
+			So(listener.DefaultDatapoints(), ShouldBeEmpty)
+			So(len(listener.Datapoints()), ShouldEqual, len(listener.DebugDatapoints()))
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func TestLineDecoderReadError(t *testing.T) {
+	Convey("body read errors are returned", t, func() {
+		decoder := &LineDecoder{}
+		_, _, err := decoder.read(errReader{}, time.Nanosecond, time.Now())
+		So(err, ShouldNotBeNil)
+		_, _, err = decoder.read(strings.NewReader(""), time.Nanosecond, time.Now())
+		So(err, ShouldBeNil)
+	})
+}
@@ -0,0 +1,366 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/signalfx/golib/v3/datapoint"
+)
+
+// The labels that split histograms into buckets and summaries into quantiles
+const (
+	bucketLabel   = "le"
+	quantileLabel = "quantile"
+)
+
+// metricType is the type of a metric family in remote write metadata
+type metricType int32
+
+// The metric types of remote write metadata
+const (
+	_ metricType = iota
+	typeCounter
+	typeGauge
+	typeHistogram
+	typeGaugeHistogram
+	typeSummary
+	typeInfo
+	typeStateset
+)
+
+// metricMetadata is the MetricMetadata message of remote write requests, which is newer than the prompb in use
+type metricMetadata struct {
+	Type             metricType `protobuf:"varint,1,opt,name=type,proto3"`
+	MetricFamilyName string     `protobuf:"bytes,2,opt,name=metric_family_name,proto3"`
+	Help             string     `protobuf:"bytes,4,opt,name=help,proto3"`
+	Unit             string     `protobuf:"bytes,5,opt,name=unit,proto3"`
+}
+
+func (m *metricMetadata) Reset()         { *m = metricMetadata{} }
+func (m *metricMetadata) String() string { return proto.CompactTextString(m) }
+func (*metricMetadata) ProtoMessage()    {}
+
+// writeRequestMetadata decodes only the metadata of a remote write request
+type writeRequestMetadata struct {
+	Metadata []*metricMetadata `protobuf:"bytes,3,rep,name=metadata,proto3"`
+}
+
+func (m *writeRequestMetadata) Reset()         { *m = writeRequestMetadata{} }
+func (m *writeRequestMetadata) String() string { return proto.CompactTextString(m) }
+func (*writeRequestMetadata) ProtoMessage()    {}
+
+// getMetadata returns the type of each metric family in the metadata of a remote write request
+func getMetadata(reqBuf []byte) (map[string]metricType, error) {
+	var r writeRequestMetadata
+	if err := proto.Unmarshal(reqBuf, &r); err != nil {
+		return nil, err
+	}
+	types := make(map[string]metricType, len(r.Metadata))
+	for _, m := range r.Metadata {
+		types[m.MetricFamilyName] = m.Type
+	}
+	return types, nil
+}
+
+func isHistogram(t metricType) bool {
+	return t == typeHistogram || t == typeGaugeHistogram
+}
+
+// typeOf is the datapoint type of a series that is not part of a histogram or summary, from its metadata if it has any
+func typeOf(metric string, types map[string]metricType) datapoint.MetricType {
+	t, exists := types[metric]
+	if !exists {
+		t = types[strings.TrimSuffix(metric, "_total")]
+	}
+	switch t {
+	case typeCounter:
+		return datapoint.Counter
+	case typeGauge, typeInfo, typeStateset:
+		return datapoint.Gauge
+	}
+	return getMetricType(metric)
+}
+
+// parseBound parses an le or quantile label, and formats it the same way whichever way it was written
+func parseBound(label string) (float64, string, error) {
+	v, err := strconv.ParseFloat(label, 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, "", fmt.Errorf("invalid bound %q", label)
+	}
+	return v, formatBound(v), nil
+}
+
+func formatBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type bucket struct {
+	bound float64
+	count float64
+}
+
+// bucketQuantile estimates quantile q from cumulative buckets sorted by bound, the same way histogram_quantile does
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].bound, 1) {
+		return math.NaN()
+	}
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].bound
+	}
+	if b == 0 && buckets[0].bound <= 0 {
+		return buckets[0].bound
+	}
+	start, count := 0.0, buckets[b].count
+	if b > 0 {
+		start = buckets[b-1].bound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return start + (buckets[b].bound-start)*(rank/count)
+}
+
+// family is a histogram or summary at one timestamp, built from the series that share its labels
+type family struct {
+	name      string
+	summary   bool
+	dims      map[string]string
+	timestamp time.Time
+	bounds    map[string]*bucket
+	sum       *float64
+	count     *float64
+}
+
+func (f *family) sortedBuckets() []bucket {
+	buckets := make([]bucket, 0, len(f.bounds)+1)
+	for _, b := range f.bounds {
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+	if f.summary {
+		return buckets
+	}
+	// buckets are cumulative, so any that go down are from series scraped at slightly different times
+	for i := 1; i < len(buckets); i++ {
+		buckets[i].count = math.Max(buckets[i].count, buckets[i-1].count)
+	}
+	if f.count != nil && (len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].bound, 1)) {
+		buckets = append(buckets, bucket{bound: math.Inf(1), count: *f.count})
+	}
+	return buckets
+}
+
+// copyDims returns a copy of the family's dimensions, since sinks further down may change a datapoint's dimensions
+func (f *family) copyDims() map[string]string {
+	dims := make(map[string]string, len(f.dims))
+	for k, v := range f.dims {
+		dims[k] = v
+	}
+	return dims
+}
+
+func (f *family) datapoints(percentiles []float64) []*datapoint.Datapoint {
+	buckets := f.sortedBuckets()
+	dps := make([]*datapoint.Datapoint, 0, len(buckets)+len(percentiles)+2)
+	if f.sum != nil {
+		dps = append(dps, datapoint.New(f.name+"_sum", f.copyDims(), newValue(*f.sum), datapoint.Gauge, f.timestamp))
+	}
+	if f.count != nil {
+		dps = append(dps, datapoint.New(f.name+"_count", f.copyDims(), newValue(*f.count), datapoint.Counter, f.timestamp))
+	}
+	if f.summary {
+		for _, b := range buckets {
+			dims := datapoint.AddMaps(f.dims, map[string]string{quantileLabel: formatBound(b.bound)})
+			dps = append(dps, datapoint.New(f.name, dims, newValue(b.count), datapoint.Gauge, f.timestamp))
+		}
+		return dps
+	}
+	for _, b := range buckets {
+		dims := datapoint.AddMaps(f.dims, map[string]string{bucketLabel: formatBound(b.bound)})
+		dps = append(dps, datapoint.New(f.name+"_bucket", dims, newValue(b.count), datapoint.Counter, f.timestamp))
+	}
+	for _, p := range percentiles {
+		if v := bucketQuantile(p, buckets); !math.IsNaN(v) {
+			dims := datapoint.AddMaps(f.dims, map[string]string{quantileLabel: formatBound(p)})
+			dps = append(dps, datapoint.New(f.name, dims, newValue(v), datapoint.Gauge, f.timestamp))
+		}
+	}
+	return dps
+}
+
+// The parts of a histogram or summary a series can be
+const (
+	partNone = iota
+	partBucket
+	partQuantile
+	partSum
+	partCount
+)
+
+// histogramBuilder groups the series of one request into histograms and summaries
+type histogramBuilder struct {
+	types map[string]metricType
+	// families are the names of the histograms and summaries in the request, and whether they are summaries
+	families map[string]bool
+	grouped  map[string]*family
+	order    []*family
+}
+
+func newHistogramBuilder(types map[string]metricType) *histogramBuilder {
+	h := &histogramBuilder{types: types, families: make(map[string]bool), grouped: make(map[string]*family)}
+	for name, t := range types {
+		if isHistogram(t) || t == typeSummary {
+			h.families[name] = t == typeSummary
+		}
+	}
+	return h
+}
+
+// addFamily records that a series without metadata is part of a histogram or summary because of its le or quantile
+// label
+func (h *histogramBuilder) addFamily(metric string, dims map[string]string) {
+	if base := strings.TrimSuffix(metric, "_bucket"); base != metric && dims[bucketLabel] != "" {
+		if t, exists := h.types[base]; !exists || isHistogram(t) {
+			h.families[base] = false
+		}
+		return
+	}
+	if _, exists := h.types[metric]; !exists && dims[quantileLabel] != "" {
+		h.families[metric] = true
+	}
+}
+
+// partOf returns the histogram or summary a series is part of, and which part it is
+func (h *histogramBuilder) partOf(metric string, dims map[string]string) (string, int) {
+	if summary, exists := h.families[metric]; exists && summary && dims[quantileLabel] != "" {
+		return metric, partQuantile
+	}
+	for suffix, part := range map[string]int{"_bucket": partBucket, "_sum": partSum, "_count": partCount} {
+		base := strings.TrimSuffix(metric, suffix)
+		if summary, exists := h.families[base]; base != metric && exists && (part != partBucket || (!summary && dims[bucketLabel] != "")) {
+			return base, part
+		}
+	}
+	return "", partNone
+}
+
+func (h *histogramBuilder) family(name string, dims map[string]string, timestamp int64) *family {
+	labels := make([]string, 0, len(dims))
+	for k, v := range dims {
+		if k != bucketLabel && k != quantileLabel {
+			labels = append(labels, k+"="+v)
+		}
+	}
+	sort.Strings(labels)
+	key := fmt.Sprintf("%s\x00%d\x00%s", name, timestamp, strings.Join(labels, "\x00"))
+	f, exists := h.grouped[key]
+	if !exists {
+		familyDims := make(map[string]string, len(dims))
+		for k, v := range dims {
+			if k != bucketLabel && k != quantileLabel {
+				familyDims[k] = v
+			}
+		}
+		f = &family{
+			name:      name,
+			summary:   h.families[name],
+			dims:      familyDims,
+			timestamp: time.Unix(0, int64(time.Millisecond)*timestamp),
+			bounds:    make(map[string]*bucket),
+		}
+		h.grouped[key] = f
+		h.order = append(h.order, f)
+	}
+	return f
+}
+
+// add puts the value of one sample into its histogram or summary, returning an error if its le or quantile is invalid
+func (h *histogramBuilder) add(name string, part int, dims map[string]string, s prompb.Sample) error {
+	f := h.family(name, dims, s.Timestamp)
+	value := s.Value
+	switch part {
+	case partSum:
+		f.sum = &value
+	case partCount:
+		f.count = &value
+	default:
+		label := bucketLabel
+		if part == partQuantile {
+			label = quantileLabel
+		}
+		bound, formatted, err := parseBound(dims[label])
+		if err != nil {
+			return err
+		}
+		f.bounds[formatted] = &bucket{bound: bound, count: value}
+	}
+	return nil
+}
+
+type parsedSeries struct {
+	metric string
+	dims   map[string]string
+	ts     *prompb.TimeSeries
+}
+
+// getHistogramDatapoints turns the series of a request into datapoints, with the buckets, sums and counts of each
+// histogram and the quantiles, sums and counts of each summary sent together and consistently labeled
+func (d *decoder) getHistogramDatapoints(r *prompb.WriteRequest, types map[string]metricType) []*datapoint.Datapoint {
+	h := newHistogramBuilder(types)
+	series := make([]parsedSeries, 0, len(r.Timeseries))
+	for _, ts := range r.Timeseries {
+		dims := getDimensions(ts.Labels)
+		metric := getMetricName(dims)
+		if metric == "" {
+			atomic.AddInt64(&d.TotalBadDatapoints, int64(len(ts.Samples)))
+			continue
+		}
+		h.addFamily(metric, dims)
+		series = append(series, parsedSeries{metric: metric, dims: dims, ts: ts})
+	}
+	dps := make([]*datapoint.Datapoint, 0, len(series))
+	for _, s := range series {
+		name, part := h.partOf(s.metric, s.dims)
+		if part == partNone {
+			dps = append(dps, d.sampleDatapoints(s.ts, s.metric, s.dims, typeOf(s.metric, types))...)
+			continue
+		}
+		d.addToFamily(h, name, part, s)
+	}
+	for _, f := range h.order {
+		if f.summary {
+			atomic.AddInt64(&d.TotalSummaries, 1)
+		} else {
+			atomic.AddInt64(&d.TotalHistograms, 1)
+		}
+		dps = append(dps, f.datapoints(d.percentiles)...)
+	}
+	return dps
+}
+
+func (d *decoder) addToFamily(h *histogramBuilder, name string, part int, s parsedSeries) {
+	for _, sample := range s.ts.Samples {
+		if math.IsNaN(sample.Value) {
+			atomic.AddInt64(&d.TotalNaNs, 1)
+			continue
+		}
+		if err := h.add(name, part, s.dims, sample); err != nil {
+			atomic.AddInt64(&d.TotalBadDatapoints, 1)
+		}
+	}
+}
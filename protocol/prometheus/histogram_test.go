@@ -0,0 +1,201 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func timeSeries(name string, value float64, labels ...string) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: model.MetricNameLabel, Value: name}, {Name: "job", Value: "api"}},
+		Samples: []prompb.Sample{{Value: value, Timestamp: 1000}},
+	}
+	for i := 0; i+1 < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, &prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return ts
+}
+
+func histogramRequest() *prompb.WriteRequest {
+	return &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			timeSeries("latency_bucket", 10, "le", "0.1"),
+			timeSeries("latency_bucket", 30, "le", "1.0"),
+			timeSeries("latency_bucket", 18, "le", "0.5"),
+			timeSeries("latency_bucket", 40, "le", "+Inf"),
+			timeSeries("latency_sum", 12.5),
+			timeSeries("latency_count", 40),
+			timeSeries("rpc", 0.2, "quantile", "0.50"),
+			timeSeries("rpc", 0.9, "quantile", ".99"),
+			timeSeries("rpc_sum", 30),
+			timeSeries("rpc_count", 100),
+			timeSeries("requests_total", 5),
+			timeSeries("open_count", 3),
+		},
+	}
+}
+
+func withMetadata(r *prompb.WriteRequest, metadata ...*metricMetadata) []byte {
+	reqBuf, err := proto.Marshal(r)
+	So(err, ShouldBeNil)
+	metadataBuf, err := proto.Marshal(&writeRequestMetadata{Metadata: metadata})
+	So(err, ShouldBeNil)
+	// concatenated protobuf messages are merged when decoded, so this is a write request with metadata
+	return append(reqBuf, metadataBuf...)
+}
+
+func value(dps []*datapoint.Datapoint, metric string, labels ...string) datapoint.Value {
+	dims := map[string]string{"job": "api"}
+	for i := 0; i+1 < len(labels); i += 2 {
+		dims[labels[i]] = labels[i+1]
+	}
+	var found []*datapoint.Datapoint
+	for _, dp := range dps {
+		if dp.Metric == metric && reflect.DeepEqual(dp.Dimensions, dims) {
+			found = append(found, dp)
+		}
+	}
+	So(len(found), ShouldEqual, 1)
+	return found[0].Value
+}
+
+func typeOfMetric(dps []*datapoint.Datapoint, metric string) datapoint.MetricType {
+	for _, dp := range dps {
+		if dp.Metric == metric {
+			return dp.MetricType
+		}
+	}
+	return -1
+}
+
+func TestHistograms(t *testing.T) {
+	Convey("given a decoder that reconstructs histograms", t, func() {
+		d := &decoder{histograms: true, percentiles: []float64{.5, .9}, Logger: log.Discard}
+		Convey("histograms and summaries should be grouped without metadata", func() {
+			dps := d.getHistogramDatapoints(histogramRequest(), nil)
+			So(len(dps), ShouldEqual, 14)
+			So(value(dps, "latency_bucket", "le", "0.1"), ShouldResemble, datapoint.NewIntValue(10))
+			So(value(dps, "latency_bucket", "le", "0.5"), ShouldResemble, datapoint.NewIntValue(18))
+			So(value(dps, "latency_bucket", "le", "1"), ShouldResemble, datapoint.NewIntValue(30))
+			So(value(dps, "latency_bucket", "le", "+Inf"), ShouldResemble, datapoint.NewIntValue(40))
+			So(value(dps, "latency_sum"), ShouldResemble, datapoint.NewFloatValue(12.5))
+			So(value(dps, "latency_count"), ShouldResemble, datapoint.NewIntValue(40))
+			So(value(dps, "latency", "quantile", "0.5").(datapoint.FloatValue).Float(), ShouldAlmostEqual, .5+.5*(2/12.0))
+			So(value(dps, "latency", "quantile", "0.9"), ShouldResemble, datapoint.NewIntValue(1))
+			So(typeOfMetric(dps, "latency_bucket"), ShouldEqual, datapoint.Counter)
+			So(typeOfMetric(dps, "latency"), ShouldEqual, datapoint.Gauge)
+
+			So(value(dps, "rpc", "quantile", "0.5"), ShouldResemble, datapoint.NewFloatValue(.2))
+			So(value(dps, "rpc", "quantile", "0.99"), ShouldResemble, datapoint.NewFloatValue(.9))
+			So(value(dps, "rpc_sum"), ShouldResemble, datapoint.NewIntValue(30))
+			So(value(dps, "rpc_count"), ShouldResemble, datapoint.NewIntValue(100))
+			So(typeOfMetric(dps, "rpc"), ShouldEqual, datapoint.Gauge)
+
+			So(typeOfMetric(dps, "requests_total"), ShouldEqual, datapoint.Counter)
+			So(typeOfMetric(dps, "open_count"), ShouldEqual, datapoint.Counter)
+			So(d.TotalHistograms, ShouldEqual, 1)
+			So(d.TotalSummaries, ShouldEqual, 1)
+		})
+		Convey("every datapoint of a family should have its own dimensions", func() {
+			dps := d.getHistogramDatapoints(histogramRequest(), nil)
+			for _, dp := range dps {
+				if dp.Metric == "latency_sum" {
+					dp.Dimensions["job"] = "changed"
+				}
+			}
+			So(value(dps, "latency_count"), ShouldResemble, datapoint.NewIntValue(40))
+			So(value(dps, "latency_bucket", "le", "+Inf"), ShouldResemble, datapoint.NewIntValue(40))
+		})
+		Convey("metadata should type series", func() {
+			types, err := getMetadata(withMetadata(histogramRequest(),
+				&metricMetadata{MetricFamilyName: "open_count", Type: typeGauge},
+				&metricMetadata{MetricFamilyName: "requests", Type: typeCounter},
+				&metricMetadata{MetricFamilyName: "rpc", Type: typeSummary},
+				&metricMetadata{MetricFamilyName: "latency", Type: typeHistogram},
+			))
+			So(err, ShouldBeNil)
+			dps := d.getHistogramDatapoints(histogramRequest(), types)
+			So(len(dps), ShouldEqual, 14)
+			So(typeOfMetric(dps, "open_count"), ShouldEqual, datapoint.Gauge)
+			So(typeOfMetric(dps, "requests_total"), ShouldEqual, datapoint.Counter)
+		})
+		Convey("metadata should make summaries without quantiles and keep series that are not histograms apart", func() {
+			r := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+				timeSeries("rpc_sum", 30),
+				timeSeries("rpc_count", 100),
+				timeSeries("queue_bucket", 3, "le", "1"),
+			}}
+			dps := d.getHistogramDatapoints(r, map[string]metricType{"rpc": typeSummary, "queue": typeGauge})
+			So(len(dps), ShouldEqual, 3)
+			So(typeOfMetric(dps, "rpc_count"), ShouldEqual, datapoint.Counter)
+			So(typeOfMetric(dps, "queue_bucket"), ShouldEqual, datapoint.Counter)
+			So(d.TotalSummaries, ShouldEqual, 1)
+		})
+		Convey("histograms should be made coherent", func() {
+			r := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+				timeSeries("latency_bucket", 10, "le", "1"),
+				timeSeries("latency_bucket", 8, "le", "2"),
+				timeSeries("latency_count", 12),
+				timeSeries("latency_bucket", 1, "le", "nope"),
+				timeSeries("latency_bucket", math.NaN(), "le", "3"),
+				{Labels: []*prompb.Label{{Name: "le", Value: "1"}}, Samples: []prompb.Sample{{Value: 1}}},
+			}}
+			dps := d.getHistogramDatapoints(r, nil)
+			So(value(dps, "latency_bucket", "le", "2"), ShouldResemble, datapoint.NewIntValue(10))
+			So(value(dps, "latency_bucket", "le", "+Inf"), ShouldResemble, datapoint.NewIntValue(12))
+			So(d.TotalBadDatapoints, ShouldEqual, 2)
+			So(d.TotalNaNs, ShouldEqual, 1)
+		})
+		Convey("bad metadata should be an error", func() {
+			_, err := getMetadata([]byte{0x1a, 0xff})
+			So(err, ShouldNotBeNil)
+			r := &writeRequestMetadata{Metadata: []*metricMetadata{{MetricFamilyName: "latency"}}}
+			So(r.String(), ShouldContainSubstring, "latency")
+			So(r.Metadata[0].String(), ShouldContainSubstring, "latency")
+			r.Metadata[0].Reset()
+			So(r.Metadata[0].MetricFamilyName, ShouldEqual, "")
+		})
+	})
+	Convey("quantiles should be estimated like histogram_quantile", t, func() {
+		inf := math.Inf(1)
+		So(math.IsNaN(bucketQuantile(.5, []bucket{{bound: inf, count: 1}})), ShouldBeTrue)
+		So(math.IsNaN(bucketQuantile(.5, []bucket{{bound: 1, count: 1}, {bound: 2, count: 1}})), ShouldBeTrue)
+		So(math.IsNaN(bucketQuantile(.5, []bucket{{bound: 1, count: 0}, {bound: inf, count: 0}})), ShouldBeTrue)
+		So(bucketQuantile(.5, []bucket{{bound: 1, count: 0}, {bound: inf, count: 4}}), ShouldEqual, 1)
+		So(bucketQuantile(.5, []bucket{{bound: -1, count: 4}, {bound: inf, count: 4}}), ShouldEqual, -1)
+		So(bucketQuantile(.25, []bucket{{bound: 2, count: 4}, {bound: inf, count: 4}}), ShouldEqual, .5)
+		So(bucketQuantile(.5, []bucket{{bound: 1, count: 2}, {bound: 2, count: 2}, {bound: 3, count: 4}, {bound: inf, count: 4}}), ShouldEqual, 1)
+	})
+	Convey("a listener with histograms should group them", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(1)
+		listener, err := NewListener(sendTo, &Config{ListenAddr: pointer.String("127.0.0.1:0"), Histograms: pointer.Bool(true), Percentiles: []float64{.9}})
+		So(err, ShouldBeNil)
+		payload := snappy.Encode(nil, withMetadata(histogramRequest(), &metricMetadata{MetricFamilyName: "open_count", Type: typeGauge}))
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/write", listener.server.Addr), bytes.NewReader(payload))
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		resp, err := http.DefaultClient.Do(req)
+		So(err, ShouldBeNil)
+		So(resp.Body.Close(), ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		dps := <-sendTo.PointsChan
+		So(len(dps), ShouldEqual, 13)
+		So(typeOfMetric(dps, "open_count"), ShouldEqual, datapoint.Gauge)
+		So(listener.Close(), ShouldBeNil)
+	})
+}
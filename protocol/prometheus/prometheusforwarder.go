@@ -0,0 +1,407 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/errors"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol"
+	"github.com/signalfx/ingest-protocols/protocol/filtering"
+)
+
+// ForwarderConfig controls optional parameters for a prometheus remote write forwarder
+type ForwarderConfig struct {
+	Filters         *filtering.FilterObj
+	URL             *string
+	Timeout         *time.Duration
+	BatchSize       *int
+	MaxRetries      *int
+	RetryBackoff    *time.Duration
+	MaxRetryBackoff *time.Duration
+	MaxIdleConns    *int64
+	Headers         map[string]string
+	GatewayVersion  *string
+	Logger          log.Logger
+	// RetryJitter is the fraction of each backoff that is randomized, between 0 and 1
+	RetryJitter *float64
+}
+
+var defaultForwarderConfig = &ForwarderConfig{
+	Filters:         &filtering.FilterObj{},
+	URL:             pointer.String("http://127.0.0.1:9090/api/v1/write"),
+	Timeout:         pointer.Duration(time.Second * 30),
+	BatchSize:       pointer.Int(1000),
+	MaxRetries:      pointer.Int(3),
+	RetryBackoff:    pointer.Duration(time.Millisecond * 100),
+	MaxRetryBackoff: pointer.Duration(time.Second * 5),
+	RetryJitter:     pointer.Float64(0.2),
+	MaxIdleConns:    pointer.Int64(20),
+	GatewayVersion:  pointer.String("UNKNOWN_VERSION"),
+	Logger:          log.Discard,
+}
+
+type forwarderStats struct {
+	totalDatapointsForwarded int64
+	totalRequests            int64
+	totalRetries             int64
+	totalBackoffNs           int64
+	totalFailedRequests      int64
+	totalUnsupportedValues   int64
+	pipeline                 int64
+	requests                 *sfxclient.RollingBucket
+}
+
+// Forwarder sends datapoints to a prometheus remote write endpoint such as Cortex, Mimir or Thanos
+type Forwarder struct {
+	filtering.FilteredForwarder
+	url             string
+	batchSize       int
+	maxRetries      int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	retryJitter     float64
+	random          func() float64
+	headers         map[string]string
+	userAgent       string
+	tr              *http.Transport
+	client          *http.Client
+	logger          log.Logger
+	stats           forwarderStats
+}
+
+var _ protocol.Forwarder = &Forwarder{}
+
+// errNonRetryable wraps remote write failures that will not succeed if sent again
+type errNonRetryable struct {
+	error
+}
+
+// errThrottled wraps a 429 whose Retry-After header asked for a minimum wait before sending again
+type errThrottled struct {
+	error
+	retryAfter time.Duration
+}
+
+// NewForwarder creates a new prometheus remote write forwarder
+func NewForwarder(passedConf *ForwarderConfig) (*Forwarder, error) {
+	conf := pointer.FillDefaultFrom(passedConf, defaultForwarderConfig).(*ForwarderConfig)
+	if *conf.BatchSize <= 0 {
+		return nil, fmt.Errorf("invalid batch size %d", *conf.BatchSize)
+	}
+	if *conf.RetryJitter < 0 || *conf.RetryJitter > 1 {
+		return nil, fmt.Errorf("invalid retry jitter %v, it must be between 0 and 1", *conf.RetryJitter)
+	}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost:   int(*conf.MaxIdleConns),
+		ResponseHeaderTimeout: *conf.Timeout,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{Timeout: *conf.Timeout}
+			return d.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout: *conf.Timeout,
+	}
+	ret := &Forwarder{
+		url:             *conf.URL,
+		batchSize:       *conf.BatchSize,
+		maxRetries:      *conf.MaxRetries,
+		retryBackoff:    *conf.RetryBackoff,
+		maxRetryBackoff: *conf.MaxRetryBackoff,
+		retryJitter:     *conf.RetryJitter,
+		random:          rand.Float64, // nolint: gosec
+		headers:         conf.Headers,
+		userAgent:       fmt.Sprintf("SignalfxGateway/%s (gover %s)", *conf.GatewayVersion, runtime.Version()),
+		tr:              tr,
+		client: &http.Client{
+			Transport: tr,
+			Timeout:   *conf.Timeout,
+		},
+		logger: conf.Logger,
+		stats: forwarderStats{
+			requests: sfxclient.NewRollingBucket("request_time.ns", map[string]string{
+				"direction":   "forwarder",
+				"destination": "prometheus",
+			}),
+		},
+	}
+	if err := ret.Setup(conf.Filters); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// DebugEndpoints returns no http handlers
+func (f *Forwarder) DebugEndpoints() map[string]http.Handler {
+	return map[string]http.Handler{}
+}
+
+// StartupFinished does nothing
+func (f *Forwarder) StartupFinished() error {
+	return nil
+}
+
+// DebugDatapoints returns request, retry and backoff stats about the forwarder
+func (f *Forwarder) DebugDatapoints() []*datapoint.Datapoint {
+	dps := f.stats.requests.Datapoints()
+	dps = append(dps,
+		sfxclient.Cumulative("prometheus.total_datapoints_forwarded", nil, atomic.LoadInt64(&f.stats.totalDatapointsForwarded)),
+		sfxclient.Cumulative("prometheus.total_requests", nil, atomic.LoadInt64(&f.stats.totalRequests)),
+		sfxclient.Cumulative("prometheus.total_retries", nil, atomic.LoadInt64(&f.stats.totalRetries)),
+		sfxclient.Cumulative("prometheus.total_backoff_time.ns", nil, atomic.LoadInt64(&f.stats.totalBackoffNs)),
+		sfxclient.Cumulative("prometheus.failed_requests", nil, atomic.LoadInt64(&f.stats.totalFailedRequests)),
+		sfxclient.Cumulative("prometheus.unsupported_values", nil, atomic.LoadInt64(&f.stats.totalUnsupportedValues)),
+	)
+	return append(dps, f.GetFilteredDatapoints()...)
+}
+
+// DefaultDatapoints returns a set of default datapoints about the forwarder
+func (f *Forwarder) DefaultDatapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{}
+}
+
+// Datapoints implements the sfxclient.Collector interface and returns all datapoints
+func (f *Forwarder) Datapoints() []*datapoint.Datapoint {
+	return append(f.DebugDatapoints(), f.DefaultDatapoints()...)
+}
+
+// Pipeline returns the number of datapoints currently being sent
+func (f *Forwarder) Pipeline() int64 {
+	return atomic.LoadInt64(&f.stats.pipeline)
+}
+
+// Close will terminate idle HTTP client connections
+func (f *Forwarder) Close() error {
+	f.tr.CloseIdleConnections()
+	return nil
+}
+
+// AddEvents does nothing since prometheus has no concept of events
+func (f *Forwarder) AddEvents(ctx context.Context, events []*event.Event) error {
+	return nil
+}
+
+// AddSpans does nothing since prometheus has no concept of spans
+func (f *Forwarder) AddSpans(ctx context.Context, spans []*trace.Span) error {
+	return nil
+}
+
+// AddDatapoints sends the points to the remote write endpoint in batches of at most BatchSize series
+func (f *Forwarder) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	atomic.AddInt64(&f.stats.pipeline, int64(len(points)))
+	defer atomic.AddInt64(&f.stats.pipeline, -int64(len(points)))
+	points = f.FilterDatapoints(points)
+	series := make([]*prompb.TimeSeries, 0, len(points))
+	for _, dp := range points {
+		if ts := f.toTimeSeries(dp); ts != nil {
+			series = append(series, ts)
+		}
+	}
+	for len(series) > 0 {
+		n := f.batchSize
+		if n > len(series) {
+			n = len(series)
+		}
+		if err := f.send(ctx, series[:n]); err != nil {
+			return err
+		}
+		atomic.AddInt64(&f.stats.totalDatapointsForwarded, int64(n))
+		series = series[n:]
+	}
+	return nil
+}
+
+func (f *Forwarder) toTimeSeries(dp *datapoint.Datapoint) *prompb.TimeSeries {
+	var value float64
+	switch v := dp.Value.(type) {
+	case datapoint.IntValue:
+		value = float64(v.Int())
+	case datapoint.FloatValue:
+		value = v.Float()
+	default:
+		atomic.AddInt64(&f.stats.totalUnsupportedValues, 1)
+		return nil
+	}
+	name := sanitizeName(dp.Metric, true)
+	if name == "" {
+		atomic.AddInt64(&f.stats.totalUnsupportedValues, 1)
+		return nil
+	}
+	if dp.MetricType == datapoint.Counter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return &prompb.TimeSeries{
+		Labels: toLabels(name, dp.Dimensions),
+		Samples: []prompb.Sample{{
+			Value:     value,
+			Timestamp: dp.Timestamp.UnixNano() / int64(time.Millisecond),
+		}},
+	}
+}
+
+// toLabels builds the sorted label set remote write requires.  Dimensions are visited in key order so
+// that when two keys sanitize to the same label name the result is deterministic.
+func toLabels(name string, dims map[string]string) []*prompb.Label {
+	keys := make([]string, 0, len(dims))
+	for k := range dims {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	labels := make([]*prompb.Label, 0, len(dims)+1)
+	labels = append(labels, &prompb.Label{Name: model.MetricNameLabel, Value: name})
+	seen := map[string]struct{}{model.MetricNameLabel: {}}
+	for _, k := range keys {
+		labelName := sanitizeName(k, false)
+		if _, exists := seen[labelName]; exists || labelName == "" || dims[k] == "" {
+			continue
+		}
+		seen[labelName] = struct{}{}
+		labels = append(labels, &prompb.Label{Name: labelName, Value: dims[k]})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// sanitizeName replaces characters prometheus does not allow in metric names (or label names when
+// allowColon is false) with underscores
+func sanitizeName(name string, allowColon bool) string {
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (allowColon && r == ':'):
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// send posts a single write request, retrying with exponential backoff on connection errors,
+// 429s and 5xxs.  Throttled requests wait at least as long as their Retry-After.
+func (f *Forwarder) send(ctx context.Context, series []*prompb.TimeSeries) error {
+	raw, err := proto.Marshal(&prompb.WriteRequest{Timeseries: series})
+	if err != nil {
+		return errors.Annotate(err, "cannot marshal prometheus write request")
+	}
+	body := snappy.Encode(nil, raw)
+	backoff := f.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = f.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*errNonRetryable); ok || attempt >= f.maxRetries {
+			break
+		}
+		wait := f.retryWait(backoff, err)
+		atomic.AddInt64(&f.stats.totalRetries, 1)
+		atomic.AddInt64(&f.stats.totalBackoffNs, wait.Nanoseconds())
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+			atomic.AddInt64(&f.stats.totalFailedRequests, 1)
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > f.maxRetryBackoff {
+			backoff = f.maxRetryBackoff
+		}
+	}
+	atomic.AddInt64(&f.stats.totalFailedRequests, 1)
+	f.logger.Log(log.Err, err, "unable to send prometheus write request")
+	return err
+}
+
+// retryWait is the backoff with jitter taken off, or the Retry-After of a throttled request if that is longer.  A
+// Retry-After never makes the wait longer than the max retry backoff.
+func (f *Forwarder) retryWait(backoff time.Duration, err error) time.Duration {
+	wait := backoff - time.Duration(float64(backoff)*f.retryJitter*f.random())
+	if throttled, ok := err.(*errThrottled); ok && wait < throttled.retryAfter {
+		if throttled.retryAfter > f.maxRetryBackoff {
+			return f.maxRetryBackoff
+		}
+		return throttled.retryAfter
+	}
+	return wait
+}
+
+// retryAfter parses a Retry-After header given either as seconds or as an HTTP date, returning 0 if there is none
+func retryAfter(header string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func (f *Forwarder) post(ctx context.Context, body []byte) error {
+	start := time.Now()
+	defer func() {
+		f.stats.requests.Add(float64(time.Since(start).Nanoseconds()))
+	}()
+	atomic.AddInt64(&f.stats.totalRequests, 1)
+	req, err := http.NewRequest("POST", f.url, bytes.NewReader(body))
+	if err != nil {
+		return &errNonRetryable{err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", f.userAgent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range f.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	log.IfErr(f.logger, resp.Body.Close())
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("remote write returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if wait := retryAfter(resp.Header.Get("Retry-After"), time.Now()); wait > 0 {
+			return &errThrottled{error: err, retryAfter: wait}
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5 {
+		return err
+	}
+	return &errNonRetryable{err}
+}
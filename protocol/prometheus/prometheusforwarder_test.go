@@ -0,0 +1,216 @@
+package prometheus
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/ingest-protocols/protocol/filtering"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type remoteWriteServer struct {
+	mu         sync.Mutex
+	requests   []*prompb.WriteRequest
+	headers    []http.Header
+	statuses   []int
+	retryAfter string
+	calls      int64
+}
+
+func (s *remoteWriteServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	call := atomic.AddInt64(&s.calls, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int(call) <= len(s.statuses) {
+		if s.retryAfter != "" {
+			rw.Header().Set("Retry-After", s.retryAfter)
+		}
+		rw.WriteHeader(s.statuses[call-1])
+		_, _ = rw.Write([]byte("try again"))
+		return
+	}
+	compressed, _ := ioutil.ReadAll(req.Body)
+	raw, _ := snappy.Decode(nil, compressed)
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(raw, &wr); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.requests = append(s.requests, &wr)
+	s.headers = append(s.headers, req.Header)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func TestSanitizeName(t *testing.T) {
+	Convey("names should follow prometheus rules", t, func() {
+		So(sanitizeName("cpu.idle", true), ShouldEqual, "cpu_idle")
+		So(sanitizeName("job:rate5m", true), ShouldEqual, "job:rate5m")
+		So(sanitizeName("job:rate5m", false), ShouldEqual, "job_rate5m")
+		So(sanitizeName("5xx-count", true), ShouldEqual, "_5xx_count")
+		So(sanitizeName("héllo", false), ShouldEqual, "h_llo")
+		So(sanitizeName("", true), ShouldEqual, "")
+	})
+	Convey("labels should be sorted, sanitized and deduplicated", t, func() {
+		labels := toLabels("m", map[string]string{"host.name": "a", "host_name": "b", "__name__": "c", "empty": "", "az": "1"})
+		So(labels, ShouldResemble, []*prompb.Label{
+			{Name: "__name__", Value: "m"},
+			{Name: "az", Value: "1"},
+			{Name: "host_name", Value: "a"},
+		})
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	Convey("Retry-After should be parsed as seconds or an HTTP date", t, func() {
+		now := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+		So(retryAfter("3", now), ShouldEqual, time.Second*3)
+		So(retryAfter(now.Add(time.Second*5).Format(http.TimeFormat), now), ShouldEqual, time.Second*5)
+		So(retryAfter(now.Add(-time.Second).Format(http.TimeFormat), now), ShouldBeLessThan, 0)
+		So(retryAfter("", now), ShouldEqual, 0)
+		So(retryAfter("soon", now), ShouldEqual, 0)
+	})
+}
+
+func TestForwarder(t *testing.T) {
+	Convey("invalid configs should fail", t, func() {
+		_, err := NewForwarder(&ForwarderConfig{BatchSize: pointer.Int(0)})
+		So(err, ShouldNotBeNil)
+		_, err = NewForwarder(&ForwarderConfig{Filters: &filtering.FilterObj{Deny: []string{"["}}})
+		So(err, ShouldNotBeNil)
+		_, err = NewForwarder(&ForwarderConfig{RetryJitter: pointer.Float64(1.5)})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("given a remote write server and forwarder", t, func() {
+		server := &remoteWriteServer{}
+		ts := httptest.NewServer(server)
+		forwarder, err := NewForwarder(&ForwarderConfig{
+			URL:          pointer.String(ts.URL + "/api/v1/write"),
+			BatchSize:    pointer.Int(2),
+			MaxRetries:   pointer.Int(2),
+			RetryBackoff: pointer.Duration(time.Millisecond),
+			Headers:      map[string]string{"X-Scope-OrgID": "tenant"},
+			Filters:      &filtering.FilterObj{Deny: []string{"^denied"}},
+		})
+		So(err, ShouldBeNil)
+		forwarder.random = func() float64 { return 0 }
+		ctx := context.Background()
+		now := time.Unix(1000, int64(time.Millisecond*5))
+		stat := func(name string) string {
+			return dptest.ExactlyOne(forwarder.DebugDatapoints(), name).Value.String()
+		}
+		Convey("should batch and convert datapoints", func() {
+			dps := []*datapoint.Datapoint{
+				datapoint.New("cpu.idle", map[string]string{"host": "a"}, datapoint.NewFloatValue(1.5), datapoint.Gauge, now),
+				datapoint.New("requests", nil, datapoint.NewIntValue(3), datapoint.Counter, now),
+				datapoint.New("bytes_total", nil, datapoint.NewIntValue(4), datapoint.Counter, now),
+				datapoint.New("msg", nil, datapoint.NewStringValue("hi"), datapoint.Gauge, now),
+				datapoint.New("denied", nil, datapoint.NewIntValue(1), datapoint.Gauge, now),
+			}
+			So(forwarder.AddDatapoints(ctx, dps), ShouldBeNil)
+			So(len(server.requests), ShouldEqual, 2)
+			So(len(server.requests[0].Timeseries), ShouldEqual, 2)
+			So(len(server.requests[1].Timeseries), ShouldEqual, 1)
+			first := server.requests[0].Timeseries[0]
+			So(first.Labels, ShouldResemble, []*prompb.Label{{Name: "__name__", Value: "cpu_idle"}, {Name: "host", Value: "a"}})
+			So(first.Samples, ShouldResemble, []prompb.Sample{{Value: 1.5, Timestamp: 1000005}})
+			So(server.requests[0].Timeseries[1].Labels[0].Value, ShouldEqual, "requests_total")
+			So(server.requests[1].Timeseries[0].Labels[0].Value, ShouldEqual, "bytes_total")
+			So(server.headers[0].Get("Content-Encoding"), ShouldEqual, "snappy")
+			So(server.headers[0].Get("X-Scope-OrgID"), ShouldEqual, "tenant")
+			So(stat("prometheus.total_datapoints_forwarded"), ShouldEqual, "3")
+			So(stat("prometheus.unsupported_values"), ShouldEqual, "1")
+			So(stat("filtered_by_forwarder"), ShouldEqual, "1")
+			So(forwarder.Pipeline(), ShouldEqual, 0)
+		})
+		Convey("should retry throttled and failed requests", func() {
+			server.statuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldBeNil)
+			So(len(server.requests), ShouldEqual, 1)
+			So(stat("prometheus.total_requests"), ShouldEqual, "3")
+			So(stat("prometheus.total_retries"), ShouldEqual, "2")
+			So(stat("prometheus.total_backoff_time.ns"), ShouldEqual, "3000000")
+		})
+		Convey("should take jitter off the backoff", func() {
+			forwarder.random = func() float64 { return 1 }
+			server.statuses = []int{http.StatusServiceUnavailable}
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldBeNil)
+			So(stat("prometheus.total_backoff_time.ns"), ShouldEqual, "800000")
+		})
+		Convey("should wait at least as long as Retry-After", func() {
+			server.statuses = []int{http.StatusTooManyRequests}
+			server.retryAfter = "1"
+			start := time.Now()
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+			So(stat("prometheus.total_backoff_time.ns"), ShouldEqual, "1000000000")
+		})
+		Convey("should not wait longer than the max retry backoff for a Retry-After", func() {
+			forwarder.maxRetryBackoff = time.Millisecond * 50
+			server.statuses = []int{http.StatusTooManyRequests}
+			server.retryAfter = "60"
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldBeNil)
+			So(stat("prometheus.total_backoff_time.ns"), ShouldEqual, "50000000")
+		})
+		Convey("should give up after the max retries", func() {
+			server.statuses = []int{500, 500, 500}
+			err := forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "try again")
+			So(stat("prometheus.total_retries"), ShouldEqual, "2")
+			So(stat("prometheus.failed_requests"), ShouldEqual, "1")
+		})
+		Convey("should not retry client errors", func() {
+			server.statuses = []int{http.StatusBadRequest}
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(stat("prometheus.total_retries"), ShouldEqual, "0")
+			So(stat("prometheus.failed_requests"), ShouldEqual, "1")
+		})
+		Convey("should stop backing off when the context is done", func() {
+			forwarder.retryBackoff = time.Hour
+			server.statuses = []int{500}
+			ctx, cancel := context.WithCancel(ctx)
+			go func() {
+				for atomic.LoadInt64(&server.calls) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				cancel()
+			}()
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldEqual, context.Canceled)
+			So(stat("prometheus.failed_requests"), ShouldEqual, "1")
+		})
+		Convey("should return connection errors", func() {
+			forwarder.url = "http://127.0.0.1:1/write"
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(stat("prometheus.total_retries"), ShouldEqual, "2")
+		})
+		Convey("should reject invalid urls", func() {
+			forwarder.url = "%gh&%ij"
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(stat("prometheus.total_retries"), ShouldEqual, "0")
+		})
+		Convey("should satisfy the forwarder interface", func() {
+			So(forwarder.AddEvents(ctx, nil), ShouldBeNil)
+			So(forwarder.AddSpans(ctx, nil), ShouldBeNil)
+			So(forwarder.StartupFinished(), ShouldBeNil)
+			So(forwarder.DebugEndpoints(), ShouldBeEmpty)
+			So(forwarder.DefaultDatapoints(), ShouldBeEmpty)
+			So(len(forwarder.Datapoints()), ShouldEqual, len(forwarder.DebugDatapoints()))
+		})
+		Reset(func() {
+			So(forwarder.Close(), ShouldBeNil)
+			ts.Close()
+		})
+	})
+}
@@ -2,6 +2,7 @@ package prometheus
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
@@ -60,11 +61,15 @@ type decoder struct {
 	TotalErrors        int64
 	TotalNaNs          int64
 	TotalBadDatapoints int64
+	TotalHistograms    int64
+	TotalSummaries     int64
 	Bucket             *sfxclient.RollingBucket
 	DrainSize          *sfxclient.RollingBucket
 	SendTo             dpsink.Sink
 	Logger             log.Logger
 	readAll            func(r io.Reader) ([]byte, error)
+	histograms         bool
+	percentiles        []float64
 }
 
 func getDimensions(labels []*prompb.Label) map[string]string {
@@ -108,6 +113,13 @@ func getMetricType(metric string) datapoint.MetricType {
 	return datapoint.Gauge
 }
 
+func newValue(v float64) datapoint.Value {
+	if v == float64(int64(v)) {
+		return datapoint.NewIntValue(int64(v))
+	}
+	return datapoint.NewFloatValue(v)
+}
+
 func (d *decoder) getDatapoints(ts *prompb.TimeSeries) []*datapoint.Datapoint {
 	dimensions := getDimensions(ts.Labels)
 	metricName := getMetricName(dimensions)
@@ -115,22 +127,18 @@ func (d *decoder) getDatapoints(ts *prompb.TimeSeries) []*datapoint.Datapoint {
 		atomic.AddInt64(&d.TotalBadDatapoints, int64(len(ts.Samples)))
 		return []*datapoint.Datapoint{}
 	}
-	metricType := getMetricType(metricName)
+	return d.sampleDatapoints(ts, metricName, dimensions, getMetricType(metricName))
+}
 
+func (d *decoder) sampleDatapoints(ts *prompb.TimeSeries, metricName string, dimensions map[string]string, metricType datapoint.MetricType) []*datapoint.Datapoint {
 	dps := make([]*datapoint.Datapoint, 0, len(ts.Samples))
 	for _, s := range ts.Samples {
 		if math.IsNaN(s.Value) {
 			atomic.AddInt64(&d.TotalNaNs, 1)
 			continue
 		}
-		var value datapoint.Value
-		if s.Value == float64(int64(s.Value)) {
-			value = datapoint.NewIntValue(int64(s.Value))
-		} else {
-			value = datapoint.NewFloatValue(s.Value)
-		}
 		timestamp := time.Unix(0, int64(time.Millisecond)*s.Timestamp)
-		dps = append(dps, datapoint.New(metricName, dimensions, value, metricType, timestamp))
+		dps = append(dps, datapoint.New(metricName, dimensions, newValue(s.Value), metricType, timestamp))
 	}
 	return dps
 }
@@ -166,22 +174,31 @@ func (d *decoder) ServeHTTPC(ctx context.Context, rw http.ResponseWriter, req *h
 		return
 	}
 
-	dps := make([]*datapoint.Datapoint, 0, len(r.Timeseries))
-	for _, ts := range r.Timeseries {
-		datapoints := d.getDatapoints(ts)
-		dps = append(dps, datapoints...)
-	}
+	dps := d.requestDatapoints(&r, reqBuf)
 
 	d.DrainSize.Add(float64(len(dps)))
 	if len(dps) > 0 {
 		err = d.SendTo.AddDatapoints(ctx, dps)
-		if err != nil {
+		if err != nil && !protocol.WriteBackoff(rw, err, d.Logger) {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
 		}
 	}
 }
 
+func (d *decoder) requestDatapoints(r *prompb.WriteRequest, reqBuf []byte) []*datapoint.Datapoint {
+	if d.histograms {
+		types, err := getMetadata(reqBuf)
+		log.IfErr(d.Logger, err)
+		return d.getHistogramDatapoints(r, types)
+	}
+	dps := make([]*datapoint.Datapoint, 0, len(r.Timeseries))
+	for _, ts := range r.Timeseries {
+		datapoints := d.getDatapoints(ts)
+		dps = append(dps, datapoints...)
+	}
+	return dps
+}
+
 // Datapoints about this decoder, including how many datapoints it decoded
 func (d *decoder) Datapoints() []*datapoint.Datapoint {
 	dps := d.Bucket.Datapoints()
@@ -190,6 +207,8 @@ func (d *decoder) Datapoints() []*datapoint.Datapoint {
 		sfxclient.Cumulative("prometheus.invalid_requests", nil, atomic.LoadInt64(&d.TotalErrors)),
 		sfxclient.Cumulative("prometheus.total_NAN_samples", nil, atomic.LoadInt64(&d.TotalNaNs)),
 		sfxclient.Cumulative("prometheus.total_bad_datapoints", nil, atomic.LoadInt64(&d.TotalBadDatapoints)),
+		sfxclient.Cumulative("prometheus.total_histograms", nil, atomic.LoadInt64(&d.TotalHistograms)),
+		sfxclient.Cumulative("prometheus.total_summaries", nil, atomic.LoadInt64(&d.TotalSummaries)),
 	)
 	return dps
 }
@@ -203,6 +222,11 @@ type Config struct {
 	HealthCheck     *string
 	HTTPChain       web.NextConstructor
 	Logger          log.Logger
+	// Histograms sends the buckets, sums and counts of each histogram and summary in a request together, typed by
+	// the request's metadata when it has any, instead of typing every series by its name
+	Histograms *bool
+	// Percentiles are estimated from each histogram when Histograms is set, and sent like summary quantiles
+	Percentiles []float64
 }
 
 var defaultConfig = &Config{
@@ -212,11 +236,18 @@ var defaultConfig = &Config{
 	HealthCheck:     pointer.String("/healthz"),
 	Logger:          log.Discard,
 	StartingContext: context.Background(),
+	Histograms:      pointer.Bool(false),
+	Percentiles:     []float64{},
 }
 
 // NewListener serves http prometheus requests
 func NewListener(sink dpsink.Sink, passedConf *Config) (*Server, error) {
 	conf := pointer.FillDefaultFrom(passedConf, defaultConfig).(*Config)
+	for _, p := range conf.Percentiles {
+		if p <= 0 || p >= 1 {
+			return nil, fmt.Errorf("percentiles must be between 0 and 1, not %v", p)
+		}
+	}
 
 	listener, err := net.Listen("tcp", *conf.ListenAddr)
 	if err != nil {
@@ -231,9 +262,11 @@ func NewListener(sink dpsink.Sink, passedConf *Config) (*Server, error) {
 		fullHandler.Add(conf.HTTPChain)
 	}
 	d := decoder{
-		SendTo:  sink,
-		Logger:  conf.Logger,
-		readAll: ioutil.ReadAll,
+		SendTo:      sink,
+		Logger:      conf.Logger,
+		readAll:     ioutil.ReadAll,
+		histograms:  *conf.Histograms,
+		percentiles: conf.Percentiles,
 		Bucket: sfxclient.NewRollingBucket("request_time.ns", map[string]string{
 			"endpoint":  "prometheus",
 			"direction": "listener",
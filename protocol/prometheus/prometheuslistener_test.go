@@ -74,6 +74,11 @@ func TestErrorCases(t *testing.T) {
 			_, err := NewListener(sendTo, conf)
 			So(err, ShouldNotBeNil)
 		})
+		Convey("test bad percentiles", func() {
+			conf.Percentiles = []float64{.5, 1}
+			_, err := NewListener(sendTo, conf)
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
 
@@ -87,6 +92,20 @@ func (e *errSink) AddEvents(ctx context.Context, points []*event.Event) error {
 	return errors.New("nope")
 }
 
+type errBufferFull struct{}
+
+func (e errBufferFull) Error() string {
+	return "buffer full"
+}
+
+func (e errBufferFull) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+func (e errBufferFull) RetryAfter() time.Duration {
+	return time.Second
+}
+
 func TestListener(t *testing.T) {
 	Convey("test listener", t, func() {
 		callCount := int64(0)
@@ -125,7 +144,7 @@ func TestListener(t *testing.T) {
 		})
 		Convey("Is a Collector", func() {
 			dps := listener.Datapoints()
-			So(len(dps), ShouldEqual, 13)
+			So(len(dps), ShouldEqual, 15)
 		})
 		Convey("test getDatapoints edge cases", func() {
 			ts := getWriteRequest().Timeseries[0]
@@ -228,6 +247,17 @@ func TestBad(t *testing.T) {
 			resp.Body.Close()
 			So(resp.StatusCode, ShouldEqual, http.StatusInternalServerError)
 		})
+		Convey("sink asks clients to back off", func() {
+			sendTo.RetError(errBufferFull{})
+			req, err := http.NewRequest("POST", baseURL, bytes.NewReader(getPayload(nil)))
+			So(err, ShouldBeNil)
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			resp, err := client.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(resp.Header.Get("Retry-After"), ShouldEqual, "1")
+		})
 		Reset(func() {
 			So(listener.Close(), ShouldBeNil)
 		})
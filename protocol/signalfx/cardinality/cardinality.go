@@ -0,0 +1,361 @@
+package cardinality
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+)
+
+// What the limiter groups series by
+const (
+	ByMetric = "metric"
+	ByToken  = "token"
+)
+
+// What the limiter does with new series once a group is over its limit
+const (
+	Drop  = "drop"
+	Strip = "strip"
+)
+
+// DebugEndpoint is where the limited groups are reported
+const DebugEndpoint = "/debug/cardinality"
+
+const (
+	// maxOffenders is how many limited metric names each token group counts
+	maxOffenders = 100
+	// topOffenders is how many of them are reported
+	topOffenders = 10
+)
+
+// Config controls how a Limiter tracks and limits series
+type Config struct {
+	// Limit is how many unique dimension sets each group may have
+	Limit *int64
+	// GroupBy is either metric, to limit the series of each metric name, or token, to limit the series sent with each token
+	GroupBy *string
+	// Action is either drop, to drop new series over the limit, or strip, to strip them down to KeepDimensions
+	Action *string
+	// KeepDimensions are the dimensions kept on stripped series
+	KeepDimensions []string
+	// SeriesExpiry is how long a series is tracked without new datapoints before it no longer counts towards the limit
+	SeriesExpiry *time.Duration
+	// MaxGroups is how many groups are tracked, after which the least recently seen ones are forgotten
+	MaxGroups *int64
+}
+
+// DefaultConfig are default values for limiters
+var DefaultConfig = &Config{
+	Limit:          pointer.Int64(10000),
+	GroupBy:        pointer.String(ByMetric),
+	Action:         pointer.String(Drop),
+	KeepDimensions: []string{},
+	SeriesExpiry:   pointer.Duration(time.Hour),
+	MaxGroups:      pointer.Int64(10000),
+}
+
+type series struct {
+	hash     uint64
+	lastSeen time.Time
+}
+
+// group is an LRU of the series of one metric or token, with the least recently seen series at the back
+type group struct {
+	name    string
+	series  map[uint64]*list.Element
+	lru     *list.List
+	limited int64
+	// how often each metric was limited, for token groups
+	offenders map[string]int64
+}
+
+func (g *group) offend(metric string) {
+	if g.offenders == nil {
+		g.offenders = make(map[string]int64)
+	}
+	if _, exists := g.offenders[metric]; exists || len(g.offenders) < maxOffenders {
+		g.offenders[metric]++
+	}
+}
+
+// topOffenders returns the most limited metrics of the group
+func (g *group) topOffenders() []Offender {
+	if len(g.offenders) == 0 {
+		return nil
+	}
+	ret := make([]Offender, 0, len(g.offenders))
+	for metric, limited := range g.offenders {
+		ret = append(ret, Offender{Metric: metric, Limited: limited})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Limited != ret[j].Limited {
+			return ret[i].Limited > ret[j].Limited
+		}
+		return ret[i].Metric < ret[j].Metric
+	})
+	if len(ret) > topOffenders {
+		ret = ret[:topOffenders]
+	}
+	return ret
+}
+
+func (g *group) touch(hash uint64, now time.Time, limit int64, expiry time.Duration) bool {
+	if elem, exists := g.series[hash]; exists {
+		elem.Value.(*series).lastSeen = now
+		g.lru.MoveToFront(elem)
+		return true
+	}
+	if int64(g.lru.Len()) >= limit {
+		oldest := g.lru.Back()
+		if oldest == nil || now.Sub(oldest.Value.(*series).lastSeen) < expiry {
+			g.limited++
+			return false
+		}
+		delete(g.series, g.lru.Remove(oldest).(*series).hash)
+	}
+	g.series[hash] = g.lru.PushFront(&series{hash: hash, lastSeen: now})
+	return true
+}
+
+// Limiter is a signalfx.NextSink that stops new series from being created once a metric or token has too many,
+// either dropping their datapoints or stripping their dimensions.  Events and spans pass through untouched.
+type Limiter struct {
+	limit          int64
+	groupBy        string
+	action         string
+	keepDimensions []string
+	expiry         time.Duration
+	maxGroups      int64
+
+	mu     sync.Mutex
+	groups map[string]*list.Element
+	lru    *list.List
+	now    func() time.Time
+
+	stats struct {
+		dropped  int64
+		stripped int64
+	}
+}
+
+var _ signalfx.NextSink = &Limiter{}
+var _ protocol.DebugEndpointer = &Limiter{}
+
+// New returns a Limiter for the given config
+func New(conf *Config) (*Limiter, error) {
+	conf = pointer.FillDefaultFrom(conf, DefaultConfig).(*Config)
+	l := &Limiter{
+		limit:          *conf.Limit,
+		groupBy:        strings.ToLower(*conf.GroupBy),
+		action:         strings.ToLower(*conf.Action),
+		keepDimensions: conf.KeepDimensions,
+		expiry:         *conf.SeriesExpiry,
+		maxGroups:      *conf.MaxGroups,
+		groups:         make(map[string]*list.Element),
+		lru:            list.New(),
+		now:            time.Now,
+	}
+	if l.limit <= 0 || l.maxGroups <= 0 {
+		return nil, fmt.Errorf("cardinality Limit and MaxGroups must be positive")
+	}
+	if l.groupBy != ByMetric && l.groupBy != ByToken {
+		return nil, fmt.Errorf("unknown cardinality GroupBy %s", *conf.GroupBy)
+	}
+	if l.action != Drop && l.action != Strip {
+		return nil, fmt.Errorf("unknown cardinality Action %s", *conf.Action)
+	}
+	return l, nil
+}
+
+func seriesHash(dp *datapoint.Datapoint) uint64 {
+	keys := make([]string, 0, len(dp.Dimensions))
+	for k := range dp.Dimensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(dp.Metric))
+	for _, k := range keys {
+		_, _ = h.Write([]byte("\x00" + k + "\x00" + dp.Dimensions[k]))
+	}
+	return h.Sum64()
+}
+
+// groupName reads the token from the context, where the listener puts it
+func (l *Limiter) groupName(ctx context.Context, dp *datapoint.Datapoint) string {
+	if l.groupBy == ByToken {
+		token, _ := ctx.Value(sfxclient.TokenHeaderName).(string)
+		return token
+	}
+	return dp.Metric
+}
+
+func (l *Limiter) group(name string) *group {
+	if elem, exists := l.groups[name]; exists {
+		l.lru.MoveToFront(elem)
+		return elem.Value.(*group)
+	}
+	if int64(l.lru.Len()) >= l.maxGroups {
+		delete(l.groups, l.lru.Remove(l.lru.Back()).(*group).name)
+	}
+	g := &group{name: name, series: make(map[uint64]*list.Element), lru: list.New()}
+	l.groups[name] = l.lru.PushFront(g)
+	return g
+}
+
+func (l *Limiter) allowed(ctx context.Context, dp *datapoint.Datapoint, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	g := l.group(l.groupName(ctx, dp))
+	if g.touch(seriesHash(dp), now, l.limit, l.expiry) {
+		return true
+	}
+	if l.groupBy == ByToken {
+		g.offend(dp.Metric)
+	}
+	return false
+}
+
+func (l *Limiter) strip(dp *datapoint.Datapoint) {
+	dims := make(map[string]string, len(l.keepDimensions))
+	for _, k := range l.keepDimensions {
+		if v, exists := dp.Dimensions[k]; exists {
+			dims[k] = v
+		}
+	}
+	dp.Dimensions = dims
+}
+
+// AddDatapoints forwards the datapoints of known series and new series under the limit, and drops or strips the rest
+func (l *Limiter) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	now := l.now()
+	kept := make([]*datapoint.Datapoint, 0, len(points))
+	for _, dp := range points {
+		if l.allowed(ctx, dp, now) {
+			kept = append(kept, dp)
+			continue
+		}
+		if l.action == Strip {
+			atomic.AddInt64(&l.stats.stripped, 1)
+			l.strip(dp)
+			kept = append(kept, dp)
+			continue
+		}
+		atomic.AddInt64(&l.stats.dropped, 1)
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return next.AddDatapoints(ctx, kept)
+}
+
+// AddEvents is a passthrough
+func (l *Limiter) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	return next.AddEvents(ctx, events)
+}
+
+// AddSpans is a passthrough
+func (l *Limiter) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	return next.AddSpans(ctx, spans)
+}
+
+// Offender is a metric whose series were limited within a token group
+type Offender struct {
+	Metric  string `json:"metric"`
+	Limited int64  `json:"limited"`
+}
+
+// Limited is a group that has gone over its limit.  Token groups are named by a hash of the token, and list the
+// metrics limited the most.
+type Limited struct {
+	Name    string     `json:"name"`
+	Series  int        `json:"series"`
+	Limited int64      `json:"limited"`
+	Metrics []Offender `json:"metrics,omitempty"`
+}
+
+// redactToken turns a token into a name that can be matched against a known token without giving the token away
+func redactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// Limited returns the groups that have had series limited, most limited first
+func (l *Limiter) Limited() []Limited {
+	l.mu.Lock()
+	ret := make([]Limited, 0)
+	for elem := l.lru.Front(); elem != nil; elem = elem.Next() {
+		g := elem.Value.(*group)
+		if g.limited == 0 {
+			continue
+		}
+		limited := Limited{Name: g.name, Series: g.lru.Len(), Limited: g.limited}
+		if l.groupBy == ByToken {
+			limited.Name = redactToken(g.name)
+			limited.Metrics = g.topOffenders()
+		}
+		ret = append(ret, limited)
+	}
+	l.mu.Unlock()
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Limited > ret[j].Limited
+	})
+	return ret
+}
+
+// DebugEndpoints returns a handler that lists the limited groups as JSON
+func (l *Limiter) DebugEndpoints() map[string]http.Handler {
+	return map[string]http.Handler{
+		DebugEndpoint: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+				"group_by": l.groupBy,
+				"limit":    l.limit,
+				"limited":  l.Limited(),
+			})
+		}),
+	}
+}
+
+// Datapoints returns how many series are tracked and how many datapoints were dropped or stripped
+func (l *Limiter) Datapoints() []*datapoint.Datapoint {
+	l.mu.Lock()
+	var tracked, limited int64
+	for elem := l.lru.Front(); elem != nil; elem = elem.Next() {
+		g := elem.Value.(*group)
+		tracked += int64(g.lru.Len())
+		if g.limited > 0 {
+			limited++
+		}
+	}
+	groups := int64(l.lru.Len())
+	l.mu.Unlock()
+	return []*datapoint.Datapoint{
+		sfxclient.Gauge("cardinality.groups", nil, groups),
+		sfxclient.Gauge("cardinality.limited_groups", nil, limited),
+		sfxclient.Gauge("cardinality.series", nil, tracked),
+		sfxclient.Cumulative("cardinality.limited", map[string]string{"action": Drop}, atomic.LoadInt64(&l.stats.dropped)),
+		sfxclient.Cumulative("cardinality.limited", map[string]string{"action": Strip}, atomic.LoadInt64(&l.stats.stripped)),
+	}
+}
@@ -0,0 +1,155 @@
+package cardinality
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func pods(metric string, from, to int) []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, to-from)
+	for i := from; i < to; i++ {
+		dps = append(dps, datapoint.New(metric, map[string]string{"pod": fmt.Sprintf("pod-%d", i), "service": "api"}, datapoint.NewIntValue(1), datapoint.Gauge, time.Now()))
+	}
+	return dps
+}
+
+func TestLimiter(t *testing.T) {
+	Convey("given a limiter that drops new series over the limit", t, func() {
+		l, err := New(&Config{Limit: pointer.Int64(3), MaxGroups: pointer.Int64(2), SeriesExpiry: pointer.Duration(time.Minute)})
+		So(err, ShouldBeNil)
+		now := time.Now()
+		l.now = func() time.Time { return now }
+		sink := dptest.NewBasicSink()
+		sink.Resize(1)
+		chain := signalfx.FromChain(sink, signalfx.NextWrap(l))
+		ctx := context.Background()
+		Convey("series over the limit should be dropped", func() {
+			So(chain.AddDatapoints(ctx, pods("cpu", 0, 5)), ShouldBeNil)
+			So(<-sink.PointsChan, ShouldHaveLength, 3)
+			So(chain.AddDatapoints(ctx, pods("cpu", 0, 3)), ShouldBeNil)
+			So(<-sink.PointsChan, ShouldHaveLength, 3)
+			So(chain.AddDatapoints(ctx, pods("cpu", 4, 5)), ShouldBeNil)
+			So(sink.PointsChan, ShouldHaveLength, 0)
+			So(chain.AddDatapoints(ctx, pods("mem", 0, 1)), ShouldBeNil)
+			So(<-sink.PointsChan, ShouldHaveLength, 1)
+			So(l.Limited(), ShouldResemble, []Limited{{Name: "cpu", Series: 3, Limited: 3}})
+			dps := l.Datapoints()
+			So(dptest.ExactlyOne(dps, "cardinality.series").Value, ShouldResemble, datapoint.NewIntValue(4))
+			So(dptest.ExactlyOne(dps, "cardinality.limited_groups").Value, ShouldResemble, datapoint.NewIntValue(1))
+			So(dptest.ExactlyOneDims(dps, "cardinality.limited", map[string]string{"action": Drop}).Value, ShouldResemble, datapoint.NewIntValue(3))
+		})
+		Convey("expired series should make room for new ones", func() {
+			So(chain.AddDatapoints(ctx, pods("cpu", 0, 3)), ShouldBeNil)
+			So(<-sink.PointsChan, ShouldHaveLength, 3)
+			now = now.Add(time.Minute)
+			So(chain.AddDatapoints(ctx, pods("cpu", 3, 5)), ShouldBeNil)
+			So(<-sink.PointsChan, ShouldHaveLength, 2)
+			So(l.Limited(), ShouldBeEmpty)
+		})
+		Convey("the least recently seen groups should be forgotten", func() {
+			So(chain.AddDatapoints(ctx, append(append(pods("a", 0, 4), pods("b", 0, 1)...), pods("c", 0, 1)...)), ShouldBeNil)
+			So(<-sink.PointsChan, ShouldHaveLength, 5)
+			So(l.Limited(), ShouldBeEmpty)
+			So(dptest.ExactlyOne(l.Datapoints(), "cardinality.groups").Value, ShouldResemble, datapoint.NewIntValue(2))
+		})
+		Convey("the debug endpoint should list the limited metrics", func() {
+			So(chain.AddDatapoints(ctx, pods("cpu", 0, 4)), ShouldBeNil)
+			<-sink.PointsChan
+			So(chain.AddDatapoints(ctx, pods("mem", 0, 6)), ShouldBeNil)
+			<-sink.PointsChan
+			rw := httptest.NewRecorder()
+			l.DebugEndpoints()[DebugEndpoint].ServeHTTP(rw, httptest.NewRequest("GET", DebugEndpoint, nil))
+			var resp struct {
+				GroupBy string    `json:"group_by"`
+				Limit   int64     `json:"limit"`
+				Limited []Limited `json:"limited"`
+			}
+			So(json.Unmarshal(rw.Body.Bytes(), &resp), ShouldBeNil)
+			So(resp.GroupBy, ShouldEqual, ByMetric)
+			So(resp.Limit, ShouldEqual, 3)
+			So(resp.Limited, ShouldResemble, []Limited{{Name: "mem", Series: 3, Limited: 3}, {Name: "cpu", Series: 3, Limited: 1}})
+		})
+		Convey("events and spans should pass through", func() {
+			events := []*event.Event{dptest.E()}
+			So(chain.AddEvents(ctx, events), ShouldBeNil)
+			So(<-sink.EventsChan, ShouldResemble, events)
+			spans := []*trace.Span{{}}
+			So(chain.AddSpans(ctx, spans), ShouldBeNil)
+			So(<-sink.TracesChan, ShouldResemble, spans)
+		})
+	})
+	Convey("a limiter that strips dimensions per token", t, func() {
+		l, err := New(&Config{Limit: pointer.Int64(2), GroupBy: pointer.String("Token"), Action: pointer.String(Strip), KeepDimensions: []string{"service"}})
+		So(err, ShouldBeNil)
+		sink := dptest.NewBasicSink()
+		sink.Resize(1)
+		ctx := context.WithValue(context.Background(), sfxclient.TokenHeaderName, "tok")
+		So(l.AddDatapoints(ctx, append(pods("cpu", 0, 2), pods("mem", 0, 1)...), sink), ShouldBeNil)
+		dps := <-sink.PointsChan
+		So(dps, ShouldHaveLength, 3)
+		So(dps[1].Dimensions, ShouldContainKey, "pod")
+		So(dps[2].Dimensions, ShouldResemble, map[string]string{"service": "api"})
+		So(l.AddDatapoints(context.Background(), pods("disk", 0, 1), sink), ShouldBeNil)
+		dps = <-sink.PointsChan
+		So(dps[0].Dimensions, ShouldContainKey, "pod")
+		So(l.Limited(), ShouldResemble, []Limited{{Name: redactToken("tok"), Series: 2, Limited: 1, Metrics: []Offender{{Metric: "mem", Limited: 1}}}})
+		So(dptest.ExactlyOneDims(l.Datapoints(), "cardinality.limited", map[string]string{"action": Strip}).Value, ShouldResemble, datapoint.NewIntValue(1))
+	})
+	Convey("a limiter per token should report the most limited metrics without the token", t, func() {
+		l, err := New(&Config{Limit: pointer.Int64(1), GroupBy: pointer.String(ByToken)})
+		So(err, ShouldBeNil)
+		ctx := context.WithValue(context.Background(), sfxclient.TokenHeaderName, "secret-token")
+		sink := dptest.NewBasicSink()
+		sink.Resize(1)
+		So(l.AddDatapoints(ctx, append(pods("cpu", 0, 3), pods("mem", 0, 3)...), sink), ShouldBeNil)
+		for i := 0; i < topOffenders+1; i++ {
+			So(l.AddDatapoints(ctx, pods(fmt.Sprintf("m%02d", i), 0, 1), sink), ShouldBeNil)
+		}
+		limited := l.Limited()
+		So(limited, ShouldHaveLength, 1)
+		So(limited[0].Name, ShouldStartWith, "sha256:")
+		So(limited[0].Metrics, ShouldHaveLength, topOffenders)
+		So(limited[0].Metrics[:2], ShouldResemble, []Offender{{Metric: "mem", Limited: 3}, {Metric: "cpu", Limited: 2}})
+		So(limited[0].Metrics[2], ShouldResemble, Offender{Metric: "m00", Limited: 1})
+
+		rw := httptest.NewRecorder()
+		l.DebugEndpoints()[DebugEndpoint].ServeHTTP(rw, httptest.NewRequest("GET", DebugEndpoint, nil))
+		So(rw.Body.String(), ShouldNotContainSubstring, "secret-token")
+		So(rw.Body.String(), ShouldContainSubstring, `"metric":"mem"`)
+		So(redactToken(""), ShouldEqual, "")
+	})
+	Convey("token groups should only count so many metrics", t, func() {
+		g := &group{}
+		for i := 0; i < maxOffenders+1; i++ {
+			g.offend(fmt.Sprintf("m%d", i))
+		}
+		g.offend("m0")
+		So(g.offenders, ShouldHaveLength, maxOffenders)
+		So(g.offenders["m0"], ShouldEqual, 2)
+		So((&group{}).topOffenders(), ShouldBeNil)
+	})
+	Convey("bad configs should throw errors", t, func() {
+		for _, conf := range []*Config{
+			{Limit: pointer.Int64(0)},
+			{MaxGroups: pointer.Int64(-1)},
+			{GroupBy: pointer.String("host")},
+			{Action: pointer.String("sample")},
+		} {
+			_, err := New(conf)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
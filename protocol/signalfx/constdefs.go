@@ -10,16 +10,40 @@ import (
 const (
 	// DefaultLogPathV1 is the default listener endpoint path
 	DefaultLogPathV1 = "/v1/log"
+	// LogV1 is a constant used for protocol naming
+	LogV1 = "log_v1"
+	// HECEventPathV1 is the Splunk HTTP Event Collector endpoint for JSON events
+	HECEventPathV1 = "/services/collector/event"
+	// HECRawPathV1 is the Splunk HTTP Event Collector endpoint for raw text
+	HECRawPathV1 = "/services/collector/raw"
+	// HECEventV1 is a constant used for protocol naming
+	HECEventV1 = "hec_event_v1"
+	// HECRawV1 is a constant used for protocol naming
+	HECRawV1 = "hec_raw_v1"
 	// JaegerV1 binary thrift protocol
 	JaegerV1 = "jaeger_thrift_v1"
+	// JaegerGRPCV1 is a constant used for protocol naming
+	JaegerGRPCV1 = "jaeger_grpc_v1"
 	// DefaultTracePathV1 is the default listen path
 	DefaultTracePathV1 = "/v1/trace"
 	// ZipkinTracePathV1 adds /api/v1/spans endpoint
 	ZipkinTracePathV1 = "/api/v1/spans"
 	// ZipkinTracePathV2 adds /api/vw/spans endpoint
 	ZipkinTracePathV2 = "/api/v2/spans"
+	// SAPMTracePathV2 is the SAPM protobuf trace endpoint
+	SAPMTracePathV2 = "/v2/trace"
+	// SAPMV2 is a constant used for protocol naming
+	SAPMV2 = "sapm_v2"
 	// ZipkinV1 is a constant used for protocol naming
 	ZipkinV1 = "zipkin_json_v1"
+	// OTLPMetricsPathV1 is the OTLP/HTTP metrics endpoint
+	OTLPMetricsPathV1 = "/v1/metrics"
+	// OTLPTracesPathV1 is the OTLP/HTTP traces endpoint
+	OTLPTracesPathV1 = "/v1/traces"
+	// OTLPMetricsV1 is a constant used for protocol naming
+	OTLPMetricsV1 = "otlp_metrics_v1"
+	// OTLPTracesV1 is a constant used for protocol naming
+	OTLPTracesV1 = "otlp_traces_v1"
 )
 
 // LogProtocol is the context type used to set what is the log protocol
@@ -0,0 +1,8 @@
+package sfx_log_model
+
+import "context"
+
+// LogSink accepts logs, and is implemented by sinks that can take logs as well as datapoints, events and spans
+type LogSink interface {
+	AddLogs(ctx context.Context, logs []*ResourceLogs) error
+}
@@ -0,0 +1,305 @@
+// Package otlp holds the subset of the OpenTelemetry protocol (OTLP) messages that the signalfx listener
+// understands, along with decoders for the OTLP/HTTP protobuf and JSON encodings of them.
+package otlp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AggregationTemporality defines how a sum's value is reported over time
+type AggregationTemporality int32
+
+// Aggregation temporalities defined by OTLP
+const (
+	AggregationTemporalityUnspecified AggregationTemporality = 0
+	AggregationTemporalityDelta       AggregationTemporality = 1
+	AggregationTemporalityCumulative  AggregationTemporality = 2
+)
+
+var aggregationTemporalityValues = map[string]int32{
+	"AGGREGATION_TEMPORALITY_UNSPECIFIED": 0,
+	"AGGREGATION_TEMPORALITY_DELTA":       1,
+	"AGGREGATION_TEMPORALITY_CUMULATIVE":  2,
+}
+
+// UnmarshalJSON accepts either the enum number or its name
+func (a *AggregationTemporality) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b, aggregationTemporalityValues)
+	*a = AggregationTemporality(v)
+	return err
+}
+
+// SpanKind is the type of a span
+type SpanKind int32
+
+// Span kinds defined by OTLP
+const (
+	SpanKindUnspecified SpanKind = 0
+	SpanKindInternal    SpanKind = 1
+	SpanKindServer      SpanKind = 2
+	SpanKindClient      SpanKind = 3
+	SpanKindProducer    SpanKind = 4
+	SpanKindConsumer    SpanKind = 5
+)
+
+var spanKindValues = map[string]int32{
+	"SPAN_KIND_UNSPECIFIED": 0,
+	"SPAN_KIND_INTERNAL":    1,
+	"SPAN_KIND_SERVER":      2,
+	"SPAN_KIND_CLIENT":      3,
+	"SPAN_KIND_PRODUCER":    4,
+	"SPAN_KIND_CONSUMER":    5,
+}
+
+// UnmarshalJSON accepts either the enum number or its name
+func (k *SpanKind) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b, spanKindValues)
+	*k = SpanKind(v)
+	return err
+}
+
+// StatusCode is the status of a span
+type StatusCode int32
+
+// Status codes defined by OTLP
+const (
+	StatusCodeUnset StatusCode = 0
+	StatusCodeOk    StatusCode = 1
+	StatusCodeError StatusCode = 2
+)
+
+var statusCodeValues = map[string]int32{
+	"STATUS_CODE_UNSET": 0,
+	"STATUS_CODE_OK":    1,
+	"STATUS_CODE_ERROR": 2,
+}
+
+// UnmarshalJSON accepts either the enum number or its name
+func (c *StatusCode) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalEnum(b, statusCodeValues)
+	*c = StatusCode(v)
+	return err
+}
+
+func unmarshalEnum(b []byte, values map[string]int32) (int32, error) {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		if v, exists := values[name]; exists {
+			return v, nil
+		}
+		return 0, fmt.Errorf("unknown enum value %q", name)
+	}
+	var v int32
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// Int64 is an int64 that can be read from a JSON number or string, since proto3 JSON encodes 64 bit
+// integers as strings
+type Int64 int64
+
+// UnmarshalJSON parses a quoted or unquoted integer
+func (i *Int64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = Int64(v)
+	return err
+}
+
+// Uint64 is an uint64 that can be read from a JSON number or string
+type Uint64 uint64
+
+// UnmarshalJSON parses a quoted or unquoted unsigned integer
+func (u *Uint64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	*u = Uint64(v)
+	return err
+}
+
+// ID is a trace or span id.  OTLP/HTTP JSON encodes ids as hex rather than base64.
+type ID []byte
+
+// UnmarshalJSON decodes a hex encoded id
+func (id *ID) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := hex.DecodeString(s)
+	*id = v
+	return err
+}
+
+// AnyValue is an attribute value, only one of the fields is set
+type AnyValue struct {
+	StringValue *string       `json:"stringValue,omitempty"`
+	BoolValue   *bool         `json:"boolValue,omitempty"`
+	IntValue    *Int64        `json:"intValue,omitempty"`
+	DoubleValue *float64      `json:"doubleValue,omitempty"`
+	ArrayValue  *ArrayValue   `json:"arrayValue,omitempty"`
+	KvlistValue *KeyValueList `json:"kvlistValue,omitempty"`
+	BytesValue  []byte        `json:"bytesValue,omitempty"`
+}
+
+// ArrayValue is a list of values
+type ArrayValue struct {
+	Values []*AnyValue `json:"values"`
+}
+
+// KeyValueList is a list of attributes
+type KeyValueList struct {
+	Values []*KeyValue `json:"values"`
+}
+
+// KeyValue is a single attribute
+type KeyValue struct {
+	Key   string    `json:"key"`
+	Value *AnyValue `json:"value"`
+}
+
+// Resource describes the entity that produced the telemetry
+type Resource struct {
+	Attributes []*KeyValue `json:"attributes"`
+}
+
+// NumberDataPoint is a single gauge or sum value, only one of AsDouble or AsInt is set
+type NumberDataPoint struct {
+	Attributes        []*KeyValue `json:"attributes"`
+	StartTimeUnixNano Uint64      `json:"startTimeUnixNano"`
+	TimeUnixNano      Uint64      `json:"timeUnixNano"`
+	AsDouble          *float64    `json:"asDouble,omitempty"`
+	AsInt             *Int64      `json:"asInt,omitempty"`
+}
+
+// Gauge is a metric whose points are sampled values
+type Gauge struct {
+	DataPoints []*NumberDataPoint `json:"dataPoints"`
+}
+
+// Sum is a metric whose points are sums over a delta or cumulative interval
+type Sum struct {
+	DataPoints             []*NumberDataPoint     `json:"dataPoints"`
+	AggregationTemporality AggregationTemporality `json:"aggregationTemporality"`
+	IsMonotonic            bool                   `json:"isMonotonic"`
+}
+
+// Metric is a single named metric.  Gauge and Sum are the only data types decoded, Unsupported is set
+// when the metric has neither.
+type Metric struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Unit        string `json:"unit"`
+	Gauge       *Gauge `json:"gauge,omitempty"`
+	Sum         *Sum   `json:"sum,omitempty"`
+	Unsupported bool   `json:"-"`
+}
+
+// ScopeMetrics groups the metrics produced by one instrumentation scope
+type ScopeMetrics struct {
+	Metrics []*Metric `json:"metrics"`
+}
+
+// ResourceMetrics groups the metrics produced by one resource.  Older senders use
+// instrumentationLibraryMetrics instead of scopeMetrics.
+type ResourceMetrics struct {
+	Resource                      *Resource       `json:"resource"`
+	ScopeMetrics                  []*ScopeMetrics `json:"scopeMetrics"`
+	InstrumentationLibraryMetrics []*ScopeMetrics `json:"instrumentationLibraryMetrics"`
+}
+
+// MetricsRequest is the body of an OTLP metrics export request
+type MetricsRequest struct {
+	ResourceMetrics []*ResourceMetrics `json:"resourceMetrics"`
+}
+
+// Event is a timestamped annotation on a span
+type Event struct {
+	TimeUnixNano Uint64      `json:"timeUnixNano"`
+	Name         string      `json:"name"`
+	Attributes   []*KeyValue `json:"attributes"`
+}
+
+// Status is the result of a span
+type Status struct {
+	Message string     `json:"message"`
+	Code    StatusCode `json:"code"`
+}
+
+// Span is a single operation within a trace
+type Span struct {
+	TraceID           ID          `json:"traceId"`
+	SpanID            ID          `json:"spanId"`
+	ParentSpanID      ID          `json:"parentSpanId"`
+	Name              string      `json:"name"`
+	Kind              SpanKind    `json:"kind"`
+	StartTimeUnixNano Uint64      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   Uint64      `json:"endTimeUnixNano"`
+	Attributes        []*KeyValue `json:"attributes"`
+	Events            []*Event    `json:"events"`
+	Status            *Status     `json:"status"`
+}
+
+// ScopeSpans groups the spans produced by one instrumentation scope
+type ScopeSpans struct {
+	Spans []*Span `json:"spans"`
+}
+
+// ResourceSpans groups the spans produced by one resource.  Older senders use
+// instrumentationLibrarySpans instead of scopeSpans.
+type ResourceSpans struct {
+	Resource                    *Resource     `json:"resource"`
+	ScopeSpans                  []*ScopeSpans `json:"scopeSpans"`
+	InstrumentationLibrarySpans []*ScopeSpans `json:"instrumentationLibrarySpans"`
+}
+
+// TracesRequest is the body of an OTLP traces export request
+type TracesRequest struct {
+	ResourceSpans []*ResourceSpans `json:"resourceSpans"`
+}
+
+// AllScopeMetrics returns the scope metrics regardless of which field name the sender used
+func (r *ResourceMetrics) AllScopeMetrics() []*ScopeMetrics {
+	return append(r.ScopeMetrics, r.InstrumentationLibraryMetrics...)
+}
+
+// AllScopeSpans returns the scope spans regardless of which field name the sender used
+func (r *ResourceSpans) AllScopeSpans() []*ScopeSpans {
+	return append(r.ScopeSpans, r.InstrumentationLibrarySpans...)
+}
+
+// UnmarshalMetricsJSON decodes an OTLP/HTTP JSON metrics request
+func UnmarshalMetricsJSON(b []byte) (*MetricsRequest, error) {
+	var req MetricsRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	// JSON senders can send null entries, which are left for the converters to skip
+	for _, rm := range req.ResourceMetrics {
+		if rm == nil {
+			continue
+		}
+		for _, sm := range rm.AllScopeMetrics() {
+			if sm == nil {
+				continue
+			}
+			for _, m := range sm.Metrics {
+				if m != nil {
+					m.Unsupported = m.Gauge == nil && m.Sum == nil
+				}
+			}
+		}
+	}
+	return &req, nil
+}
+
+// UnmarshalTracesJSON decodes an OTLP/HTTP JSON traces request
+func UnmarshalTracesJSON(b []byte) (*TracesRequest, error) {
+	var req TracesRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
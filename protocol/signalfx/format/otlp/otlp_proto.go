@@ -0,0 +1,391 @@
+package otlp
+
+import (
+	"errors"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages are decoded field by field with protowire so only the fields we use need to be known,
+// everything else is skipped.
+
+var errWrongWireType = errors.New("unexpected protobuf wire type")
+
+type protoMessage interface {
+	unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error)
+}
+
+// unmarshalProto walks every field in b, giving each to m and skipping any m does not consume
+func unmarshalProto(b []byte, m protoMessage) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := m.unmarshalField(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeMessage(typ protowire.Type, b []byte, m protoMessage) (int, error) {
+	v, n, err := consumeBytes(typ, b)
+	if err != nil {
+		return 0, err
+	}
+	return n, unmarshalProto(v, m)
+}
+
+func consumeBytes(typ protowire.Type, b []byte) ([]byte, int, error) {
+	if typ != protowire.BytesType {
+		return nil, 0, errWrongWireType
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return nil, 0, protowire.ParseError(n)
+	}
+	return v, n, nil
+}
+
+func consumeString(typ protowire.Type, b []byte, dst *string) (int, error) {
+	v, n, err := consumeBytes(typ, b)
+	*dst = string(v)
+	return n, err
+}
+
+func consumeVarint(typ protowire.Type, b []byte) (uint64, int, error) {
+	if typ != protowire.VarintType {
+		return 0, 0, errWrongWireType
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, 0, protowire.ParseError(n)
+	}
+	return v, n, nil
+}
+
+func consumeFixed64(typ protowire.Type, b []byte) (uint64, int, error) {
+	if typ != protowire.Fixed64Type {
+		return 0, 0, errWrongWireType
+	}
+	v, n := protowire.ConsumeFixed64(b)
+	if n < 0 {
+		return 0, 0, protowire.ParseError(n)
+	}
+	return v, n, nil
+}
+
+func (a *AnyValue) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		a.StringValue = new(string)
+		return consumeString(typ, b, a.StringValue)
+	case 2:
+		v, n, err := consumeVarint(typ, b)
+		a.BoolValue = new(bool)
+		*a.BoolValue = v != 0
+		return n, err
+	case 3:
+		v, n, err := consumeVarint(typ, b)
+		a.IntValue = new(Int64)
+		*a.IntValue = Int64(v)
+		return n, err
+	case 4:
+		v, n, err := consumeFixed64(typ, b)
+		a.DoubleValue = new(float64)
+		*a.DoubleValue = math.Float64frombits(v)
+		return n, err
+	case 5:
+		a.ArrayValue = &ArrayValue{}
+		return consumeMessage(typ, b, a.ArrayValue)
+	case 6:
+		a.KvlistValue = &KeyValueList{}
+		return consumeMessage(typ, b, a.KvlistValue)
+	case 7:
+		v, n, err := consumeBytes(typ, b)
+		a.BytesValue = append([]byte{}, v...)
+		return n, err
+	}
+	return 0, nil
+}
+
+func (a *ArrayValue) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 1 {
+		v := &AnyValue{}
+		a.Values = append(a.Values, v)
+		return consumeMessage(typ, b, v)
+	}
+	return 0, nil
+}
+
+func (l *KeyValueList) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 1 {
+		return consumeKeyValue(typ, b, &l.Values)
+	}
+	return 0, nil
+}
+
+func consumeKeyValue(typ protowire.Type, b []byte, dst *[]*KeyValue) (int, error) {
+	kv := &KeyValue{}
+	*dst = append(*dst, kv)
+	return consumeMessage(typ, b, kv)
+}
+
+func (kv *KeyValue) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		return consumeString(typ, b, &kv.Key)
+	case 2:
+		kv.Value = &AnyValue{}
+		return consumeMessage(typ, b, kv.Value)
+	}
+	return 0, nil
+}
+
+func (r *Resource) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 1 {
+		return consumeKeyValue(typ, b, &r.Attributes)
+	}
+	return 0, nil
+}
+
+func (dp *NumberDataPoint) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 2:
+		v, n, err := consumeFixed64(typ, b)
+		dp.StartTimeUnixNano = Uint64(v)
+		return n, err
+	case 3:
+		v, n, err := consumeFixed64(typ, b)
+		dp.TimeUnixNano = Uint64(v)
+		return n, err
+	case 4:
+		v, n, err := consumeFixed64(typ, b)
+		dp.AsDouble = new(float64)
+		*dp.AsDouble = math.Float64frombits(v)
+		return n, err
+	case 6:
+		v, n, err := consumeFixed64(typ, b)
+		dp.AsInt = new(Int64)
+		*dp.AsInt = Int64(v)
+		return n, err
+	case 7:
+		return consumeKeyValue(typ, b, &dp.Attributes)
+	}
+	return 0, nil
+}
+
+func consumeDataPoint(typ protowire.Type, b []byte, dst *[]*NumberDataPoint) (int, error) {
+	dp := &NumberDataPoint{}
+	*dst = append(*dst, dp)
+	return consumeMessage(typ, b, dp)
+}
+
+func (g *Gauge) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 1 {
+		return consumeDataPoint(typ, b, &g.DataPoints)
+	}
+	return 0, nil
+}
+
+func (s *Sum) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		return consumeDataPoint(typ, b, &s.DataPoints)
+	case 2:
+		v, n, err := consumeVarint(typ, b)
+		s.AggregationTemporality = AggregationTemporality(v)
+		return n, err
+	case 3:
+		v, n, err := consumeVarint(typ, b)
+		s.IsMonotonic = v != 0
+		return n, err
+	}
+	return 0, nil
+}
+
+func (m *Metric) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		return consumeString(typ, b, &m.Name)
+	case 2:
+		return consumeString(typ, b, &m.Description)
+	case 3:
+		return consumeString(typ, b, &m.Unit)
+	case 5:
+		m.Gauge = &Gauge{}
+		return consumeMessage(typ, b, m.Gauge)
+	case 7:
+		m.Sum = &Sum{}
+		return consumeMessage(typ, b, m.Sum)
+	}
+	return 0, nil
+}
+
+func (s *ScopeMetrics) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 2 {
+		m := &Metric{}
+		s.Metrics = append(s.Metrics, m)
+		n, err := consumeMessage(typ, b, m)
+		m.Unsupported = m.Gauge == nil && m.Sum == nil
+		return n, err
+	}
+	return 0, nil
+}
+
+func (r *ResourceMetrics) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		r.Resource = &Resource{}
+		return consumeMessage(typ, b, r.Resource)
+	case 2:
+		sm := &ScopeMetrics{}
+		r.ScopeMetrics = append(r.ScopeMetrics, sm)
+		return consumeMessage(typ, b, sm)
+	case 1000:
+		sm := &ScopeMetrics{}
+		r.InstrumentationLibraryMetrics = append(r.InstrumentationLibraryMetrics, sm)
+		return consumeMessage(typ, b, sm)
+	}
+	return 0, nil
+}
+
+func (r *MetricsRequest) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 1 {
+		rm := &ResourceMetrics{}
+		r.ResourceMetrics = append(r.ResourceMetrics, rm)
+		return consumeMessage(typ, b, rm)
+	}
+	return 0, nil
+}
+
+func (e *Event) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		v, n, err := consumeFixed64(typ, b)
+		e.TimeUnixNano = Uint64(v)
+		return n, err
+	case 2:
+		return consumeString(typ, b, &e.Name)
+	case 3:
+		return consumeKeyValue(typ, b, &e.Attributes)
+	}
+	return 0, nil
+}
+
+func (s *Status) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 2:
+		return consumeString(typ, b, &s.Message)
+	case 3:
+		v, n, err := consumeVarint(typ, b)
+		s.Code = StatusCode(v)
+		return n, err
+	}
+	return 0, nil
+}
+
+func consumeID(typ protowire.Type, b []byte, dst *ID) (int, error) {
+	v, n, err := consumeBytes(typ, b)
+	*dst = append(ID{}, v...)
+	return n, err
+}
+
+func (s *Span) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		return consumeID(typ, b, &s.TraceID)
+	case 2:
+		return consumeID(typ, b, &s.SpanID)
+	case 4:
+		return consumeID(typ, b, &s.ParentSpanID)
+	case 5:
+		return consumeString(typ, b, &s.Name)
+	case 6:
+		v, n, err := consumeVarint(typ, b)
+		s.Kind = SpanKind(v)
+		return n, err
+	case 7:
+		v, n, err := consumeFixed64(typ, b)
+		s.StartTimeUnixNano = Uint64(v)
+		return n, err
+	case 8:
+		v, n, err := consumeFixed64(typ, b)
+		s.EndTimeUnixNano = Uint64(v)
+		return n, err
+	case 9:
+		return consumeKeyValue(typ, b, &s.Attributes)
+	case 11:
+		e := &Event{}
+		s.Events = append(s.Events, e)
+		return consumeMessage(typ, b, e)
+	case 15:
+		s.Status = &Status{}
+		return consumeMessage(typ, b, s.Status)
+	}
+	return 0, nil
+}
+
+func (s *ScopeSpans) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 2 {
+		span := &Span{}
+		s.Spans = append(s.Spans, span)
+		return consumeMessage(typ, b, span)
+	}
+	return 0, nil
+}
+
+func (r *ResourceSpans) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		r.Resource = &Resource{}
+		return consumeMessage(typ, b, r.Resource)
+	case 2:
+		ss := &ScopeSpans{}
+		r.ScopeSpans = append(r.ScopeSpans, ss)
+		return consumeMessage(typ, b, ss)
+	case 1000:
+		ss := &ScopeSpans{}
+		r.InstrumentationLibrarySpans = append(r.InstrumentationLibrarySpans, ss)
+		return consumeMessage(typ, b, ss)
+	}
+	return 0, nil
+}
+
+func (r *TracesRequest) unmarshalField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 1 {
+		rs := &ResourceSpans{}
+		r.ResourceSpans = append(r.ResourceSpans, rs)
+		return consumeMessage(typ, b, rs)
+	}
+	return 0, nil
+}
+
+// UnmarshalMetricsProto decodes an OTLP/HTTP protobuf metrics request
+func UnmarshalMetricsProto(b []byte) (*MetricsRequest, error) {
+	var req MetricsRequest
+	if err := unmarshalProto(b, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// UnmarshalTracesProto decodes an OTLP/HTTP protobuf traces request
+func UnmarshalTracesProto(b []byte) (*TracesRequest, error) {
+	var req TracesRequest
+	if err := unmarshalProto(b, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
@@ -0,0 +1,265 @@
+package otlp
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func stringKV(key, value string) []byte {
+	return appendMessage(appendString(nil, 1, key), 2, appendString(nil, 1, value))
+}
+
+func testMetricsProto() []byte {
+	resource := appendMessage(nil, 1, stringKV("service.name", "api"))
+	gaugePoint := appendMessage(nil, 7, stringKV("host", "a"))
+	gaugePoint = appendFixed64(gaugePoint, 3, 1000)
+	gaugePoint = appendFixed64(gaugePoint, 4, math.Float64bits(1.5))
+	gauge := appendString(nil, 1, "cpu")
+	gauge = appendString(gauge, 3, "1")
+	gauge = appendMessage(gauge, 5, appendMessage(nil, 1, gaugePoint))
+
+	sumPoint := appendFixed64(nil, 2, 500)
+	sumPoint = appendFixed64(sumPoint, 6, 7)
+	sumBody := appendMessage(nil, 1, sumPoint)
+	sumBody = appendVarint(sumBody, 2, 2)
+	sumBody = appendVarint(sumBody, 3, 1)
+	sum := appendString(nil, 1, "requests")
+	sum = appendMessage(sum, 7, sumBody)
+
+	histogram := appendString(nil, 1, "latency")
+	histogram = appendMessage(histogram, 9, appendVarint(nil, 2, 1))
+
+	scope := appendMessage(nil, 1, appendString(nil, 1, "lib"))
+	scope = appendMessage(scope, 2, gauge)
+	scope = appendMessage(scope, 2, sum)
+	scope = appendMessage(scope, 2, histogram)
+
+	rm := appendMessage(nil, 1, resource)
+	rm = appendMessage(rm, 2, scope)
+	rm = appendMessage(rm, 1000, appendMessage(nil, 2, appendString(nil, 1, "old")))
+	return appendMessage(nil, 1, rm)
+}
+
+func TestUnmarshalMetricsProto(t *testing.T) {
+	req, err := UnmarshalMetricsProto(testMetricsProto())
+	require.NoError(t, err)
+	require.Len(t, req.ResourceMetrics, 1)
+	rm := req.ResourceMetrics[0]
+	assert.Equal(t, "service.name", rm.Resource.Attributes[0].Key)
+	assert.Equal(t, "api", *rm.Resource.Attributes[0].Value.StringValue)
+	scopes := rm.AllScopeMetrics()
+	require.Len(t, scopes, 2)
+	require.Len(t, scopes[0].Metrics, 3)
+
+	gauge := scopes[0].Metrics[0]
+	assert.Equal(t, "cpu", gauge.Name)
+	assert.Equal(t, "1", gauge.Unit)
+	assert.False(t, gauge.Unsupported)
+	assert.Equal(t, Uint64(1000), gauge.Gauge.DataPoints[0].TimeUnixNano)
+	assert.Equal(t, 1.5, *gauge.Gauge.DataPoints[0].AsDouble)
+	assert.Equal(t, "host", gauge.Gauge.DataPoints[0].Attributes[0].Key)
+
+	sum := scopes[0].Metrics[1]
+	assert.Equal(t, AggregationTemporalityCumulative, sum.Sum.AggregationTemporality)
+	assert.True(t, sum.Sum.IsMonotonic)
+	assert.Equal(t, Uint64(500), sum.Sum.DataPoints[0].StartTimeUnixNano)
+	assert.Equal(t, Int64(7), *sum.Sum.DataPoints[0].AsInt)
+
+	assert.True(t, scopes[0].Metrics[2].Unsupported)
+	assert.Equal(t, "old", scopes[1].Metrics[0].Name)
+}
+
+func TestUnmarshalAnyValueProto(t *testing.T) {
+	arr := appendMessage(nil, 1, appendVarint(nil, 2, 1))
+	arr = appendMessage(arr, 1, appendVarint(nil, 3, 42))
+	b := appendMessage(nil, 5, arr)
+	var a AnyValue
+	require.NoError(t, unmarshalProto(b, &a))
+	require.Len(t, a.ArrayValue.Values, 2)
+	assert.True(t, *a.ArrayValue.Values[0].BoolValue)
+	assert.Equal(t, Int64(42), *a.ArrayValue.Values[1].IntValue)
+
+	b = appendMessage(nil, 6, appendMessage(nil, 1, stringKV("k", "v")))
+	b = appendFixed64(b, 4, math.Float64bits(2.5))
+	b = appendMessage(b, 7, []byte("raw"))
+	a = AnyValue{}
+	require.NoError(t, unmarshalProto(b, &a))
+	assert.Equal(t, "k", a.KvlistValue.Values[0].Key)
+	assert.Equal(t, 2.5, *a.DoubleValue)
+	assert.Equal(t, []byte("raw"), a.BytesValue)
+}
+
+func testTracesProto() []byte {
+	event := appendFixed64(nil, 1, 1500)
+	event = appendString(event, 2, "retry")
+	event = appendMessage(event, 3, stringKV("attempt", "2"))
+	status := appendString(nil, 2, "boom")
+	status = appendVarint(status, 3, 2)
+
+	span := appendMessage(nil, 1, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	span = appendMessage(span, 2, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	span = appendString(span, 3, "tracestate")
+	span = appendMessage(span, 4, []byte{8, 7, 6, 5, 4, 3, 2, 1})
+	span = appendString(span, 5, "GET /")
+	span = appendVarint(span, 6, 2)
+	span = appendFixed64(span, 7, 1000)
+	span = appendFixed64(span, 8, 3000)
+	span = appendMessage(span, 9, stringKV("http.method", "GET"))
+	span = appendMessage(span, 11, event)
+	span = appendMessage(span, 15, status)
+
+	rs := appendMessage(nil, 1, appendMessage(nil, 1, stringKV("service.name", "api")))
+	rs = appendMessage(rs, 2, appendMessage(nil, 2, span))
+	rs = appendMessage(rs, 1000, appendMessage(nil, 2, appendString(nil, 5, "old")))
+	return appendMessage(nil, 1, rs)
+}
+
+func TestUnmarshalTracesProto(t *testing.T) {
+	req, err := UnmarshalTracesProto(testTracesProto())
+	require.NoError(t, err)
+	require.Len(t, req.ResourceSpans, 1)
+	scopes := req.ResourceSpans[0].AllScopeSpans()
+	require.Len(t, scopes, 2)
+	span := scopes[0].Spans[0]
+	assert.Equal(t, ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, span.TraceID)
+	assert.Equal(t, ID{1, 2, 3, 4, 5, 6, 7, 8}, span.SpanID)
+	assert.Equal(t, ID{8, 7, 6, 5, 4, 3, 2, 1}, span.ParentSpanID)
+	assert.Equal(t, "GET /", span.Name)
+	assert.Equal(t, SpanKindServer, span.Kind)
+	assert.Equal(t, Uint64(1000), span.StartTimeUnixNano)
+	assert.Equal(t, Uint64(3000), span.EndTimeUnixNano)
+	assert.Equal(t, "http.method", span.Attributes[0].Key)
+	assert.Equal(t, "retry", span.Events[0].Name)
+	assert.Equal(t, Uint64(1500), span.Events[0].TimeUnixNano)
+	assert.Equal(t, "attempt", span.Events[0].Attributes[0].Key)
+	assert.Equal(t, StatusCodeError, span.Status.Code)
+	assert.Equal(t, "boom", span.Status.Message)
+	assert.Equal(t, "old", scopes[1].Spans[0].Name)
+}
+
+func TestUnmarshalProtoErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		{0xff},                  // truncated tag
+		appendVarint(nil, 1, 1), // message sent as varint
+		{0x0a, 0x05, 0x01},      // truncated message
+		appendMessage(nil, 1, []byte{0x0a, 0x02, 0x12, 0x01}),                                                                 // truncated nested message
+		appendMessage(nil, 1, appendMessage(nil, 2, appendMessage(nil, 2, appendMessage(nil, 7, appendString(nil, 2, "x"))))), // wrong nested wire type
+	} {
+		_, err := UnmarshalMetricsProto(b)
+		assert.Error(t, err)
+		_, err = UnmarshalTracesProto(b)
+		assert.Error(t, err)
+	}
+	var dp NumberDataPoint
+	assert.Error(t, unmarshalProto(appendVarint(nil, 3, 1), &dp))
+	var s Sum
+	assert.Error(t, unmarshalProto(appendFixed64(nil, 2, 1), &s))
+	assert.Error(t, unmarshalProto([]byte{0x10}, &s))
+	assert.Error(t, unmarshalProto([]byte{0x19, 0x01}, &dp))
+	// unknown fields are skipped, but still have to be well formed
+	assert.NoError(t, unmarshalProto(appendVarint(nil, 99, 1), &dp))
+	assert.Error(t, unmarshalProto([]byte{0x98, 0x06}, &dp))
+}
+
+const testMetricsJSON = `{"resourceMetrics":[{
+	"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+	"scopeMetrics":[{"metrics":[
+		{"name":"cpu","gauge":{"dataPoints":[{"timeUnixNano":"1000","asDouble":1.5,"attributes":[{"key":"up","value":{"boolValue":true}}]}]}},
+		{"name":"requests","sum":{"aggregationTemporality":"AGGREGATION_TEMPORALITY_DELTA","isMonotonic":true,"dataPoints":[{"timeUnixNano":2000,"asInt":"7"}]}},
+		{"name":"latency","histogram":{"dataPoints":[]}}
+	]}],
+	"instrumentationLibraryMetrics":[{"metrics":[{"name":"old","sum":{"aggregationTemporality":2,"dataPoints":[]}}]}]
+}]}`
+
+func TestUnmarshalMetricsJSON(t *testing.T) {
+	req, err := UnmarshalMetricsJSON([]byte(testMetricsJSON))
+	require.NoError(t, err)
+	scopes := req.ResourceMetrics[0].AllScopeMetrics()
+	require.Len(t, scopes, 2)
+	metrics := scopes[0].Metrics
+	assert.Equal(t, Uint64(1000), metrics[0].Gauge.DataPoints[0].TimeUnixNano)
+	assert.True(t, *metrics[0].Gauge.DataPoints[0].Attributes[0].Value.BoolValue)
+	assert.Equal(t, AggregationTemporalityDelta, metrics[1].Sum.AggregationTemporality)
+	assert.Equal(t, Int64(7), *metrics[1].Sum.DataPoints[0].AsInt)
+	assert.Equal(t, Uint64(2000), metrics[1].Sum.DataPoints[0].TimeUnixNano)
+	assert.True(t, metrics[2].Unsupported)
+	assert.Equal(t, AggregationTemporalityCumulative, scopes[1].Metrics[0].Sum.AggregationTemporality)
+
+	req, err = UnmarshalMetricsJSON([]byte(`{"resourceMetrics":[null,{"scopeMetrics":[null,{"metrics":[null,{"name":"g"}]}]}]}`))
+	require.NoError(t, err)
+	assert.Nil(t, req.ResourceMetrics[0])
+	assert.True(t, req.ResourceMetrics[1].ScopeMetrics[1].Metrics[1].Unsupported)
+
+	for _, bad := range []string{
+		`{`,
+		`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"sum":{"aggregationTemporality":"BOB"}}]}]}]}`,
+		`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"sum":{"aggregationTemporality":1.5}}]}]}]}`,
+		`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"gauge":{"dataPoints":[{"asInt":"x"}]}}]}]}]}`,
+		`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"gauge":{"dataPoints":[{"timeUnixNano":"-1"}]}}]}]}]}`,
+	} {
+		_, err := UnmarshalMetricsJSON([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+const testTracesJSON = `{"resourceSpans":[{
+	"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+	"scopeSpans":[{"spans":[{
+		"traceId":"0102030405060708090a0b0c0d0e0f10","spanId":"0102030405060708","parentSpanId":"",
+		"name":"GET /","kind":"SPAN_KIND_CLIENT","startTimeUnixNano":"1000","endTimeUnixNano":"3000",
+		"attributes":[{"key":"payload","value":{"bytesValue":"aGk="}}],
+		"events":[{"timeUnixNano":"1500","name":"retry"}],
+		"status":{"code":"STATUS_CODE_ERROR","message":"boom"}
+	}]}],
+	"instrumentationLibrarySpans":[{"spans":[{"name":"old","kind":4,"status":{"code":1}}]}]
+}]}`
+
+func TestUnmarshalTracesJSON(t *testing.T) {
+	req, err := UnmarshalTracesJSON([]byte(testTracesJSON))
+	require.NoError(t, err)
+	scopes := req.ResourceSpans[0].AllScopeSpans()
+	require.Len(t, scopes, 2)
+	span := scopes[0].Spans[0]
+	assert.Equal(t, ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, span.TraceID)
+	assert.Empty(t, span.ParentSpanID)
+	assert.Equal(t, SpanKindClient, span.Kind)
+	assert.Equal(t, []byte("hi"), span.Attributes[0].Value.BytesValue)
+	assert.Equal(t, StatusCodeError, span.Status.Code)
+	assert.Equal(t, SpanKindProducer, scopes[1].Spans[0].Kind)
+	assert.Equal(t, StatusCodeOk, scopes[1].Spans[0].Status.Code)
+
+	for _, bad := range []string{
+		`[`,
+		`{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"xyz"}]}]}]}`,
+		`{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":1}]}]}]}`,
+		`{"resourceSpans":[{"scopeSpans":[{"spans":[{"kind":"SPAN_KIND_BOB"}]}]}]}`,
+		`{"resourceSpans":[{"scopeSpans":[{"spans":[{"status":{"code":"BOB"}}]}]}]}`,
+	} {
+		_, err := UnmarshalTracesJSON([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
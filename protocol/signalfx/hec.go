@@ -0,0 +1,442 @@
+package signalfx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/signalfx/ingest-protocols/protocol"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
+)
+
+const (
+	hecAuthPrefix = "Splunk "
+	// hecMetricEvent is the event of HEC events whose fields are metrics
+	hecMetricEvent      = "metric"
+	hecMetricPrefix     = "metric_name:"
+	hecMetricName       = "metric_name"
+	hecMetricValue      = "_value"
+	hecDefaultEventType = "hec"
+)
+
+// the codes HEC clients expect in the body of responses
+const (
+	hecCodeSuccess       = 0
+	hecCodeInvalidData   = 6
+	hecCodeInternalError = 8
+	hecCodeServerBusy    = 9
+	hecCodeNoEvent       = 12
+)
+
+// hecError is an invalid request, along with its HEC response code
+type hecError struct {
+	text string
+	code int
+}
+
+func (e *hecError) Error() string {
+	return e.text
+}
+
+var (
+	errHECInvalidData = &hecError{text: "invalid data format", code: hecCodeInvalidData}
+	errHECNoEvent     = &hecError{text: "event field is required", code: hecCodeNoEvent}
+)
+
+// hecResponse is the JSON body of every HEC response
+type hecResponse struct {
+	Text string `json:"text"`
+	Code int    `json:"code"`
+}
+
+func writeHECResponse(rw http.ResponseWriter, status int, resp hecResponse) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, err = rw.Write(body)
+	return err
+}
+
+// hecEvent is one event of a Splunk HTTP Event Collector request
+type hecEvent struct {
+	Time       interface{}            `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	SourceType string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      interface{}            `json:"event"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+func (e *hecEvent) isMetric() bool {
+	return e.Event == hecMetricEvent
+}
+
+// dimensions are the host, source, sourcetype and index of the event that are set
+func (e *hecEvent) dimensions() map[string]string {
+	dims := make(map[string]string, 4+len(e.Fields))
+	for k, v := range map[string]string{"host": e.Host, "source": e.Source, "sourcetype": e.SourceType, "index": e.Index} {
+		if v != "" {
+			dims[k] = v
+		}
+	}
+	return dims
+}
+
+// hecTime parses the seconds since the epoch HEC times are in, which may be a number or a string
+func hecTime(t interface{}, now time.Time) time.Time {
+	var s string
+	switch v := t.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) {
+		return now
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// hecString flattens a field or event into a dimension or property value, with objects and arrays turned into JSON
+func hecString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func hecMetricDatapointValue(v interface{}) datapoint.Value {
+	var n json.Number
+	switch t := v.(type) {
+	case json.Number:
+		n = t
+	case string:
+		n = json.Number(strings.TrimSpace(t))
+	default:
+		return nil
+	}
+	if i, err := n.Int64(); err == nil {
+		return datapoint.NewIntValue(i)
+	}
+	if f, err := n.Float64(); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return datapoint.NewFloatValue(f)
+	}
+	return nil
+}
+
+func hecLogValue(v interface{}) *sfxlog.Value {
+	switch t := v.(type) {
+	case string:
+		return &sfxlog.Value{Value: &sfxlog.Value_StringValue{StringValue: t}}
+	case bool:
+		return &sfxlog.Value{Value: &sfxlog.Value_BoolValue{BoolValue: t}}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return &sfxlog.Value{Value: &sfxlog.Value_IntValue{IntValue: i}}
+		}
+		f, _ := t.Float64()
+		return &sfxlog.Value{Value: &sfxlog.Value_DoubleValue{DoubleValue: f}}
+	case []interface{}:
+		values := make([]*sfxlog.Value, 0, len(t))
+		for _, av := range t {
+			values = append(values, hecLogValue(av))
+		}
+		return &sfxlog.Value{Value: &sfxlog.Value_ArrayValue{ArrayValue: &sfxlog.ValueList{Values: values}}}
+	case map[string]interface{}:
+		return &sfxlog.Value{Value: &sfxlog.Value_KvlistValue{KvlistValue: hecKeyValues(t)}}
+	}
+	return &sfxlog.Value{}
+}
+
+// hecKeyValues turns an object into a key value list sorted by key, or nil if it is empty
+func hecKeyValues(m map[string]interface{}) *sfxlog.KeyValueList {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := &sfxlog.KeyValueList{Values: make([]*sfxlog.KeyValue, 0, len(keys))}
+	for _, k := range keys {
+		kvs.Values = append(kvs.Values, &sfxlog.KeyValue{Key: k, Value: hecLogValue(m[k])})
+	}
+	return kvs
+}
+
+// addHECTokenToContext uses the token of an "Authorization: Splunk <token>" header when there is no X-SF-TOKEN
+func addHECTokenToContext(ctx context.Context, req *http.Request) context.Context {
+	if ctx.Value(sfxclient.TokenHeaderName) != nil {
+		return ctx
+	}
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, hecAuthPrefix) {
+		if token := strings.TrimSpace(strings.TrimPrefix(auth, hecAuthPrefix)); token != "" {
+			return context.WithValue(ctx, sfxclient.TokenHeaderName, token)
+		}
+	}
+	return ctx
+}
+
+// readHECEvents reads the concatenated JSON events of a HEC event request
+func readHECEvents(req *http.Request) ([]*hecEvent, error) {
+	dec := json.NewDecoder(req.Body)
+	dec.UseNumber()
+	var events []*hecEvent
+	for {
+		var e hecEvent
+		if err := dec.Decode(&e); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, errHECInvalidData
+		}
+		if e.Event == nil || e.Event == "" {
+			return nil, errHECNoEvent
+		}
+		events = append(events, &e)
+	}
+}
+
+// readHECRaw reads each line of a HEC raw request as an event, taking host, source, sourcetype and index from the
+// query string
+func readHECRaw(req *http.Request, logger log.Logger) ([]*hecEvent, error) {
+	jeff := buffs.Get().(*bytes.Buffer)
+	defer buffs.Put(jeff)
+	jeff.Reset()
+	if err := readFromRequest(jeff, req, logger); err != nil {
+		return nil, err
+	}
+	query := req.URL.Query()
+	var events []*hecEvent
+	for _, line := range strings.Split(jeff.String(), "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) == "" {
+			continue
+		}
+		events = append(events, &hecEvent{
+			Host:       query.Get("host"),
+			Source:     query.Get("source"),
+			SourceType: query.Get("sourcetype"),
+			Index:      query.Get("index"),
+			Event:      line,
+		})
+	}
+	return events, nil
+}
+
+// HECDecoderV1 decodes Splunk HTTP Event Collector requests.  Metric events are sent to Sink as datapoints and every
+// other event is sent to LogSink as logs, or to Sink as events if there is no LogSink.
+type HECDecoderV1 struct {
+	Sink    Sink
+	LogSink sfxlog.LogSink
+	Logger  log.Logger
+	// Raw reads each line of the body as an event instead of reading HEC JSON
+	Raw          bool
+	invalidValue int64
+}
+
+// Datapoints returns how many metric values the decoder could not parse
+func (decoder *HECDecoderV1) Datapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.Counter("dropped_points", map[string]string{"protocol": "hec", "reason": "invalid_value"}, atomic.LoadInt64(&decoder.invalidValue)),
+	}
+}
+
+// writeSuccess writes the response HEC clients expect
+func (decoder *HECDecoderV1) writeSuccess(rw http.ResponseWriter, req *http.Request) error {
+	return writeHECResponse(rw, http.StatusOK, hecResponse{Text: "Success", Code: hecCodeSuccess})
+}
+
+// writeError responds with the status and code HEC uses for err: a 400 for invalid requests, the status and
+// Retry-After of backoff errors as "server is busy", and a 500 for everything else
+func (decoder *HECDecoderV1) writeError(rw http.ResponseWriter, err error) error {
+	if invalid, ok := err.(*hecError); ok {
+		return writeHECResponse(rw, http.StatusBadRequest, hecResponse{Text: invalid.text, Code: invalid.code})
+	}
+	if backoff, ok := protocol.AsBackoffError(err); ok {
+		rw.Header().Set("Retry-After", protocol.RetryAfterSeconds(backoff.RetryAfter()))
+		return writeHECResponse(rw, backoff.StatusCode(), hecResponse{Text: backoff.Error(), Code: hecCodeServerBusy})
+	}
+	return writeHECResponse(rw, http.StatusInternalServerError, hecResponse{Text: err.Error(), Code: hecCodeInternalError})
+}
+
+func (decoder *HECDecoderV1) Read(ctx context.Context, req *http.Request) error {
+	ctx = addHECTokenToContext(ctx, req)
+	var events []*hecEvent
+	var err error
+	if decoder.Raw {
+		events, err = readHECRaw(req, decoder.Logger)
+	} else {
+		events, err = readHECEvents(req)
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var dps []*datapoint.Datapoint
+	var others []*hecEvent
+	for _, e := range events {
+		if e.isMetric() {
+			dps = append(dps, decoder.datapoints(e, now)...)
+		} else {
+			others = append(others, e)
+		}
+	}
+	var errs []error
+	if len(dps) > 0 {
+		errs = append(errs, decoder.Sink.AddDatapoints(ctx, dps))
+	}
+	if len(others) > 0 {
+		errs = append(errs, decoder.addOthers(ctx, others, now))
+	}
+	return protocol.NewMultiErr(errs)
+}
+
+// hecMetrics splits the fields of a metric event into the value of each "metric_name:<name>" field, or the "_value"
+// field of a "metric_name" field, and the other fields, which are dimensions
+func hecMetrics(fields map[string]interface{}) (map[string]interface{}, map[string]string) {
+	values := make(map[string]interface{})
+	dims := make(map[string]string, len(fields))
+	for k, v := range fields {
+		switch {
+		case strings.HasPrefix(k, hecMetricPrefix):
+			values[strings.TrimPrefix(k, hecMetricPrefix)] = v
+		case k == hecMetricName || k == hecMetricValue:
+		default:
+			dims[k] = hecString(v)
+		}
+	}
+	if name, ok := fields[hecMetricName].(string); ok {
+		values[name] = fields[hecMetricValue]
+	}
+	return values, dims
+}
+
+// datapoints makes a gauge of each metric of a metric event
+func (decoder *HECDecoderV1) datapoints(e *hecEvent, now time.Time) []*datapoint.Datapoint {
+	values, fieldDims := hecMetrics(e.Fields)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ts := hecTime(e.Time, now)
+	dps := make([]*datapoint.Datapoint, 0, len(names))
+	for _, name := range names {
+		value := hecMetricDatapointValue(values[name])
+		if value == nil {
+			atomic.AddInt64(&decoder.invalidValue, 1)
+			continue
+		}
+		dims := e.dimensions()
+		for k, v := range fieldDims {
+			dims[k] = v
+		}
+		dps = append(dps, datapoint.New(name, dims, value, datapoint.Gauge, ts))
+	}
+	return dps
+}
+
+func (decoder *HECDecoderV1) addOthers(ctx context.Context, others []*hecEvent, now time.Time) error {
+	if decoder.LogSink != nil {
+		return decoder.LogSink.AddLogs(context.WithValue(ctx, LogProtocolType, HECV1Protocol), hecLogs(others, now))
+	}
+	return decoder.Sink.AddEvents(ctx, hecEvents(others, now))
+}
+
+// hecLogs makes a log record of each event, grouping the events with the same host, source, sourcetype and index
+// into the same resource logs
+func hecLogs(events []*hecEvent, now time.Time) []*sfxlog.ResourceLogs {
+	var logs []*sfxlog.ResourceLogs
+	byResource := make(map[[4]string]*sfxlog.ResourceLogs)
+	for _, e := range events {
+		key := [4]string{e.Host, e.Source, e.SourceType, e.Index}
+		rl, exists := byResource[key]
+		if !exists {
+			resource := make(map[string]interface{})
+			for k, v := range e.dimensions() {
+				resource[k] = v
+			}
+			rl = &sfxlog.ResourceLogs{Resource: hecKeyValues(resource)}
+			byResource[key] = rl
+			logs = append(logs, rl)
+		}
+		rl.LogRecords = append(rl.LogRecords, &sfxlog.LogRecord{
+			Timestamp:  &sfxlog.TimeField{Value: &sfxlog.TimeField_NumericValue{NumericValue: uint64(hecTime(e.Time, now).UnixNano())}},
+			Body:       hecLogValue(e.Event),
+			Attributes: hecKeyValues(e.Fields),
+		})
+	}
+	return logs
+}
+
+// hecEvents makes a SignalFx event of each event, typed by its sourcetype, with its fields as dimensions
+func hecEvents(events []*hecEvent, now time.Time) []*event.Event {
+	evts := make([]*event.Event, 0, len(events))
+	for _, e := range events {
+		dims := e.dimensions()
+		for k, v := range e.Fields {
+			dims[k] = hecString(v)
+		}
+		eventType := e.SourceType
+		if eventType == "" {
+			eventType = hecDefaultEventType
+		}
+		evts = append(evts, event.NewWithProperties(eventType, event.USERDEFINED, dims, map[string]interface{}{"event": hecString(e.Event)}, hecTime(e.Time, now)))
+	}
+	return evts
+}
+
+// hecDecoder sends logs through the chain, like every other item, when the listener's sink accepts logs
+func hecDecoder(s Sink, acceptsLogs bool, logger log.Logger, raw bool) *HECDecoderV1 {
+	decoder := &HECDecoderV1{Sink: s, Logger: logger, Raw: raw}
+	if acceptsLogs {
+		decoder.LogSink = s.(sfxlog.LogSink)
+	}
+	return decoder
+}
+
+func setupHECV1(ctx context.Context, r *mux.Router, sink Sink, acceptsLogs bool, logger log.Logger, httpChain web.NextConstructor, counter *dpsink.Counter) sfxclient.Collector {
+	var decoder *HECDecoderV1
+	eventHandler, eventStats := SetupChain(ctx, sink, HECEventV1, func(s Sink) ErrorReader {
+		decoder = hecDecoder(s, acceptsLogs, logger, false)
+		return decoder
+	}, httpChain, logger, counter)
+	rawHandler, rawStats := SetupChain(ctx, sink, HECRawV1, func(s Sink) ErrorReader {
+		return hecDecoder(s, acceptsLogs, logger, true)
+	}, httpChain, logger, counter)
+	for _, path := range []string{HECEventPathV1, HECEventPathV1 + "/1.0", "/services/collector"} {
+		r.Path(path).Methods("POST").Handler(eventHandler)
+	}
+	for _, path := range []string{HECRawPathV1, HECRawPathV1 + "/1.0"} {
+		r.Path(path).Methods("POST").Handler(rawHandler)
+	}
+	return sfxclient.NewMultiCollector(eventStats, decoder, rawStats)
+}
@@ -0,0 +1,192 @@
+package signalfx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/nettest"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const hecTestEvents = `{"time":1426279439.5,"host":"web1","source":"app","sourcetype":"access","index":"main","event":"GET /","fields":{"status":200}}
+{"time":"1426279440","host":"web1","source":"app","sourcetype":"access","index":"main","event":{"path":"/a","ok":true,"sizes":[1,2.5]}}
+{"host":"web2","event":"hello"}
+{"time":1426279439,"host":"web1","event":"metric","fields":{"metric_name:cpu.idle":99.5,"metric_name:mem.used":"1024","metric_name:bad":"x","region":"us"}}
+{"time":1426279439,"event":"metric","fields":{"metric_name":"disk.free","_value":7}}`
+
+func TestHECDecoderV1(t *testing.T) {
+	Convey("given a HEC decoder with a log sink", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(1)
+		logs := newLogSink()
+		decoder := &HECDecoderV1{Sink: sendTo, LogSink: logs, Logger: log.Discard}
+		read := func(ctx context.Context, path string, body string) error {
+			req, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+			So(err, ShouldBeNil)
+			req.Header.Set("Authorization", "Splunk hectoken")
+			return decoder.Read(ctx, req)
+		}
+		Convey("metric events should become datapoints", func() {
+			So(read(context.Background(), HECEventPathV1, hecTestEvents), ShouldBeNil)
+			dps := <-sendTo.PointsChan
+			So(len(dps), ShouldEqual, 3)
+			So(dps[0].Metric, ShouldEqual, "cpu.idle")
+			So(dps[0].Value, ShouldResemble, datapoint.NewFloatValue(99.5))
+			So(dps[0].MetricType, ShouldEqual, datapoint.Gauge)
+			So(dps[0].Dimensions, ShouldResemble, map[string]string{"host": "web1", "region": "us"})
+			So(dps[0].Timestamp, ShouldResemble, time.Unix(1426279439, 0))
+			So(dps[1].Metric, ShouldEqual, "mem.used")
+			So(dps[1].Value, ShouldResemble, datapoint.NewIntValue(1024))
+			So(dps[2].Metric, ShouldEqual, "disk.free")
+			So(dps[2].Dimensions, ShouldResemble, map[string]string{})
+			So(dptest.ExactlyOne(decoder.Datapoints(), "dropped_points").Value, ShouldResemble, datapoint.NewIntValue(1))
+		})
+		Convey("other events should become logs grouped by resource", func() {
+			So(read(context.Background(), HECEventPathV1, hecTestEvents), ShouldBeNil)
+			resourceLogs := <-logs.logs
+			So(logs.token, ShouldEqual, "hectoken")
+			So(len(resourceLogs), ShouldEqual, 2)
+			So(resourceLogs[0].Resource.Values[0].Key, ShouldEqual, "host")
+			So(len(resourceLogs[0].Resource.Values), ShouldEqual, 4)
+			records := resourceLogs[0].LogRecords
+			So(len(records), ShouldEqual, 2)
+			So(records[0].Timestamp.GetNumericValue(), ShouldEqual, uint64(time.Unix(1426279439, 5e8).UnixNano()))
+			So(records[0].Body.GetStringValue(), ShouldEqual, "GET /")
+			So(records[0].Attributes.Values[0].Key, ShouldEqual, "status")
+			So(records[0].Attributes.Values[0].Value.GetIntValue(), ShouldEqual, 200)
+			So(records[1].Timestamp.GetNumericValue(), ShouldEqual, uint64(time.Unix(1426279440, 0).UnixNano()))
+			body := records[1].Body.GetKvlistValue().Values
+			So(body[0].Key, ShouldEqual, "ok")
+			So(body[0].Value.GetBoolValue(), ShouldBeTrue)
+			So(body[2].Value.GetArrayValue().Values[1].GetDoubleValue(), ShouldEqual, 2.5)
+			So(records[1].Attributes, ShouldBeNil)
+			So(resourceLogs[1].Resource.Values[0].Value.GetStringValue(), ShouldEqual, "web2")
+		})
+		Convey("X-SF-TOKEN should win over the Splunk token", func() {
+			So(read(context.WithValue(context.Background(), sfxclient.TokenHeaderName, "sfx"), HECEventPathV1, `{"event":"hi"}`), ShouldBeNil)
+			<-logs.logs
+			So(logs.token, ShouldEqual, "sfx")
+		})
+		Convey("raw lines should become logs", func() {
+			decoder.Raw = true
+			So(read(context.Background(), HECRawPathV1+"?host=web3&sourcetype=syslog", "line one\r\n\n  \nline two"), ShouldBeNil)
+			resourceLogs := <-logs.logs
+			So(len(resourceLogs), ShouldEqual, 1)
+			So(resourceLogs[0].Resource.Values[0].Value.GetStringValue(), ShouldEqual, "web3")
+			So(len(resourceLogs[0].LogRecords), ShouldEqual, 2)
+			So(resourceLogs[0].LogRecords[0].Body.GetStringValue(), ShouldEqual, "line one")
+			So(resourceLogs[0].LogRecords[1].Body.GetStringValue(), ShouldEqual, "line two")
+		})
+		Convey("invalid requests should be errors", func() {
+			So(read(context.Background(), HECEventPathV1, `{"event":`), ShouldEqual, errHECInvalidData)
+			So(read(context.Background(), HECEventPathV1, `{"host":"a"}`), ShouldEqual, errHECNoEvent)
+			So(read(context.Background(), HECEventPathV1, `{"event":""}`), ShouldEqual, errHECNoEvent)
+		})
+		Convey("sink errors should be returned", func() {
+			logs.err = errors.New("nope")
+			So(read(context.Background(), HECEventPathV1, `{"event":"hi"}`), ShouldEqual, logs.err)
+		})
+		Convey("errors should be written as HEC responses", func() {
+			for _, tt := range []struct {
+				err    error
+				status int
+				body   string
+			}{
+				{err: errHECNoEvent, status: http.StatusBadRequest, body: `{"text":"event field is required","code":12}`},
+				{err: &ErrRateLimited{Type: "log", Delay: time.Second}, status: http.StatusTooManyRequests, body: `{"text":"rate limit exceeded for log, retry after 1s","code":9}`},
+				{err: errors.New("nope"), status: http.StatusInternalServerError, body: `{"text":"nope","code":8}`},
+			} {
+				rw := httptest.NewRecorder()
+				So(decoder.writeError(rw, tt.err), ShouldBeNil)
+				So(rw.Code, ShouldEqual, tt.status)
+				So(rw.Body.String(), ShouldEqual, tt.body)
+				So(rw.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			}
+		})
+	})
+	Convey("given a HEC decoder without a log sink", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(1)
+		decoder := &HECDecoderV1{Sink: sendTo, Logger: log.Discard}
+		req, err := http.NewRequest("POST", HECEventPathV1, bytes.NewBufferString(`{"time":1,"host":"a","event":{"msg":"hi"},"fields":{"n":1.5}}{"event":"hello","sourcetype":"app"}`))
+		So(err, ShouldBeNil)
+		Convey("events should become SignalFx events", func() {
+			So(decoder.Read(context.Background(), req), ShouldBeNil)
+			events := <-sendTo.EventsChan
+			So(len(events), ShouldEqual, 2)
+			So(events[0].EventType, ShouldEqual, "hec")
+			So(events[0].Category, ShouldEqual, event.USERDEFINED)
+			So(events[0].Dimensions, ShouldResemble, map[string]string{"host": "a", "n": "1.5"})
+			So(events[0].Properties, ShouldResemble, map[string]interface{}{"event": `{"msg":"hi"}`})
+			So(events[0].Timestamp, ShouldResemble, time.Unix(1, 0))
+			So(events[1].EventType, ShouldEqual, "app")
+			So(time.Since(events[1].Timestamp), ShouldBeLessThan, time.Minute)
+		})
+	})
+	Convey("HEC values should flatten", t, func() {
+		So(hecString(nil), ShouldEqual, "")
+		So(hecString(true), ShouldEqual, "true")
+		So(hecString([]interface{}{"a"}), ShouldEqual, `["a"]`)
+		So(hecLogValue(nil), ShouldResemble, &sfxlog.Value{})
+		So(hecMetricDatapointValue(true), ShouldBeNil)
+		So(hecMetricDatapointValue("1e999"), ShouldBeNil)
+	})
+}
+
+func TestHECListener(t *testing.T) {
+	Convey("given a signalfx listener", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(1)
+		listener, err := NewListener(sendTo, &ListenerConfig{ListenAddr: pointer.String("127.0.0.1:0"), Counter: &dpsink.Counter{}, HTTPChain: passThroughChain})
+		So(err, ShouldBeNil)
+		baseURI := fmt.Sprintf("http://127.0.0.1:%d", nettest.TCPPort(listener.listener))
+		post := func(path string, body string) (*http.Response, string) {
+			req, err := http.NewRequest("POST", baseURI+path, bytes.NewBufferString(body))
+			So(err, ShouldBeNil)
+			req.Header.Set("Authorization", "Splunk token")
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			respBody, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			return resp, string(respBody)
+		}
+		Convey("Should accept HEC events", func() {
+			for _, path := range []string{HECEventPathV1, HECEventPathV1 + "/1.0", "/services/collector"} {
+				resp, body := post(path, hecTestEvents)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(body, ShouldEqual, `{"text":"Success","code":0}`)
+				So(len(<-sendTo.PointsChan), ShouldEqual, 3)
+				So(len(<-sendTo.EventsChan), ShouldEqual, 3)
+			}
+		})
+		Convey("Should accept HEC raw text", func() {
+			resp, _ := post(HECRawPathV1+"/1.0?sourcetype=syslog", "a\nb")
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(len(<-sendTo.EventsChan), ShouldEqual, 2)
+		})
+		Convey("Should reject invalid HEC events", func() {
+			resp, body := post(HECEventPathV1, "{")
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(body, ShouldEqual, `{"text":"invalid data format","code":6}`)
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package signalfx
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/web"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
+)
+
+func isProtobuf(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-protobuf")
+}
+
+// LogDecoderV1 decodes protobuf and JSON log requests and sends their resource logs to Sink
+type LogDecoderV1 struct {
+	Sink       sfxlog.LogSink
+	Logger     log.Logger
+	logRecords int64
+}
+
+// Datapoints returns how many log records the decoder has read
+func (decoder *LogDecoderV1) Datapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.Cumulative("total_log_records", map[string]string{"protocol": "sfx_" + LogV1}, atomic.LoadInt64(&decoder.logRecords)),
+	}
+}
+
+func (decoder *LogDecoderV1) Read(ctx context.Context, req *http.Request) error {
+	jeff := buffs.Get().(*bytes.Buffer)
+	defer buffs.Put(jeff)
+	jeff.Reset()
+	if err := readFromRequest(jeff, req, decoder.Logger); err != nil {
+		return err
+	}
+	var msg sfxlog.LogRequest
+	if isProtobuf(req) {
+		if err := proto.Unmarshal(jeff.Bytes(), &msg); err != nil {
+			return err
+		}
+	} else if err := (&jsonpb.Unmarshaler{AllowUnknownFields: true}).Unmarshal(jeff, &msg); err != nil {
+		return errInvalidJSONFormat
+	}
+	records := logRecordCount(msg.ResourceLogs)
+	if records == 0 {
+		return nil
+	}
+	atomic.AddInt64(&decoder.logRecords, int64(records))
+	return decoder.Sink.AddLogs(ctx, msg.ResourceLogs)
+}
+
+func logRecordCount(logs []*sfxlog.ResourceLogs) int {
+	records := 0
+	for _, rl := range logs {
+		records += len(rl.GetLogRecords())
+	}
+	return records
+}
+
+// logCounter counts the calls with logs on the listener's counter, which only has item totals for datapoints,
+// events and spans
+type logCounter struct {
+	NextSink
+	counter *dpsink.Counter
+}
+
+var _ NextLogSink = &logCounter{}
+
+// AddLogs tracks the call, its time and whether it failed
+func (c *logCounter) AddLogs(ctx context.Context, logs []*sfxlog.ResourceLogs, next sfxlog.LogSink) error {
+	atomic.AddInt64(&c.counter.TotalProcessCalls, 1)
+	atomic.AddInt64(&c.counter.CallsInFlight, 1)
+	start := time.Now()
+	err := next.AddLogs(ctx, logs)
+	atomic.AddInt64(&c.counter.TotalProcessTimeNs, time.Since(start).Nanoseconds())
+	atomic.AddInt64(&c.counter.CallsInFlight, -1)
+	if err != nil {
+		atomic.AddInt64(&c.counter.TotalProcessErrors, 1)
+	}
+	return err
+}
+
+// setupLogV1 reads logs into the chain, which only reaches sink's AddLogs if sink is a sfxlog.LogSink
+func setupLogV1(ctx context.Context, r *mux.Router, sink Sink, logger log.Logger, httpChain web.NextConstructor, counter *dpsink.Counter) sfxclient.Collector {
+	decoder := &LogDecoderV1{Logger: logger}
+	handler, st := SetupChain(ctx, sink, LogV1, func(s Sink) ErrorReader {
+		decoder.Sink = s.(sfxlog.LogSink)
+		return decoder
+	}, httpChain, logger, counter)
+	r.Path(DefaultLogPathV1).Methods("POST").Headers("Content-Type", "application/x-protobuf").Handler(handler)
+	SetupJSONByPaths(r, handler, DefaultLogPathV1)
+	return sfxclient.NewMultiCollector(st, decoder)
+}
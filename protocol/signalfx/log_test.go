@@ -0,0 +1,198 @@
+package signalfx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/nettest"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const logJSON = `{"resourceLogs":[{"resource":{"values":[{"key":"host","value":{"stringValue":"a"}}]},
+"logRecords":[{"Timestamp":{"numericValue":"1000"},"SeverityText":"INFO","Name":"json","Body":{"stringValue":"hello"},
+"Attributes":{"values":[{"key":"retries","value":{"intValue":"2"}}]}},{"Body":{"kvlistValue":{"values":[{"key":"ok","value":{"boolValue":true}}]}}}],
+"unknown":1}]}`
+
+type logSink struct {
+	*dptest.BasicSink
+	logs  chan []*sfxlog.ResourceLogs
+	token interface{}
+	err   error
+}
+
+func newLogSink() *logSink {
+	return &logSink{BasicSink: dptest.NewBasicSink(), logs: make(chan []*sfxlog.ResourceLogs, 1)}
+}
+
+func (s *logSink) AddLogs(ctx context.Context, logs []*sfxlog.ResourceLogs) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.token = ctx.Value(sfxclient.TokenHeaderName)
+	s.logs <- logs
+	return nil
+}
+
+func logRequest() *sfxlog.LogRequest {
+	return &sfxlog.LogRequest{ResourceLogs: []*sfxlog.ResourceLogs{{
+		LogRecords: []*sfxlog.LogRecord{{
+			Name:      "proto",
+			Timestamp: &sfxlog.TimeField{Value: &sfxlog.TimeField_NumericValue{NumericValue: 1000}},
+			Body:      &sfxlog.Value{Value: &sfxlog.Value_StringValue{StringValue: "hello"}},
+		}},
+	}}}
+}
+
+func TestLogDecoderV1(t *testing.T) {
+	Convey("given a log decoder", t, func() {
+		sink := newLogSink()
+		decoder := &LogDecoderV1{Sink: sink, Logger: log.Discard}
+		read := func(contentType string, body []byte) error {
+			req, err := http.NewRequest("POST", DefaultLogPathV1, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			req.Header.Set("Content-Type", contentType)
+			return decoder.Read(context.Background(), req)
+		}
+		Convey("protobuf requests should be read", func() {
+			body, err := proto.Marshal(logRequest())
+			So(err, ShouldBeNil)
+			So(read("application/x-protobuf", body), ShouldBeNil)
+			logs := <-sink.logs
+			So(len(logs), ShouldEqual, 1)
+			So(logs[0].LogRecords[0].Name, ShouldEqual, "proto")
+			So(logs[0].LogRecords[0].GetTimestamp().GetNumericValue(), ShouldEqual, 1000)
+			So(logs[0].LogRecords[0].GetBody().GetStringValue(), ShouldEqual, "hello")
+		})
+		Convey("JSON requests should be read", func() {
+			So(read("application/json", []byte(logJSON)), ShouldBeNil)
+			logs := <-sink.logs
+			So(logs[0].GetResource().Values[0].Key, ShouldEqual, "host")
+			records := logs[0].LogRecords
+			So(len(records), ShouldEqual, 2)
+			So(records[0].Name, ShouldEqual, "json")
+			So(records[0].SeverityText, ShouldEqual, "INFO")
+			So(records[0].GetTimestamp().GetNumericValue(), ShouldEqual, 1000)
+			So(records[0].GetBody().GetStringValue(), ShouldEqual, "hello")
+			So(records[0].GetAttributes().Values[0].Value.GetIntValue(), ShouldEqual, 2)
+			So(records[1].GetBody().GetKvlistValue().Values[0].Value.GetBoolValue(), ShouldBeTrue)
+			So(dptest.ExactlyOne(decoder.Datapoints(), "total_log_records").Value, ShouldResemble, datapoint.NewIntValue(2))
+		})
+		Convey("requests without log records should not be sent", func() {
+			So(read("application/x-protobuf", nil), ShouldBeNil)
+			So(read("application/json", []byte(`{"resourceLogs":[{}]}`)), ShouldBeNil)
+			So(len(sink.logs), ShouldEqual, 0)
+		})
+		Convey("invalid requests should be errors", func() {
+			So(read("application/x-protobuf", []byte{0xff}), ShouldNotBeNil)
+			So(read("application/json", []byte("{")), ShouldEqual, errInvalidJSONFormat)
+		})
+		Convey("sink errors should be returned", func() {
+			sink.err = errors.New("nope")
+			So(read("application/json", []byte(logJSON)), ShouldEqual, sink.err)
+		})
+	})
+}
+
+func TestLogListener(t *testing.T) {
+	Convey("given a signalfx listener with a sink that takes logs", t, func() {
+		sink := newLogSink()
+		counter := &dpsink.Counter{}
+		listener, err := NewListener(sink, &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:0"),
+			Counter:    counter,
+			RateLimit:  &RateLimit{LogRecordsPerSecond: pointer.Float64(1)},
+			HTTPChain:  passThroughChain,
+		})
+		So(err, ShouldBeNil)
+		baseURI := fmt.Sprintf("http://127.0.0.1:%d", nettest.TCPPort(listener.listener))
+		post := func(contentType string, body []byte) *http.Response {
+			req, err := http.NewRequest("POST", baseURI+DefaultLogPathV1, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set(sfxclient.TokenHeaderName, "token")
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			return resp
+		}
+		Convey("Should accept JSON logs", func() {
+			So(post("application/json", []byte(logJSON)).StatusCode, ShouldEqual, http.StatusOK)
+			So(len(<-sink.logs), ShouldEqual, 1)
+			So(sink.token, ShouldEqual, "token")
+			So(atomic.LoadInt64(&counter.TotalProcessCalls), ShouldEqual, 1)
+		})
+		Convey("Should rate limit logs", func() {
+			So(post("application/json", []byte(logJSON)).StatusCode, ShouldEqual, http.StatusOK)
+			<-sink.logs
+			So(post("application/json", []byte(logJSON)).StatusCode, ShouldEqual, http.StatusTooManyRequests)
+		})
+		Convey("Should accept protobuf logs", func() {
+			body, err := proto.Marshal(logRequest())
+			So(err, ShouldBeNil)
+			So(post("application/x-protobuf", body).StatusCode, ShouldEqual, http.StatusOK)
+			So((<-sink.logs)[0].LogRecords[0].Name, ShouldEqual, "proto")
+		})
+		Convey("Should reject invalid logs", func() {
+			So(post("application/x-protobuf", []byte{0xff}).StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+	Convey("a signalfx listener whose sink does not take logs should not serve them", t, func() {
+		listener, err := NewListener(dptest.NewBasicSink(), &ListenerConfig{ListenAddr: pointer.String("127.0.0.1:0")})
+		So(err, ShouldBeNil)
+		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d%s", nettest.TCPPort(listener.listener), DefaultLogPathV1), "application/json", bytes.NewBufferString(logJSON))
+		So(err, ShouldBeNil)
+		So(resp.Body.Close(), ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		So(listener.Close(), ShouldBeNil)
+	})
+	Convey("a signalfx listener whose wrapped sink does not take logs", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(1)
+		listener, err := NewListener(IncludingDimensions(map[string]string{"env": "test"}, sendTo), &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:0"),
+			Counter:    &dpsink.Counter{},
+			HTTPChain:  passThroughChain,
+		})
+		So(err, ShouldBeNil)
+		baseURI := fmt.Sprintf("http://127.0.0.1:%d", nettest.TCPPort(listener.listener))
+		Convey("should not serve logs", func() {
+			resp, err := http.Post(baseURI+DefaultLogPathV1, "application/json", bytes.NewBufferString(logJSON))
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("should send HEC events as events", func() {
+			resp, err := http.Post(baseURI+HECEventPathV1, "application/json", bytes.NewBufferString(`{"host":"web2","event":"hello"}`))
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			events := <-sendTo.EventsChan
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Dimensions["env"], ShouldEqual, "test")
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+	Convey("chain wrappers should take logs only if the end of the chain does", t, func() {
+		So(acceptsLogs(dptest.NewBasicSink()), ShouldBeFalse)
+		So(acceptsLogs(FromChain(dptest.NewBasicSink(), NextWrap(&WithDimensions{}))), ShouldBeFalse)
+		So(acceptsLogs(FromChain(newLogSink(), NextWrap(&WithDimensions{}), NextWrap(&WithDimensions{}))), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,432 @@
+package signalfx
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx/format/otlp"
+)
+
+const otlpServiceNameKey = "service.name"
+
+func isOTLPJSON(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+}
+
+// otlpResponder writes the empty export response OTLP/HTTP clients expect, in the encoding they sent
+type otlpResponder struct{}
+
+func (otlpResponder) writeSuccess(rw http.ResponseWriter, req *http.Request) error {
+	if isOTLPJSON(req) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, err := rw.Write([]byte(`{}`))
+		return err
+	}
+	rw.Header().Set("Content-Type", "application/x-protobuf")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func readOTLPRequest(req *http.Request, logger log.Logger, fromJSON func([]byte) error, fromProto func([]byte) error) error {
+	jeff := buffs.Get().(*bytes.Buffer)
+	defer buffs.Put(jeff)
+	jeff.Reset()
+	if err := readFromRequest(jeff, req, logger); err != nil {
+		return err
+	}
+	if isOTLPJSON(req) {
+		return fromJSON(jeff.Bytes())
+	}
+	return fromProto(jeff.Bytes())
+}
+
+// OTLPMetricsDecoder decodes OTLP/HTTP metric export requests and sends gauges and sums to Sink
+type OTLPMetricsDecoder struct {
+	otlpResponder
+	Sink            dpsink.Sink
+	Logger          log.Logger
+	unsupportedType int64
+	invalidValue    int64
+}
+
+// Datapoints returns datapoints for the OTLP metrics decoder
+func (decoder *OTLPMetricsDecoder) Datapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.Counter("dropped_points", map[string]string{"protocol": "otlp", "reason": "unsupported_metric_type"}, atomic.LoadInt64(&decoder.unsupportedType)),
+		sfxclient.Counter("dropped_points", map[string]string{"protocol": "otlp", "reason": "invalid_value"}, atomic.LoadInt64(&decoder.invalidValue)),
+	}
+}
+
+func (decoder *OTLPMetricsDecoder) Read(ctx context.Context, req *http.Request) error {
+	var msg *otlp.MetricsRequest
+	err := readOTLPRequest(req, decoder.Logger, func(b []byte) (err error) {
+		msg, err = otlp.UnmarshalMetricsJSON(b)
+		return err
+	}, func(b []byte) (err error) {
+		msg, err = otlp.UnmarshalMetricsProto(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	dps := decoder.convert(msg)
+	if len(dps) > 0 {
+		err = decoder.Sink.AddDatapoints(ctx, dps)
+	}
+	return err
+}
+
+func (decoder *OTLPMetricsDecoder) convert(msg *otlp.MetricsRequest) []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0)
+	for _, rm := range msg.ResourceMetrics {
+		if rm == nil {
+			continue
+		}
+		resourceDims := make(map[string]string)
+		if rm.Resource != nil {
+			otlpAttributesToMap(resourceDims, rm.Resource.Attributes)
+		}
+		for _, sm := range rm.AllScopeMetrics() {
+			if sm == nil {
+				continue
+			}
+			for _, m := range sm.Metrics {
+				dps = decoder.appendMetric(dps, m, resourceDims)
+			}
+		}
+	}
+	return dps
+}
+
+func (decoder *OTLPMetricsDecoder) appendMetric(dps []*datapoint.Datapoint, m *otlp.Metric, resourceDims map[string]string) []*datapoint.Datapoint {
+	if m == nil {
+		return dps
+	}
+	if m.Unsupported {
+		atomic.AddInt64(&decoder.unsupportedType, 1)
+		return dps
+	}
+	var points []*otlp.NumberDataPoint
+	if m.Sum != nil {
+		points = m.Sum.DataPoints
+	} else {
+		points = m.Gauge.DataPoints
+	}
+	mt := otlpMetricType(m)
+	for _, p := range points {
+		if p == nil {
+			continue
+		}
+		value := otlpDatapointValue(p)
+		if value == nil {
+			atomic.AddInt64(&decoder.invalidValue, 1)
+			continue
+		}
+		dims := make(map[string]string, len(resourceDims)+len(p.Attributes))
+		for k, v := range resourceDims {
+			dims[k] = v
+		}
+		otlpAttributesToMap(dims, p.Attributes)
+		dps = append(dps, datapoint.New(m.Name, dims, value, mt, otlpTimestamp(p.TimeUnixNano)))
+	}
+	return dps
+}
+
+// otlpMetricType maps a metric onto SignalFx types the same way the OpenTelemetry collector's SignalFx
+// exporter does: monotonic delta sums are counters, monotonic cumulative sums are cumulative counters
+// and everything else is a gauge
+func otlpMetricType(m *otlp.Metric) datapoint.MetricType {
+	if m.Sum == nil || !m.Sum.IsMonotonic {
+		return datapoint.Gauge
+	}
+	if m.Sum.AggregationTemporality == otlp.AggregationTemporalityDelta {
+		return datapoint.Count
+	}
+	return datapoint.Counter
+}
+
+func otlpDatapointValue(p *otlp.NumberDataPoint) datapoint.Value {
+	if p.AsInt != nil {
+		return datapoint.NewIntValue(int64(*p.AsInt))
+	}
+	if p.AsDouble != nil && !math.IsNaN(*p.AsDouble) && !math.IsInf(*p.AsDouble, 0) {
+		return datapoint.NewFloatValue(*p.AsDouble)
+	}
+	return nil
+}
+
+func otlpTimestamp(ns otlp.Uint64) time.Time {
+	if ns == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, int64(ns))
+}
+
+func otlpRawValue(v *otlp.AnyValue) interface{} {
+	switch {
+	case v == nil:
+		return nil
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, av := range v.ArrayValue.Values {
+			values = append(values, otlpRawValue(av))
+		}
+		return values
+	case v.KvlistValue != nil:
+		return otlpRawMap(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		return v.BytesValue
+	}
+	return nil
+}
+
+func otlpRawMap(kvs []*otlp.KeyValue) map[string]interface{} {
+	values := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		if kv != nil {
+			values[kv.Key] = otlpRawValue(kv.Value)
+		}
+	}
+	return values
+}
+
+// otlpAttributeString flattens an attribute value into a dimension or tag value, with arrays, maps and
+// bytes turned into JSON
+func otlpAttributeString(v *otlp.AnyValue) string {
+	switch raw := otlpRawValue(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return raw
+	case bool:
+		return strconv.FormatBool(raw)
+	case int64:
+		return strconv.FormatInt(raw, 10)
+	case float64:
+		return strconv.FormatFloat(raw, 'f', -1, 64)
+	default:
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+func otlpAttributesToMap(dst map[string]string, attrs []*otlp.KeyValue) {
+	for _, kv := range attrs {
+		if kv == nil {
+			continue
+		}
+		if val := otlpAttributeString(kv.Value); val != "" {
+			dst[kv.Key] = val
+		}
+	}
+}
+
+// OTLPTraceDecoder decodes OTLP/HTTP trace export requests and sends the spans to Sink
+type OTLPTraceDecoder struct {
+	otlpResponder
+	Sink   trace.Sink
+	Logger log.Logger
+}
+
+func (decoder *OTLPTraceDecoder) Read(ctx context.Context, req *http.Request) error {
+	var msg *otlp.TracesRequest
+	err := readOTLPRequest(req, decoder.Logger, func(b []byte) (err error) {
+		msg, err = otlp.UnmarshalTracesJSON(b)
+		return err
+	}, func(b []byte) (err error) {
+		msg, err = otlp.UnmarshalTracesProto(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	spans := convertOTLPTraces(msg)
+	if len(spans) > 0 {
+		err = decoder.Sink.AddSpans(ctx, spans)
+	}
+	return err
+}
+
+func convertOTLPTraces(msg *otlp.TracesRequest) []*trace.Span {
+	spans := make([]*trace.Span, 0)
+	for _, rs := range msg.ResourceSpans {
+		if rs == nil {
+			continue
+		}
+		var serviceName *string
+		resourceTags := make(map[string]string)
+		if rs.Resource != nil {
+			otlpAttributesToMap(resourceTags, rs.Resource.Attributes)
+		}
+		if name, exists := resourceTags[otlpServiceNameKey]; exists {
+			serviceName = pointer.String(name)
+			delete(resourceTags, otlpServiceNameKey)
+		}
+		for _, ss := range rs.AllScopeSpans() {
+			if ss == nil {
+				continue
+			}
+			for _, s := range ss.Spans {
+				if s != nil {
+					spans = append(spans, convertOTLPSpan(s, serviceName, resourceTags))
+				}
+			}
+		}
+	}
+	return spans
+}
+
+func convertOTLPSpan(s *otlp.Span, serviceName *string, resourceTags map[string]string) *trace.Span {
+	tags := make(map[string]string, len(resourceTags)+len(s.Attributes)+3)
+	for k, v := range resourceTags {
+		tags[k] = v
+	}
+	remote := otlpSpanTags(tags, s.Attributes)
+	if s.Status != nil {
+		switch s.Status.Code {
+		case otlp.StatusCodeError:
+			tags[string(ext.Error)] = "true"
+			tags["otel.status_code"] = "ERROR"
+		case otlp.StatusCodeOk:
+			tags["otel.status_code"] = "OK"
+		}
+		if s.Status.Message != "" {
+			tags["otel.status_description"] = s.Status.Message
+		}
+	}
+
+	start := int64(s.StartTimeUnixNano) / int64(time.Microsecond)
+	duration := int64(0)
+	if s.EndTimeUnixNano > s.StartTimeUnixNano {
+		duration = int64(s.EndTimeUnixNano-s.StartTimeUnixNano) / int64(time.Microsecond)
+	}
+	span := &trace.Span{
+		TraceID:        hex.EncodeToString(s.TraceID),
+		ID:             hex.EncodeToString(s.SpanID),
+		Name:           pointer.String(s.Name),
+		Kind:           convertOTLPKind(s.Kind),
+		Timestamp:      &start,
+		Duration:       &duration,
+		LocalEndpoint:  &trace.Endpoint{ServiceName: serviceName},
+		RemoteEndpoint: remote,
+		Annotations:    convertOTLPEvents(s.Events),
+		Tags:           tags,
+	}
+	if len(s.ParentSpanID) > 0 {
+		span.ParentID = pointer.String(hex.EncodeToString(s.ParentSpanID))
+	}
+	return span
+}
+
+// otlpSpanTags adds the span attributes to tags, returning peer.service as the remote endpoint instead
+func otlpSpanTags(tags map[string]string, attrs []*otlp.KeyValue) *trace.Endpoint {
+	var remote *trace.Endpoint
+	for _, kv := range attrs {
+		if kv == nil {
+			continue
+		}
+		val := otlpAttributeString(kv.Value)
+		if kv.Key == string(ext.PeerService) && val != "" {
+			remote = &trace.Endpoint{ServiceName: pointer.String(val)}
+		} else if val != "" {
+			tags[kv.Key] = val
+		}
+	}
+	return remote
+}
+
+func convertOTLPKind(kind otlp.SpanKind) *string {
+	switch kind {
+	case otlp.SpanKindClient:
+		return &ClientKind
+	case otlp.SpanKindServer:
+		return &ServerKind
+	case otlp.SpanKindProducer:
+		return &ProducerKind
+	case otlp.SpanKindConsumer:
+		return &ConsumerKind
+	}
+	return nil
+}
+
+// convertOTLPEvents turns span events into annotations, using just the event name as the value when
+// there are no attributes like materializeWithJSON does for jaeger logs
+func convertOTLPEvents(events []*otlp.Event) []*trace.Annotation {
+	annotations := make([]*trace.Annotation, 0, len(events))
+	for _, e := range events {
+		if e == nil {
+			continue
+		}
+		ts := int64(e.TimeUnixNano) / int64(time.Microsecond)
+		anno := &trace.Annotation{Timestamp: &ts}
+		if len(e.Attributes) == 0 {
+			anno.Value = pointer.String(e.Name)
+		} else {
+			fields := make(map[string]string, len(e.Attributes)+1)
+			otlpAttributesToMap(fields, e.Attributes)
+			fields["event"] = e.Name
+			if content, err := json.Marshal(fields); err == nil {
+				anno.Value = pointer.String(string(content))
+			}
+		}
+		annotations = append(annotations, anno)
+	}
+	return annotations
+}
+
+func setupOTLPMetricsV1(ctx context.Context, r *mux.Router, sink Sink, logger log.Logger, debugContext *web.HeaderCtxFlag, httpChain web.NextConstructor, counter *dpsink.Counter) sfxclient.Collector {
+	var additionalConstructors []web.Constructor
+	if debugContext != nil {
+		additionalConstructors = append(additionalConstructors, debugContext)
+	}
+	var decoder *OTLPMetricsDecoder
+	handler, st := SetupChain(ctx, sink, OTLPMetricsV1, func(s Sink) ErrorReader {
+		decoder = &OTLPMetricsDecoder{Sink: s, Logger: logger}
+		return decoder
+	}, httpChain, logger, counter, additionalConstructors...)
+	SetupOTLPByPaths(r, handler, OTLPMetricsPathV1)
+	return sfxclient.NewMultiCollector(st, decoder)
+}
+
+func setupOTLPTracesV1(ctx context.Context, r *mux.Router, sink Sink, logger log.Logger, httpChain web.NextConstructor, counter *dpsink.Counter) sfxclient.Collector {
+	handler, st := SetupChain(ctx, sink, OTLPTracesV1, func(s Sink) ErrorReader {
+		return &OTLPTraceDecoder{Sink: s, Logger: logger}
+	}, httpChain, logger, counter)
+	SetupOTLPByPaths(r, handler, OTLPTracesPathV1)
+	return st
+}
+
+// SetupOTLPByPaths tells the router which paths the given handler (which should handle OTLP/HTTP protobuf
+// and JSON) should see
+func SetupOTLPByPaths(r *mux.Router, handler http.Handler, endpoint string) {
+	r.Path(endpoint).Methods("POST").Headers("Content-Type", "application/x-protobuf").Handler(handler)
+	r.Path(endpoint).Methods("POST").Headers("Content-Type", "application/json").Handler(handler)
+}
@@ -0,0 +1,254 @@
+package signalfx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/nettest"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx/format/otlp"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const otlpMetricsJSON = `{"resourceMetrics":[{"resource":{"attributes":[{"key":"host.name","value":{"stringValue":"a"}}]},
+"scopeMetrics":[{"metrics":[
+{"name":"g","gauge":{"dataPoints":[{"timeUnixNano":"1000000000","asDouble":1.5,"attributes":[{"key":"cpu","value":{"intValue":"2"}}]}]}},
+{"name":"delta","sum":{"isMonotonic":true,"aggregationTemporality":"AGGREGATION_TEMPORALITY_DELTA","dataPoints":[{"asInt":"3"}]}},
+{"name":"cumulative","sum":{"isMonotonic":true,"aggregationTemporality":2,"dataPoints":[{"asInt":4}]}},
+{"name":"updown","sum":{"aggregationTemporality":2,"dataPoints":[{"asDouble":-1}]}},
+{"name":"novalue","gauge":{"dataPoints":[{}]}},
+{"name":"histogram","histogram":{}}
+]}]}]}`
+
+const otlpTracesJSON = `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}},{"key":"env","value":{"stringValue":"prod"}}]},
+"scopeSpans":[{"spans":[{"traceId":"0102030405060708090a0b0c0d0e0f10","spanId":"0102030405060708","parentSpanId":"0807060504030201",
+"name":"get","kind":"SPAN_KIND_SERVER","startTimeUnixNano":"1000000000","endTimeUnixNano":"1002000000",
+"attributes":[{"key":"peer.service","value":{"stringValue":"db"}},{"key":"http.status_code","value":{"intValue":500}}],
+"events":[{"timeUnixNano":"1001000000","name":"retry"},{"timeUnixNano":"1001000000","name":"log","attributes":[{"key":"msg","value":{"stringValue":"hi"}}]}],
+"status":{"code":"STATUS_CODE_ERROR","message":"boom"}}]}]}]}`
+
+// otlpNullMetricsJSON and otlpNullTracesJSON have a null entry in every array, along with one valid value
+const otlpNullMetricsJSON = `{"resourceMetrics":[null,{"resource":{"attributes":[null]},"scopeMetrics":[null,{"metrics":[null,
+{"name":"g","gauge":{"dataPoints":[null,{"asInt":1,"attributes":[null,{"key":"kv","value":{"kvlistValue":{"values":[null]}}}]}]}}]}]}]}`
+
+const otlpNullTracesJSON = `{"resourceSpans":[null,{"resource":{"attributes":[null]},"scopeSpans":[null,{"spans":[null,
+{"name":"get","attributes":[null],"events":[null,{"name":"retry","attributes":[null]}]}]}]}]}`
+
+func TestOTLPMetricsConversion(t *testing.T) {
+	Convey("given an OTLP metrics decoder", t, func() {
+		decoder := &OTLPMetricsDecoder{Logger: log.Discard}
+		msg, err := otlp.UnmarshalMetricsJSON([]byte(otlpMetricsJSON))
+		So(err, ShouldBeNil)
+		dps := decoder.convert(msg)
+		So(len(dps), ShouldEqual, 4)
+		Convey("gauges should keep resource and point attributes", func() {
+			So(dps[0].Metric, ShouldEqual, "g")
+			So(dps[0].Dimensions, ShouldResemble, map[string]string{"host.name": "a", "cpu": "2"})
+			So(dps[0].Value, ShouldResemble, datapoint.NewFloatValue(1.5))
+			So(dps[0].MetricType, ShouldEqual, datapoint.Gauge)
+			So(dps[0].Timestamp, ShouldResemble, time.Unix(1, 0))
+		})
+		Convey("sums should map temporality onto metric types", func() {
+			So(dps[1].MetricType, ShouldEqual, datapoint.Count)
+			So(dps[1].Value, ShouldResemble, datapoint.NewIntValue(3))
+			So(time.Since(dps[1].Timestamp), ShouldBeLessThan, time.Minute)
+			So(dps[2].MetricType, ShouldEqual, datapoint.Counter)
+			So(dps[3].MetricType, ShouldEqual, datapoint.Gauge)
+		})
+		Convey("dropped points should be counted", func() {
+			stats := decoder.Datapoints()
+			So(stats[0].Value.String(), ShouldEqual, "1")
+			So(stats[1].Value.String(), ShouldEqual, "1")
+		})
+	})
+	Convey("null entries should be skipped", t, func() {
+		decoder := &OTLPMetricsDecoder{Logger: log.Discard}
+		msg, err := otlp.UnmarshalMetricsJSON([]byte(otlpNullMetricsJSON))
+		So(err, ShouldBeNil)
+		dps := decoder.convert(msg)
+		So(len(dps), ShouldEqual, 1)
+		So(dps[0].Dimensions, ShouldResemble, map[string]string{"kv": "{}"})
+	})
+	Convey("non finite values are invalid", t, func() {
+		So(otlpDatapointValue(&otlp.NumberDataPoint{AsDouble: pointer.Float64(math.NaN())}), ShouldBeNil)
+		So(otlpDatapointValue(&otlp.NumberDataPoint{AsDouble: pointer.Float64(math.Inf(1))}), ShouldBeNil)
+	})
+}
+
+func TestOTLPAttributeString(t *testing.T) {
+	Convey("attribute values should flatten to strings", t, func() {
+		i := otlp.Int64(7)
+		So(otlpAttributeString(nil), ShouldEqual, "")
+		So(otlpAttributeString(&otlp.AnyValue{}), ShouldEqual, "")
+		So(otlpAttributeString(&otlp.AnyValue{BoolValue: pointer.Bool(true)}), ShouldEqual, "true")
+		So(otlpAttributeString(&otlp.AnyValue{DoubleValue: pointer.Float64(0.25)}), ShouldEqual, "0.25")
+		So(otlpAttributeString(&otlp.AnyValue{BytesValue: []byte("hi")}), ShouldEqual, `"aGk="`)
+		So(otlpAttributeString(&otlp.AnyValue{ArrayValue: &otlp.ArrayValue{Values: []*otlp.AnyValue{
+			{StringValue: pointer.String("a")}, {IntValue: &i},
+		}}}), ShouldEqual, `["a",7]`)
+		So(otlpAttributeString(&otlp.AnyValue{KvlistValue: &otlp.KeyValueList{Values: []*otlp.KeyValue{
+			{Key: "k", Value: &otlp.AnyValue{StringValue: pointer.String("v")}},
+		}}}), ShouldEqual, `{"k":"v"}`)
+		So(otlpAttributeString(&otlp.AnyValue{ArrayValue: &otlp.ArrayValue{Values: []*otlp.AnyValue{
+			{DoubleValue: pointer.Float64(math.NaN())},
+		}}}), ShouldEqual, "")
+	})
+}
+
+func TestOTLPSpanConversion(t *testing.T) {
+	Convey("given OTLP spans", t, func() {
+		msg, err := otlp.UnmarshalTracesJSON([]byte(otlpTracesJSON))
+		So(err, ShouldBeNil)
+		spans := convertOTLPTraces(msg)
+		So(len(spans), ShouldEqual, 1)
+		span := spans[0]
+		Convey("ids, timing and kind should convert", func() {
+			So(span.TraceID, ShouldEqual, "0102030405060708090a0b0c0d0e0f10")
+			So(span.ID, ShouldEqual, "0102030405060708")
+			So(*span.ParentID, ShouldEqual, "0807060504030201")
+			So(*span.Name, ShouldEqual, "get")
+			So(*span.Kind, ShouldEqual, ServerKind)
+			So(*span.Timestamp, ShouldEqual, 1000000)
+			So(*span.Duration, ShouldEqual, 2000)
+		})
+		Convey("endpoints and tags should come from the resource and attributes", func() {
+			So(*span.LocalEndpoint.ServiceName, ShouldEqual, "api")
+			So(*span.RemoteEndpoint.ServiceName, ShouldEqual, "db")
+			So(span.Tags, ShouldResemble, map[string]string{
+				"env":                     "prod",
+				"http.status_code":        "500",
+				"error":                   "true",
+				"otel.status_code":        "ERROR",
+				"otel.status_description": "boom",
+			})
+		})
+		Convey("events should become annotations", func() {
+			So(len(span.Annotations), ShouldEqual, 2)
+			So(*span.Annotations[0].Timestamp, ShouldEqual, 1001000)
+			So(*span.Annotations[0].Value, ShouldEqual, "retry")
+			So(*span.Annotations[1].Value, ShouldEqual, `{"event":"log","msg":"hi"}`)
+		})
+	})
+	Convey("null entries should be skipped", t, func() {
+		msg, err := otlp.UnmarshalTracesJSON([]byte(otlpNullTracesJSON))
+		So(err, ShouldBeNil)
+		spans := convertOTLPTraces(msg)
+		So(len(spans), ShouldEqual, 1)
+		So(len(spans[0].Annotations), ShouldEqual, 1)
+		So(*spans[0].Annotations[0].Value, ShouldEqual, `{"event":"retry"}`)
+	})
+	Convey("span kinds without a SignalFx equivalent are left empty", t, func() {
+		So(convertOTLPKind(otlp.SpanKindInternal), ShouldBeNil)
+		So(*convertOTLPKind(otlp.SpanKindClient), ShouldEqual, ClientKind)
+		So(*convertOTLPKind(otlp.SpanKindProducer), ShouldEqual, ProducerKind)
+		So(*convertOTLPKind(otlp.SpanKindConsumer), ShouldEqual, ConsumerKind)
+	})
+	Convey("ok spans without a parent or end time", t, func() {
+		span := convertOTLPSpan(&otlp.Span{StartTimeUnixNano: 5000, Status: &otlp.Status{Code: otlp.StatusCodeOk}}, nil, nil)
+		So(span.ParentID, ShouldBeNil)
+		So(*span.Duration, ShouldEqual, 0)
+		So(span.Tags, ShouldResemble, map[string]string{"otel.status_code": "OK"})
+	})
+}
+
+func TestOTLPListener(t *testing.T) {
+	Convey("given a signalfx listener", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(1)
+		listener, err := NewListener(sendTo, &ListenerConfig{ListenAddr: pointer.String("127.0.0.1:0"), Counter: &dpsink.Counter{}, HTTPChain: passThroughChain})
+		So(err, ShouldBeNil)
+		baseURI := fmt.Sprintf("http://127.0.0.1:%d", nettest.TCPPort(listener.listener))
+		post := func(path string, contentType string, body []byte) (*http.Response, string) {
+			req, err := http.NewRequest("POST", baseURI+path, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			req.Header.Set("Content-Type", contentType)
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			respBody, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			return resp, string(respBody)
+		}
+		Convey("Should accept JSON metrics", func() {
+			resp, body := post(OTLPMetricsPathV1, "application/json", []byte(otlpMetricsJSON))
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/json")
+			So(body, ShouldEqual, "{}")
+			dps := <-sendTo.PointsChan
+			So(len(dps), ShouldEqual, 4)
+		})
+		Convey("Should accept protobuf metrics", func() {
+			var dp, gauge, metric, scope, rm, req []byte
+			dp = protowire.AppendTag(dp, 4, protowire.Fixed64Type)
+			dp = protowire.AppendFixed64(dp, math.Float64bits(2.5))
+			gauge = protowire.AppendTag(gauge, 1, protowire.BytesType)
+			gauge = protowire.AppendBytes(gauge, dp)
+			metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+			metric = protowire.AppendString(metric, "proto")
+			metric = protowire.AppendTag(metric, 5, protowire.BytesType)
+			metric = protowire.AppendBytes(metric, gauge)
+			scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+			scope = protowire.AppendBytes(scope, metric)
+			rm = protowire.AppendTag(rm, 2, protowire.BytesType)
+			rm = protowire.AppendBytes(rm, scope)
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, rm)
+			resp, body := post(OTLPMetricsPathV1, "application/x-protobuf", req)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/x-protobuf")
+			So(body, ShouldEqual, "")
+			dp2 := sendTo.Next()
+			So(dp2.Metric, ShouldEqual, "proto")
+			So(dp2.Value, ShouldResemble, datapoint.NewFloatValue(2.5))
+		})
+		Convey("Should accept JSON traces", func() {
+			resp, _ := post(OTLPTracesPathV1, "application/json", []byte(otlpTracesJSON))
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			span := sendTo.NextSpan()
+			So(*span.Name, ShouldEqual, "get")
+		})
+		Convey("Should skip null entries", func() {
+			resp, _ := post(OTLPMetricsPathV1, "application/json", []byte(otlpNullMetricsJSON))
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(sendTo.Next().Metric, ShouldEqual, "g")
+			resp, _ = post(OTLPTracesPathV1, "application/json", []byte(otlpNullTracesJSON))
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(*sendTo.NextSpan().Name, ShouldEqual, "get")
+		})
+		Convey("Should reject invalid payloads", func() {
+			resp, _ := post(OTLPTracesPathV1, "application/x-protobuf", []byte{0xff})
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			resp, _ = post(OTLPMetricsPathV1, "application/json", []byte("{"))
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Should ignore empty requests", func() {
+			resp, _ := post(OTLPMetricsPathV1, "application/json", []byte("{}"))
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			resp, _ = post(OTLPTracesPathV1, "application/x-protobuf", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+	Convey("sink errors should be returned", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.RetError(fmt.Errorf("nope"))
+		decoder := &OTLPMetricsDecoder{Sink: sendTo, Logger: log.Discard}
+		req, err := http.NewRequest("POST", OTLPMetricsPathV1, bytes.NewBufferString(otlpMetricsJSON))
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", "application/json")
+		So(decoder.Read(context.Background(), req), ShouldNotBeNil)
+	})
+}
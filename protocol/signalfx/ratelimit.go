@@ -0,0 +1,250 @@
+package signalfx
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
+)
+
+// RateLimit is how many datapoints, events, spans and log records a token may send each second.  A missing or zero
+// rate is unlimited.
+type RateLimit struct {
+	DatapointsPerSecond *float64 `json:",omitempty"`
+	EventsPerSecond     *float64 `json:",omitempty"`
+	SpansPerSecond      *float64 `json:",omitempty"`
+	LogRecordsPerSecond *float64 `json:",omitempty"`
+	// BurstSeconds is how many seconds of items a token can send at once after being idle
+	BurstSeconds *float64 `json:",omitempty"`
+}
+
+var defaultRateLimit = &RateLimit{
+	DatapointsPerSecond: pointer.Float64(0),
+	EventsPerSecond:     pointer.Float64(0),
+	SpansPerSecond:      pointer.Float64(0),
+	LogRecordsPerSecond: pointer.Float64(0),
+	BurstSeconds:        pointer.Float64(1),
+}
+
+// ErrRateLimited is returned when a token has sent more items than its rate limit allows
+type ErrRateLimited struct {
+	Type  string
+	Delay time.Duration
+}
+
+var _ protocol.BackoffError = &ErrRateLimited{}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry after %s", e.Type, e.Delay)
+}
+
+// StatusCode is 429
+func (e *ErrRateLimited) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// RetryAfter is how long until the token has enough room for the items it sent
+func (e *ErrRateLimited) RetryAfter() time.Duration {
+	return e.Delay
+}
+
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, burstSeconds float64, now time.Time) *tokenBucket {
+	capacity := math.Max(rate*burstSeconds, 1)
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take removes n tokens from the bucket, returning how long to wait if there aren't enough.  Batches bigger than
+// the bucket are let through when it is full, leaving it in debt.
+func (b *tokenBucket) take(n float64, now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	need := math.Min(n, b.capacity)
+	if b.tokens < need {
+		return false, time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens -= n
+	return true, 0
+}
+
+func (b *tokenBucket) full() bool {
+	return b.tokens >= b.capacity
+}
+
+// the types of items a token is limited on
+const (
+	limitDatapoints = iota
+	limitEvents
+	limitSpans
+	limitLogs
+)
+
+var limitTypes = [...]string{"datapoint", "event", "span", "log"}
+
+type tokenBuckets [len(limitTypes)]*tokenBucket
+
+// maxIdleBuckets is how many tokens are tracked before the buckets of idle tokens are removed
+const maxIdleBuckets = 10000
+
+// RateLimiter is a NextSink that limits how many datapoints, events, spans and log records each token sends, keyed by
+// the token on the context of the request
+type RateLimiter struct {
+	defaultLimit *RateLimit
+	tokenLimits  map[string]*RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBuckets
+	now     func() time.Time
+
+	stats struct {
+		limitedItems    [len(limitTypes)]int64
+		limitedRequests [len(limitTypes)]int64
+	}
+}
+
+var _ NextSink = &RateLimiter{}
+var _ NextLogSink = &RateLimiter{}
+
+// NewRateLimiter returns a RateLimiter that limits tokens to the given limits, with any field missing from a
+// token's limits taken from defaultLimit
+func NewRateLimiter(defaultLimit *RateLimit, tokenLimits map[string]*RateLimit) *RateLimiter {
+	defaultLimit = pointer.FillDefaultFrom(defaultLimit, defaultRateLimit).(*RateLimit)
+	limits := make(map[string]*RateLimit, len(tokenLimits))
+	for token, limit := range tokenLimits {
+		limits[token] = pointer.FillDefaultFrom(limit, defaultLimit).(*RateLimit)
+	}
+	return &RateLimiter{
+		defaultLimit: defaultLimit,
+		tokenLimits:  limits,
+		buckets:      make(map[string]*tokenBuckets),
+		now:          time.Now,
+	}
+}
+
+func (r *RateLimiter) newBuckets(token string, now time.Time) *tokenBuckets {
+	limit, exists := r.tokenLimits[token]
+	if !exists {
+		limit = r.defaultLimit
+	}
+	var buckets tokenBuckets
+	for i, rate := range []float64{*limit.DatapointsPerSecond, *limit.EventsPerSecond, *limit.SpansPerSecond, *limit.LogRecordsPerSecond} {
+		if rate > 0 {
+			buckets[i] = newTokenBucket(rate, *limit.BurstSeconds, now)
+		}
+	}
+	if len(r.buckets) >= maxIdleBuckets {
+		r.removeIdle(now)
+	}
+	r.buckets[token] = &buckets
+	return &buckets
+}
+
+// removeIdle forgets tokens whose buckets have filled back up, since they are the same as new buckets
+func (r *RateLimiter) removeIdle(now time.Time) {
+	for token, buckets := range r.buckets {
+		idle := true
+		for _, b := range buckets {
+			if b != nil {
+				b.refill(now)
+				idle = idle && b.full()
+			}
+		}
+		if idle {
+			delete(r.buckets, token)
+		}
+	}
+}
+
+func (r *RateLimiter) check(ctx context.Context, kind int, n int) error {
+	token, _ := ctx.Value(sfxclient.TokenHeaderName).(string)
+	now := r.now()
+	r.mu.Lock()
+	buckets, exists := r.buckets[token]
+	if !exists {
+		buckets = r.newBuckets(token, now)
+	}
+	b := buckets[kind]
+	if b == nil {
+		r.mu.Unlock()
+		return nil
+	}
+	ok, retryAfter := b.take(float64(n), now)
+	r.mu.Unlock()
+	if ok {
+		return nil
+	}
+	atomic.AddInt64(&r.stats.limitedItems[kind], int64(n))
+	atomic.AddInt64(&r.stats.limitedRequests[kind], 1)
+	return &ErrRateLimited{Type: limitTypes[kind], Delay: retryAfter}
+}
+
+// AddDatapoints forwards the points if the token is under its datapoint limit
+func (r *RateLimiter) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next Sink) error {
+	if err := r.check(ctx, limitDatapoints, len(points)); err != nil {
+		return err
+	}
+	return next.AddDatapoints(ctx, points)
+}
+
+// AddEvents forwards the events if the token is under its event limit
+func (r *RateLimiter) AddEvents(ctx context.Context, events []*event.Event, next Sink) error {
+	if err := r.check(ctx, limitEvents, len(events)); err != nil {
+		return err
+	}
+	return next.AddEvents(ctx, events)
+}
+
+// AddSpans forwards the spans if the token is under its span limit
+func (r *RateLimiter) AddSpans(ctx context.Context, spans []*trace.Span, next Sink) error {
+	if err := r.check(ctx, limitSpans, len(spans)); err != nil {
+		return err
+	}
+	return next.AddSpans(ctx, spans)
+}
+
+// AddLogs forwards the logs if the token is under its log record limit
+func (r *RateLimiter) AddLogs(ctx context.Context, logs []*sfxlog.ResourceLogs, next sfxlog.LogSink) error {
+	if err := r.check(ctx, limitLogs, logRecordCount(logs)); err != nil {
+		return err
+	}
+	return next.AddLogs(ctx, logs)
+}
+
+// Datapoints returns how many tokens are tracked and how many items and requests were rate limited
+func (r *RateLimiter) Datapoints() []*datapoint.Datapoint {
+	r.mu.Lock()
+	tokens := int64(len(r.buckets))
+	r.mu.Unlock()
+	dps := []*datapoint.Datapoint{
+		sfxclient.Gauge("rate_limiter.tokens", nil, tokens),
+	}
+	for i, typ := range limitTypes {
+		dims := map[string]string{"type": typ}
+		dps = append(dps,
+			sfxclient.Cumulative("rate_limited_items", dims, atomic.LoadInt64(&r.stats.limitedItems[i])),
+			sfxclient.Cumulative("rate_limited_requests", dims, atomic.LoadInt64(&r.stats.limitedRequests[i])),
+		)
+	}
+	return dps
+}
@@ -0,0 +1,130 @@
+package signalfx
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/nettest"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimiter(t *testing.T) {
+	Convey("given a rate limiter with a default and a per token limit", t, func() {
+		limiter := NewRateLimiter(&RateLimit{DatapointsPerSecond: pointer.Float64(10), BurstSeconds: pointer.Float64(2)}, map[string]*RateLimit{
+			"small": {DatapointsPerSecond: pointer.Float64(1), EventsPerSecond: pointer.Float64(2), BurstSeconds: pointer.Float64(1)},
+		})
+		now := time.Now()
+		limiter.now = func() time.Time { return now }
+		sink := dptest.NewBasicSink()
+		sink.Resize(10)
+		chain := FromChain(sink, NextWrap(limiter))
+		ctx := context.Background()
+		small := context.WithValue(ctx, sfxclient.TokenHeaderName, "small")
+		points := func(n int) []*datapoint.Datapoint {
+			dps := make([]*datapoint.Datapoint, n)
+			for i := range dps {
+				dps[i] = dptest.DP()
+			}
+			return dps
+		}
+		Convey("tokens should be limited to their burst and then their rate", func() {
+			So(chain.AddDatapoints(ctx, points(15)), ShouldBeNil)
+			err := chain.AddDatapoints(ctx, points(10))
+			So(err, ShouldHaveSameTypeAs, &ErrRateLimited{})
+			So(err.(*ErrRateLimited).Type, ShouldEqual, "datapoint")
+			So(err.(*ErrRateLimited).RetryAfter(), ShouldEqual, time.Millisecond*500)
+			now = now.Add(time.Second / 2)
+			So(chain.AddDatapoints(ctx, points(10)), ShouldBeNil)
+			So(chain.AddDatapoints(small, points(1)), ShouldBeNil)
+			So(chain.AddDatapoints(small, points(1)), ShouldNotBeNil)
+			dps := limiter.Datapoints()
+			So(dptest.ExactlyOneDims(dps, "rate_limited_items", map[string]string{"type": "datapoint"}).Value, ShouldResemble, datapoint.NewIntValue(11))
+			So(dptest.ExactlyOneDims(dps, "rate_limited_requests", map[string]string{"type": "datapoint"}).Value, ShouldResemble, datapoint.NewIntValue(2))
+			So(dptest.ExactlyOne(dps, "rate_limiter.tokens").Value, ShouldResemble, datapoint.NewIntValue(2))
+		})
+		Convey("batches bigger than the burst should get through when the bucket is full", func() {
+			So(chain.AddDatapoints(small, points(5)), ShouldBeNil)
+			err := chain.AddDatapoints(small, points(1))
+			So(err, ShouldNotBeNil)
+			So(err.(*ErrRateLimited).RetryAfter(), ShouldEqual, time.Second*5)
+			So(err.Error(), ShouldContainSubstring, "datapoint")
+		})
+		Convey("each type of item should have its own limit", func() {
+			events := []*event.Event{dptest.E(), dptest.E()}
+			So(chain.AddEvents(small, events), ShouldBeNil)
+			So(chain.AddEvents(small, events), ShouldNotBeNil)
+			So(chain.AddEvents(ctx, events), ShouldBeNil)
+			So(chain.AddEvents(ctx, events), ShouldBeNil)
+			spans := []*trace.Span{{}}
+			So(chain.AddSpans(small, spans), ShouldBeNil)
+			So(chain.AddDatapoints(small, points(1)), ShouldBeNil)
+		})
+		Convey("log records should have their own limit", func() {
+			logs := newLogSink()
+			limited := NewRateLimiter(&RateLimit{LogRecordsPerSecond: pointer.Float64(1)}, nil)
+			logChain := FromChain(logs, NextWrap(limited)).(sfxlog.LogSink)
+			So(logChain.AddLogs(ctx, logRequest().ResourceLogs), ShouldBeNil)
+			So(<-logs.logs, ShouldHaveLength, 1)
+			err := logChain.AddLogs(ctx, logRequest().ResourceLogs)
+			So(err, ShouldHaveSameTypeAs, &ErrRateLimited{})
+			So(err.(*ErrRateLimited).Type, ShouldEqual, "log")
+			So(FromChain(sink, NextWrap(limited)).(sfxlog.LogSink).AddLogs(ctx, nil), ShouldEqual, errNotLogSink)
+		})
+		Convey("idle tokens should be forgotten once too many are tracked", func() {
+			var err error
+			for i := 0; i < maxIdleBuckets && err == nil; i++ {
+				err = limiter.check(context.WithValue(ctx, sfxclient.TokenHeaderName, fmt.Sprintf("token-%d", i)), limitSpans, 1)
+			}
+			So(err, ShouldBeNil)
+			So(chain.AddDatapoints(small, points(1)), ShouldBeNil)
+			So(dptest.ExactlyOne(limiter.Datapoints(), "rate_limiter.tokens").Value, ShouldResemble, datapoint.NewIntValue(1))
+		})
+	})
+}
+
+func TestRateLimitedListener(t *testing.T) {
+	Convey("given a rate limited signalfx listener", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(10)
+		listener, err := NewListener(sendTo, &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:0"),
+			RateLimit:  &RateLimit{DatapointsPerSecond: pointer.Float64(1)},
+			Counter:    &dpsink.Counter{},
+			HTTPChain:  passThroughChain,
+		})
+		So(err, ShouldBeNil)
+		post := func(token string) *http.Response {
+			req, err := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d/v2/datapoint", nettest.TCPPort(listener.listener)), strings.NewReader(`{"gauge": [{"metric": "a", "value": 1}]}`))
+			So(err, ShouldBeNil)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(sfxclient.TokenHeaderName, token)
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			return resp
+		}
+		Convey("tokens over their limit should get a 429 with Retry-After", func() {
+			So(post("a").StatusCode, ShouldEqual, http.StatusOK)
+			resp := post("a")
+			So(resp.StatusCode, ShouldEqual, http.StatusTooManyRequests)
+			So(resp.Header.Get("Retry-After"), ShouldEqual, "1")
+			So(post("b").StatusCode, ShouldEqual, http.StatusOK)
+			So(dptest.ExactlyOneDims(listener.DebugDatapoints(), "rate_limited_requests", map[string]string{"type": "datapoint"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,271 @@
+package relabel
+
+import (
+	"context"
+	"crypto/md5" // nolint: gosec
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+)
+
+// MetricNameLabel is the label that refers to the metric name of datapoints and the event type of events
+const MetricNameLabel = "__name__"
+
+// The relabel actions, which behave like the Prometheus actions of the same name
+const (
+	Replace   = "replace"
+	Keep      = "keep"
+	Drop      = "drop"
+	HashMod   = "hashmod"
+	LabelMap  = "labelmap"
+	LabelDrop = "labeldrop"
+	LabelKeep = "labelkeep"
+)
+
+// Config is a single relabel action.  The values of SourceLabels are joined with Separator and matched against
+// Regex, which is anchored at both ends.  Replace sets TargetLabel to Replacement (expanded with the groups of
+// Regex) when Regex matches, and removes TargetLabel when that is empty.  Keep and Drop drop items that don't
+// or do match.  HashMod sets TargetLabel to the hash of the joined values modulo Modulus.  LabelMap copies
+// dimensions whose names match Regex to the name given by Replacement, while LabelDrop and LabelKeep remove
+// dimensions whose names do or don't match.
+type Config struct {
+	SourceLabels []string `json:",omitempty"`
+	Separator    *string  `json:",omitempty"`
+	Regex        *string  `json:",omitempty"`
+	Modulus      *uint64  `json:",omitempty"`
+	TargetLabel  *string  `json:",omitempty"`
+	Replacement  *string  `json:",omitempty"`
+	Action       *string  `json:",omitempty"`
+}
+
+var defaultConfig = &Config{
+	Separator:   pointer.String(";"),
+	Regex:       pointer.String("(.*)"),
+	Replacement: pointer.String("$1"),
+	Action:      pointer.String(Replace),
+}
+
+type action struct {
+	name         string
+	kind         string
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	modulus      uint64
+	targetLabel  string
+	replacement  string
+	matches      int64
+}
+
+// nolint: gocyclo
+func newAction(i int, conf *Config) (*action, error) {
+	conf = pointer.FillDefaultFrom(conf, defaultConfig).(*Config)
+	a := &action{
+		kind:         strings.ToLower(*conf.Action),
+		sourceLabels: conf.SourceLabels,
+		separator:    *conf.Separator,
+		replacement:  *conf.Replacement,
+	}
+	a.name = fmt.Sprintf("%d_%s", i, a.kind)
+	var err error
+	if a.regex, err = regexp.Compile("^(?:" + *conf.Regex + ")$"); err != nil {
+		return nil, fmt.Errorf("relabel action %s: %s", a.name, err)
+	}
+	if conf.TargetLabel != nil {
+		a.targetLabel = *conf.TargetLabel
+	}
+	if conf.Modulus != nil {
+		a.modulus = *conf.Modulus
+	}
+	switch a.kind {
+	case Replace:
+		if a.targetLabel == "" {
+			return nil, fmt.Errorf("relabel action %s needs a TargetLabel", a.name)
+		}
+	case HashMod:
+		if a.targetLabel == "" || a.modulus == 0 {
+			return nil, fmt.Errorf("relabel action %s needs a TargetLabel and a Modulus", a.name)
+		}
+	case Keep, Drop, LabelMap, LabelDrop, LabelKeep:
+	default:
+		return nil, fmt.Errorf("unknown relabel action %s", a.kind)
+	}
+	return a, nil
+}
+
+func getLabel(name string, dims map[string]string, label string) string {
+	if label == MetricNameLabel {
+		return name
+	}
+	return dims[label]
+}
+
+func setLabel(name *string, dims *map[string]string, label string, value string) {
+	if label == MetricNameLabel {
+		*name = value
+		return
+	}
+	if value == "" {
+		delete(*dims, label)
+		return
+	}
+	if *dims == nil {
+		*dims = make(map[string]string)
+	}
+	(*dims)[label] = value
+}
+
+func (a *action) sourceValue(name string, dims map[string]string) string {
+	values := make([]string, len(a.sourceLabels))
+	for i, l := range a.sourceLabels {
+		values[i] = getLabel(name, dims, l)
+	}
+	return strings.Join(values, a.separator)
+}
+
+func hashMod(value string, modulus uint64) uint64 {
+	sum := md5.Sum([]byte(value)) // nolint: gosec
+	return binary.BigEndian.Uint64(sum[8:]) % modulus
+}
+
+// apply runs the action over the name and dimensions of an item and returns false if the item should be dropped
+// nolint: gocyclo
+func (a *action) apply(name *string, dims *map[string]string) bool {
+	switch a.kind {
+	case Replace:
+		value := a.sourceValue(*name, *dims)
+		indexes := a.regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			return true
+		}
+		atomic.AddInt64(&a.matches, 1)
+		target := string(a.regex.ExpandString(nil, a.targetLabel, value, indexes))
+		if target == "" {
+			return true
+		}
+		setLabel(name, dims, target, string(a.regex.ExpandString(nil, a.replacement, value, indexes)))
+	case Keep, Drop:
+		matched := a.regex.MatchString(a.sourceValue(*name, *dims))
+		if matched {
+			atomic.AddInt64(&a.matches, 1)
+		}
+		return matched == (a.kind == Keep)
+	case HashMod:
+		atomic.AddInt64(&a.matches, 1)
+		setLabel(name, dims, a.targetLabel, strconv.FormatUint(hashMod(a.sourceValue(*name, *dims), a.modulus), 10))
+	case LabelMap:
+		mapped := make(map[string]string)
+		for k, v := range *dims {
+			if a.regex.MatchString(k) {
+				atomic.AddInt64(&a.matches, 1)
+				mapped[a.regex.ReplaceAllString(k, a.replacement)] = v
+			}
+		}
+		for k, v := range mapped {
+			setLabel(name, dims, k, v)
+		}
+	default:
+		for k := range *dims {
+			if a.regex.MatchString(k) == (a.kind == LabelDrop) {
+				atomic.AddInt64(&a.matches, 1)
+				delete(*dims, k)
+			}
+		}
+	}
+	return true
+}
+
+// Relabel is a signalfx.NextSink that runs an ordered list of relabel actions over the metric names and
+// dimensions of datapoints and the event types and dimensions of events, dropping the items keep and drop
+// actions reject.  Spans pass through untouched.  This modifies the objects parsed, so in a concurrent context,
+// you will want to copy the objects sent here first
+type Relabel struct {
+	actions []*action
+	stats   struct {
+		droppedDatapoints int64
+		droppedEvents     int64
+	}
+}
+
+var _ signalfx.NextSink = &Relabel{}
+
+// New returns a Relabel that runs the given actions in order
+func New(confs []*Config) (*Relabel, error) {
+	r := &Relabel{
+		actions: make([]*action, 0, len(confs)),
+	}
+	for i, conf := range confs {
+		a, err := newAction(i, conf)
+		if err != nil {
+			return nil, err
+		}
+		r.actions = append(r.actions, a)
+	}
+	return r, nil
+}
+
+func (r *Relabel) apply(name *string, dims *map[string]string) bool {
+	for _, a := range r.actions {
+		if !a.apply(name, dims) {
+			return false
+		}
+	}
+	return true
+}
+
+// AddDatapoints relabels the points and forwards the ones that are kept to next
+func (r *Relabel) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	kept := make([]*datapoint.Datapoint, 0, len(points))
+	for _, dp := range points {
+		if r.apply(&dp.Metric, &dp.Dimensions) {
+			kept = append(kept, dp)
+		}
+	}
+	atomic.AddInt64(&r.stats.droppedDatapoints, int64(len(points)-len(kept)))
+	if len(kept) == 0 {
+		return nil
+	}
+	return next.AddDatapoints(ctx, kept)
+}
+
+// AddEvents relabels the events and forwards the ones that are kept to next
+func (r *Relabel) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	kept := make([]*event.Event, 0, len(events))
+	for _, e := range events {
+		if r.apply(&e.EventType, &e.Dimensions) {
+			kept = append(kept, e)
+		}
+	}
+	atomic.AddInt64(&r.stats.droppedEvents, int64(len(events)-len(kept)))
+	if len(kept) == 0 {
+		return nil
+	}
+	return next.AddEvents(ctx, kept)
+}
+
+// AddSpans is a passthrough
+func (r *Relabel) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	return next.AddSpans(ctx, spans)
+}
+
+// Datapoints returns how often each action matched and how many items were dropped
+func (r *Relabel) Datapoints() []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, len(r.actions)+2)
+	for _, a := range r.actions {
+		dps = append(dps, sfxclient.Cumulative("relabel.matches", map[string]string{"action": a.name}, atomic.LoadInt64(&a.matches)))
+	}
+	return append(dps,
+		sfxclient.Cumulative("relabel.dropped", map[string]string{"type": "datapoint"}, atomic.LoadInt64(&r.stats.droppedDatapoints)),
+		sfxclient.Cumulative("relabel.dropped", map[string]string{"type": "event"}, atomic.LoadInt64(&r.stats.droppedEvents)),
+	)
+}
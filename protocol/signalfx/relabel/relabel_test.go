@@ -0,0 +1,128 @@
+package relabel
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func dp(metric string, dims map[string]string) *datapoint.Datapoint {
+	return datapoint.New(metric, dims, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())
+}
+
+func relabeled(confs []*Config, points ...*datapoint.Datapoint) []*datapoint.Datapoint {
+	r, err := New(confs)
+	So(err, ShouldBeNil)
+	sink := dptest.NewBasicSink()
+	sink.Resize(1)
+	So(r.AddDatapoints(context.Background(), points, sink), ShouldBeNil)
+	if len(sink.PointsChan) == 0 {
+		return nil
+	}
+	return <-sink.PointsChan
+}
+
+func TestRelabelActions(t *testing.T) {
+	Convey("replace should rename metrics and set dimensions", t, func() {
+		points := relabeled([]*Config{
+			{SourceLabels: []string{MetricNameLabel}, Regex: pointer.String("cpu_(.*)"), TargetLabel: pointer.String(MetricNameLabel), Replacement: pointer.String("cpu.$1")},
+			{SourceLabels: []string{"host", "port"}, Separator: pointer.String(":"), TargetLabel: pointer.String("instance")},
+			{SourceLabels: []string{"env"}, Regex: pointer.String("(prod|dev)"), TargetLabel: pointer.String("${1}_env"), Replacement: pointer.String("yes")},
+			{SourceLabels: []string{"port"}, TargetLabel: pointer.String("port"), Replacement: pointer.String("")},
+			{SourceLabels: []string{"host"}, Regex: pointer.String("(.*)"), TargetLabel: pointer.String("$2")},
+		}, dp("cpu_idle", map[string]string{"host": "a", "port": "80", "env": "dev"}))
+		So(points, ShouldHaveLength, 1)
+		So(points[0].Metric, ShouldEqual, "cpu.idle")
+		So(points[0].Dimensions, ShouldResemble, map[string]string{"host": "a", "instance": "a:80", "env": "dev", "dev_env": "yes"})
+	})
+	Convey("replace should create dimensions", t, func() {
+		points := relabeled([]*Config{{SourceLabels: []string{MetricNameLabel}, TargetLabel: pointer.String("name")}}, dp("m", nil))
+		So(points[0].Dimensions, ShouldResemble, map[string]string{"name": "m"})
+	})
+	Convey("keep and drop should filter points", t, func() {
+		points := relabeled([]*Config{
+			{SourceLabels: []string{"env"}, Regex: pointer.String("prod|staging"), Action: pointer.String(Keep)},
+			{SourceLabels: []string{MetricNameLabel}, Regex: pointer.String("debug\\..*"), Action: pointer.String("DROP")},
+		}, dp("a", map[string]string{"env": "prod"}), dp("b", map[string]string{"env": "dev"}), dp("debug.c", map[string]string{"env": "staging"}), dp("d", nil))
+		So(points, ShouldHaveLength, 1)
+		So(points[0].Metric, ShouldEqual, "a")
+		So(relabeled([]*Config{{Action: pointer.String(Drop)}}, dp("a", nil)), ShouldBeNil)
+	})
+	Convey("hashmod should shard consistently", t, func() {
+		confs := []*Config{{SourceLabels: []string{"host"}, Modulus: pointer.Uint64(4), TargetLabel: pointer.String("shard"), Action: pointer.String(HashMod)}}
+		first := relabeled(confs, dp("a", map[string]string{"host": "web-1"}), dp("b", map[string]string{"host": "web-2"}))
+		again := relabeled(confs, dp("c", map[string]string{"host": "web-1"}))
+		So(first[0].Dimensions["shard"], ShouldEqual, again[0].Dimensions["shard"])
+		So(hashMod("web-1", 4), ShouldBeLessThan, 4)
+		So(first[0].Dimensions["shard"], ShouldEqual, "0")
+		So(first[1].Dimensions["shard"], ShouldEqual, "3")
+	})
+	Convey("labelmap, labeldrop and labelkeep should work on dimension names", t, func() {
+		points := relabeled([]*Config{
+			{Regex: pointer.String("k8s_(.*)"), Action: pointer.String(LabelMap)},
+			{Regex: pointer.String("k8s_.*"), Action: pointer.String(LabelDrop)},
+		}, dp("a", map[string]string{"k8s_pod": "p", "k8s_ns": "n", "host": "h"}))
+		So(points[0].Dimensions, ShouldResemble, map[string]string{"pod": "p", "ns": "n", "host": "h"})
+		points = relabeled([]*Config{{Regex: pointer.String("host|pod"), Action: pointer.String(LabelKeep)}}, points...)
+		So(points[0].Dimensions, ShouldResemble, map[string]string{"pod": "p", "host": "h"})
+	})
+	Convey("bad configs should throw errors", t, func() {
+		for _, conf := range []*Config{
+			{Regex: pointer.String("[")},
+			{Action: pointer.String(Replace)},
+			{Action: pointer.String(HashMod), TargetLabel: pointer.String("a")},
+			{Action: pointer.String("rename")},
+		} {
+			_, err := New([]*Config{conf})
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestRelabel(t *testing.T) {
+	Convey("given a relabel sink configured from JSON", t, func() {
+		var confs []*Config
+		So(json.Unmarshal([]byte(`[
+			{"SourceLabels": ["__name__"], "Regex": "old\\.(.*)", "TargetLabel": "__name__", "Replacement": "new.$1"},
+			{"SourceLabels": ["env"], "Regex": "dev", "Action": "drop"}
+		]`), &confs), ShouldBeNil)
+		r, err := New(confs)
+		So(err, ShouldBeNil)
+		sink := dptest.NewBasicSink()
+		sink.Resize(1)
+		chain := signalfx.FromChain(sink, signalfx.NextWrap(r))
+		ctx := context.Background()
+		Convey("datapoints and events should be relabeled", func() {
+			So(chain.AddDatapoints(ctx, []*datapoint.Datapoint{dp("old.a", nil), dp("b", map[string]string{"env": "dev"})}), ShouldBeNil)
+			points := <-sink.PointsChan
+			So(points, ShouldHaveLength, 1)
+			So(points[0].Metric, ShouldEqual, "new.a")
+			So(chain.AddEvents(ctx, []*event.Event{event.New("old.deploy", event.USERDEFINED, nil, time.Now()), event.New("e", event.USERDEFINED, map[string]string{"env": "dev"}, time.Now())}), ShouldBeNil)
+			events := <-sink.EventsChan
+			So(events, ShouldHaveLength, 1)
+			So(events[0].EventType, ShouldEqual, "new.deploy")
+			So(chain.AddEvents(ctx, []*event.Event{event.New("e", event.USERDEFINED, map[string]string{"env": "dev"}, time.Now())}), ShouldBeNil)
+			So(sink.EventsChan, ShouldHaveLength, 0)
+			spans := []*trace.Span{{Name: pointer.String("old.a")}}
+			So(chain.AddSpans(ctx, spans), ShouldBeNil)
+			So(<-sink.TracesChan, ShouldResemble, spans)
+		})
+		Convey("stats should count matches and drops", func() {
+			So(chain.AddDatapoints(ctx, []*datapoint.Datapoint{dp("old.a", map[string]string{"env": "dev"})}), ShouldBeNil)
+			dps := r.Datapoints()
+			So(dps, ShouldHaveLength, 4)
+			So(dptest.ExactlyOneDims(dps, "relabel.matches", map[string]string{"action": "0_replace"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+			So(dptest.ExactlyOneDims(dps, "relabel.matches", map[string]string{"action": "1_drop"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+			So(dptest.ExactlyOneDims(dps, "relabel.dropped", map[string]string{"type": "datapoint"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+		})
+	})
+}
@@ -1,12 +1,19 @@
 package signalfx
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"runtime"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -19,6 +26,7 @@ import (
 	"github.com/signalfx/golib/v3/sfxclient"
 	"github.com/signalfx/golib/v3/trace"
 	"github.com/signalfx/ingest-protocols/protocol/filtering"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
 )
 
 // Forwarder controls forwarding datapoints to SignalFx
@@ -29,12 +37,15 @@ type Forwarder struct {
 	client                *http.Client
 	userAgent             string
 	emptyMetricNameFilter dpsink.EmptyMetricFilter
+	logURL                string
+	compressLogs          bool
 
 	sink Sink
 
 	jsonMarshal func(v interface{}) ([]byte, error)
 	Logger      log.Logger
 	stats       stats
+	retry       retryPolicy
 }
 
 // DebugEndpoints returns the httphandlers of the sampler
@@ -48,7 +59,10 @@ type stats struct {
 	requests                 *sfxclient.RollingBucket
 	drainSize                *sfxclient.RollingBucket
 	totalSpansForwarded      int64
+	totalLogsForwarded       int64
 	pipeline                 int64
+	totalRetries             int64
+	totalRetryGiveUps        int64
 }
 
 // ForwarderConfig controls optional parameters for a signalfx forwarder
@@ -57,6 +71,8 @@ type ForwarderConfig struct {
 	DatapointURL       *string
 	EventURL           *string
 	TraceURL           *string
+	SAPMTraceURL       *string
+	LogURL             *string
 	Timeout            *time.Duration
 	SourceDimensions   *string
 	GatewayVersion     *string
@@ -66,6 +82,15 @@ type ForwarderConfig struct {
 	JSONMarshal        func(v interface{}) ([]byte, error)
 	Logger             log.Logger
 	DisableCompression *bool
+	// UseSAPM forwards spans to SAPMTraceURL as SAPM protobuf, batched by process, instead of to TraceURL as JSON
+	UseSAPM *bool
+	// MaxAttempts is how many times a request is tried, 1 disables retries
+	MaxAttempts      *int
+	RetryBaseBackoff *time.Duration
+	RetryMaxBackoff  *time.Duration
+	// RetryJitter is the fraction of each backoff that is randomized, between 0 and 1
+	RetryJitter      *float64
+	RetryStatusCodes []int
 }
 
 var defaultForwarderConfig = &ForwarderConfig{
@@ -73,6 +98,8 @@ var defaultForwarderConfig = &ForwarderConfig{
 	DatapointURL:       pointer.String("https://ingest.signalfx.com/v2/datapoint"),
 	EventURL:           pointer.String("https://ingest.signalfx.com/v2/event"),
 	TraceURL:           pointer.String("https://ingest.signalfx.com/v1/trace"),
+	SAPMTraceURL:       pointer.String("https://ingest.signalfx.com/v2/trace"),
+	LogURL:             pointer.String("https://ingest.signalfx.com/v1/log"),
 	AuthToken:          pointer.String(""),
 	Timeout:            pointer.Duration(time.Second * 30),
 	GatewayVersion:     pointer.String("UNKNOWN_VERSION"),
@@ -80,11 +107,106 @@ var defaultForwarderConfig = &ForwarderConfig{
 	JSONMarshal:        json.Marshal,
 	Logger:             log.Discard,
 	DisableCompression: pointer.Bool(false),
+	UseSAPM:            pointer.Bool(false),
+	MaxAttempts:        pointer.Int(1),
+	RetryBaseBackoff:   pointer.Duration(time.Millisecond * 100),
+	RetryMaxBackoff:    pointer.Duration(time.Second * 10),
+	RetryJitter:        pointer.Float64(0.2),
+	RetryStatusCodes: []int{
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+	statusCodes map[int]struct{}
+	random      func() float64
+	now         func() time.Time
+}
+
+func newRetryPolicy(conf *ForwarderConfig) retryPolicy {
+	codes := make(map[int]struct{}, len(conf.RetryStatusCodes))
+	for _, code := range conf.RetryStatusCodes {
+		codes[code] = struct{}{}
+	}
+	return retryPolicy{
+		maxAttempts: *conf.MaxAttempts,
+		baseBackoff: *conf.RetryBaseBackoff,
+		maxBackoff:  *conf.RetryMaxBackoff,
+		jitter:      *conf.RetryJitter,
+		statusCodes: codes,
+		random:      rand.Float64, // nolint: gosec
+		now:         time.Now,
+	}
+}
+
+// backoff is how long to wait before the given retry, counting from 1
+func (r *retryPolicy) backoff(retry int) time.Duration {
+	wait := r.baseBackoff
+	for i := 1; i < retry && wait < r.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > r.maxBackoff {
+		wait = r.maxBackoff
+	}
+	return wait - time.Duration(float64(wait)*r.jitter*r.random())
+}
+
+// retryable returns if err is worth retrying along with any minimum wait the server asked for
+func (r *retryPolicy) retryable(ctx context.Context, err error) (bool, time.Duration) {
+	if ctx.Err() != nil {
+		return false, 0
+	}
+	var throttled *sfxclient.TooManyRequestError
+	if errors.As(err, &throttled) {
+		_, ok := r.statusCodes[http.StatusTooManyRequests]
+		return ok, throttled.RetryAfter
+	}
+	var apiErr *sfxclient.SFXAPIError
+	if errors.As(err, &apiErr) {
+		_, ok := r.statusCodes[apiErr.StatusCode]
+		return ok, 0
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr), 0
+}
+
+// newSendingSink makes the sink that sends spans as JSON to TraceURL, or as SAPM to SAPMTraceURL
+func newSendingSink(conf *ForwarderConfig) *sfxclient.HTTPSink {
+	if *conf.UseSAPM {
+		sink := sfxclient.NewHTTPSink(sfxclient.WithSAPMTraceExporter())
+		sink.TraceEndpoint = *conf.SAPMTraceURL
+		return sink
+	}
+	sink := sfxclient.NewHTTPSink()
+	sink.TraceEndpoint = *conf.TraceURL
+	return sink
+}
+
+// validateRetries rejects retry settings that would never send a request or would wait a negative backoff
+func validateRetries(conf *ForwarderConfig) error {
+	if *conf.MaxAttempts < 1 {
+		return fmt.Errorf("MaxAttempts must be at least 1, not %d", *conf.MaxAttempts)
+	}
+	if *conf.RetryJitter < 0 || *conf.RetryJitter > 1 {
+		return fmt.Errorf("RetryJitter must be between 0 and 1, not %v", *conf.RetryJitter)
+	}
+	return nil
 }
 
 // NewForwarder creates a new JSON forwarder
 func NewForwarder(conf *ForwarderConfig) (ret *Forwarder, err error) {
 	conf = pointer.FillDefaultFrom(conf, defaultForwarderConfig).(*ForwarderConfig)
+	if err := validateRetries(conf); err != nil {
+		return nil, err
+	}
 	tr := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		MaxIdleConnsPerHost:   int(*conf.MaxIdleConns * 2),
@@ -94,7 +216,7 @@ func NewForwarder(conf *ForwarderConfig) (ret *Forwarder, err error) {
 		},
 		TLSHandshakeTimeout: *conf.Timeout,
 	}
-	sendingSink := sfxclient.NewHTTPSink()
+	sendingSink := newSendingSink(conf)
 	sendingSink.DisableCompression = *conf.DisableCompression
 	sendingSink.Client = &http.Client{
 		Transport: tr,
@@ -104,15 +226,17 @@ func NewForwarder(conf *ForwarderConfig) (ret *Forwarder, err error) {
 	sendingSink.UserAgent = fmt.Sprintf("SignalfxGateway/%s (gover %s)", *conf.GatewayVersion, runtime.Version())
 	sendingSink.DatapointEndpoint = *conf.DatapointURL
 	sendingSink.EventEndpoint = *conf.EventURL
-	sendingSink.TraceEndpoint = *conf.TraceURL
 	ret = &Forwarder{
 		defaultAuthToken: sendingSink.AuthToken,
 		userAgent:        sendingSink.UserAgent,
 		tr:               tr,
 		client:           sendingSink.Client,
+		logURL:           *conf.LogURL,
+		compressLogs:     !*conf.DisableCompression,
 		jsonMarshal:      conf.JSONMarshal,
 		sink:             sendingSink,
 		Logger:           conf.Logger,
+		retry:            newRetryPolicy(conf),
 		stats: stats{
 			requests: sfxclient.NewRollingBucket("request_time.ns", map[string]string{
 				"direction":   "forwarder",
@@ -136,6 +260,10 @@ func (connector *Forwarder) DebugDatapoints() []*datapoint.Datapoint {
 	dps := connector.stats.requests.Datapoints()
 	dps = append(dps, connector.stats.drainSize.Datapoints()...)
 	dps = append(dps, connector.GetFilteredDatapoints()...)
+	dps = append(dps,
+		sfxclient.Cumulative("total_retries", connector.retryDims(), atomic.LoadInt64(&connector.stats.totalRetries)),
+		sfxclient.Cumulative("total_retry_give_ups", connector.retryDims(), atomic.LoadInt64(&connector.stats.totalRetryGiveUps)),
+	)
 	return dps
 }
 
@@ -149,6 +277,49 @@ func (connector *Forwarder) Datapoints() []*datapoint.Datapoint {
 	return append(connector.DebugDatapoints(), connector.DefaultDatapoints()...)
 }
 
+func (connector *Forwarder) retryDims() map[string]string {
+	return map[string]string{
+		"direction":   "forwarder",
+		"destination": "signalfx",
+	}
+}
+
+// withRetries calls send until it succeeds, fails with an error that is not retryable, runs out of
+// attempts or would have to wait past the context deadline
+func (connector *Forwarder) withRetries(ctx context.Context, send func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil {
+			return nil
+		}
+		retryable, minWait := connector.retry.retryable(ctx, err)
+		if !retryable {
+			return err
+		}
+		wait := connector.retry.backoff(attempt)
+		if wait < minWait {
+			wait = minWait
+		}
+		deadline, hasDeadline := ctx.Deadline()
+		if attempt >= connector.retry.maxAttempts || (hasDeadline && connector.retry.now().Add(wait).After(deadline)) {
+			// requests that were never retried did not give up on anything
+			if attempt > 1 {
+				atomic.AddInt64(&connector.stats.totalRetryGiveUps, 1)
+			}
+			return err
+		}
+		atomic.AddInt64(&connector.stats.totalRetries, 1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddInt64(&connector.stats.totalRetryGiveUps, 1)
+			return err
+		}
+	}
+}
+
 // Close will terminate idle HTTP client connections
 func (connector *Forwarder) Close() error {
 	connector.tr.CloseIdleConnections()
@@ -171,7 +342,9 @@ func (connector *Forwarder) AddDatapoints(ctx context.Context, datapoints []*dat
 	if len(datapoints) == 0 {
 		return nil
 	}
-	return connector.sink.AddDatapoints(ctx, datapoints)
+	return connector.withRetries(ctx, func() error {
+		return connector.sink.AddDatapoints(ctx, datapoints)
+	})
 }
 
 // AddEvents forwards events to SignalFx
@@ -179,11 +352,13 @@ func (connector *Forwarder) AddEvents(ctx context.Context, events []*event.Event
 	atomic.AddInt64(&connector.stats.pipeline, int64(len(events)))
 	defer atomic.AddInt64(&connector.stats.pipeline, -int64(len(events)))
 	atomic.AddInt64(&connector.stats.totalEventsForwarded, int64(len(events)))
-	// could filter here
+	events = connector.FilterEvents(events)
 	if len(events) == 0 {
 		return nil
 	}
-	return connector.sink.AddEvents(ctx, events)
+	return connector.withRetries(ctx, func() error {
+		return connector.sink.AddEvents(ctx, events)
+	})
 }
 
 // AddSpans forwards traces to SignalFx
@@ -191,11 +366,84 @@ func (connector *Forwarder) AddSpans(ctx context.Context, spans []*trace.Span) e
 	atomic.AddInt64(&connector.stats.pipeline, int64(len(spans)))
 	defer atomic.AddInt64(&connector.stats.pipeline, -int64(len(spans)))
 	atomic.AddInt64(&connector.stats.totalSpansForwarded, int64(len(spans)))
-	// could filter here
+	spans = connector.FilterSpans(spans)
 	if len(spans) == 0 {
 		return nil
 	}
-	return connector.sink.AddSpans(ctx, spans)
+	return connector.withRetries(ctx, func() error {
+		return connector.sink.AddSpans(ctx, spans)
+	})
+}
+
+// AddLogs forwards logs to SignalFx as a protobuf log request
+func (connector *Forwarder) AddLogs(ctx context.Context, logs []*sfxlog.ResourceLogs) error {
+	atomic.AddInt64(&connector.stats.pipeline, int64(len(logs)))
+	defer atomic.AddInt64(&connector.stats.pipeline, -int64(len(logs)))
+	atomic.AddInt64(&connector.stats.totalLogsForwarded, int64(len(logs)))
+	if len(logs) == 0 {
+		return nil
+	}
+	body, compressed, err := connector.encodeLogs(logs)
+	if err != nil {
+		return err
+	}
+	return connector.withRetries(ctx, func() error {
+		return connector.postLogs(ctx, body, compressed)
+	})
+}
+
+func (connector *Forwarder) encodeLogs(logs []*sfxlog.ResourceLogs) ([]byte, bool, error) {
+	body, err := proto.Marshal(&sfxlog.LogRequest{ResourceLogs: logs})
+	if err != nil || !connector.compressLogs {
+		return body, false, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(body)
+	if err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), true, err
+}
+
+// postLogs sends one log request, returning the same errors as the datapoint, event and trace sink so the retry
+// policy treats them alike
+func (connector *Forwarder) postLogs(ctx context.Context, body []byte, compressed bool) error {
+	req, err := http.NewRequest("POST", connector.logURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", connector.userAgent)
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	token := connector.defaultAuthToken
+	if v, ok := ctx.Value(sfxclient.TokenHeaderName).(string); ok {
+		token = v
+	}
+	req.Header.Set(sfxclient.TokenHeaderName, token)
+	resp, err := connector.client.Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	log.IfErr(connector.Logger, resp.Body.Close())
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	apiErr := &sfxclient.SFXAPIError{StatusCode: resp.StatusCode, ResponseBody: string(respBody), Endpoint: req.URL.Path}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			return &sfxclient.TooManyRequestError{
+				ThrottleType: resp.Header.Get("Throttle-Type"),
+				RetryAfter:   time.Duration(seconds) * time.Second,
+				Err:          apiErr,
+			}
+		}
+	}
+	return apiErr
 }
 
 // Pipeline returns the total of all things forwarded
@@ -0,0 +1,302 @@
+package signalfx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/filtering"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type statusServer struct {
+	statuses   []int
+	retryAfter string
+	calls      int64
+}
+
+func (s *statusServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	call := atomic.AddInt64(&s.calls, 1)
+	if int(call) <= len(s.statuses) {
+		if s.retryAfter != "" {
+			rw.Header().Set("Retry-After", s.retryAfter)
+		}
+		rw.WriteHeader(s.statuses[call-1])
+		return
+	}
+	_, _ = rw.Write([]byte(`"OK"`))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	Convey("backoff should grow exponentially up to the max with jitter taken off", t, func() {
+		r := newRetryPolicy(pointer.FillDefaultFrom(&ForwarderConfig{
+			RetryBaseBackoff: pointer.Duration(time.Second),
+			RetryMaxBackoff:  pointer.Duration(time.Second * 5),
+			RetryJitter:      pointer.Float64(0.5),
+		}, defaultForwarderConfig).(*ForwarderConfig))
+		r.random = func() float64 { return 0 }
+		So(r.backoff(1), ShouldEqual, time.Second)
+		So(r.backoff(2), ShouldEqual, time.Second*2)
+		So(r.backoff(3), ShouldEqual, time.Second*4)
+		So(r.backoff(4), ShouldEqual, time.Second*5)
+		So(r.backoff(100), ShouldEqual, time.Second*5)
+		r.random = func() float64 { return 1 }
+		So(r.backoff(1), ShouldEqual, time.Millisecond*500)
+	})
+	Convey("only some errors should be retried", t, func() {
+		r := newRetryPolicy(pointer.FillDefaultFrom(&ForwarderConfig{}, defaultForwarderConfig).(*ForwarderConfig))
+		ctx := context.Background()
+		ok, wait := r.retryable(ctx, &sfxclient.TooManyRequestError{RetryAfter: time.Second})
+		So(ok, ShouldBeTrue)
+		So(wait, ShouldEqual, time.Second)
+		ok, _ = r.retryable(ctx, &sfxclient.SFXAPIError{StatusCode: http.StatusServiceUnavailable})
+		So(ok, ShouldBeTrue)
+		ok, _ = r.retryable(ctx, &sfxclient.SFXAPIError{StatusCode: http.StatusBadRequest})
+		So(ok, ShouldBeFalse)
+		ok, _ = r.retryable(ctx, errors.New("nope"))
+		So(ok, ShouldBeFalse)
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		ok, _ = r.retryable(canceled, &sfxclient.SFXAPIError{StatusCode: http.StatusServiceUnavailable})
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestForwarderRetries(t *testing.T) {
+	Convey("given a forwarder that retries", t, func() {
+		server := &statusServer{}
+		ts := httptest.NewServer(server)
+		forwarder, err := NewForwarder(&ForwarderConfig{
+			DatapointURL:     pointer.String(ts.URL + "/v2/datapoint"),
+			EventURL:         pointer.String(ts.URL + "/v2/event"),
+			TraceURL:         pointer.String(ts.URL + "/v1/trace"),
+			LogURL:           pointer.String(ts.URL + "/v1/log"),
+			MaxAttempts:      pointer.Int(3),
+			RetryBaseBackoff: pointer.Duration(time.Millisecond),
+			RetryMaxBackoff:  pointer.Duration(time.Millisecond * 2),
+		})
+		So(err, ShouldBeNil)
+		ctx := context.Background()
+		stat := func(name string) int64 {
+			return dptest.ExactlyOne(forwarder.DebugDatapoints(), name).Value.(datapoint.IntValue).Int()
+		}
+		Convey("should retry server errors until they succeed", func() {
+			server.statuses = []int{http.StatusServiceUnavailable, http.StatusBadGateway}
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldBeNil)
+			So(atomic.LoadInt64(&server.calls), ShouldEqual, 3)
+			So(stat("total_retries"), ShouldEqual, 2)
+			So(stat("total_retry_give_ups"), ShouldEqual, 0)
+		})
+		Convey("should retry events and spans", func() {
+			server.statuses = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+			So(forwarder.AddEvents(ctx, []*event.Event{dptest.E()}), ShouldBeNil)
+			So(forwarder.AddSpans(ctx, []*trace.Span{{}}), ShouldBeNil)
+			So(stat("total_retries"), ShouldEqual, 2)
+		})
+		Convey("should retry logs", func() {
+			server.statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+			So(forwarder.AddLogs(ctx, []*sfxlog.ResourceLogs{{}}), ShouldNotBeNil)
+			So(atomic.LoadInt64(&server.calls), ShouldEqual, 3)
+			So(stat("total_retry_give_ups"), ShouldEqual, 1)
+		})
+		Convey("should give up after max attempts", func() {
+			server.statuses = []int{500, 500, 500, 500}
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(atomic.LoadInt64(&server.calls), ShouldEqual, 3)
+			So(stat("total_retries"), ShouldEqual, 2)
+			So(stat("total_retry_give_ups"), ShouldEqual, 1)
+		})
+		Convey("should not retry client errors", func() {
+			server.statuses = []int{http.StatusBadRequest}
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(atomic.LoadInt64(&server.calls), ShouldEqual, 1)
+			So(stat("total_retry_give_ups"), ShouldEqual, 0)
+		})
+		Convey("should wait at least as long as Retry-After", func() {
+			server.statuses = []int{http.StatusTooManyRequests}
+			server.retryAfter = "1"
+			start := time.Now()
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+			So(stat("total_retries"), ShouldEqual, 1)
+		})
+		Convey("should not wait past the context deadline", func() {
+			server.statuses = []int{http.StatusTooManyRequests}
+			server.retryAfter = "60"
+			ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+			defer cancel()
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(atomic.LoadInt64(&server.calls), ShouldEqual, 1)
+			So(stat("total_retry_give_ups"), ShouldEqual, 0)
+		})
+		Convey("should not count give ups when retries are disabled", func() {
+			forwarder.retry.maxAttempts = 1
+			server.statuses = []int{http.StatusServiceUnavailable}
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(stat("total_retries"), ShouldEqual, 0)
+			So(stat("total_retry_give_ups"), ShouldEqual, 0)
+		})
+		Convey("should stop waiting when the context is canceled", func() {
+			forwarder.retry.baseBackoff = time.Hour
+			forwarder.retry.maxBackoff = time.Hour
+			server.statuses = []int{http.StatusServiceUnavailable}
+			ctx, cancel := context.WithCancel(ctx)
+			go func() {
+				for atomic.LoadInt64(&forwarder.stats.totalRetries) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				cancel()
+			}()
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(stat("total_retry_give_ups"), ShouldEqual, 1)
+		})
+		Convey("should retry connection errors", func() {
+			forwarder.sink.(*sfxclient.HTTPSink).DatapointEndpoint = "http://127.0.0.1:1/v2/datapoint"
+			So(forwarder.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldNotBeNil)
+			So(stat("total_retries"), ShouldEqual, 2)
+			So(stat("total_retry_give_ups"), ShouldEqual, 1)
+		})
+		Reset(func() {
+			So(forwarder.Close(), ShouldBeNil)
+			ts.Close()
+		})
+	})
+}
+
+func TestForwarderRetryConfig(t *testing.T) {
+	Convey("forwarders should not be created with bad retry settings", t, func() {
+		for _, conf := range []*ForwarderConfig{
+			{MaxAttempts: pointer.Int(0)},
+			{RetryJitter: pointer.Float64(-0.1)},
+			{RetryJitter: pointer.Float64(1.5)},
+		} {
+			forwarder, err := NewForwarder(conf)
+			So(err, ShouldNotBeNil)
+			So(forwarder, ShouldBeNil)
+		}
+	})
+}
+
+func TestForwarderDimensionFilters(t *testing.T) {
+	Convey("given a forwarder with dimension filters", t, func() {
+		server := &statusServer{}
+		ts := httptest.NewServer(server)
+		forwarder, err := NewForwarder(&ForwarderConfig{
+			DatapointURL: pointer.String(ts.URL + "/v2/datapoint"),
+			EventURL:     pointer.String(ts.URL + "/v2/event"),
+			TraceURL:     pointer.String(ts.URL + "/v1/trace"),
+			Filters: &filtering.FilterObj{
+				DenyDimensions: []*filtering.DimensionFilter{{Dimension: pointer.String("env"), Values: []string{"dev"}}},
+			},
+		})
+		So(err, ShouldBeNil)
+		ctx := context.Background()
+		Convey("events and spans should be filtered", func() {
+			e := dptest.E()
+			e.Dimensions = map[string]string{"env": "dev"}
+			So(forwarder.AddEvents(ctx, []*event.Event{e}), ShouldBeNil)
+			So(forwarder.AddSpans(ctx, []*trace.Span{{Tags: map[string]string{"env": "dev"}}}), ShouldBeNil)
+			So(atomic.LoadInt64(&server.calls), ShouldEqual, 0)
+			So(forwarder.AddSpans(ctx, []*trace.Span{{Tags: map[string]string{"env": "prod"}}}), ShouldBeNil)
+			So(atomic.LoadInt64(&server.calls), ShouldEqual, 1)
+			dps := forwarder.DebugDatapoints()
+			So(dptest.ExactlyOneDims(dps, "filtered_by_forwarder", map[string]string{"type": "event"}).Value, ShouldResemble, datapoint.NewIntValue(1))
+			So(dptest.ExactlyOneDims(dps, "filter_rule_matches", map[string]string{"rule": "deny_0"}).Value, ShouldResemble, datapoint.NewIntValue(2))
+		})
+		Reset(func() {
+			So(forwarder.Close(), ShouldBeNil)
+			ts.Close()
+		})
+	})
+}
+
+func TestForwarderLogs(t *testing.T) {
+	Convey("given a forwarder that sends logs", t, func() {
+		requests := make(chan *http.Request, 1)
+		bodies := make(chan []byte, 1)
+		status := http.StatusOK
+		ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			requests <- req
+			bodies <- body
+			rw.Header().Set("Retry-After", "3")
+			rw.WriteHeader(status)
+		}))
+		conf := &ForwarderConfig{LogURL: pointer.String(ts.URL + "/v1/log"), AuthToken: pointer.String("default")}
+		forwarder, err := NewForwarder(conf)
+		So(err, ShouldBeNil)
+		ctx := context.Background()
+		logs := []*sfxlog.ResourceLogs{{LogRecords: []*sfxlog.LogRecord{{Name: "a"}}}}
+		received := func(body []byte) *sfxlog.LogRequest {
+			var msg sfxlog.LogRequest
+			So(proto.Unmarshal(body, &msg), ShouldBeNil)
+			return &msg
+		}
+		Convey("logs should be sent compressed with the default token", func() {
+			So(forwarder.AddLogs(ctx, logs), ShouldBeNil)
+			req := <-requests
+			So(req.Header.Get("Content-Type"), ShouldEqual, "application/x-protobuf")
+			So(req.Header.Get("Content-Encoding"), ShouldEqual, "gzip")
+			So(req.Header.Get(sfxclient.TokenHeaderName), ShouldEqual, "default")
+			r, err := gzip.NewReader(bytes.NewReader(<-bodies))
+			So(err, ShouldBeNil)
+			body, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(received(body).ResourceLogs[0].LogRecords[0].Name, ShouldEqual, "a")
+		})
+		Convey("logs should be sent uncompressed with the token of the context", func() {
+			conf.DisableCompression = pointer.Bool(true)
+			uncompressed, err := NewForwarder(conf)
+			So(err, ShouldBeNil)
+			So(uncompressed.AddLogs(context.WithValue(ctx, sfxclient.TokenHeaderName, "mine"), logs), ShouldBeNil)
+			req := <-requests
+			So(req.Header.Get("Content-Encoding"), ShouldEqual, "")
+			So(req.Header.Get(sfxclient.TokenHeaderName), ShouldEqual, "mine")
+			So(received(<-bodies).ResourceLogs[0].LogRecords[0].Name, ShouldEqual, "a")
+			So(uncompressed.Close(), ShouldBeNil)
+		})
+		Convey("errors should be the same as the other sinks return", func() {
+			status = http.StatusTooManyRequests
+			err := forwarder.AddLogs(ctx, logs)
+			<-requests
+			<-bodies
+			var throttled *sfxclient.TooManyRequestError
+			So(errors.As(err, &throttled), ShouldBeTrue)
+			So(throttled.RetryAfter, ShouldEqual, time.Second*3)
+			status = http.StatusBadRequest
+			err = forwarder.AddLogs(ctx, logs)
+			var apiErr *sfxclient.SFXAPIError
+			So(errors.As(err, &apiErr), ShouldBeTrue)
+			So(apiErr.Endpoint, ShouldEqual, "/v1/log")
+		})
+		Convey("empty logs should not be sent", func() {
+			So(forwarder.AddLogs(ctx, nil), ShouldBeNil)
+			So(len(requests), ShouldEqual, 0)
+		})
+		Convey("bad urls should be errors", func() {
+			forwarder.logURL = "%gh&%ij"
+			So(forwarder.AddLogs(ctx, logs), ShouldNotBeNil)
+			forwarder.logURL = "http://127.0.0.1:1/v1/log"
+			So(forwarder.AddLogs(ctx, logs), ShouldNotBeNil)
+		})
+		Reset(func() {
+			So(forwarder.Close(), ShouldBeNil)
+			ts.Close()
+		})
+	})
+}
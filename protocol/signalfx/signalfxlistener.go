@@ -26,7 +26,9 @@ import (
 	"github.com/signalfx/ingest-protocols/protocol/signalfx/processdebug"
 	"github.com/signalfx/ingest-protocols/protocol/signalfx/spanobfuscation"
 	"github.com/signalfx/ingest-protocols/protocol/signalfx/tagreplace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx/tailsampling"
 	"github.com/signalfx/ingest-protocols/protocol/zipper"
+	"google.golang.org/grpc"
 )
 
 // ListenerServer controls listening on a socket for SignalFx connections
@@ -38,11 +40,20 @@ type ListenerServer struct {
 	internalCollectors sfxclient.Collector
 	metricHandler      metricHandler
 	counter            *dpsink.Counter
+	sampler            *tailsampling.TailSampler
+	grpcServer         *grpc.Server
 }
 
-// Close the exposed socket listening for new connections
+// Close the exposed socket listening for new connections, and forward any traces waiting on a sampling decision
 func (streamer *ListenerServer) Close() error {
-	return streamer.listener.Close()
+	err := streamer.listener.Close()
+	if streamer.grpcServer != nil {
+		streamer.grpcServer.Stop()
+	}
+	if streamer.sampler != nil {
+		err = errors.NewMultiErr([]error{err, streamer.sampler.Close()})
+	}
+	return err
 }
 
 // Addr returns the currently listening address
@@ -102,17 +113,38 @@ func addTokenToContext(ctx context.Context, req *http.Request) context.Context {
 	return ctx
 }
 
+// successResponder is implemented by an ErrorReader whose protocol expects a specific response body on success
+type successResponder interface {
+	writeSuccess(rw http.ResponseWriter, req *http.Request) error
+}
+
+// errorResponder is implemented by an ErrorReader whose protocol expects a specific response body on errors
+type errorResponder interface {
+	writeError(rw http.ResponseWriter, err error) error
+}
+
 // ServeHTTPC will serve the wrapped ErrorReader and return the error (if any) to rw if ErrorReader
 // fails
 func (e *ErrorTrackerHandler) ServeHTTPC(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
 	ctx = addTokenToContext(ctx, req)
 	if err := e.reader.Read(ctx, req); err != nil {
 		atomic.AddInt64(&e.TotalErrors, 1)
+		if responder, ok := e.reader.(errorResponder); ok {
+			log.IfErr(e.Logger, responder.writeError(rw, err))
+			return
+		}
+		if protocol.WriteBackoff(rw, err, e.Logger) {
+			return
+		}
 		rw.WriteHeader(http.StatusBadRequest)
 		_, err = rw.Write([]byte(err.Error()))
 		log.IfErr(e.Logger, err)
 		return
 	}
+	if responder, ok := e.reader.(successResponder); ok {
+		log.IfErr(e.Logger, responder.writeSuccess(rw, req))
+		return
+	}
 	_, err := rw.Write([]byte(`"OK"`))
 	log.IfErr(e.Logger, err)
 }
@@ -133,6 +165,11 @@ type ListenerConfig struct {
 	RemoveSpanTags                     []*spanobfuscation.TagMatchRuleConfig
 	ObfuscateSpanTags                  []*spanobfuscation.TagMatchRuleConfig
 	Counter                            *dpsink.Counter
+	RateLimit                          *RateLimit
+	TokenRateLimits                    map[string]*RateLimit
+	TailSampling                       *tailsampling.Config
+	SpanMetrics                        *SpanMetricsConfig
+	JaegerGRPCListenAddr               *string
 }
 
 var defaultListenerConfig = &ListenerConfig{
@@ -233,9 +270,34 @@ func NewListener(sink Sink, conf *ListenerConfig) (*ListenerServer, error) {
 	r.Handle("/v1/metric", &listenServer.metricHandler)
 	r.Handle("/metric", &listenServer.metricHandler)
 
-	traceSink, err := createTraceSink(sink, conf)
+	traceSink, err := listenServer.createTraceSink(sink, conf)
+
+	var collectors []sfxclient.Collector
+	if err == nil {
+		if traceSink, collectors, err = listenServer.wrapTraceSink(traceSink, conf); err != nil {
+			log.IfErr(conf.Logger, listenServer.Close())
+			return nil, err
+		}
+	}
+	takesLogs := acceptsLogs(sink)
+	if conf.RateLimit != nil || len(conf.TokenRateLimits) > 0 {
+		limiter := NewRateLimiter(conf.RateLimit, conf.TokenRateLimits)
+		sink = FromChain(sink, NextWrap(limiter))
+		if traceSink != nil {
+			traceSink = FromChain(traceSink, NextWrap(limiter))
+		}
+		collectors = append(collectors, limiter)
+	}
+	if takesLogs {
+		collectors = append(collectors, setupLogV1(conf.RootContext, r, sink, conf.Logger, conf.HTTPChain, conf.Counter))
+	}
+	var grpcErr error
+	if collectors, grpcErr = listenServer.setupJaegerGRPC(collectors, traceSink, conf); grpcErr != nil {
+		log.IfErr(conf.Logger, listenServer.Close())
+		return nil, grpcErr
+	}
 
-	listenServer.internalCollectors = sfxclient.NewMultiCollector(
+	listenServer.internalCollectors = sfxclient.NewMultiCollector(append(collectors,
 		setupNotFoundHandler(conf.RootContext, r),
 		setupProtobufV1(conf.RootContext, r, sink, &listenServer.metricHandler, conf.Logger, conf.HTTPChain, conf.Counter),
 		setupJSONV1(conf.RootContext, r, sink, &listenServer.metricHandler, conf.Logger, conf.Counter, conf.HTTPChain),
@@ -246,7 +308,11 @@ func NewListener(sink Sink, conf *ListenerConfig) (*ListenerServer, error) {
 		setupCollectd(conf.RootContext, r, sink, conf.DebugContext, conf.HTTPChain, conf.Logger, conf.Counter),
 		setupThriftTraceV1(conf.RootContext, r, traceSink, conf.Logger, conf.HTTPChain, conf.Counter),
 		setupJSONTraceV1(conf.RootContext, r, traceSink, conf.Logger, conf.HTTPChain, conf.Counter),
-	)
+		setupOTLPMetricsV1(conf.RootContext, r, sink, conf.Logger, conf.DebugContext, conf.HTTPChain, conf.Counter),
+		setupOTLPTracesV1(conf.RootContext, r, traceSink, conf.Logger, conf.HTTPChain, conf.Counter),
+		setupSAPMTraceV2(conf.RootContext, r, traceSink, conf.Logger, conf.HTTPChain, conf.Counter),
+		setupHECV1(conf.RootContext, r, sink, takesLogs, conf.Logger, conf.HTTPChain, conf.Counter),
+	)...)
 
 	go func() {
 		log.IfErr(conf.Logger, server.Serve(listener))
@@ -263,9 +329,51 @@ func setupNotFoundHandler(ctx context.Context, r *mux.Router) sfxclient.Collecto
 	}
 }
 
-func createTraceSink(sink Sink, conf *ListenerConfig) (Sink, error) {
+// wrapTraceSink adds span metrics to the trace sink if they are configured.  Span metrics are derived before the
+// tail sampler drops any spans.
+func (streamer *ListenerServer) wrapTraceSink(traceSink Sink, conf *ListenerConfig) (Sink, []sfxclient.Collector, error) {
+	var collectors []sfxclient.Collector
+	if streamer.sampler != nil {
+		collectors = append(collectors, streamer.sampler)
+	}
+	if conf.SpanMetrics != nil {
+		spanMetrics, err := NewSpanMetrics(conf.SpanMetrics, conf.Logger)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "cannot create span metrics %v", conf.SpanMetrics)
+		}
+		traceSink = FromChain(traceSink, NextWrap(spanMetrics))
+		collectors = append(collectors, spanMetrics)
+	}
+	return traceSink, collectors, nil
+}
+
+// setupJaegerGRPC serves Jaeger gRPC spans into traceSink if there is a JaegerGRPCListenAddr
+func (streamer *ListenerServer) setupJaegerGRPC(collectors []sfxclient.Collector, traceSink Sink, conf *ListenerConfig) ([]sfxclient.Collector, error) {
+	if conf.JaegerGRPCListenAddr == nil {
+		return collectors, nil
+	}
+	if traceSink == nil {
+		return nil, errors.Errorf("cannot serve jaeger gRPC on %s without a trace sink", *conf.JaegerGRPCListenAddr)
+	}
+	server, collector, err := setupJaegerGRPCV1(*conf.JaegerGRPCListenAddr, traceSink, conf.Logger, conf.Counter)
+	if err != nil {
+		return nil, errors.Annotatef(err, "cannot open jaeger gRPC listening address %s", *conf.JaegerGRPCListenAddr)
+	}
+	streamer.grpcServer = server
+	return append(collectors, collector), nil
+}
+
+func (streamer *ListenerServer) createTraceSink(sink Sink, conf *ListenerConfig) (Sink, error) {
 	// These sinks will be called in the opposite order that they are declared here, since we are passing them as "next"
-	// to each successive sink
+	// to each successive sink.  The tail sampler is declared first so it decides on spans as they will be sent.
+	if conf.TailSampling != nil {
+		sampler, err := tailsampling.New(conf.TailSampling, sink, conf.Logger)
+		if err != nil {
+			return nil, errors.Annotatef(err, "cannot create tail sampler %v", conf.TailSampling)
+		}
+		streamer.sampler = sampler
+		sink = sampler
+	}
 	if len(conf.RemoveSpanTags) > 0 {
 		var err error
 		sink, err = spanobfuscation.NewRm(conf.RemoveSpanTags, sink)
@@ -299,7 +407,7 @@ func createTraceSink(sink Sink, conf *ListenerConfig) (Sink, error) {
 func SetupChain(ctx context.Context, sink Sink, chainType string, getReader func(Sink) ErrorReader, httpChain web.NextConstructor, logger log.Logger, counter *dpsink.Counter, moreConstructors ...web.Constructor) (http.Handler, sfxclient.Collector) {
 	zippers := zipper.NewZipper()
 
-	ucount := UnifyNextSinkWrap(counter)
+	ucount := &logCounter{NextSink: UnifyNextSinkWrap(counter), counter: counter}
 	finalSink := FromChain(sink, NextWrap(ucount))
 	errReader := getReader(finalSink)
 	errorTracker := ErrorTrackerHandler{
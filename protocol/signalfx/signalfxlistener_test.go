@@ -30,6 +30,7 @@ import (
 	"github.com/signalfx/golib/v3/web"
 	"github.com/signalfx/ingest-protocols/protocol/filtering"
 	"github.com/signalfx/ingest-protocols/protocol/signalfx/spanobfuscation"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx/tailsampling"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/stretchr/testify/assert"
 )
@@ -42,6 +43,11 @@ func (errorReader *errorReader) Read([]byte) (int, error) {
 	return 0, errReadErr
 }
 
+// passThroughChain is the smallest HTTPChain a listener can be given
+func passThroughChain(ctx context.Context, rw http.ResponseWriter, r *http.Request, next web.ContextHandler) {
+	next.ServeHTTPC(ctx, rw, r)
+}
+
 func TestSignalfxProtoDecoders(t *testing.T) {
 	readerCheck := func(decoder ErrorReader) {
 		Convey("should check read errors", func() {
@@ -197,6 +203,22 @@ func TestSignalfxListenerFailure(t *testing.T) {
 		_, err := NewListener(nil, listenConf)
 		So(err, ShouldNotBeNil)
 	})
+	Convey("invalid tail sampling policy should not listen", t, func() {
+		listenConf := &ListenerConfig{
+			ListenAddr:   pointer.String("127.0.0.1:0"),
+			TailSampling: &tailsampling.Config{Policies: []*tailsampling.Policy{{}}},
+		}
+		_, err := NewListener(nil, listenConf)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("invalid span metric buckets should not listen", t, func() {
+		listenConf := &ListenerConfig{
+			ListenAddr:  pointer.String("127.0.0.1:0"),
+			SpanMetrics: &SpanMetricsConfig{Buckets: []time.Duration{-time.Second}},
+		}
+		_, err := NewListener(nil, listenConf)
+		So(err, ShouldNotBeNil)
+	})
 }
 
 func TestCheckResp(t *testing.T) {
@@ -305,7 +327,7 @@ func TestSignalfxListener(t *testing.T) {
 			So(forwarder.StartupFinished(), ShouldBeNil)
 			So(forwarder.DebugEndpoints(), ShouldResemble, map[string]http.Handler{})
 			So(err, ShouldBeNil)
-			So(len(forwarder.Datapoints()), ShouldEqual, 7)
+			So(len(forwarder.Datapoints()), ShouldEqual, 9)
 			So(forwarder.Pipeline(), ShouldEqual, 0)
 			Convey("Should be able to send a point", func() {
 				dpSent := dptest.DP()
@@ -473,7 +495,7 @@ func TestSignalfxListener(t *testing.T) {
 			verifyStatusCode("INVALID_PROTOBUF", "application/x-protobuf", "/v2/datapoint", http.StatusBadRequest)
 			dps = listener.Datapoints()
 			So(dptest.ExactlyOneDims(dps, "total_errors", map[string]string{"protocol": "sfx_protobuf_v2"}).Value.String(), ShouldEqual, "1")
-			So(len(dps), ShouldEqual, 85)
+			So(len(dps), ShouldEqual, 128)
 			So(dptest.ExactlyOneDims(dps, "dropped_points", map[string]string{"protocol": "sfx_json_v2", "reason": "unknown_metric_type"}).Value.String(), ShouldEqual, "0")
 			So(dptest.ExactlyOneDims(dps, "dropped_points", map[string]string{"protocol": "sfx_json_v2", "reason": "invalid_value"}).Value.String(), ShouldEqual, "0")
 		})
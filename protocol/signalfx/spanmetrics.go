@@ -0,0 +1,226 @@
+package signalfx
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/logkey"
+)
+
+// SpanMetricsConfig controls which request, error and duration metrics are derived from spans
+type SpanMetricsConfig struct {
+	// MetricPrefix starts the name of each derived metric
+	MetricPrefix *string `json:",omitempty"`
+	// Kind adds the span kind as the kind dimension
+	Kind *bool `json:",omitempty"`
+	// Service adds the local endpoint service name as the service dimension
+	Service *bool `json:",omitempty"`
+	// Operation adds the span name as the operation dimension
+	Operation *bool `json:",omitempty"`
+	// Tags are span tags added as dimensions of the same name
+	Tags []string `json:",omitempty"`
+	// Buckets are the upper bounds of the duration histogram
+	Buckets []time.Duration `json:",omitempty"`
+}
+
+var defaultSpanMetricsConfig = &SpanMetricsConfig{
+	MetricPrefix: pointer.String("spans"),
+	Kind:         pointer.Bool(true),
+	Service:      pointer.Bool(true),
+	Operation:    pointer.Bool(true),
+	Tags:         []string{},
+	Buckets: []time.Duration{
+		time.Millisecond * 5, time.Millisecond * 10, time.Millisecond * 25, time.Millisecond * 50, time.Millisecond * 100,
+		time.Millisecond * 250, time.Millisecond * 500, time.Second, time.Millisecond * 2500, time.Second * 5, time.Second * 10,
+	},
+}
+
+// spanSeries is what a batch of spans adds up to for one set of dimensions
+type spanSeries struct {
+	dims     map[string]string
+	requests int64
+	errors   int64
+	buckets  []int64
+	sum      float64
+}
+
+// datapoint makes a count for the series with its own copy of the dimensions, so sinks changing the dimensions of
+// one datapoint do not change the others
+func (series *spanSeries) datapoint(metric string, value datapoint.Value, now time.Time) *datapoint.Datapoint {
+	dims := make(map[string]string, len(series.dims))
+	for k, v := range series.dims {
+		dims[k] = v
+	}
+	return datapoint.New(metric, dims, value, datapoint.Count, now)
+}
+
+// SpanMetrics is a NextSink that derives request, error and duration metrics from the spans passing through it and
+// sends them on with the datapoints of the same request.  Each batch of spans is sent as counters of how many
+// requests and errors and how much duration it had, with the duration histogram as one counter per bucket with an le
+// dimension.  Spans are passed on untouched.
+type SpanMetrics struct {
+	prefix    string
+	kind      bool
+	service   bool
+	operation bool
+	tags      []string
+	buckets   []time.Duration
+	// le are the le dimension values of the buckets, in seconds
+	le     []string
+	now    func() time.Time
+	logger log.Logger
+
+	stats struct {
+		spans      int64
+		datapoints int64
+	}
+}
+
+var _ NextSink = &SpanMetrics{}
+
+// NewSpanMetrics returns a SpanMetrics that derives the metrics in conf
+func NewSpanMetrics(conf *SpanMetricsConfig, logger log.Logger) (*SpanMetrics, error) {
+	conf = pointer.FillDefaultFrom(conf, defaultSpanMetricsConfig).(*SpanMetricsConfig)
+	s := &SpanMetrics{
+		prefix:    *conf.MetricPrefix,
+		kind:      *conf.Kind,
+		service:   *conf.Service,
+		operation: *conf.Operation,
+		tags:      conf.Tags,
+		buckets:   conf.Buckets,
+		now:       time.Now,
+		logger:    log.NewContext(logger).With(logkey.Struct, "SpanMetrics"),
+	}
+	for i, b := range conf.Buckets {
+		if b <= 0 || (i > 0 && b <= conf.Buckets[i-1]) {
+			return nil, fmt.Errorf("span metric buckets must be positive and increasing, not %v", conf.Buckets)
+		}
+		s.le = append(s.le, strconv.FormatFloat(b.Seconds(), 'f', -1, 64))
+	}
+	s.le = append(s.le, "+Inf")
+	return s, nil
+}
+
+func (s *SpanMetrics) dims(span *trace.Span) map[string]string {
+	dims := make(map[string]string, 3+len(s.tags))
+	addDim := func(key string, value *string) {
+		if value != nil && *value != "" {
+			dims[key] = *value
+		}
+	}
+	if s.kind {
+		addDim("kind", span.Kind)
+	}
+	if s.service && span.LocalEndpoint != nil {
+		addDim("service", span.LocalEndpoint.ServiceName)
+	}
+	if s.operation {
+		addDim("operation", span.Name)
+	}
+	for _, tag := range s.tags {
+		if v, exists := span.Tags[tag]; exists {
+			addDim(tag, &v)
+		}
+	}
+	return dims
+}
+
+func seriesKey(dims map[string]string) string {
+	parts := make([]string, 0, len(dims))
+	for k, v := range dims {
+		parts = append(parts, k+"\x00"+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "\x00")
+}
+
+func spanHasError(span *trace.Span) bool {
+	v, exists := span.Tags[string(ext.Error)]
+	return exists && v != "false"
+}
+
+func (s *SpanMetrics) observe(series *spanSeries, span *trace.Span) {
+	series.requests++
+	if spanHasError(span) {
+		series.errors++
+	}
+	if span.Duration == nil {
+		return
+	}
+	duration := time.Duration(*span.Duration) * time.Microsecond
+	series.sum += duration.Seconds()
+	// buckets are cumulative, so every bucket at least as big as the duration counts it
+	for i := sort.Search(len(s.buckets), func(i int) bool { return duration <= s.buckets[i] }); i < len(series.buckets); i++ {
+		series.buckets[i]++
+	}
+}
+
+func (s *SpanMetrics) datapoints(spans []*trace.Span) []*datapoint.Datapoint {
+	bySeries := make(map[string]*spanSeries)
+	for _, span := range spans {
+		dims := s.dims(span)
+		key := seriesKey(dims)
+		series, exists := bySeries[key]
+		if !exists {
+			series = &spanSeries{dims: dims, buckets: make([]int64, len(s.le))}
+			bySeries[key] = series
+		}
+		s.observe(series, span)
+	}
+	now := s.now()
+	dps := make([]*datapoint.Datapoint, 0, len(bySeries)*(3+len(s.le)))
+	for _, series := range bySeries {
+		dps = append(dps,
+			series.datapoint(s.prefix+".count", datapoint.NewIntValue(series.requests), now),
+			series.datapoint(s.prefix+".errors", datapoint.NewIntValue(series.errors), now),
+			series.datapoint(s.prefix+".duration.sum", datapoint.NewFloatValue(series.sum), now),
+		)
+		for i, le := range s.le {
+			dps = append(dps, datapoint.New(s.prefix+".duration.bucket", datapoint.AddMaps(series.dims, map[string]string{"le": le}), datapoint.NewIntValue(series.buckets[i]), datapoint.Count, now))
+		}
+	}
+	return dps
+}
+
+// AddDatapoints is a passthrough
+func (s *SpanMetrics) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next Sink) error {
+	return next.AddDatapoints(ctx, points)
+}
+
+// AddEvents is a passthrough
+func (s *SpanMetrics) AddEvents(ctx context.Context, events []*event.Event, next Sink) error {
+	return next.AddEvents(ctx, events)
+}
+
+// AddSpans forwards the spans and then the metrics derived from them.  Nothing is derived from spans that could not
+// be forwarded, since they will be counted when they are sent again.
+func (s *SpanMetrics) AddSpans(ctx context.Context, spans []*trace.Span, next Sink) error {
+	if err := next.AddSpans(ctx, spans); err != nil || len(spans) == 0 {
+		return err
+	}
+	dps := s.datapoints(spans)
+	atomic.AddInt64(&s.stats.spans, int64(len(spans)))
+	atomic.AddInt64(&s.stats.datapoints, int64(len(dps)))
+	log.IfErr(s.logger, next.AddDatapoints(ctx, dps))
+	return nil
+}
+
+// Datapoints returns how many spans were observed and how many datapoints were derived from them
+func (s *SpanMetrics) Datapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.Cumulative("span_metrics.spans", nil, atomic.LoadInt64(&s.stats.spans)),
+		sfxclient.Cumulative("span_metrics.datapoints", nil, atomic.LoadInt64(&s.stats.datapoints)),
+	}
+}
@@ -0,0 +1,101 @@
+package signalfx
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSpanMetrics(t *testing.T) {
+	Convey("given span metrics with a tag dimension and two buckets", t, func() {
+		spanMetrics, err := NewSpanMetrics(&SpanMetricsConfig{
+			Tags:    []string{"env"},
+			Buckets: []time.Duration{time.Millisecond * 10, time.Millisecond * 100},
+		}, log.Discard)
+		So(err, ShouldBeNil)
+		now := time.Now()
+		spanMetrics.now = func() time.Time { return now }
+		sink := dptest.NewBasicSink()
+		sink.Resize(2)
+		chain := FromChain(sink, NextWrap(spanMetrics))
+		ctx := context.Background()
+		spans := []*trace.Span{
+			{TraceID: "a", ID: "1", Kind: pointer.String("SERVER"), Name: pointer.String("GET"), LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String("api")}, Duration: pointer.Int64(3000), Tags: map[string]string{"error": "false"}},
+			{TraceID: "a", ID: "2", Kind: pointer.String("SERVER"), Name: pointer.String("GET"), LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String("api")}, Duration: pointer.Int64(20000), Tags: map[string]string{"error": "true"}},
+			{TraceID: "a", ID: "3", Kind: pointer.String("CLIENT"), Name: pointer.String("db"), LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String("api")}, Tags: map[string]string{"env": "prod"}},
+		}
+		Convey("spans should pass through followed by their metrics", func() {
+			So(chain.AddSpans(ctx, spans), ShouldBeNil)
+			So(<-sink.TracesChan, ShouldResemble, spans)
+			dps := <-sink.PointsChan
+			So(len(dps), ShouldEqual, 12)
+			server := map[string]string{"kind": "SERVER", "service": "api", "operation": "GET"}
+			client := map[string]string{"kind": "CLIENT", "service": "api", "operation": "db", "env": "prod"}
+			with := func(dims map[string]string, le string) map[string]string {
+				return datapoint.AddMaps(dims, map[string]string{"le": le})
+			}
+			So(dptest.ExactlyOneDims(dps, "spans.count", server).Value, ShouldResemble, datapoint.NewIntValue(2))
+			So(dptest.ExactlyOneDims(dps, "spans.count", server).MetricType, ShouldEqual, datapoint.Count)
+			So(dptest.ExactlyOneDims(dps, "spans.count", server).Timestamp, ShouldEqual, now)
+			So(dptest.ExactlyOneDims(dps, "spans.errors", server).Value, ShouldResemble, datapoint.NewIntValue(1))
+			So(dptest.ExactlyOneDims(dps, "spans.duration.sum", server).Value.(datapoint.FloatValue).Float(), ShouldAlmostEqual, .023)
+			So(dptest.ExactlyOneDims(dps, "spans.duration.bucket", with(server, "0.01")).Value, ShouldResemble, datapoint.NewIntValue(1))
+			So(dptest.ExactlyOneDims(dps, "spans.duration.bucket", with(server, "0.1")).Value, ShouldResemble, datapoint.NewIntValue(2))
+			So(dptest.ExactlyOneDims(dps, "spans.duration.bucket", with(server, "+Inf")).Value, ShouldResemble, datapoint.NewIntValue(2))
+			So(dptest.ExactlyOneDims(dps, "spans.count", client).Value, ShouldResemble, datapoint.NewIntValue(1))
+			So(dptest.ExactlyOneDims(dps, "spans.errors", client).Value, ShouldResemble, datapoint.NewIntValue(0))
+			So(dptest.ExactlyOneDims(dps, "spans.duration.bucket", with(client, "+Inf")).Value, ShouldResemble, datapoint.NewIntValue(0))
+			// every datapoint should have its own dimensions
+			dptest.ExactlyOneDims(dps, "spans.count", server).Dimensions["host"] = "changed"
+			So(dptest.ExactlyOneDims(dps, "spans.errors", server).Dimensions, ShouldResemble, server)
+			So(dptest.ExactlyOneDims(dps, "spans.duration.sum", server).Dimensions, ShouldResemble, server)
+
+			stats := spanMetrics.Datapoints()
+			So(dptest.ExactlyOne(stats, "span_metrics.spans").Value, ShouldResemble, datapoint.NewIntValue(3))
+			So(dptest.ExactlyOne(stats, "span_metrics.datapoints").Value, ShouldResemble, datapoint.NewIntValue(12))
+		})
+		Convey("spans that fail to forward should not be counted", func() {
+			sink.RetError(errors.New("nope"))
+			So(chain.AddSpans(ctx, spans), ShouldNotBeNil)
+			So(len(sink.PointsChan), ShouldEqual, 0)
+			So(dptest.ExactlyOne(spanMetrics.Datapoints(), "span_metrics.spans").Value, ShouldResemble, datapoint.NewIntValue(0))
+		})
+		Convey("empty batches should not make datapoints", func() {
+			So(chain.AddSpans(ctx, []*trace.Span{}), ShouldBeNil)
+			So(len(sink.PointsChan), ShouldEqual, 0)
+		})
+		Convey("datapoints and events should pass through", func() {
+			So(chain.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldBeNil)
+			So(chain.AddEvents(ctx, []*event.Event{dptest.E()}), ShouldBeNil)
+			So(len(sink.PointsChan), ShouldEqual, 1)
+			So(len(sink.EventsChan), ShouldEqual, 1)
+		})
+	})
+	Convey("span metrics without dimensions should put every span in one series", t, func() {
+		spanMetrics, err := NewSpanMetrics(&SpanMetricsConfig{
+			MetricPrefix: pointer.String("red"),
+			Kind:         pointer.Bool(false),
+			Service:      pointer.Bool(false),
+			Operation:    pointer.Bool(false),
+		}, log.Discard)
+		So(err, ShouldBeNil)
+		dps := spanMetrics.datapoints([]*trace.Span{{Name: pointer.String("a")}, {Name: pointer.String("b")}})
+		So(dptest.ExactlyOneDims(dps, "red.count", map[string]string{}).Value, ShouldResemble, datapoint.NewIntValue(2))
+		So(len(dps), ShouldEqual, 3+len(defaultSpanMetricsConfig.Buckets)+1)
+	})
+	Convey("buckets should be positive and increasing", t, func() {
+		for _, buckets := range [][]time.Duration{{0}, {time.Second, time.Second}} {
+			_, err := NewSpanMetrics(&SpanMetricsConfig{Buckets: buckets}, log.Discard)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -17,6 +17,7 @@ type obfsink interface {
 var _ obfsink = &SpanTagObfuscation{}
 
 // SpanTagObfuscation does a wildcard search for service and operation name, and replaces the given tags from matching spans with the OBFUSCATED const
+// Rules with value patterns instead redact, hash or truncate the matching parts of the given tags, span names and annotation values
 // This modifies the objects parsed, so in a concurrent context, you will want to copy the objects sent here first
 type SpanTagObfuscation struct {
 	rules []*rule
@@ -51,6 +52,10 @@ func (o *SpanTagObfuscation) AddSpans(ctx context.Context, spans []*trace.Span)
 
 		for _, r := range o.rules {
 			if r.service.Match(service) && r.operation.Match(name) {
+				if len(r.patterns) > 0 {
+					r.scrub(s)
+					continue
+				}
 				for _, t := range r.tags {
 					if _, exists := s.Tags[t]; exists {
 						s.Tags[t] = OBFUSCATED
@@ -2,6 +2,7 @@ package spanobfuscation
 
 import (
 	"context"
+	"errors"
 
 	"github.com/signalfx/golib/v3/datapoint"
 	"github.com/signalfx/golib/v3/datapoint/dpsink"
@@ -63,6 +64,11 @@ func NewRm(ruleConfigs []*TagMatchRuleConfig, next rmsink) (*SpanTagRemoval, err
 	if err != nil {
 		return nil, err
 	}
+	for _, r := range ruleConfigs {
+		if len(r.ValuePatterns) > 0 || len(r.Tags) == 0 {
+			return nil, errors.New("span tag removal rules must include Tags and cannot include ValuePatterns")
+		}
+	}
 
 	return &SpanTagRemoval{
 		rules: rules,
@@ -11,16 +11,20 @@ type rule struct {
 	service   glob.Glob
 	operation glob.Glob
 	tags      []string
+	patterns  []*valuePattern
 }
 
 // TagMatchRuleConfig describes a wildcard search for a service and operation, along with which specific tags to match
 // Service and Operation can both include "*" for wildcard search, but Tags will only perform an exact text match
 // If Service or Operation are omitted, they will use a default value of "*", to match any service/operation
-// Tags must be present, and cannot be empty
+// Tags must be present, and cannot be empty, unless ValuePatterns are given
+// ValuePatterns change only the matching parts of the values of Tags, span names and annotation values, instead of
+// the whole value of Tags
 type TagMatchRuleConfig struct {
-	Service   *string  `json:",omitempty"`
-	Operation *string  `json:",omitempty"`
-	Tags      []string `json:",omitempty"`
+	Service       *string               `json:",omitempty"`
+	Operation     *string               `json:",omitempty"`
+	Tags          []string              `json:",omitempty"`
+	ValuePatterns []*ValuePatternConfig `json:",omitempty"`
 }
 
 func getRules(ruleConfigs []*TagMatchRuleConfig) ([]*rule, error) {
@@ -34,7 +38,7 @@ func getRules(ruleConfigs []*TagMatchRuleConfig) ([]*rule, error) {
 		if r.Operation != nil {
 			operation = *r.Operation
 		}
-		if len(r.Tags) == 0 {
+		if len(r.Tags) == 0 && len(r.ValuePatterns) == 0 {
 			return nil, fmt.Errorf("must include Tags for %s:%s", service, operation)
 		}
 
@@ -46,11 +50,21 @@ func getRules(ruleConfigs []*TagMatchRuleConfig) ([]*rule, error) {
 			}
 		}
 
+		patterns := make([]*valuePattern, 0, len(r.ValuePatterns))
+		for _, p := range r.ValuePatterns {
+			pattern, err := newValuePattern(p)
+			if err != nil {
+				return nil, fmt.Errorf("%v in %s:%s", err, service, operation)
+			}
+			patterns = append(patterns, pattern)
+		}
+
 		rules = append(rules,
 			&rule{
 				service:   serviceGlob,
 				operation: operationGlob,
 				tags:      r.Tags,
+				patterns:  patterns,
 			})
 	}
 	return rules, nil
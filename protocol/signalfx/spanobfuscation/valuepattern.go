@@ -0,0 +1,134 @@
+package spanobfuscation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+)
+
+// The actions a value pattern can take on the substrings it matches
+const (
+	Redact   = "redact"
+	Hash     = "hash"
+	Truncate = "truncate"
+)
+
+// ValuePatternConfig describes a regular expression whose matches inside tag values, span names and annotation values
+// are redacted, hashed or truncated.  If Pattern has a capture group, only the text of the first group is changed, so
+// `Bearer (\S+)` keeps the "Bearer " prefix.
+type ValuePatternConfig struct {
+	Pattern *string `json:",omitempty"`
+	// Action is redact, hash or truncate, and defaults to redact
+	Action *string `json:",omitempty"`
+	// Replacement is what redact replaces matches with, and defaults to the OBFUSCATED const
+	Replacement *string `json:",omitempty"`
+	// HashKey is the HMAC-SHA256 key hash uses, so the same value always hashes the same way
+	HashKey *string `json:",omitempty"`
+	// Length is how many characters of each match truncate keeps
+	Length *int `json:",omitempty"`
+}
+
+type valuePattern struct {
+	re        *regexp.Regexp
+	transform func(string) string
+}
+
+func newValuePattern(conf *ValuePatternConfig) (*valuePattern, error) {
+	if conf == nil || conf.Pattern == nil {
+		return nil, fmt.Errorf("value patterns must include a Pattern")
+	}
+	re, err := regexp.Compile(*conf.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile value pattern %s: %v", *conf.Pattern, err)
+	}
+	action := Redact
+	if conf.Action != nil {
+		action = *conf.Action
+	}
+	p := &valuePattern{re: re}
+	switch action {
+	case Redact:
+		replacement := OBFUSCATED
+		if conf.Replacement != nil {
+			replacement = *conf.Replacement
+		}
+		p.transform = func(string) string { return replacement }
+	case Hash:
+		if conf.HashKey == nil || *conf.HashKey == "" {
+			return nil, fmt.Errorf("value pattern %s must include a HashKey to hash", *conf.Pattern)
+		}
+		key := []byte(*conf.HashKey)
+		p.transform = func(s string) string {
+			mac := hmac.New(sha256.New, key)
+			_, _ = mac.Write([]byte(s))
+			return hex.EncodeToString(mac.Sum(nil))
+		}
+	case Truncate:
+		if conf.Length == nil || *conf.Length < 0 {
+			return nil, fmt.Errorf("value pattern %s must include a non negative Length to truncate", *conf.Pattern)
+		}
+		length := *conf.Length
+		p.transform = func(s string) string {
+			if r := []rune(s); len(r) > length {
+				return string(r[:length])
+			}
+			return s
+		}
+	default:
+		return nil, fmt.Errorf("unknown value pattern action %s", action)
+	}
+	return p, nil
+}
+
+func (p *valuePattern) apply(value string) string {
+	matches := p.re.FindAllStringSubmatchIndex(value, -1)
+	if matches == nil {
+		return value
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) > 2 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		if start == end {
+			continue
+		}
+		b.WriteString(value[last:start])
+		b.WriteString(p.transform(value[start:end]))
+		last = end
+	}
+	b.WriteString(value[last:])
+	return b.String()
+}
+
+func (r *rule) scrubValue(value string) string {
+	for _, p := range r.patterns {
+		value = p.apply(value)
+	}
+	return value
+}
+
+// scrub applies the value patterns of the rule to its tags, the span name and the values of the span's annotations
+func (r *rule) scrub(s *trace.Span) {
+	for _, t := range r.tags {
+		if v, exists := s.Tags[t]; exists {
+			s.Tags[t] = r.scrubValue(v)
+		}
+	}
+	if s.Name != nil {
+		s.Name = pointer.String(r.scrubValue(*s.Name))
+	}
+	for _, a := range s.Annotations {
+		if a != nil && a.Value != nil {
+			a.Value = pointer.String(r.scrubValue(*a.Value))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package spanobfuscation
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func hmacHex(key string, value string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValuePattern(t *testing.T) {
+	Convey("value patterns should", t, func() {
+		apply := func(conf *ValuePatternConfig, value string) string {
+			p, err := newValuePattern(conf)
+			So(err, ShouldBeNil)
+			return p.apply(value)
+		}
+		Convey("redact every match", func() {
+			email := &ValuePatternConfig{Pattern: pointer.String(`[\w.]+@[\w.]+`)}
+			So(apply(email, "from a@b.com to c.d@e.org"), ShouldEqual, "from "+OBFUSCATED+" to "+OBFUSCATED)
+			So(apply(email, "nobody"), ShouldEqual, "nobody")
+			email.Replacement = pointer.String("<email>")
+			So(apply(email, "a@b.com"), ShouldEqual, "<email>")
+		})
+		Convey("only change the first capture group", func() {
+			bearer := &ValuePatternConfig{Pattern: pointer.String(`Bearer (\S+)`)}
+			So(apply(bearer, "Authorization: Bearer abc123 ok"), ShouldEqual, "Authorization: Bearer "+OBFUSCATED+" ok")
+			optional := &ValuePatternConfig{Pattern: pointer.String(`secret(=\w+)?`)}
+			So(apply(optional, "secret and secret=x"), ShouldEqual, OBFUSCATED+" and secret"+OBFUSCATED)
+		})
+		Convey("ignore empty matches", func() {
+			So(apply(&ValuePatternConfig{Pattern: pointer.String(`x*`)}, "abxxc"), ShouldEqual, "ab"+OBFUSCATED+"c")
+		})
+		Convey("hash matches with the key", func() {
+			hash := &ValuePatternConfig{Pattern: pointer.String(`\d{4}-\d{4}-\d{4}-\d{4}`), Action: pointer.String(Hash), HashKey: pointer.String("key")}
+			So(apply(hash, "card 1234-5678-9012-3456"), ShouldEqual, "card "+hmacHex("key", "1234-5678-9012-3456"))
+			So(apply(hash, "1234-5678-9012-3456"), ShouldEqual, apply(hash, "1234-5678-9012-3456"))
+		})
+		Convey("truncate matches to their length", func() {
+			truncate := &ValuePatternConfig{Pattern: pointer.String(`token=(\w+)`), Action: pointer.String(Truncate), Length: pointer.Int(3)}
+			So(apply(truncate, "/login?token=abcdef&token=ab"), ShouldEqual, "/login?token=abc&token=ab")
+		})
+		Convey("fail on bad configs", func() {
+			for _, conf := range []*ValuePatternConfig{
+				nil,
+				{},
+				{Pattern: pointer.String(`(`)},
+				{Pattern: pointer.String(`a`), Action: pointer.String("explode")},
+				{Pattern: pointer.String(`a`), Action: pointer.String(Hash)},
+				{Pattern: pointer.String(`a`), Action: pointer.String(Truncate)},
+				{Pattern: pointer.String(`a`), Action: pointer.String(Truncate), Length: pointer.Int(-1)},
+			} {
+				_, err := newValuePattern(conf)
+				So(err, ShouldNotBeNil)
+			}
+			_, err := getRules([]*TagMatchRuleConfig{{ValuePatterns: []*ValuePatternConfig{{}}}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+	Convey("obfuscation rules with value patterns", t, func() {
+		obf, err := NewObf([]*TagMatchRuleConfig{
+			{
+				Service:       pointer.String("db*"),
+				Tags:          []string{"db.statement", "http.url"},
+				ValuePatterns: []*ValuePatternConfig{{Pattern: pointer.String(`[\w.]+@[\w.]+`)}},
+			},
+		}, &obfend{})
+		So(err, ShouldBeNil)
+		Convey("should scrub tags, span names and annotations", func() {
+			span := makeSpan("db-service", "lookup a@b.com", map[string]string{"db.statement": "select * where email = 'a@b.com'", "other": "a@b.com"})
+			span.Annotations = []*trace.Annotation{{Value: pointer.String("sent to a@b.com")}, {}, nil}
+			So(obf.AddSpans(context.Background(), []*trace.Span{span}), ShouldBeNil)
+			So(span.Tags, ShouldResemble, map[string]string{"db.statement": "select * where email = '" + OBFUSCATED + "'", "other": "a@b.com"})
+			So(*span.Name, ShouldEqual, "lookup "+OBFUSCATED)
+			So(*span.Annotations[0].Value, ShouldEqual, "sent to "+OBFUSCATED)
+		})
+		Convey("should leave other services alone", func() {
+			span := makeSpan("web", "lookup a@b.com", map[string]string{"db.statement": "a@b.com"})
+			So(obf.AddSpans(context.Background(), []*trace.Span{span}), ShouldBeNil)
+			So(*span.Name, ShouldEqual, "lookup a@b.com")
+			So(span.Tags["db.statement"], ShouldEqual, "a@b.com")
+		})
+	})
+	Convey("removal rules should not take value patterns", t, func() {
+		_, err := NewRm([]*TagMatchRuleConfig{{Tags: []string{"a"}, ValuePatterns: []*ValuePatternConfig{{Pattern: pointer.String("a")}}}}, &rmend{})
+		So(err, ShouldNotBeNil)
+		_, err = NewRm([]*TagMatchRuleConfig{{ValuePatterns: []*ValuePatternConfig{{Pattern: pointer.String("a")}}}}, &rmend{})
+		So(err, ShouldNotBeNil)
+	})
+}
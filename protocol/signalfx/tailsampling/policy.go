@@ -0,0 +1,175 @@
+package tailsampling
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/config/globbing"
+)
+
+// Policy keeps the traces that match it.  Exactly one of the criteria should be set.
+type Policy struct {
+	// Name is used for the decision stats, and defaults to policy_N
+	Name *string `json:",omitempty"`
+	// Errors keeps traces with a span that has an error tag
+	Errors *bool `json:",omitempty"`
+	// MinDuration keeps traces that took at least this long from their first span starting to their last span ending
+	MinDuration *time.Duration `json:",omitempty"`
+	// Services keeps traces with a span from a service matching one of these globs
+	Services []string `json:",omitempty"`
+	// Operations keeps traces with a span whose name matches one of these globs
+	Operations []string `json:",omitempty"`
+	// Debug keeps traces with a debug span or a span with a sampling.priority of 1
+	Debug *bool `json:",omitempty"`
+	// Rate keeps this fraction of traces, chosen by their trace id so every instance makes the same decision
+	Rate *float64 `json:",omitempty"`
+}
+
+type predicate func(spans []*trace.Span) bool
+
+type policy struct {
+	name  string
+	match predicate
+	kept  int64
+}
+
+var errPolicyCriteria = errors.New("a tail sampling policy needs exactly one of Errors, MinDuration, Services, Operations, Debug or Rate")
+
+func validate(p *Policy) error {
+	if p == nil {
+		return errPolicyCriteria
+	}
+	count := 0
+	for _, set := range []bool{p.Errors != nil, p.MinDuration != nil, p.Services != nil, p.Operations != nil, p.Debug != nil, p.Rate != nil} {
+		if set {
+			count++
+		}
+	}
+	if count != 1 {
+		return errPolicyCriteria
+	}
+	if p.Rate != nil && (*p.Rate < 0 || *p.Rate > 1) {
+		return fmt.Errorf("tail sampling Rate must be between 0 and 1, not %v", *p.Rate)
+	}
+	return nil
+}
+
+func newPolicy(i int, p *Policy) (*policy, error) {
+	if err := validate(p); err != nil {
+		return nil, err
+	}
+	ret := &policy{name: fmt.Sprintf("policy_%d", i)}
+	if p.Name != nil {
+		ret.name = *p.Name
+	}
+	switch {
+	case p.Errors != nil:
+		ret.match = anySpan(*p.Errors, hasError)
+	case p.MinDuration != nil:
+		ret.match = minDuration(*p.MinDuration)
+	case p.Services != nil:
+		ret.match = anyGlob(p.Services, serviceName)
+	case p.Operations != nil:
+		ret.match = anyGlob(p.Operations, operationName)
+	case p.Debug != nil:
+		ret.match = anySpan(*p.Debug, isDebug)
+	default:
+		ret.match = rate(*p.Rate)
+	}
+	return ret, nil
+}
+
+// anySpan matches traces with a span for which check returns true, or never matches if enabled is false
+func anySpan(enabled bool, check func(*trace.Span) bool) predicate {
+	return func(spans []*trace.Span) bool {
+		if !enabled {
+			return false
+		}
+		for _, s := range spans {
+			if check(s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func hasError(s *trace.Span) bool {
+	v, exists := s.Tags[string(ext.Error)]
+	return exists && v != "false"
+}
+
+var samplingPriority = string(ext.SamplingPriority)
+
+func isDebug(s *trace.Span) bool {
+	return (s.Debug != nil && *s.Debug) || s.Tags[samplingPriority] == "1"
+}
+
+func serviceName(s *trace.Span) string {
+	if s.LocalEndpoint != nil && s.LocalEndpoint.ServiceName != nil {
+		return *s.LocalEndpoint.ServiceName
+	}
+	return ""
+}
+
+func operationName(s *trace.Span) string {
+	if s.Name != nil {
+		return *s.Name
+	}
+	return ""
+}
+
+func anyGlob(patterns []string, value func(*trace.Span) string) predicate {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, p := range patterns {
+		globs = append(globs, globbing.GetGlob(p))
+	}
+	return anySpan(true, func(s *trace.Span) bool {
+		v := value(s)
+		for _, g := range globs {
+			if g.Match(v) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// minDuration matches traces whose spans cover at least d, with span timestamps and durations in microseconds
+func minDuration(d time.Duration) predicate {
+	min := d.Microseconds()
+	return func(spans []*trace.Span) bool {
+		var start, end int64
+		found := false
+		for _, s := range spans {
+			if s.Timestamp == nil || s.Duration == nil {
+				continue
+			}
+			if !found || *s.Timestamp < start {
+				start = *s.Timestamp
+			}
+			if !found || *s.Timestamp+*s.Duration > end {
+				end = *s.Timestamp + *s.Duration
+			}
+			found = true
+		}
+		return found && end-start >= min
+	}
+}
+
+// rateBuckets is how finely the trace id hash is split when sampling by rate
+const rateBuckets = 10000
+
+func rate(r float64) predicate {
+	threshold := uint32(r * rateBuckets)
+	return func(spans []*trace.Span) bool {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(spans[0].TraceID))
+		return h.Sum32()%rateBuckets < threshold
+	}
+}
@@ -0,0 +1,96 @@
+package tailsampling
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func span(traceID string, service string, operation string, timestamp int64, duration int64, tags map[string]string) *trace.Span {
+	return &trace.Span{
+		TraceID:       traceID,
+		ID:            fmt.Sprintf("%s-%d", traceID, timestamp),
+		Name:          pointer.String(operation),
+		LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String(service)},
+		Timestamp:     pointer.Int64(timestamp),
+		Duration:      pointer.Int64(duration),
+		Tags:          tags,
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	Convey("policies should need exactly one criterion", t, func() {
+		for _, p := range []*Policy{nil, {}, {Errors: pointer.Bool(true), Debug: pointer.Bool(true)}} {
+			_, err := newPolicy(0, p)
+			So(err, ShouldEqual, errPolicyCriteria)
+		}
+		_, err := newPolicy(0, &Policy{Rate: pointer.Float64(1.5)})
+		So(err.Error(), ShouldContainSubstring, "between 0 and 1")
+	})
+	Convey("policies should be named", t, func() {
+		p, err := newPolicy(2, &Policy{Errors: pointer.Bool(true)})
+		So(err, ShouldBeNil)
+		So(p.name, ShouldEqual, "policy_2")
+		p, err = newPolicy(2, &Policy{Name: pointer.String("errors"), Errors: pointer.Bool(true)})
+		So(err, ShouldBeNil)
+		So(p.name, ShouldEqual, "errors")
+	})
+	Convey("given a trace", t, func() {
+		spans := []*trace.Span{
+			span("abc", "frontend", "GET /", 1000, 500, nil),
+			span("abc", "backend", "select", 1100, 2000, map[string]string{"error": "false"}),
+			{TraceID: "abc", ID: "no-timestamp"},
+		}
+		matches := func(p *Policy) bool {
+			compiled, err := newPolicy(0, p)
+			So(err, ShouldBeNil)
+			return compiled.match(spans)
+		}
+		Convey("errors should match spans with a true error tag", func() {
+			So(matches(&Policy{Errors: pointer.Bool(true)}), ShouldBeFalse)
+			spans[0].Tags = map[string]string{"error": "true"}
+			So(matches(&Policy{Errors: pointer.Bool(true)}), ShouldBeTrue)
+			So(matches(&Policy{Errors: pointer.Bool(false)}), ShouldBeFalse)
+		})
+		Convey("min duration should cover every span of the trace", func() {
+			So(matches(&Policy{MinDuration: pointer.Duration(time.Microsecond * 2100)}), ShouldBeTrue)
+			So(matches(&Policy{MinDuration: pointer.Duration(time.Microsecond * 2101)}), ShouldBeFalse)
+			spans = spans[2:]
+			So(matches(&Policy{MinDuration: pointer.Duration(0)}), ShouldBeFalse)
+		})
+		Convey("services and operations should be globbed", func() {
+			So(matches(&Policy{Services: []string{"front*"}}), ShouldBeTrue)
+			So(matches(&Policy{Services: []string{"db", "cache*"}}), ShouldBeFalse)
+			So(matches(&Policy{Operations: []string{"sel*"}}), ShouldBeTrue)
+			So(matches(&Policy{Operations: []string{"GET /users"}}), ShouldBeFalse)
+			So(matches(&Policy{Services: []string{""}}), ShouldBeTrue)
+		})
+		Convey("debug should match debug spans and a sampling priority of 1", func() {
+			So(matches(&Policy{Debug: pointer.Bool(true)}), ShouldBeFalse)
+			spans[1].Tags["sampling.priority"] = "1"
+			So(matches(&Policy{Debug: pointer.Bool(true)}), ShouldBeTrue)
+			delete(spans[1].Tags, "sampling.priority")
+			spans[2].Debug = pointer.Bool(true)
+			So(matches(&Policy{Debug: pointer.Bool(true)}), ShouldBeTrue)
+		})
+		Convey("rate should keep the same traces every time", func() {
+			So(matches(&Policy{Rate: pointer.Float64(0)}), ShouldBeFalse)
+			So(matches(&Policy{Rate: pointer.Float64(1)}), ShouldBeTrue)
+			half, err := newPolicy(0, &Policy{Rate: pointer.Float64(.5)})
+			So(err, ShouldBeNil)
+			kept := 0
+			for i := 0; i < 1000; i++ {
+				spans := []*trace.Span{{TraceID: fmt.Sprintf("%016x", i*7919)}}
+				if half.match(spans) {
+					kept++
+					So(half.match(spans), ShouldBeTrue)
+				}
+			}
+			So(kept, ShouldBeBetween, 400, 600)
+		})
+	})
+}
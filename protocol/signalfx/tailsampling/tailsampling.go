@@ -0,0 +1,305 @@
+package tailsampling
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/logkey"
+)
+
+type sink interface {
+	dpsink.Sink
+	trace.Sink
+}
+
+// Config controls how long spans are buffered and which traces are kept
+type Config struct {
+	// DecisionWait is how long the spans of a trace are buffered after its first span arrives before it is decided on
+	DecisionWait *time.Duration
+	// MaxTraces is how many traces can wait for a decision, after which the oldest are decided early
+	MaxTraces *int64
+	// MaxSpans is how many spans can be buffered, after which the oldest traces are decided early
+	MaxSpans *int64
+	// DecisionCacheSize is how many decisions are remembered to keep or drop spans that arrive after their trace
+	DecisionCacheSize *int64
+	// Policies decide which traces are kept, a trace is kept if any of them match it
+	Policies []*Policy
+}
+
+// DefaultConfig are default values for tail samplers
+var DefaultConfig = &Config{
+	DecisionWait:      pointer.Duration(time.Second * 10),
+	MaxTraces:         pointer.Int64(50000),
+	MaxSpans:          pointer.Int64(1000000),
+	DecisionCacheSize: pointer.Int64(100000),
+}
+
+type pendingTrace struct {
+	id    string
+	first time.Time
+	spans []*trace.Span
+	// tokens are the tokens each span was sent with, so kept spans are forwarded with them
+	tokens []string
+}
+
+type decision struct {
+	keep bool
+	slot int
+}
+
+// decisionCache remembers the most recent decisions, forgetting the oldest ones once it is full
+type decisionCache struct {
+	decisions map[string]decision
+	ring      []string
+	next      int
+}
+
+func (c *decisionCache) add(id string, keep bool) {
+	if old := c.ring[c.next]; old != "" && c.decisions[old].slot == c.next {
+		delete(c.decisions, old)
+	}
+	c.ring[c.next] = id
+	c.decisions[id] = decision{keep: keep, slot: c.next}
+	c.next = (c.next + 1) % len(c.ring)
+}
+
+// TailSampler buffers spans by trace id for DecisionWait and then forwards the traces that match any of its
+// policies.  Spans that arrive after their trace was decided are forwarded or dropped straight away.
+type TailSampler struct {
+	wait      time.Duration
+	maxTraces int
+	maxSpans  int64
+	policies  []*policy
+
+	mu      sync.Mutex
+	pending map[string]*list.Element
+	order   *list.List
+	spans   int64
+	decided decisionCache
+	now     func() time.Time
+
+	next        sink
+	logger      log.Logger
+	stopContext context.Context
+	stopFunc    context.CancelFunc
+	done        sync.WaitGroup
+	stats       struct {
+		kept        int64
+		dropped     int64
+		early       int64
+		lateKept    int64
+		lateDropped int64
+	}
+}
+
+var _ sink = &TailSampler{}
+
+// New returns a TailSampler that forwards the traces it keeps to next until it is closed
+func New(conf *Config, next sink, logger log.Logger) (*TailSampler, error) {
+	conf = pointer.FillDefaultFrom(conf, DefaultConfig).(*Config)
+	if *conf.DecisionWait <= 0 || *conf.MaxTraces <= 0 || *conf.MaxSpans <= 0 || *conf.DecisionCacheSize <= 0 {
+		return nil, errors.New("tail sampling DecisionWait, MaxTraces, MaxSpans and DecisionCacheSize must be positive")
+	}
+	if len(conf.Policies) == 0 {
+		return nil, errors.New("tail sampling needs at least one policy")
+	}
+	t := &TailSampler{
+		wait:      *conf.DecisionWait,
+		maxTraces: int(*conf.MaxTraces),
+		maxSpans:  *conf.MaxSpans,
+		pending:   make(map[string]*list.Element),
+		order:     list.New(),
+		decided: decisionCache{
+			decisions: make(map[string]decision, *conf.DecisionCacheSize),
+			ring:      make([]string, *conf.DecisionCacheSize),
+		},
+		now:    time.Now,
+		next:   next,
+		logger: log.NewContext(logger).With(logkey.Struct, "TailSampler"),
+	}
+	for i, p := range conf.Policies {
+		compiled, err := newPolicy(i, p)
+		if err != nil {
+			return nil, err
+		}
+		t.policies = append(t.policies, compiled)
+	}
+	t.stopContext, t.stopFunc = context.WithCancel(context.Background())
+	t.done.Add(1)
+	go t.decideLoop()
+	return t, nil
+}
+
+// minDecisionTick keeps very short decision waits from ticking too fast, or at all, since tickers need a positive period
+const minDecisionTick = time.Millisecond
+
+// decisionTick is how often traces are checked for an expired decision wait
+func decisionTick(wait time.Duration) time.Duration {
+	if tick := wait / 10; tick > minDecisionTick {
+		return tick
+	}
+	return minDecisionTick
+}
+
+func (t *TailSampler) decideLoop() {
+	defer t.done.Done()
+	ticker := time.NewTicker(decisionTick(t.wait))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopContext.Done():
+			return
+		case <-ticker.C:
+			t.forward(t.decideExpired())
+		}
+	}
+}
+
+// Close stops the decision loop and decides on every trace still waiting
+func (t *TailSampler) Close() error {
+	t.stopFunc()
+	t.done.Wait()
+	t.mu.Lock()
+	var kept []*pendingTrace
+	for t.order.Len() > 0 {
+		kept = t.decideFront(kept)
+	}
+	t.mu.Unlock()
+	t.forward(kept)
+	return nil
+}
+
+// decideFront decides on the oldest pending trace, appending it to kept if it should be forwarded
+func (t *TailSampler) decideFront(kept []*pendingTrace) []*pendingTrace {
+	pt := t.order.Remove(t.order.Front()).(*pendingTrace)
+	delete(t.pending, pt.id)
+	t.spans -= int64(len(pt.spans))
+	keep := false
+	for _, p := range t.policies {
+		if p.match(pt.spans) {
+			atomic.AddInt64(&p.kept, 1)
+			keep = true
+			break
+		}
+	}
+	t.decided.add(pt.id, keep)
+	if !keep {
+		atomic.AddInt64(&t.stats.dropped, 1)
+		return kept
+	}
+	atomic.AddInt64(&t.stats.kept, 1)
+	return append(kept, pt)
+}
+
+func (t *TailSampler) decideExpired() []*pendingTrace {
+	cutoff := t.now().Add(-t.wait)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var kept []*pendingTrace
+	for t.order.Len() > 0 && !t.order.Front().Value.(*pendingTrace).first.After(cutoff) {
+		kept = t.decideFront(kept)
+	}
+	return kept
+}
+
+// forward sends the spans of kept traces to next, grouped by the token they were sent with
+func (t *TailSampler) forward(kept []*pendingTrace) {
+	byToken := make(map[string][]*trace.Span)
+	for _, pt := range kept {
+		for i, s := range pt.spans {
+			byToken[pt.tokens[i]] = append(byToken[pt.tokens[i]], s)
+		}
+	}
+	for token, spans := range byToken {
+		ctx := context.Background()
+		if token != "" {
+			ctx = context.WithValue(ctx, sfxclient.TokenHeaderName, token)
+		}
+		log.IfErr(t.logger, t.next.AddSpans(ctx, spans))
+	}
+}
+
+// add buffers a span, or returns whether to keep it if its trace has already been decided on
+func (t *TailSampler) add(s *trace.Span, token string, now time.Time) (decided bool, keep bool) {
+	if d, exists := t.decided.decisions[s.TraceID]; exists {
+		return true, d.keep
+	}
+	elem, exists := t.pending[s.TraceID]
+	if !exists {
+		elem = t.order.PushBack(&pendingTrace{id: s.TraceID, first: now})
+		t.pending[s.TraceID] = elem
+	}
+	pt := elem.Value.(*pendingTrace)
+	pt.spans = append(pt.spans, s)
+	pt.tokens = append(pt.tokens, token)
+	t.spans++
+	return false, false
+}
+
+// AddSpans buffers spans until their trace is decided on, and forwards or drops spans of traces already decided on
+func (t *TailSampler) AddSpans(ctx context.Context, spans []*trace.Span) error {
+	token, _ := ctx.Value(sfxclient.TokenHeaderName).(string)
+	now := t.now()
+	var late []*trace.Span
+	var kept []*pendingTrace
+	t.mu.Lock()
+	for _, s := range spans {
+		if decided, keep := t.add(s, token, now); decided && keep {
+			late = append(late, s)
+			atomic.AddInt64(&t.stats.lateKept, 1)
+		} else if decided {
+			atomic.AddInt64(&t.stats.lateDropped, 1)
+		}
+	}
+	for t.order.Len() > t.maxTraces || t.spans > t.maxSpans {
+		atomic.AddInt64(&t.stats.early, 1)
+		kept = t.decideFront(kept)
+	}
+	t.mu.Unlock()
+	t.forward(kept)
+	if len(late) == 0 {
+		return nil
+	}
+	return t.next.AddSpans(ctx, late)
+}
+
+// AddDatapoints is a passthrough
+func (t *TailSampler) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	return t.next.AddDatapoints(ctx, points)
+}
+
+// AddEvents is a passthrough
+func (t *TailSampler) AddEvents(ctx context.Context, events []*event.Event) error {
+	return t.next.AddEvents(ctx, events)
+}
+
+// Datapoints returns how much is buffered and how many traces and spans were kept or dropped
+func (t *TailSampler) Datapoints() []*datapoint.Datapoint {
+	t.mu.Lock()
+	traces, spans := int64(t.order.Len()), t.spans
+	t.mu.Unlock()
+	dps := []*datapoint.Datapoint{
+		sfxclient.Gauge("tailsampling.pending_traces", nil, traces),
+		sfxclient.Gauge("tailsampling.pending_spans", nil, spans),
+		sfxclient.Cumulative("tailsampling.traces", map[string]string{"decision": "kept"}, atomic.LoadInt64(&t.stats.kept)),
+		sfxclient.Cumulative("tailsampling.traces", map[string]string{"decision": "dropped"}, atomic.LoadInt64(&t.stats.dropped)),
+		sfxclient.Cumulative("tailsampling.early_decisions", nil, atomic.LoadInt64(&t.stats.early)),
+		sfxclient.Cumulative("tailsampling.late_spans", map[string]string{"decision": "kept"}, atomic.LoadInt64(&t.stats.lateKept)),
+		sfxclient.Cumulative("tailsampling.late_spans", map[string]string{"decision": "dropped"}, atomic.LoadInt64(&t.stats.lateDropped)),
+	}
+	for _, p := range t.policies {
+		dps = append(dps, sfxclient.Cumulative("tailsampling.policy_matches", map[string]string{"policy": p.name}, atomic.LoadInt64(&p.kept)))
+	}
+	return dps
+}
@@ -0,0 +1,203 @@
+package tailsampling
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recordingSink remembers the spans it is sent by the token on their context
+type recordingSink struct {
+	mu     sync.Mutex
+	spans  map[string][]*trace.Span
+	points int
+	events int
+	err    error
+}
+
+func (r *recordingSink) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.points += len(points)
+	return r.err
+}
+
+func (r *recordingSink) AddEvents(ctx context.Context, events []*event.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events += len(events)
+	return r.err
+}
+
+func (r *recordingSink) AddSpans(ctx context.Context, spans []*trace.Span) error {
+	token, _ := ctx.Value(sfxclient.TokenHeaderName).(string)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans[token] = append(r.spans[token], spans...)
+	return r.err
+}
+
+func (r *recordingSink) ids(token string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]string, 0, len(r.spans[token]))
+	for _, s := range r.spans[token] {
+		ret = append(ret, s.ID)
+	}
+	return ret
+}
+
+func value(dps []*datapoint.Datapoint, metric string, dims map[string]string) datapoint.Value {
+	if dims == nil {
+		return dptest.ExactlyOne(dps, metric).Value
+	}
+	return dptest.ExactlyOneDims(dps, metric, dims).Value
+}
+
+func TestTailSampler(t *testing.T) {
+	Convey("given a tail sampler that keeps errors and slow traces", t, func() {
+		next := &recordingSink{spans: make(map[string][]*trace.Span)}
+		conf := &Config{
+			DecisionWait:      pointer.Duration(time.Hour),
+			MaxTraces:         pointer.Int64(3),
+			MaxSpans:          pointer.Int64(5),
+			DecisionCacheSize: pointer.Int64(2),
+			Policies: []*Policy{
+				{Name: pointer.String("errors"), Errors: pointer.Bool(true)},
+				{Name: pointer.String("slow"), MinDuration: pointer.Duration(time.Second)},
+			},
+		}
+		sampler, err := New(conf, next, log.Discard)
+		So(err, ShouldBeNil)
+		now := time.Now()
+		sampler.now = func() time.Time { return now }
+		ctx := context.Background()
+		tokenA := context.WithValue(ctx, sfxclient.TokenHeaderName, "a")
+		tokenB := context.WithValue(ctx, sfxclient.TokenHeaderName, "b")
+		errTags := map[string]string{"error": "true"}
+		decide := func() {
+			now = now.Add(time.Hour)
+			sampler.forward(sampler.decideExpired())
+		}
+		Convey("spans should be buffered until the decision wait is over", func() {
+			So(sampler.AddSpans(tokenA, []*trace.Span{span("err", "svc", "op", 0, 10, nil), span("ok", "svc", "op", 0, 10, nil)}), ShouldBeNil)
+			So(sampler.AddSpans(tokenB, []*trace.Span{span("err", "svc", "op", 5, 10, errTags)}), ShouldBeNil)
+			now = now.Add(time.Minute)
+			So(sampler.AddSpans(tokenA, []*trace.Span{span("slow", "svc", "op", 0, int64(time.Second/time.Microsecond), nil)}), ShouldBeNil)
+			So(next.ids("a"), ShouldBeEmpty)
+			dps := sampler.Datapoints()
+			So(value(dps, "tailsampling.pending_traces", nil), ShouldResemble, datapoint.NewIntValue(3))
+			So(value(dps, "tailsampling.pending_spans", nil), ShouldResemble, datapoint.NewIntValue(4))
+
+			now = now.Add(time.Hour - time.Minute)
+			sampler.forward(sampler.decideExpired())
+			So(next.ids("a"), ShouldResemble, []string{"err-0"})
+			So(next.ids("b"), ShouldResemble, []string{"err-5"})
+			now = now.Add(time.Minute)
+			sampler.forward(sampler.decideExpired())
+			So(next.ids("a"), ShouldResemble, []string{"err-0", "slow-0"})
+
+			dps = sampler.Datapoints()
+			So(value(dps, "tailsampling.pending_traces", nil), ShouldResemble, datapoint.NewIntValue(0))
+			So(value(dps, "tailsampling.pending_spans", nil), ShouldResemble, datapoint.NewIntValue(0))
+			So(value(dps, "tailsampling.traces", map[string]string{"decision": "kept"}), ShouldResemble, datapoint.NewIntValue(2))
+			So(value(dps, "tailsampling.traces", map[string]string{"decision": "dropped"}), ShouldResemble, datapoint.NewIntValue(1))
+			So(value(dps, "tailsampling.policy_matches", map[string]string{"policy": "errors"}), ShouldResemble, datapoint.NewIntValue(1))
+			So(value(dps, "tailsampling.policy_matches", map[string]string{"policy": "slow"}), ShouldResemble, datapoint.NewIntValue(1))
+		})
+		Convey("spans arriving after their trace was decided should be kept or dropped straight away", func() {
+			So(sampler.AddSpans(tokenA, []*trace.Span{span("err", "svc", "op", 0, 10, errTags), span("ok", "svc", "op", 0, 10, nil)}), ShouldBeNil)
+			decide()
+			So(sampler.AddSpans(tokenB, []*trace.Span{span("err", "svc", "op", 1, 10, nil), span("ok", "svc", "op", 1, 10, nil)}), ShouldBeNil)
+			So(next.ids("b"), ShouldResemble, []string{"err-1"})
+			dps := sampler.Datapoints()
+			So(value(dps, "tailsampling.late_spans", map[string]string{"decision": "kept"}), ShouldResemble, datapoint.NewIntValue(1))
+			So(value(dps, "tailsampling.late_spans", map[string]string{"decision": "dropped"}), ShouldResemble, datapoint.NewIntValue(1))
+			So(value(dps, "tailsampling.pending_traces", nil), ShouldResemble, datapoint.NewIntValue(0))
+
+			next.err = errors.New("nope")
+			So(sampler.AddSpans(tokenB, []*trace.Span{span("err", "svc", "op", 2, 10, nil)}), ShouldEqual, next.err)
+		})
+		Convey("old decisions should be forgotten", func() {
+			for _, id := range []string{"err", "ok", "other"} {
+				So(sampler.AddSpans(tokenA, []*trace.Span{span(id, "svc", "op", 0, 10, errTags)}), ShouldBeNil)
+			}
+			decide()
+			So(sampler.AddSpans(tokenA, []*trace.Span{span("err", "svc", "op", 1, 10, nil)}), ShouldBeNil)
+			So(value(sampler.Datapoints(), "tailsampling.pending_traces", nil), ShouldResemble, datapoint.NewIntValue(1))
+			So(sampler.AddSpans(tokenA, []*trace.Span{span("other", "svc", "op", 1, 10, nil)}), ShouldBeNil)
+			So(value(sampler.Datapoints(), "tailsampling.pending_traces", nil), ShouldResemble, datapoint.NewIntValue(1))
+		})
+		Convey("the oldest traces should be decided early when too many are buffered", func() {
+			for _, id := range []string{"a", "b", "c", "d"} {
+				So(sampler.AddSpans(tokenA, []*trace.Span{span(id, "svc", "op", 0, 10, errTags)}), ShouldBeNil)
+			}
+			So(next.ids("a"), ShouldResemble, []string{"a-0"})
+			So(sampler.AddSpans(tokenA, []*trace.Span{span("b", "svc", "op", 1, 10, nil), span("b", "svc", "op", 2, 10, nil), span("b", "svc", "op", 3, 10, nil)}), ShouldBeNil)
+			So(next.ids("a"), ShouldResemble, []string{"a-0", "b-0", "b-1", "b-2", "b-3"})
+			dps := sampler.Datapoints()
+			So(value(dps, "tailsampling.early_decisions", nil), ShouldResemble, datapoint.NewIntValue(2))
+			So(value(dps, "tailsampling.pending_spans", nil), ShouldResemble, datapoint.NewIntValue(2))
+		})
+		Convey("close should decide on everything still buffered", func() {
+			So(sampler.AddSpans(tokenA, []*trace.Span{span("err", "svc", "op", 0, 10, errTags), span("ok", "svc", "op", 0, 10, nil)}), ShouldBeNil)
+			So(sampler.Close(), ShouldBeNil)
+			So(next.ids("a"), ShouldResemble, []string{"err-0"})
+		})
+		Convey("datapoints and events should pass through", func() {
+			So(sampler.AddDatapoints(ctx, []*datapoint.Datapoint{dptest.DP()}), ShouldBeNil)
+			So(sampler.AddEvents(ctx, []*event.Event{dptest.E()}), ShouldBeNil)
+			So(next.points, ShouldEqual, 1)
+			So(next.events, ShouldEqual, 1)
+		})
+		Reset(func() {
+			So(sampler.Close(), ShouldBeNil)
+		})
+	})
+	Convey("traces should be decided on by the decision loop", t, func() {
+		next := &recordingSink{spans: make(map[string][]*trace.Span)}
+		sampler, err := New(&Config{
+			DecisionWait: pointer.Duration(time.Millisecond * 10),
+			Policies:     []*Policy{{Rate: pointer.Float64(1)}},
+		}, next, log.Discard)
+		So(err, ShouldBeNil)
+		So(sampler.AddSpans(context.Background(), []*trace.Span{span("abc", "svc", "op", 0, 10, nil)}), ShouldBeNil)
+		for len(next.ids("")) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		So(sampler.Close(), ShouldBeNil)
+	})
+	Convey("decision waits too short to tick ten times should tick at the minimum", t, func() {
+		So(decisionTick(time.Second), ShouldEqual, time.Millisecond*100)
+		So(decisionTick(time.Millisecond), ShouldEqual, minDecisionTick)
+		sampler, err := New(&Config{
+			DecisionWait: pointer.Duration(time.Nanosecond),
+			Policies:     []*Policy{{Rate: pointer.Float64(1)}},
+		}, &recordingSink{spans: make(map[string][]*trace.Span)}, log.Discard)
+		So(err, ShouldBeNil)
+		So(sampler.Close(), ShouldBeNil)
+	})
+	Convey("bad configs should fail", t, func() {
+		next := &recordingSink{}
+		for _, conf := range []*Config{
+			{},
+			{MaxTraces: pointer.Int64(0), Policies: []*Policy{{Debug: pointer.Bool(true)}}},
+			{Policies: []*Policy{{}}},
+		} {
+			sampler, err := New(conf, next, log.Discard)
+			So(err, ShouldNotBeNil)
+			So(sampler, ShouldBeNil)
+		}
+	})
+}
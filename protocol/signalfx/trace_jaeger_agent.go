@@ -0,0 +1,202 @@
+package signalfx
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/jaegertracing/jaeger/thrift-gen/agent"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/errors"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/logkey"
+	"github.com/signalfx/ingest-protocols/protocol"
+)
+
+// Constants for the thrift protocol config of the jaeger agent listener
+const (
+	JaegerAgentCompact = "compact"
+	JaegerAgentBinary  = "binary"
+)
+
+const jaegerAgentEmitBatch = "emitBatch"
+
+// JaegerAgentListener listens on a UDP socket for the emitBatch messages jaeger clients send to a jaeger agent
+type JaegerAgentListener struct {
+	protocol.CloseableHealthCheck
+	udpsocket       *net.UDPConn
+	sink            trace.Sink
+	protocolFactory thrift.TProtocolFactory
+	maxPacketSize   int
+	logger          log.Logger
+	stats           jaegerAgentStats
+	wg              sync.WaitGroup
+}
+
+var _ protocol.Listener = &JaegerAgentListener{}
+
+type jaegerAgentStats struct {
+	totalPackets    int64
+	oversizePackets int64
+	invalidPackets  int64
+	totalSpans      int64
+}
+
+// DebugDatapoints returns datapoints that are used for debugging the listener
+func (listener *JaegerAgentListener) DebugDatapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.Cumulative("total_packets", nil, atomic.LoadInt64(&listener.stats.totalPackets)),
+		sfxclient.Cumulative("oversize_packets", nil, atomic.LoadInt64(&listener.stats.oversizePackets)),
+		sfxclient.Cumulative("invalid_packets", nil, atomic.LoadInt64(&listener.stats.invalidPackets)),
+		sfxclient.Cumulative("total_spans", nil, atomic.LoadInt64(&listener.stats.totalSpans)),
+	}
+}
+
+// DefaultDatapoints returns datapoints that should always be reported from the listener
+func (listener *JaegerAgentListener) DefaultDatapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{}
+}
+
+// Datapoints reports information about the packets seen by the listener
+func (listener *JaegerAgentListener) Datapoints() []*datapoint.Datapoint {
+	return append(listener.DebugDatapoints(), listener.DefaultDatapoints()...)
+}
+
+// Close the exposed UDP port
+func (listener *JaegerAgentListener) Close() error {
+	err := listener.udpsocket.Close()
+	listener.wg.Wait()
+	return err
+}
+
+// Addr returns the listening address of this jaeger agent listener
+func (listener *JaegerAgentListener) Addr() net.Addr {
+	return listener.udpsocket.LocalAddr()
+}
+
+// decode reads the batch of an emitBatch message
+func (listener *JaegerAgentListener) decode(ctx context.Context, packet []byte) ([]*trace.Span, error) {
+	buf := thrift.NewTMemoryBufferLen(len(packet))
+	if _, err := buf.Write(packet); err != nil {
+		return nil, err
+	}
+	iprot := listener.protocolFactory.GetProtocol(buf)
+	name, _, _, err := iprot.ReadMessageBegin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if name != jaegerAgentEmitBatch {
+		return nil, errors.Errorf("unsupported jaeger agent method %s", name)
+	}
+	args := agent.NewAgentEmitBatchArgs()
+	if err := args.Read(ctx, iprot); err != nil {
+		return nil, err
+	}
+	if err := iprot.ReadMessageEnd(ctx); err != nil {
+		return nil, err
+	}
+	if args.Batch == nil {
+		return nil, nil
+	}
+	return convertJaegerBatch(args.Batch), nil
+}
+
+func (listener *JaegerAgentListener) handlePacket(ctx context.Context, addr *net.UDPAddr, packet []byte) {
+	atomic.AddInt64(&listener.stats.totalPackets, 1)
+	if len(packet) > listener.maxPacketSize {
+		atomic.AddInt64(&listener.stats.oversizePackets, 1)
+		listener.logger.Log(logkey.RemoteAddr, addr, "Dropping a jaeger agent packet larger than the max packet size")
+		return
+	}
+	spans, err := listener.decode(ctx, packet)
+	if err != nil {
+		atomic.AddInt64(&listener.stats.invalidPackets, 1)
+		listener.logger.Log(logkey.RemoteAddr, addr, log.Err, err, "Received data on a jaeger agent port, but it doesn't look like an emitBatch message")
+		return
+	}
+	if len(spans) == 0 {
+		return
+	}
+	atomic.AddInt64(&listener.stats.totalSpans, int64(len(spans)))
+	log.IfErr(listener.logger, listener.sink.AddSpans(ctx, spans))
+}
+
+func (listener *JaegerAgentListener) startListening() {
+	defer listener.wg.Done()
+	defer listener.logger.Log("Stop listening jaeger agent UDP")
+	// one byte more than the max packet size so that larger packets can be told apart from ones that just fit
+	buf := make([]byte, listener.maxPacketSize+1)
+	for {
+		n, addr, err := listener.udpsocket.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			listener.logger.Log(log.Err, err, "Unable to read from the jaeger agent udp socket")
+			return
+		}
+		if n != 0 {
+			listener.handlePacket(context.Background(), addr, buf[:n])
+		}
+	}
+}
+
+// JaegerAgentListenerConfig controls optional parameters for jaeger agent listeners
+type JaegerAgentListenerConfig struct {
+	ListenAddr    *string
+	Protocol      *string
+	MaxPacketSize *int
+	Logger        log.Logger
+}
+
+var defaultJaegerAgentListenerConfig = &JaegerAgentListenerConfig{
+	ListenAddr:    pointer.String("127.0.0.1:6831"),
+	Protocol:      pointer.String(JaegerAgentCompact),
+	MaxPacketSize: pointer.Int(65000),
+	Logger:        log.Discard,
+}
+
+func jaegerAgentProtocolFactory(protocol string) (thrift.TProtocolFactory, error) {
+	switch strings.ToLower(protocol) {
+	case JaegerAgentCompact:
+		return thrift.NewTCompactProtocolFactoryConf(&thrift.TConfiguration{}), nil
+	case JaegerAgentBinary:
+		return thrift.NewTBinaryProtocolFactoryConf(&thrift.TConfiguration{}), nil
+	}
+	return nil, fmt.Errorf("specified protocol '%s' not recognized. '%s' or '%s' only please", protocol, JaegerAgentCompact, JaegerAgentBinary)
+}
+
+// NewJaegerAgentListener creates a new listener for the emitBatch messages of jaeger clients.  Clients send compact
+// thrift to port 6831 and binary thrift to port 6832 by default.
+func NewJaegerAgentListener(sendTo trace.Sink, passedConf *JaegerAgentListenerConfig) (*JaegerAgentListener, error) {
+	conf := pointer.FillDefaultFrom(passedConf, defaultJaegerAgentListenerConfig).(*JaegerAgentListenerConfig)
+	protocolFactory, err := jaegerAgentProtocolFactory(*conf.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", *conf.ListenAddr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "cannot listen to addr %s", *conf.ListenAddr)
+	}
+	server, err := net.ListenUDP("udp", serverAddr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "cannot listen to addr %s", *conf.ListenAddr)
+	}
+	receiver := &JaegerAgentListener{
+		udpsocket:       server,
+		sink:            sendTo,
+		protocolFactory: protocolFactory,
+		maxPacketSize:   *conf.MaxPacketSize,
+		logger:          log.NewContext(conf.Logger).With(logkey.Protocol, "jaeger_agent", logkey.Direction, "listener"),
+	}
+	receiver.wg.Add(1)
+	go receiver.startListening()
+	return receiver, nil
+}
@@ -0,0 +1,88 @@
+package signalfx
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/jaegertracing/jaeger/thrift-gen/agent"
+	jThrift "github.com/jaegertracing/jaeger/thrift-gen/jaeger"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func jaegerAgentPacket(factory thrift.TProtocolFactory, method string, batch *jThrift.Batch) []byte {
+	ctx := context.Background()
+	buf := thrift.NewTMemoryBuffer()
+	oprot := factory.GetProtocol(buf)
+	So(oprot.WriteMessageBegin(ctx, method, thrift.ONEWAY, 1), ShouldBeNil)
+	args := agent.NewAgentEmitBatchArgs()
+	args.Batch = batch
+	So(args.Write(ctx, oprot), ShouldBeNil)
+	So(oprot.WriteMessageEnd(ctx), ShouldBeNil)
+	So(oprot.Flush(ctx), ShouldBeNil)
+	return buf.Bytes()
+}
+
+func TestJaegerAgentListener(t *testing.T) {
+	var batch jThrift.Batch
+	// the test batch has a flags field of the wrong type, which json reports after decoding everything else
+	if err := json.Unmarshal([]byte(jaegerBatchJSON), &batch); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); !ok {
+			panic("couldn't unmarshal test batch")
+		}
+	}
+	for _, protocol := range []string{JaegerAgentCompact, JaegerAgentBinary} {
+		protocol := protocol
+		Convey("given a jaeger agent listener for "+protocol+" thrift", t, func() {
+			sendTo := dptest.NewBasicSink()
+			sendTo.Resize(1)
+			listener, err := NewJaegerAgentListener(sendTo, &JaegerAgentListenerConfig{
+				ListenAddr: pointer.String("127.0.0.1:0"),
+				Protocol:   pointer.String(protocol),
+			})
+			So(err, ShouldBeNil)
+			factory, err := jaegerAgentProtocolFactory(protocol)
+			So(err, ShouldBeNil)
+			Convey("emitBatch packets should be sent as spans", func() {
+				conn, err := net.Dial("udp", listener.Addr().String())
+				So(err, ShouldBeNil)
+				_, err = conn.Write(jaegerAgentPacket(factory, jaegerAgentEmitBatch, &batch))
+				So(err, ShouldBeNil)
+				So(conn.Close(), ShouldBeNil)
+				So(<-sendTo.TracesChan, ShouldResemble, convertJaegerBatch(&batch))
+				So(dptest.ExactlyOne(listener.Datapoints(), "total_packets").Value, ShouldResemble, datapoint.NewIntValue(1))
+				So(dptest.ExactlyOne(listener.Datapoints(), "total_spans").Value, ShouldResemble, datapoint.NewIntValue(int64(len(batch.Spans))))
+			})
+			Convey("packets that aren't emitBatch messages should be counted", func() {
+				listener.handlePacket(context.Background(), nil, []byte("not thrift"))
+				listener.handlePacket(context.Background(), nil, jaegerAgentPacket(factory, "emitZipkinBatch", &batch))
+				So(dptest.ExactlyOne(listener.Datapoints(), "invalid_packets").Value, ShouldResemble, datapoint.NewIntValue(2))
+				So(dptest.ExactlyOne(listener.Datapoints(), "total_spans").Value, ShouldResemble, datapoint.NewIntValue(0))
+				So(len(sendTo.TracesChan), ShouldEqual, 0)
+			})
+			Convey("packets over the max packet size should be dropped", func() {
+				small := &JaegerAgentListener{sink: sendTo, protocolFactory: factory, maxPacketSize: 10, logger: log.Discard}
+				small.handlePacket(context.Background(), nil, jaegerAgentPacket(factory, jaegerAgentEmitBatch, &batch))
+				So(dptest.ExactlyOne(small.Datapoints(), "oversize_packets").Value, ShouldResemble, datapoint.NewIntValue(1))
+				So(len(sendTo.TracesChan), ShouldEqual, 0)
+			})
+			Reset(func() {
+				So(listener.Close(), ShouldBeNil)
+			})
+		})
+	}
+	Convey("a jaeger agent listener should not start with a bad config", t, func() {
+		_, err := NewJaegerAgentListener(dptest.NewBasicSink(), &JaegerAgentListenerConfig{Protocol: pointer.String("json")})
+		So(err, ShouldNotBeNil)
+		_, err = NewJaegerAgentListener(dptest.NewBasicSink(), &JaegerAgentListenerConfig{ListenAddr: pointer.String("127.0.0.1:999999")})
+		So(err, ShouldNotBeNil)
+		_, err = NewJaegerAgentListener(dptest.NewBasicSink(), &JaegerAgentListenerConfig{ListenAddr: pointer.String("not an address")})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,136 @@
+package signalfx
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/jaegertracing/jaeger/model"
+	jThriftConverter "github.com/jaegertracing/jaeger/model/converter/thrift/jaeger"
+	"github.com/jaegertracing/jaeger/proto-gen/api_v2"
+	jThrift "github.com/jaegertracing/jaeger/thrift-gen/jaeger"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	sfxgrpc "github.com/signalfx/ingest-protocols/grpc"
+	"github.com/signalfx/ingest-protocols/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// JaegerGRPCCollector is a Jaeger api_v2 CollectorService that converts the batches posted to it into spans
+type JaegerGRPCCollector struct {
+	Sink          trace.Sink
+	Logger        log.Logger
+	totalRequests int64
+	totalErrors   int64
+}
+
+var _ api_v2.CollectorServiceServer = &JaegerGRPCCollector{}
+
+// Datapoints returns how many requests the collector has received and how many of them failed
+func (c *JaegerGRPCCollector) Datapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.Cumulative("total_requests", nil, atomic.LoadInt64(&c.totalRequests)),
+		sfxclient.Cumulative("total_errors", nil, atomic.LoadInt64(&c.totalErrors)),
+	}
+}
+
+// PostSpans sends the spans of the request's batch to Sink, with the token of the request's metadata in the context
+func (c *JaegerGRPCCollector) PostSpans(ctx context.Context, req *api_v2.PostSpansRequest) (*api_v2.PostSpansResponse, error) {
+	atomic.AddInt64(&c.totalRequests, 1)
+	if token := sfxgrpc.TokenFromIncomingContext(ctx); token != "" {
+		ctx = context.WithValue(ctx, sfxclient.TokenHeaderName, token)
+	}
+	if err := c.Sink.AddSpans(ctx, convertJaegerModelBatch(&req.Batch)); err != nil {
+		atomic.AddInt64(&c.totalErrors, 1)
+		c.Logger.Log(log.Err, err, "Unable to add jaeger gRPC spans")
+		return nil, jaegerGRPCError(err)
+	}
+	return &api_v2.PostSpansResponse{}, nil
+}
+
+// jaegerGRPCError gives errors that mean a client should back off the gRPC status codes clients retry on
+func jaegerGRPCError(err error) error {
+	backoff, ok := protocol.AsBackoffError(err)
+	if !ok {
+		return err
+	}
+	if _, limited := backoff.(*ErrRateLimited); limited {
+		return status.Error(codes.ResourceExhausted, backoff.Error())
+	}
+	return status.Error(codes.Unavailable, backoff.Error())
+}
+
+// convertJaegerModelBatch converts each span of batch to thrift so that convertJaegerSpan can convert it.  A span's
+// own process takes precedence over the batch's.
+func convertJaegerModelBatch(batch *model.Batch) []*trace.Span {
+	batchProcess := convertJaegerModelProcess(batch.Process)
+	spans := make([]*trace.Span, 0, len(batch.Spans))
+	for _, s := range batch.Spans {
+		process := batchProcess
+		if s.Process != nil {
+			process = convertJaegerModelProcess(s.Process)
+		}
+		spans = append(spans, convertJaegerSpan(jThriftConverter.FromDomainSpan(s), process))
+	}
+	return spans
+}
+
+func convertJaegerModelProcess(process *model.Process) *jThrift.Process {
+	if process == nil {
+		return &jThrift.Process{}
+	}
+	tags := make([]*jThrift.Tag, 0, len(process.Tags))
+	for i := range process.Tags {
+		tags = append(tags, convertJaegerModelTag(&process.Tags[i]))
+	}
+	return &jThrift.Process{ServiceName: process.ServiceName, Tags: tags}
+}
+
+func convertJaegerModelTag(kv *model.KeyValue) *jThrift.Tag {
+	tag := &jThrift.Tag{Key: kv.Key}
+	switch kv.VType {
+	case model.BoolType:
+		tag.VType = jThrift.TagType_BOOL
+		tag.VBool = &kv.VBool
+	case model.Int64Type:
+		tag.VType = jThrift.TagType_LONG
+		tag.VLong = &kv.VInt64
+	case model.Float64Type:
+		tag.VType = jThrift.TagType_DOUBLE
+		tag.VDouble = &kv.VFloat64
+	case model.BinaryType:
+		tag.VType = jThrift.TagType_BINARY
+		tag.VBinary = kv.VBinary
+	default:
+		tag.VType = jThrift.TagType_STRING
+		tag.VStr = &kv.VStr
+	}
+	return tag
+}
+
+// setupJaegerGRPCV1 serves the Jaeger api_v2 CollectorService on listenAddr.  Spans are counted the same way the
+// http chains count them.
+func setupJaegerGRPCV1(listenAddr string, sink Sink, logger log.Logger, counter *dpsink.Counter) (*grpc.Server, sfxclient.Collector, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	collector := &JaegerGRPCCollector{
+		Sink:   FromChain(sink, NextWrap(UnifyNextSinkWrap(counter))),
+		Logger: logger,
+	}
+	server := grpc.NewServer()
+	api_v2.RegisterCollectorServiceServer(server, collector)
+	go func() {
+		log.IfErr(logger, server.Serve(listener))
+	}()
+	return server, &sfxclient.WithDimensions{
+		Collector:  collector,
+		Dimensions: map[string]string{"protocol": "sfx_" + JaegerGRPCV1},
+	}, nil
+}
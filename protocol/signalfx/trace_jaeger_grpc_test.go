@@ -0,0 +1,209 @@
+package signalfx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/proto-gen/api_v2"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/nettest"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	sfxgrpc "github.com/signalfx/ingest-protocols/grpc"
+	"github.com/signalfx/ingest-protocols/protocol"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func jaegerModelBatch() model.Batch {
+	traceID := model.NewTraceID(1, 0x52969a8955571a3f)
+	return model.Batch{
+		Process: &model.Process{
+			ServiceName: "api",
+			Tags:        []model.KeyValue{model.String("hostname", "api246-sjc1"), model.String("ip", "10.53.69.61")},
+		},
+		Spans: []*model.Span{
+			{
+				TraceID:       traceID,
+				SpanID:        model.NewSpanID(0x647d98),
+				References:    []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(0x68c4e3))},
+				OperationName: "get",
+				StartTime:     time.Unix(0, 1485467191639875*int64(time.Microsecond)),
+				Duration:      22938 * time.Microsecond,
+				Tags: []model.KeyValue{
+					model.String("span.kind", "server"),
+					model.String("peer.ipv4", "192.53.69.61"),
+					model.Int64("peer.port", 53931),
+					model.String("peer.service", "rtapi"),
+					model.Bool("someBool", true),
+					model.Float64("someDouble", 129.8),
+				},
+				Logs: []model.Log{{
+					Timestamp: time.Unix(0, 1485467191639875*int64(time.Microsecond)),
+					Fields:    []model.KeyValue{model.String("event", "nothing")},
+				}},
+			},
+			{
+				TraceID:       model.NewTraceID(0, 0x52969a8955571a3f),
+				SpanID:        model.NewSpanID(0x61d092272e8c3a),
+				OperationName: "post",
+				StartTime:     time.Unix(0, 1485467191639875*int64(time.Microsecond)),
+				Duration:      22938 * time.Microsecond,
+				Flags:         model.DebugFlag,
+				Process:       &model.Process{ServiceName: "worker", Tags: []model.KeyValue{model.Int64("pid", 7)}},
+			},
+		},
+	}
+}
+
+var jaegerModelSpans = []*trace.Span{
+	{
+		TraceID:  "000000000000000152969a8955571a3f",
+		ParentID: pointer.String("000000000068c4e3"),
+		ID:       "0000000000647d98",
+		Name:     pointer.String("get"),
+		Kind:     &ServerKind,
+		LocalEndpoint: &trace.Endpoint{
+			ServiceName: pointer.String("api"),
+			Ipv4:        pointer.String("10.53.69.61"),
+		},
+		RemoteEndpoint: &trace.Endpoint{
+			ServiceName: pointer.String("rtapi"),
+			Ipv4:        pointer.String("192.53.69.61"),
+			Port:        pointer.Int32(53931),
+		},
+		Timestamp: pointer.Int64(1485467191639875),
+		Duration:  pointer.Int64(22938),
+		Annotations: []*trace.Annotation{
+			{Timestamp: pointer.Int64(1485467191639875), Value: pointer.String("nothing")},
+		},
+		Tags: map[string]string{
+			"someBool":   "true",
+			"someDouble": "129.8",
+			"hostname":   "api246-sjc1",
+		},
+	},
+	{
+		TraceID: "52969a8955571a3f",
+		ID:      "0061d092272e8c3a",
+		Name:    pointer.String("post"),
+		Debug:   pointer.Bool(true),
+		LocalEndpoint: &trace.Endpoint{
+			ServiceName: pointer.String("worker"),
+		},
+		Timestamp:   pointer.Int64(1485467191639875),
+		Duration:    pointer.Int64(22938),
+		Annotations: []*trace.Annotation{},
+		Tags: map[string]string{
+			"pid": "7",
+		},
+	},
+}
+
+type errBufferFull struct{}
+
+func (e errBufferFull) Error() string {
+	return "buffer full"
+}
+
+func (e errBufferFull) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+func (e errBufferFull) RetryAfter() time.Duration {
+	return time.Second
+}
+
+func TestJaegerGRPCCollector(t *testing.T) {
+	Convey("given a jaeger gRPC collector", t, func() {
+		var spans []*trace.Span
+		sink := &fakeSink{handler: func(ss []*trace.Span) {
+			spans = append(spans, ss...)
+		}}
+		collector := &JaegerGRPCCollector{Sink: sink, Logger: log.Discard}
+		Convey("spans should be converted the way thrift spans are", func() {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(sfxclient.TokenHeaderName, "token"))
+			resp, err := collector.PostSpans(ctx, &api_v2.PostSpansRequest{Batch: jaegerModelBatch()})
+			So(err, ShouldBeNil)
+			So(resp, ShouldNotBeNil)
+			So(spans, ShouldResemble, jaegerModelSpans)
+			So(sink.ctx.Value(sfxclient.TokenHeaderName), ShouldEqual, "token")
+			So(dptest.ExactlyOne(collector.Datapoints(), "total_requests").Value, ShouldResemble, datapoint.NewIntValue(1))
+		})
+		Convey("requests without a token should not have one", func() {
+			_, err := collector.PostSpans(context.Background(), &api_v2.PostSpansRequest{})
+			So(err, ShouldBeNil)
+			So(sink.ctx.Value(sfxclient.TokenHeaderName), ShouldBeNil)
+		})
+		Convey("sink errors should be returned", func() {
+			sendTo := dptest.NewBasicSink()
+			sendTo.RetError(errors.New("nope"))
+			collector.Sink = sendTo
+			_, err := collector.PostSpans(context.Background(), &api_v2.PostSpansRequest{Batch: jaegerModelBatch()})
+			So(err, ShouldNotBeNil)
+			So(dptest.ExactlyOne(collector.Datapoints(), "total_errors").Value, ShouldResemble, datapoint.NewIntValue(1))
+		})
+		Convey("errors that mean clients should back off should have the status codes they retry on", func() {
+			sendTo := dptest.NewBasicSink()
+			collector.Sink = sendTo
+			post := func(err error) codes.Code {
+				sendTo.RetError(err)
+				_, err = collector.PostSpans(context.Background(), &api_v2.PostSpansRequest{Batch: jaegerModelBatch()})
+				return status.Code(err)
+			}
+			So(post(&ErrRateLimited{Type: "span", Delay: time.Second}), ShouldEqual, codes.ResourceExhausted)
+			So(post(protocol.NewMultiErr([]error{errors.New("nope"), errBufferFull{}})), ShouldEqual, codes.Unavailable)
+			So(post(errors.New("nope")), ShouldEqual, codes.Unknown)
+		})
+	})
+}
+
+func TestJaegerGRPCListener(t *testing.T) {
+	Convey("given a signalfx listener with a jaeger gRPC address", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(1)
+		grpcAddr := fmt.Sprintf("127.0.0.1:%d", nettest.FreeTCPPort())
+		listener, err := NewListener(sendTo, &ListenerConfig{
+			ListenAddr:           pointer.String("127.0.0.1:0"),
+			JaegerGRPCListenAddr: pointer.String(grpcAddr),
+			Counter:              &dpsink.Counter{},
+		})
+		So(err, ShouldBeNil)
+		conn, err := grpc.Dial(grpcAddr, grpc.WithInsecure(), grpc.WithPerRPCCredentials(&sfxgrpc.SignalFxTokenAuth{Token: "token", DisableTransportSecurity: true}))
+		So(err, ShouldBeNil)
+		Convey("Should accept jaeger gRPC spans", func() {
+			_, err := api_v2.NewCollectorServiceClient(conn).PostSpans(context.Background(), &api_v2.PostSpansRequest{Batch: jaegerModelBatch()})
+			So(err, ShouldBeNil)
+			spans := <-sendTo.TracesChan
+			So(len(spans), ShouldEqual, 2)
+			So(spans[0], ShouldResemble, jaegerModelSpans[0])
+			So(spans[1].Tags["sampling.priority"], ShouldEqual, "1")
+			So(dptest.ExactlyOneDims(listener.Datapoints(), "total_requests", map[string]string{"protocol": "sfx_" + JaegerGRPCV1}).Value, ShouldResemble, datapoint.NewIntValue(1))
+		})
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+	Convey("a signalfx listener should fail if it cannot serve jaeger gRPC", t, func() {
+		_, err := NewListener(dptest.NewBasicSink(), &ListenerConfig{
+			ListenAddr:           pointer.String("127.0.0.1:0"),
+			JaegerGRPCListenAddr: pointer.String("127.0.0.1:999999"),
+		})
+		So(err, ShouldNotBeNil)
+		_, err = (&ListenerServer{}).setupJaegerGRPC(nil, nil, &ListenerConfig{JaegerGRPCListenAddr: pointer.String("127.0.0.1:0")})
+		So(err, ShouldNotBeNil)
+	})
+}
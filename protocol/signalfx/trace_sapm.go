@@ -0,0 +1,62 @@
+package signalfx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/golib/v3/web"
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+// ErrInvalidSAPMFormat is returned when we are unable to decode the request payload into a splunksapm.PostSpansRequest
+var ErrInvalidSAPMFormat = errors.New("invalid SAPM protobuf format")
+
+// SAPMTraceDecoderV2 decodes SAPM protobuf requests, whose batches of jaeger spans are grouped by process
+type SAPMTraceDecoderV2 struct {
+	Logger log.Logger
+	Sink   trace.Sink
+}
+
+func (decoder *SAPMTraceDecoderV2) Read(ctx context.Context, req *http.Request) error {
+	jeff := buffs.Get().(*bytes.Buffer)
+	defer buffs.Put(jeff)
+	jeff.Reset()
+	if err := readFromRequest(jeff, req, decoder.Logger); err != nil {
+		return err
+	}
+	var msg splunksapm.PostSpansRequest
+	if err := proto.Unmarshal(jeff.Bytes(), &msg); err != nil {
+		return ErrInvalidSAPMFormat
+	}
+	var spans []*trace.Span
+	for _, batch := range msg.Batches {
+		spans = append(spans, convertJaegerModelBatch(batch)...)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	return decoder.Sink.AddSpans(ctx, spans)
+}
+
+// writeSuccess writes the empty protobuf response SAPM clients expect
+func (decoder *SAPMTraceDecoderV2) writeSuccess(rw http.ResponseWriter, req *http.Request) error {
+	rw.Header().Set("Content-Type", "application/x-protobuf")
+	_, err := rw.Write(nil)
+	return err
+}
+
+func setupSAPMTraceV2(ctx context.Context, r *mux.Router, sink Sink, logger log.Logger, httpChain web.NextConstructor, counter *dpsink.Counter) sfxclient.Collector {
+	handler, st := SetupChain(ctx, sink, SAPMV2, func(s Sink) ErrorReader {
+		return &SAPMTraceDecoderV2{Logger: logger, Sink: s}
+	}, httpChain, logger, counter)
+	r.Path(SAPMTracePathV2).Methods("POST").Headers("Content-Type", "application/x-protobuf").Handler(handler)
+	return st
+}
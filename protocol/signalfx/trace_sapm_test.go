@@ -0,0 +1,153 @@
+package signalfx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/nettest"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func sapmRequestBody() []byte {
+	batch := jaegerModelBatch()
+	body, err := proto.Marshal(&splunksapm.PostSpansRequest{Batches: []*model.Batch{&batch}})
+	So(err, ShouldBeNil)
+	return body
+}
+
+func TestSAPMTraceDecoderV2(t *testing.T) {
+	Convey("given a SAPM decoder", t, func() {
+		var spans []*trace.Span
+		calls := 0
+		decoder := &SAPMTraceDecoderV2{Logger: log.Discard, Sink: &fakeSink{handler: func(ss []*trace.Span) {
+			calls++
+			spans = append(spans, ss...)
+		}}}
+		read := func(body []byte) error {
+			req, err := http.NewRequest("POST", SAPMTracePathV2, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			return decoder.Read(context.Background(), req)
+		}
+		Convey("batches should be converted the way jaeger gRPC batches are", func() {
+			So(read(sapmRequestBody()), ShouldBeNil)
+			So(spans, ShouldResemble, jaegerModelSpans)
+		})
+		Convey("requests without spans should not be sent", func() {
+			So(read(nil), ShouldBeNil)
+			So(calls, ShouldEqual, 0)
+		})
+		Convey("invalid requests should be errors", func() {
+			So(read([]byte{0xff}), ShouldEqual, ErrInvalidSAPMFormat)
+		})
+	})
+}
+
+func TestSAPMListener(t *testing.T) {
+	Convey("given a signalfx listener", t, func() {
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(1)
+		listener, err := NewListener(sendTo, &ListenerConfig{ListenAddr: pointer.String("127.0.0.1:0"), Counter: &dpsink.Counter{}, HTTPChain: passThroughChain})
+		So(err, ShouldBeNil)
+		baseURI := fmt.Sprintf("http://127.0.0.1:%d", nettest.TCPPort(listener.listener))
+		post := func(body []byte, gzipped bool) *http.Response {
+			if gzipped {
+				var buf bytes.Buffer
+				w := gzip.NewWriter(&buf)
+				_, err := w.Write(body)
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+				body = buf.Bytes()
+			}
+			req, err := http.NewRequest("POST", baseURI+SAPMTracePathV2, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			if gzipped {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			So(resp.Body.Close(), ShouldBeNil)
+			return resp
+		}
+		Convey("Should accept gzipped SAPM", func() {
+			resp := post(sapmRequestBody(), true)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/x-protobuf")
+			So(len(<-sendTo.TracesChan), ShouldEqual, 2)
+		})
+		Convey("Should accept uncompressed SAPM", func() {
+			So(post(sapmRequestBody(), false).StatusCode, ShouldEqual, http.StatusOK)
+			So(len(<-sendTo.TracesChan), ShouldEqual, 2)
+		})
+		Convey("Should reject invalid SAPM", func() {
+			So(post([]byte{0xff}, false).StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("And a SAPM forwarder", func() {
+			forwarder, err := NewForwarder(&ForwarderConfig{
+				SAPMTraceURL: pointer.String(baseURI + SAPMTracePathV2),
+				UseSAPM:      pointer.Bool(true),
+			})
+			So(err, ShouldBeNil)
+			Convey("Should send spans batched by service", func() {
+				spansSent := []*trace.Span{
+					{
+						TraceID:       "0000000000000001",
+						ID:            "0000000000000002",
+						ParentID:      pointer.String("0000000000000003"),
+						Name:          pointer.String("get"),
+						Kind:          &ServerKind,
+						LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String("api")},
+						Timestamp:     pointer.Int64(1485467191639875),
+						Duration:      pointer.Int64(22938),
+						Tags:          map[string]string{"k": "v"},
+					},
+					{
+						TraceID:       "0000000000000001",
+						ID:            "0000000000000004",
+						Name:          pointer.String("query"),
+						Kind:          &ClientKind,
+						LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String("db")},
+						Timestamp:     pointer.Int64(1485467191639876),
+						Duration:      pointer.Int64(10),
+					},
+				}
+				So(forwarder.AddSpans(context.Background(), spansSent), ShouldBeNil)
+				spansSeen := <-sendTo.TracesChan
+				So(len(spansSeen), ShouldEqual, 2)
+				sort.Slice(spansSeen, func(i, j int) bool {
+					return spansSeen[i].ID < spansSeen[j].ID
+				})
+				for i, s := range spansSeen {
+					So(s.TraceID, ShouldEqual, spansSent[i].TraceID)
+					So(s.ID, ShouldEqual, spansSent[i].ID)
+					So(s.ParentID, ShouldResemble, spansSent[i].ParentID)
+					So(s.Name, ShouldResemble, spansSent[i].Name)
+					So(s.Kind, ShouldResemble, spansSent[i].Kind)
+					So(s.LocalEndpoint.ServiceName, ShouldResemble, spansSent[i].LocalEndpoint.ServiceName)
+					So(s.Timestamp, ShouldResemble, spansSent[i].Timestamp)
+					So(s.Duration, ShouldResemble, spansSent[i].Duration)
+				}
+				So(spansSeen[0].Tags["k"], ShouldEqual, "v")
+			})
+			Reset(func() {
+				So(forwarder.Close(), ShouldBeNil)
+			})
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+}
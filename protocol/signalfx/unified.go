@@ -2,11 +2,13 @@ package signalfx
 
 import (
 	"context"
+	"errors"
 
 	"github.com/signalfx/golib/v3/datapoint"
 	"github.com/signalfx/golib/v3/datapoint/dpsink"
 	"github.com/signalfx/golib/v3/event"
 	"github.com/signalfx/golib/v3/trace"
+	sfxlog "github.com/signalfx/ingest-protocols/protocol/signalfx/format/log"
 )
 
 // Sink is a dpsink and trace.sink
@@ -22,6 +24,14 @@ type NextSink interface {
 	AddSpans(ctx context.Context, spans []*trace.Span, next Sink) error
 }
 
+// NextLogSink is implemented by NextSinks that also see the logs passing through a chain.  Chained NextSinks that
+// don't implement it pass logs straight through.
+type NextLogSink interface {
+	AddLogs(ctx context.Context, logs []*sfxlog.ResourceLogs, next sfxlog.LogSink) error
+}
+
+var errNotLogSink = errors.New("sink does not accept logs")
+
 // A MiddlewareConstructor is used by FromChain to chain together a bunch of sinks that forward to each other
 type MiddlewareConstructor func(sendTo Sink) Sink
 
@@ -62,6 +72,30 @@ func (n *nextWrapped) AddSpans(ctx context.Context, spans []*trace.Span) error {
 	return n.wrapping.AddSpans(ctx, spans, n.forwardTo)
 }
 
+func (n *nextWrapped) AddLogs(ctx context.Context, logs []*sfxlog.ResourceLogs) error {
+	next, ok := n.forwardTo.(sfxlog.LogSink)
+	if !ok {
+		return errNotLogSink
+	}
+	if wrapping, ok := n.wrapping.(NextLogSink); ok {
+		return wrapping.AddLogs(ctx, logs, next)
+	}
+	return next.AddLogs(ctx, logs)
+}
+
+// acceptsLogs returns if logs sent to sink reach a sfxlog.LogSink.  Chain wrappers take logs whatever they wrap, so
+// they are looked past to the sink at the end of the chain.
+func acceptsLogs(sink Sink) bool {
+	for {
+		wrapped, ok := sink.(*nextWrapped)
+		if !ok {
+			_, ok = sink.(sfxlog.LogSink)
+			return ok
+		}
+		sink = wrapped.forwardTo
+	}
+}
+
 // IncludingDimensions returns a sink that wraps another sink adding dims to each datapoint and
 // event
 func IncludingDimensions(dims map[string]string, sink Sink) Sink {
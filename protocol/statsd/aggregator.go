@@ -0,0 +1,173 @@
+package statsd
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+)
+
+// bucket holds the values seen for a single series during a flush interval
+type bucket struct {
+	name       string
+	metricType string
+	dimensions map[string]string
+	// updated is false for gauges that were carried over from a previous interval and not set since
+	updated bool
+	// idle counts the flushes since a gauge was last updated
+	idle    int
+	count   float64
+	samples int64
+	sum     float64
+	min     float64
+	max     float64
+	last    float64
+	set     map[string]struct{}
+}
+
+// aggregator rolls statsd metrics up into buckets that are emitted as datapoints on every flush
+type aggregator struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// gauges are kept between flushes so relative updates have something to apply to
+	gauges map[string]*bucket
+	// gaugeIdleFlushes is how many flushes a gauge is kept without updates, 0 keeps them forever
+	gaugeIdleFlushes int
+}
+
+func newAggregator(gaugeIdleFlushes int) *aggregator {
+	return &aggregator{
+		buckets:          make(map[string]*bucket),
+		gauges:           make(map[string]*bucket),
+		gaugeIdleFlushes: gaugeIdleFlushes,
+	}
+}
+
+func seriesKey(m *metric) string {
+	keys := make([]string, 0, len(m.dimensions))
+	for k := range m.dimensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(m.name)
+	b.WriteByte('|')
+	b.WriteString(m.metricType)
+	for _, k := range keys {
+		b.WriteByte('|')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(m.dimensions[k])
+	}
+	return b.String()
+}
+
+func (a *aggregator) add(m *metric) {
+	key := seriesKey(m)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if m.metricType == gaugeType {
+		b, exists := a.gauges[key]
+		if !exists {
+			b = &bucket{name: m.name, metricType: m.metricType, dimensions: m.dimensions}
+			a.gauges[key] = b
+		}
+		if m.relative {
+			b.last += m.value
+		} else {
+			b.last = m.value
+		}
+		b.updated = true
+		return
+	}
+	b, exists := a.buckets[key]
+	if !exists {
+		b = &bucket{name: m.name, metricType: m.metricType, dimensions: m.dimensions, min: m.value, max: m.value}
+		a.buckets[key] = b
+	}
+	switch m.metricType {
+	case counterType:
+		b.count += m.value / m.sampleRate
+	case setType:
+		if b.set == nil {
+			b.set = make(map[string]struct{})
+		}
+		b.set[m.rawValue] = struct{}{}
+	default:
+		b.count += 1 / m.sampleRate
+		b.samples++
+		b.sum += m.value
+		if m.value < b.min {
+			b.min = m.value
+		}
+		if m.value > b.max {
+			b.max = m.value
+		}
+	}
+}
+
+// series returns the number of series currently being aggregated
+func (a *aggregator) series() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return int64(len(a.buckets) + len(a.gauges))
+}
+
+// flush returns datapoints for everything aggregated since the last flush and resets the buckets.  Gauges that have
+// been idle for gaugeIdleFlushes are forgotten.
+func (a *aggregator) flush(now time.Time) []*datapoint.Datapoint {
+	a.mu.Lock()
+	buckets := a.buckets
+	a.buckets = make(map[string]*bucket, len(buckets))
+	dps := make([]*datapoint.Datapoint, 0, len(buckets)+len(a.gauges))
+	for key, b := range a.gauges {
+		if b.updated {
+			dps = append(dps, b.datapoint(b.name, toValue(b.last), datapoint.Gauge, now))
+			b.updated = false
+			b.idle = 0
+			continue
+		}
+		b.idle++
+		if a.gaugeIdleFlushes > 0 && b.idle >= a.gaugeIdleFlushes {
+			delete(a.gauges, key)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, b := range buckets {
+		switch b.metricType {
+		case counterType:
+			dps = append(dps, b.datapoint(b.name, toValue(b.count), datapoint.Count, now))
+		case setType:
+			dps = append(dps, b.datapoint(b.name, datapoint.NewIntValue(int64(len(b.set))), datapoint.Gauge, now))
+		default:
+			dps = append(dps,
+				b.datapoint(b.name+".count", toValue(b.count), datapoint.Count, now),
+				b.datapoint(b.name+".sum", toValue(b.sum), datapoint.Count, now),
+				b.datapoint(b.name+".min", toValue(b.min), datapoint.Gauge, now),
+				b.datapoint(b.name+".max", toValue(b.max), datapoint.Gauge, now),
+				b.datapoint(b.name+".mean", toValue(b.sum/float64(b.samples)), datapoint.Gauge, now),
+			)
+		}
+	}
+	return dps
+}
+
+// datapoint creates a datapoint for the bucket with its own copy of the dimensions, since sinks further down may
+// change them
+func (b *bucket) datapoint(metric string, value datapoint.Value, mtype datapoint.MetricType, now time.Time) *datapoint.Datapoint {
+	dims := make(map[string]string, len(b.dimensions))
+	for k, v := range b.dimensions {
+		dims[k] = v
+	}
+	return datapoint.New(metric, dims, value, mtype, now)
+}
+
+func toValue(f float64) datapoint.Value {
+	if f == float64(int64(f)) {
+		return datapoint.NewIntValue(int64(f))
+	}
+	return datapoint.NewFloatValue(f)
+}
@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func addLines(t *testing.T, a *aggregator, lines ...string) {
+	for _, l := range lines {
+		m, err := parseLine(l)
+		require.NoError(t, err, l)
+		a.add(m)
+	}
+}
+
+func TestAggregatorCounters(t *testing.T) {
+	a := newAggregator(0)
+	addLines(t, a, "hits:1|c", "hits:2|c|@0.5", "hits:1|c|#host:a", "hits:0.5|c|#host:a")
+	assert.Equal(t, int64(2), a.series())
+	dps := a.flush(time.Now())
+	assert.Len(t, dps, 2)
+	for _, dp := range dps {
+		assert.Equal(t, datapoint.Count, dp.MetricType)
+		if dp.Dimensions["host"] == "a" {
+			assert.Equal(t, datapoint.NewFloatValue(1.5), dp.Value)
+		} else {
+			assert.Equal(t, datapoint.NewIntValue(5), dp.Value)
+		}
+	}
+	assert.Empty(t, a.flush(time.Now()))
+	assert.Equal(t, int64(0), a.series())
+}
+
+func TestAggregatorGauges(t *testing.T) {
+	a := newAggregator(0)
+	addLines(t, a, "cpu:10|g", "cpu:+5|g", "cpu:-3|g")
+	dps := a.flush(time.Now())
+	dp := dptest.ExactlyOne(dps, "cpu")
+	assert.Equal(t, datapoint.Gauge, dp.MetricType)
+	assert.Equal(t, datapoint.NewIntValue(12), dp.Value)
+
+	// gauges that were not updated are not re-sent, but relative updates still apply
+	assert.Empty(t, a.flush(time.Now()))
+	addLines(t, a, "cpu:+1|g")
+	assert.Equal(t, datapoint.NewIntValue(13), dptest.ExactlyOne(a.flush(time.Now()), "cpu").Value)
+	addLines(t, a, "cpu:2|g")
+	assert.Equal(t, datapoint.NewIntValue(2), dptest.ExactlyOne(a.flush(time.Now()), "cpu").Value)
+	assert.Equal(t, int64(1), a.series())
+}
+
+func TestAggregatorIdleGauges(t *testing.T) {
+	a := newAggregator(2)
+	addLines(t, a, "cpu:10|g", "mem:5|g")
+	assert.Len(t, a.flush(time.Now()), 2)
+	assert.Empty(t, a.flush(time.Now()))
+	addLines(t, a, "mem:+1|g")
+	assert.Equal(t, datapoint.NewIntValue(6), dptest.ExactlyOne(a.flush(time.Now()), "mem").Value)
+	// cpu has now gone two flushes without an update, so it is forgotten and relative updates start from zero
+	assert.Equal(t, int64(1), a.series())
+	addLines(t, a, "cpu:+1|g")
+	assert.Equal(t, datapoint.NewIntValue(1), dptest.ExactlyOne(a.flush(time.Now()), "cpu").Value)
+}
+
+func TestAggregatorSets(t *testing.T) {
+	a := newAggregator(0)
+	addLines(t, a, "users:bob|s", "users:alice|s", "users:bob|s")
+	dp := dptest.ExactlyOne(a.flush(time.Now()), "users")
+	assert.Equal(t, datapoint.Gauge, dp.MetricType)
+	assert.Equal(t, datapoint.NewIntValue(2), dp.Value)
+}
+
+func TestAggregatorTimers(t *testing.T) {
+	a := newAggregator(0)
+	addLines(t, a, "latency:10|ms", "latency:5|ms|@0.5", "latency:30|ms")
+	dps := a.flush(time.Now())
+	assert.Len(t, dps, 5)
+	assert.Equal(t, datapoint.NewIntValue(4), dptest.ExactlyOne(dps, "latency.count").Value)
+	assert.Equal(t, datapoint.NewIntValue(45), dptest.ExactlyOne(dps, "latency.sum").Value)
+	assert.Equal(t, datapoint.NewIntValue(5), dptest.ExactlyOne(dps, "latency.min").Value)
+	assert.Equal(t, datapoint.NewIntValue(30), dptest.ExactlyOne(dps, "latency.max").Value)
+	assert.Equal(t, datapoint.NewIntValue(15), dptest.ExactlyOne(dps, "latency.mean").Value)
+	assert.Equal(t, datapoint.Count, dptest.ExactlyOne(dps, "latency.count").MetricType)
+	assert.Equal(t, datapoint.Gauge, dptest.ExactlyOne(dps, "latency.max").MetricType)
+}
+
+func TestAggregatorDimensionsNotShared(t *testing.T) {
+	a := newAggregator(0)
+	addLines(t, a, "latency:10|ms|#host:a", "cpu:1|g|#host:a")
+	dps := a.flush(time.Now())
+	dptest.ExactlyOne(dps, "latency.count").Dimensions["host"] = "changed"
+	assert.Equal(t, "a", dptest.ExactlyOne(dps, "latency.sum").Dimensions["host"])
+	dptest.ExactlyOne(dps, "cpu").Dimensions["host"] = "changed"
+
+	// gauges are kept between flushes, so a datapoint changed downstream must not change the next one
+	addLines(t, a, "cpu:2|g|#host:a")
+	assert.Equal(t, "a", dptest.ExactlyOne(a.flush(time.Now()), "cpu").Dimensions["host"])
+}
+
+func TestSeriesKey(t *testing.T) {
+	m1, err := parseLine("a:1|c|#x:1,y:2")
+	require.NoError(t, err)
+	m2, err := parseLine("a:1|c|#y:2,x:1")
+	require.NoError(t, err)
+	m3, err := parseLine("a:1|g|#y:2,x:1")
+	require.NoError(t, err)
+	assert.Equal(t, seriesKey(m1), seriesKey(m2))
+	assert.NotEqual(t, seriesKey(m1), seriesKey(m3))
+}
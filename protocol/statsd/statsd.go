@@ -0,0 +1,102 @@
+package statsd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/signalfx/golib/v3/errors"
+)
+
+// Metric types understood by the statsd parser
+const (
+	counterType = "c"
+	gaugeType   = "g"
+	timerType   = "ms"
+	histoType   = "h"
+	setType     = "s"
+)
+
+// metric is a single parsed statsd line
+type metric struct {
+	name       string
+	value      float64
+	rawValue   string
+	metricType string
+	sampleRate float64
+	// relative is set for gauges sent with an explicit sign, which statsd treats as a delta
+	relative   bool
+	dimensions map[string]string
+}
+
+var (
+	errInvalidLine       = errors.New("invalid statsd line")
+	errInvalidType       = errors.New("invalid statsd metric type")
+	errInvalidValue      = errors.New("invalid statsd metric value")
+	errInvalidSampleRate = errors.New("invalid statsd sample rate")
+)
+
+// parseLine parses a statsd line of the form
+//
+//	<name>:<value>|<type>[|@<sample rate>][|#<tag>:<value>,<tag>]
+//
+// The last section is the DogStatsD tag extension, tags are turned into dimensions.
+func parseLine(line string) (*metric, error) {
+	pipe := strings.Index(line, "|")
+	if pipe == -1 {
+		return nil, errInvalidLine
+	}
+	// tags may contain a colon, so only look for the name separator before the first pipe
+	colon := strings.LastIndex(line[:pipe], ":")
+	if colon <= 0 {
+		return nil, errInvalidLine
+	}
+	m := &metric{
+		name:       line[:colon],
+		rawValue:   line[colon+1 : pipe],
+		sampleRate: 1,
+	}
+	sections := strings.Split(line[pipe+1:], "|")
+	m.metricType = sections[0]
+	switch m.metricType {
+	case counterType, gaugeType, timerType, histoType, setType:
+	default:
+		return nil, errInvalidType
+	}
+	for _, section := range sections[1:] {
+		if len(section) == 0 {
+			continue
+		}
+		switch section[0] {
+		case '@':
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, errInvalidSampleRate
+			}
+			m.sampleRate = rate
+		case '#':
+			m.dimensions = parseTags(section[1:])
+		}
+	}
+	if m.metricType != setType {
+		v, err := strconv.ParseFloat(m.rawValue, 64)
+		if err != nil {
+			return nil, errInvalidValue
+		}
+		m.value = v
+		m.relative = m.metricType == gaugeType && (m.rawValue[0] == '+' || m.rawValue[0] == '-')
+	}
+	return m, nil
+}
+
+// parseTags turns DogStatsD style tags into dimensions.  Tags without a value are ignored since they
+// cannot be represented as a dimension.
+func parseTags(tags string) map[string]string {
+	dims := make(map[string]string)
+	for _, tag := range strings.Split(tags, ",") {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+			dims[kv[0]] = kv[1]
+		}
+	}
+	return dims
+}
@@ -0,0 +1,137 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var statsdTestCases = []struct {
+	in         string
+	name       string
+	value      float64
+	metricType string
+	sampleRate float64
+	relative   bool
+	dimensions map[string]string
+	shouldErr  error
+}{
+	{
+		in:         "hits:1|c",
+		name:       "hits",
+		value:      1,
+		metricType: counterType,
+		sampleRate: 1,
+	},
+	{
+		in:         "hits:2|c|@0.5",
+		name:       "hits",
+		value:      2,
+		metricType: counterType,
+		sampleRate: 0.5,
+	},
+	{
+		in:         "cpu:3.5|g",
+		name:       "cpu",
+		value:      3.5,
+		metricType: gaugeType,
+		sampleRate: 1,
+	},
+	{
+		in:         "cpu:-2|g",
+		name:       "cpu",
+		value:      -2,
+		metricType: gaugeType,
+		sampleRate: 1,
+		relative:   true,
+	},
+	{
+		in:         "latency:320|ms|@0.1|#host:a,env:prod,bare",
+		name:       "latency",
+		value:      320,
+		metricType: timerType,
+		sampleRate: 0.1,
+		dimensions: map[string]string{"host": "a", "env": "prod"},
+	},
+	{
+		in:         "size:12|h|#url:http://x",
+		name:       "size",
+		value:      12,
+		metricType: histoType,
+		sampleRate: 1,
+		dimensions: map[string]string{"url": "http://x"},
+	},
+	{
+		in:         "users:bob|s",
+		name:       "users",
+		metricType: setType,
+		sampleRate: 1,
+	},
+	{
+		in:         "a.b:c:1|c",
+		name:       "a.b:c",
+		value:      1,
+		metricType: counterType,
+		sampleRate: 1,
+	},
+	{
+		in:        "hits",
+		shouldErr: errInvalidLine,
+	},
+	{
+		in:        ":1|c",
+		shouldErr: errInvalidLine,
+	},
+	{
+		in:        "hits|c",
+		shouldErr: errInvalidLine,
+	},
+	{
+		in:        "hits:1|x",
+		shouldErr: errInvalidType,
+	},
+	{
+		in:        "hits:bob|c",
+		shouldErr: errInvalidValue,
+	},
+	{
+		in:        "hits:1|c|@2",
+		shouldErr: errInvalidSampleRate,
+	},
+	{
+		in:        "hits:1|c|@0",
+		shouldErr: errInvalidSampleRate,
+	},
+	{
+		in:        "hits:1|c|@bob",
+		shouldErr: errInvalidSampleRate,
+	},
+}
+
+func TestParseLine(t *testing.T) {
+	for _, c := range statsdTestCases {
+		m, err := parseLine(c.in)
+		if c.shouldErr != nil {
+			assert.Equal(t, c.shouldErr, err, c.in)
+			assert.Nil(t, m, c.in)
+			continue
+		}
+		assert.NoError(t, err, c.in)
+		assert.Equal(t, c.name, m.name, c.in)
+		assert.Equal(t, c.value, m.value, c.in)
+		assert.Equal(t, c.metricType, m.metricType, c.in)
+		assert.Equal(t, c.sampleRate, m.sampleRate, c.in)
+		assert.Equal(t, c.relative, m.relative, c.in)
+		if c.dimensions != nil {
+			assert.Equal(t, c.dimensions, m.dimensions, c.in)
+		} else {
+			assert.Empty(t, m.dimensions, c.in)
+		}
+	}
+}
+
+func TestParseLineEmptySection(t *testing.T) {
+	m, err := parseLine("hits:1|c||#a:b")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "b"}, m.dimensions)
+}
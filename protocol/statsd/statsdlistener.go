@@ -0,0 +1,324 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/errors"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/ingest-protocols/logkey"
+	"github.com/signalfx/ingest-protocols/protocol"
+)
+
+// Listener once setup will listen for statsd protocol points, aggregate them and forward them on
+// every flush interval
+type Listener struct {
+	protocol.CloseableHealthCheck
+	psocket              net.Listener
+	udpsocket            *net.UDPConn
+	sink                 dpsink.Sink
+	aggregator           *aggregator
+	serverAcceptDeadline time.Duration
+	connectionTimeout    time.Duration
+	flushInterval        time.Duration
+	listenfunc           func()
+	logger               log.Logger
+	stats                listenerStats
+	wg                   sync.WaitGroup
+	flushWg              sync.WaitGroup
+	stopFlush            chan struct{}
+	closeOnce            sync.Once
+	closeErr             error
+}
+
+var _ protocol.Listener = &Listener{}
+
+type listenerStats struct {
+	totalMetrics        int64
+	invalidMetrics      int64
+	idleTimeouts        int64
+	retriedListenErrors int64
+	totalEOFCloses      int64
+	totalConnections    int64
+	activeConnections   int64
+	totalFlushes        int64
+	flushedDatapoints   int64
+	flushErrors         int64
+}
+
+// DebugDatapoints returns datapoints that are used for debugging the listener
+func (listener *Listener) DebugDatapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.Cumulative("total_metrics", nil, atomic.LoadInt64(&listener.stats.totalMetrics)),
+		sfxclient.Cumulative("invalid_datapoints", nil, atomic.LoadInt64(&listener.stats.invalidMetrics)),
+		sfxclient.Cumulative("total_connections", nil, atomic.LoadInt64(&listener.stats.totalConnections)),
+		sfxclient.Gauge("active_connections", nil, atomic.LoadInt64(&listener.stats.activeConnections)),
+		sfxclient.Cumulative("idle_timeouts", nil, atomic.LoadInt64(&listener.stats.idleTimeouts)),
+		sfxclient.Cumulative("total_eof_closes", nil, atomic.LoadInt64(&listener.stats.totalEOFCloses)),
+		sfxclient.Cumulative("retry_listen_errors", nil, atomic.LoadInt64(&listener.stats.retriedListenErrors)),
+		sfxclient.Cumulative("total_flushes", nil, atomic.LoadInt64(&listener.stats.totalFlushes)),
+		sfxclient.Cumulative("flushed_datapoints", nil, atomic.LoadInt64(&listener.stats.flushedDatapoints)),
+		sfxclient.Cumulative("flush_errors", nil, atomic.LoadInt64(&listener.stats.flushErrors)),
+		sfxclient.Gauge("aggregated_series", nil, listener.aggregator.series()),
+	}
+}
+
+// DefaultDatapoints returns datapoints that should always be reported from the listener
+func (listener *Listener) DefaultDatapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{}
+}
+
+// Datapoints reports information about the total points seen by statsd
+func (listener *Listener) Datapoints() []*datapoint.Datapoint {
+	return append(listener.DebugDatapoints(), listener.DefaultDatapoints()...)
+}
+
+// Close the exposed statsd port and flush anything that is still being aggregated.  It is safe to call more than once,
+// later calls return the result of the first.
+func (listener *Listener) Close() error {
+	listener.closeOnce.Do(func() {
+		if listener.psocket != nil {
+			listener.closeErr = listener.psocket.Close()
+		}
+		if listener.udpsocket != nil {
+			listener.closeErr = listener.udpsocket.Close()
+		}
+
+		listener.wg.Wait()
+		close(listener.stopFlush)
+		listener.flushWg.Wait()
+		listener.flush(context.Background())
+	})
+	return listener.closeErr
+}
+
+type statsdListenConn interface {
+	io.Reader
+	Close() error
+	SetDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+}
+
+func (listener *Listener) handleLine(connLogger log.Logger, line string) {
+	m, err := parseLine(line)
+	if err != nil {
+		atomic.AddInt64(&listener.stats.invalidMetrics, 1)
+		connLogger.Log(logkey.StatsdLine, line, log.Err, err, "Received data on a statsd port, but it doesn't look like statsd data")
+		return
+	}
+	listener.aggregator.add(m)
+	atomic.AddInt64(&listener.stats.totalMetrics, 1)
+}
+
+func (listener *Listener) handleUDPPacket(addr *net.UDPAddr, data []byte) {
+	connLogger := log.NewContext(listener.logger).With(logkey.RemoteAddr, addr)
+	atomic.AddInt64(&listener.stats.totalConnections, 1)
+	for _, b := range bytes.Split(data, []byte{'\n'}) {
+		line := strings.TrimSpace(string(b))
+		if line != "" {
+			listener.handleLine(connLogger, line)
+		}
+	}
+}
+
+func (listener *Listener) handleTCPConnection(conn statsdListenConn) error {
+	connLogger := log.NewContext(listener.logger).With(logkey.RemoteAddr, conn.RemoteAddr())
+	defer func() {
+		log.IfErr(connLogger, conn.Close())
+	}()
+	reader := bufio.NewReader(conn)
+	atomic.AddInt64(&listener.stats.totalConnections, 1)
+	atomic.AddInt64(&listener.stats.activeConnections, 1)
+	defer atomic.AddInt64(&listener.stats.activeConnections, -1)
+	for {
+		log.IfErr(connLogger, conn.SetDeadline(time.Now().Add(listener.connectionTimeout)))
+		bytes, err := reader.ReadBytes((byte)('\n'))
+		if err != nil && err != io.EOF {
+			atomic.AddInt64(&listener.stats.idleTimeouts, 1)
+			connLogger.Log(log.Err, err, "Listening for statsd data returned an error (Note: We timeout idle connections)")
+			return err
+		}
+		line := strings.TrimSpace(string(bytes))
+		if line != "" {
+			listener.handleLine(connLogger, line)
+		}
+
+		if err == io.EOF {
+			atomic.AddInt64(&listener.stats.totalEOFCloses, 1)
+			return nil
+		}
+	}
+}
+
+func (listener *Listener) startListeningUDP() {
+	defer listener.wg.Done()
+	defer listener.logger.Log("Stop listening statsd UDP")
+	buf := make([]byte, 65507) // max size for udp packet body
+	for {
+		log.IfErr(listener.logger, listener.udpsocket.SetDeadline(time.Now().Add(listener.connectionTimeout)))
+		n, addr, err := listener.udpsocket.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok {
+				if netErr.Timeout() {
+					atomic.AddInt64(&listener.stats.idleTimeouts, 1)
+					continue
+				}
+			}
+			listener.logger.Log(log.Err, err, "Unable to accept a udp socket connection")
+			return
+		}
+		if n != 0 {
+			// parsing only aggregates in memory, so it is cheap enough to do inline and lets us reuse buf
+			listener.handleUDPPacket(addr, buf[:n])
+		}
+	}
+}
+
+func (listener *Listener) startListeningTCP() {
+	defer listener.wg.Done()
+	defer listener.logger.Log("Stop listening statsd TCP")
+	for {
+		deadlineable, ok := listener.psocket.(*net.TCPListener)
+		if ok {
+			log.IfErr(listener.logger, deadlineable.SetDeadline(time.Now().Add(listener.serverAcceptDeadline)))
+		}
+		conn, err := listener.psocket.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok {
+				if netErr.Timeout() || netErr.Temporary() {
+					atomic.AddInt64(&listener.stats.retriedListenErrors, 1)
+					continue
+				}
+			}
+			listener.logger.Log(log.Err, err, "Unable to accept a socket connection")
+			return
+		}
+		go func() {
+			log.IfErr(listener.logger, listener.handleTCPConnection(conn))
+		}()
+	}
+}
+
+func (listener *Listener) flush(ctx context.Context) {
+	dps := listener.aggregator.flush(time.Now())
+	atomic.AddInt64(&listener.stats.totalFlushes, 1)
+	if len(dps) == 0 {
+		return
+	}
+	atomic.AddInt64(&listener.stats.flushedDatapoints, int64(len(dps)))
+	if err := listener.sink.AddDatapoints(ctx, dps); err != nil {
+		atomic.AddInt64(&listener.stats.flushErrors, 1)
+		listener.logger.Log(log.Err, err, "Unable to flush statsd datapoints")
+	}
+}
+
+func (listener *Listener) startFlushing() {
+	defer listener.flushWg.Done()
+	ticker := time.NewTicker(listener.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-listener.stopFlush:
+			return
+		case <-ticker.C:
+			listener.flush(context.Background())
+		}
+	}
+}
+
+// Constants for udp and tcp config
+const (
+	TCP = "tcp"
+	UDP = "udp"
+)
+
+// ListenerConfig controls optional parameters for statsd listeners
+type ListenerConfig struct {
+	ServerAcceptDeadline *time.Duration
+	ConnectionTimeout    *time.Duration
+	FlushInterval        *time.Duration
+	ListenAddr           *string
+	Logger               log.Logger
+	Protocol             *string
+	// GaugeIdleFlushes is how many flushes a gauge can go without an update before it is forgotten, so gauges that
+	// stop reporting do not use memory forever.  0 keeps gauges until the listener is closed.
+	GaugeIdleFlushes *int
+}
+
+var defaultListenerConfig = &ListenerConfig{
+	ServerAcceptDeadline: pointer.Duration(time.Second),
+	ConnectionTimeout:    pointer.Duration(time.Second * 30),
+	FlushInterval:        pointer.Duration(time.Second * 10),
+	ListenAddr:           pointer.String("127.0.0.1:8125"),
+	Protocol:             pointer.String(UDP),
+	GaugeIdleFlushes:     pointer.Int(60),
+}
+
+// Addr returns the listening address of this statsd listener
+func (listener *Listener) Addr() net.Addr {
+	if listener.psocket != nil {
+		return listener.psocket.Addr()
+	}
+	return listener.udpsocket.LocalAddr()
+}
+
+func (listener *Listener) getServer(conf *ListenerConfig) error {
+	loweredProtocol := strings.ToLower(*conf.Protocol)
+	if loweredProtocol == UDP {
+		serverAddr, err := net.ResolveUDPAddr(UDP, *conf.ListenAddr)
+		if err != nil {
+			return errors.Annotatef(err, "cannot listen to addr %s", *conf.ListenAddr)
+		}
+		server, err := net.ListenUDP(UDP, serverAddr)
+		if err != nil {
+			return errors.Annotatef(err, "cannot listen to addr %s", *conf.ListenAddr)
+		}
+		listener.udpsocket = server
+		listener.listenfunc = listener.startListeningUDP
+	} else if loweredProtocol == TCP {
+		server, err := net.Listen(TCP, *conf.ListenAddr)
+		if err != nil {
+			return errors.Annotatef(err, "cannot listen to addr %s", *conf.ListenAddr)
+		}
+		listener.psocket = server
+		listener.listenfunc = listener.startListeningTCP
+	} else {
+		return fmt.Errorf("specified protocol '%s' not recognized. '%s' or '%s' only please", *conf.Protocol, UDP, TCP)
+	}
+	return nil
+}
+
+// NewListener creates a new listener for statsd metrics
+func NewListener(sendTo dpsink.Sink, passedConf *ListenerConfig) (*Listener, error) {
+	conf := pointer.FillDefaultFrom(passedConf, defaultListenerConfig).(*ListenerConfig)
+	receiver := Listener{
+		sink:                 sendTo,
+		aggregator:           newAggregator(*conf.GaugeIdleFlushes),
+		serverAcceptDeadline: *conf.ServerAcceptDeadline,
+		connectionTimeout:    *conf.ConnectionTimeout,
+		flushInterval:        *conf.FlushInterval,
+		logger:               log.NewContext(conf.Logger).With(logkey.Protocol, "statsd", logkey.Direction, "listener"),
+		stopFlush:            make(chan struct{}),
+	}
+	err := receiver.getServer(conf)
+	if err != nil {
+		return nil, err
+	}
+	receiver.wg.Add(1)
+	go receiver.listenfunc()
+	receiver.flushWg.Add(1)
+	go receiver.startFlushing()
+	return &receiver, nil
+}
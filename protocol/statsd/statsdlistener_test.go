@@ -0,0 +1,194 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dptest"
+	"github.com/signalfx/golib/v3/nettest"
+	"github.com/signalfx/golib/v3/pointer"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStatsdListenerBadAddr(t *testing.T) {
+	Convey("bad listener ports shouldn't be able to accept", t, func() {
+		listenFrom := &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:90090999r"),
+			Protocol:   pointer.String("tcp"),
+		}
+		sendTo := dptest.NewBasicSink()
+		_, err := NewListener(sendTo, listenFrom)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("bad udp listener ports shouldn't be able to accept", t, func() {
+		listenFrom := &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:90090999r"),
+		}
+		sendTo := dptest.NewBasicSink()
+		_, err := NewListener(sendTo, listenFrom)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("udp listener ports already in use shouldn't be able to accept", t, func() {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		So(err, ShouldBeNil)
+		listenFrom := &ListenerConfig{
+			ListenAddr: pointer.String(conn.LocalAddr().String()),
+		}
+		sendTo := dptest.NewBasicSink()
+		_, err = NewListener(sendTo, listenFrom)
+		So(err, ShouldNotBeNil)
+		So(conn.Close(), ShouldBeNil)
+	})
+	Convey("non tcp or udp connections prohibited", t, func() {
+		listenFrom := &ListenerConfig{
+			ListenAddr: pointer.String("127.0.0.1:0"),
+			Protocol:   pointer.String("jack"),
+		}
+		sendTo := dptest.NewBasicSink()
+		_, err := NewListener(sendTo, listenFrom)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func findDp(dps []*datapoint.Datapoint, metric string) *datapoint.Datapoint {
+	for _, dp := range dps {
+		if dp.Metric == metric {
+			return dp
+		}
+	}
+	return nil
+}
+
+func TestStatsdListenerNormalTCP(t *testing.T) {
+	Convey("A normally setup tcp listener", t, func() {
+		listenFrom := &ListenerConfig{
+			ListenAddr:    pointer.String("127.0.0.1:0"),
+			Protocol:      pointer.String("tcp"),
+			FlushInterval: pointer.Duration(time.Hour),
+		}
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(10)
+		listener, err := NewListener(sendTo, listenFrom)
+		So(err, ShouldBeNil)
+		connAddr := fmt.Sprintf("127.0.0.1:%d", nettest.TCPPort(listener))
+
+		Convey("aggregates valid lines and counts invalid ones", func() {
+			s, err := net.Dial("tcp", connAddr)
+			So(err, ShouldBeNil)
+			_, err = io.WriteString(s, "hello world bob\nhits:1|c\nhits:2|c|#host:a\nhits:3|c\n")
+			So(err, ShouldBeNil)
+			So(s.Close(), ShouldBeNil)
+
+			for atomic.LoadInt64(&listener.stats.totalEOFCloses) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			listener.flush(context.Background())
+			dps := <-sendTo.PointsChan
+			So(len(dps), ShouldEqual, 2)
+			for _, dp := range dps {
+				So(dp.Metric, ShouldEqual, "hits")
+				So(dp.MetricType, ShouldEqual, datapoint.Count)
+				if dp.Dimensions["host"] == "a" {
+					So(dp.Value.String(), ShouldEqual, "2")
+				} else {
+					So(dp.Value.String(), ShouldEqual, "4")
+				}
+			}
+
+			stats := listener.Datapoints()
+			So(dptest.ExactlyOne(stats, "invalid_datapoints").Value.String(), ShouldEqual, "1")
+			So(dptest.ExactlyOne(stats, "total_metrics").Value.String(), ShouldEqual, "3")
+			So(dptest.ExactlyOne(stats, "flushed_datapoints").Value.String(), ShouldEqual, "2")
+			So(dptest.ExactlyOne(stats, "total_eof_closes").Value.String(), ShouldEqual, "1")
+		})
+		Convey("should eventually time out idle connections", func() {
+			listenFrom.ConnectionTimeout = pointer.Duration(time.Millisecond)
+			listenFrom.ServerAcceptDeadline = pointer.Duration(time.Millisecond)
+			So(listener.Close(), ShouldBeNil)
+			listener, err = NewListener(sendTo, listenFrom)
+			So(err, ShouldBeNil)
+
+			s, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", nettest.TCPPort(listener)))
+			So(err, ShouldBeNil)
+			for atomic.LoadInt64(&listener.stats.idleTimeouts) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			So(s.Close(), ShouldBeNil)
+			for atomic.LoadInt64(&listener.stats.retriedListenErrors) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			So(dptest.ExactlyOne(listener.Datapoints(), "retry_listen_errors").Value.String(), ShouldNotEqual, "0")
+		})
+		Reset(func() {
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func TestStatsdListenerNormalUDP(t *testing.T) {
+	Convey("A normally setup udp listener", t, func() {
+		listenFrom := &ListenerConfig{
+			ListenAddr:    pointer.String("127.0.0.1:0"),
+			FlushInterval: pointer.Duration(time.Hour),
+		}
+		sendTo := dptest.NewBasicSink()
+		sendTo.Resize(10)
+		listener, err := NewListener(sendTo, listenFrom)
+		So(err, ShouldBeNil)
+
+		send := func(lines string) {
+			s, err := net.DialUDP("udp", nil, listener.Addr().(*net.UDPAddr))
+			So(err, ShouldBeNil)
+			_, err = io.WriteString(s, lines)
+			So(err, ShouldBeNil)
+			So(s.Close(), ShouldBeNil)
+		}
+
+		Convey("flushes whatever is aggregated on close", func() {
+			send("latency:10|ms\nlatency:20|ms\ncpu:3|g\nusers:bob|s\nbad")
+			for atomic.LoadInt64(&listener.stats.totalMetrics) != 4 {
+				time.Sleep(time.Millisecond)
+			}
+			So(dptest.ExactlyOne(listener.Datapoints(), "aggregated_series").Value.String(), ShouldEqual, "3")
+			So(listener.Close(), ShouldBeNil)
+			dps := <-sendTo.PointsChan
+			So(len(dps), ShouldEqual, 7)
+			So(findDp(dps, "latency.mean").Value.String(), ShouldEqual, "15")
+			So(findDp(dps, "cpu").Value.String(), ShouldEqual, "3")
+			So(findDp(dps, "users").Value.String(), ShouldEqual, "1")
+			So(atomic.LoadInt64(&listener.stats.invalidMetrics), ShouldEqual, 1)
+		})
+		Convey("counts flush errors", func() {
+			sendTo.RetError(errors.New("nope"))
+			send("hits:1|c")
+			for atomic.LoadInt64(&listener.stats.totalMetrics) != 1 {
+				time.Sleep(time.Millisecond)
+			}
+			So(listener.Close(), ShouldBeNil)
+			So(atomic.LoadInt64(&listener.stats.flushErrors), ShouldEqual, 1)
+		})
+		Convey("can be closed more than once", func() {
+			So(listener.Close(), ShouldBeNil)
+			flushes := atomic.LoadInt64(&listener.stats.totalFlushes)
+			So(listener.Close(), ShouldBeNil)
+			So(atomic.LoadInt64(&listener.stats.totalFlushes), ShouldEqual, flushes)
+		})
+		Convey("should eventually time out idle connections", func() {
+			listenFrom.ConnectionTimeout = pointer.Duration(time.Millisecond)
+			So(listener.Close(), ShouldBeNil)
+			listener, err = NewListener(sendTo, listenFrom)
+			So(err, ShouldBeNil)
+			for atomic.LoadInt64(&listener.stats.idleTimeouts) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			So(listener.Close(), ShouldBeNil)
+		})
+	})
+}